@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// adminAPIKeys are accepted for the admin API, alongside any keys in the store
+var adminAPIKeys []string
+
+// adminNamePattern is what names of saved styles and API keys may look like, so a style name
+// can go straight into a ?palette= parameter
+var adminNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+// parseAPIKeys splits a comma-separated list of API keys
+func parseAPIKeys(s string) []string {
+	var keys []string
+	for _, key := range strings.Split(s, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// isAdminKey reports whether an API key may use the admin API
+func isAdminKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, k := range adminAPIKeys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return true
+		}
+	}
+	if store != nil {
+		_, ok := store.apiKeyName(key)
+		return ok
+	}
+	return false
+}
+
+// requireAdmin only lets requests with an admin API key through
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(adminAPIKeys) == 0 && store == nil {
+			http.Error(w, "Admin API is not configured", http.StatusNotFound)
+			return
+		}
+		if !isAdminKey(requestAPIKey(r)) {
+			metrics.incr("admin_auth_failures")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveAPIKeyAdd creates a named admin API key in the store. The key is only ever shown in
+// this response; the store keeps just its hash.
+func serveAPIKeyAdd(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		http.Error(w, "Adding API keys needs STORE_PATH", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !adminNamePattern.MatchString(req.Name) {
+		http.Error(w, "Key names are up to 64 lowercase letters, digits, _ and -", http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		reportError("store", err, nil)
+		http.Error(w, "Failed to generate a key", http.StatusInternalServerError)
+		return
+	}
+	key := hex.EncodeToString(b)
+	if err := store.addAPIKey(req.Name, key); err != nil {
+		// Names are unique, revoked or not
+		http.Error(w, "Failed to add key: "+err.Error(), http.StatusConflict)
+		return
+	}
+	recordAudit(r, "apikey.add", map[string]string{"name": req.Name})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"name": req.Name, "key": key})
+}
+
+// serveAPIKeyRevoke stops a key in the store from working
+func serveAPIKeyRevoke(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		http.Error(w, "Revoking API keys needs STORE_PATH", http.StatusNotFound)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	revoked, err := store.revokeAPIKey(name)
+	if err != nil {
+		reportError("store", err, map[string]string{"key": name})
+		http.Error(w, "Failed to revoke key", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "No such key", http.StatusNotFound)
+		return
+	}
+	recordAudit(r, "apikey.revoke", map[string]string{"name": name})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveConfigReload re-reads the configuration files that can change without a restart:
+// PALETTES_FILE and CACHE_POLICY_FILE. Nothing changes unless both load. Palettes removed from
+// the file stay until a restart.
+func serveConfigReload(w http.ResponseWriter, r *http.Request) {
+	var loaded map[string]*palette
+	if path := os.Getenv("PALETTES_FILE"); path != "" {
+		var err error
+		if loaded, err = loadPalettes(path); err != nil {
+			http.Error(w, "Failed to reload palettes: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var policy *CachePolicy
+	if path := os.Getenv("CACHE_POLICY_FILE"); path != "" {
+		var err error
+		if policy, err = loadCachePolicy(path); err != nil {
+			http.Error(w, "Failed to reload cache policy: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	reloaded := make(map[string]string)
+	if loaded != nil {
+		addPalettes(loaded)
+		reloaded["palettes"] = strconv.Itoa(len(loaded))
+
+		// Saved styles still take precedence over the file, as they do at startup
+		if store != nil {
+			if _, err := loadSavedStyles(); err != nil {
+				reportError("store", err, nil)
+			}
+		}
+		refreshTileVersion()
+		reloaded["version"] = tileVersion()
+	}
+	if policy != nil {
+		cachePolicy.replace(policy)
+		reloaded["cacheRules"] = strconv.Itoa(len(policy.Rules))
+	}
+
+	log.Printf("Reloaded configuration: %v", reloaded)
+	recordAudit(r, "config.reload", reloaded)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(reloaded)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// maxAnimFrames limits how many sea levels one animated tile steps through
+const maxAnimFrames = 32
+
+// animLevels lists the sea levels from one to another in steps, either way round
+func animLevels(from, to, step int) ([]int, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("Step must be positive")
+	}
+	from, to = clampSeaLevel(from), clampSeaLevel(to)
+	if to < from {
+		step = -step
+	}
+	var levels []int
+	for level := from; (step > 0 && level <= to) || (step < 0 && level >= to); level += step {
+		clamped := clampSeaLevel(level)
+		if len(levels) == 0 || levels[len(levels)-1] != clamped {
+			levels = append(levels, clamped)
+		}
+		if len(levels) > maxAnimFrames {
+			return nil, fmt.Errorf("Too many frames: at most %d", maxAnimFrames)
+		}
+	}
+	return levels, nil
+}
+
+// encodeAPNG joins frames into an animated PNG that loops forever, showing each for delay
+// milliseconds. Browsers that don't support APNG show the first frame.
+func encodeAPNG(frames []image.Image, delay int) ([]byte, error) {
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("no frames to encode")
+	}
+	var out bytes.Buffer
+	out.WriteString("\x89PNG\r\n\x1a\n")
+	writeChunk := func(kind string, data []byte) {
+		binary.Write(&out, binary.BigEndian, uint32(len(data)))
+		crc := crc32.NewIEEE()
+		crc.Write([]byte(kind))
+		crc.Write(data)
+		out.WriteString(kind)
+		out.Write(data)
+		binary.Write(&out, binary.BigEndian, crc.Sum32())
+	}
+
+	// The header is shared by every frame, so it is always 8-bit RGBA; letting the PNG encoder
+	// pick would make it RGB whenever the first frame happened to be opaque
+	bounds := frames[0].Bounds()
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(bounds.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(bounds.Dy()))
+	ihdr[8], ihdr[9] = 8, 6
+	writeChunk("IHDR", ihdr)
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl, uint32(len(frames)))
+	writeChunk("acTL", actl) // Zero plays forever
+
+	sequence := uint32(0)
+	for i, frame := range frames {
+		if frame.Bounds().Dx() != bounds.Dx() || frame.Bounds().Dy() != bounds.Dy() {
+			return nil, fmt.Errorf("frame %d is %v, not %v", i, frame.Bounds().Size(), bounds.Size())
+		}
+		data, err := rgbaImageData(frame)
+		if err != nil {
+			return nil, err
+		}
+
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], sequence)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(bounds.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(bounds.Dy()))
+		binary.BigEndian.PutUint16(fctl[20:], uint16(delay))
+		binary.BigEndian.PutUint16(fctl[22:], 1000)
+		// Dispose to transparent and replace, as each frame is a whole tile with transparency
+		fctl[24], fctl[25] = 1, 0
+		writeChunk("fcTL", fctl)
+		sequence++
+
+		if i == 0 {
+			writeChunk("IDAT", data)
+			continue
+		}
+		fdat := make([]byte, 4+len(data))
+		binary.BigEndian.PutUint32(fdat, sequence)
+		copy(fdat[4:], data)
+		writeChunk("fdAT", fdat)
+		sequence++
+	}
+	writeChunk("IEND", nil)
+	return out.Bytes(), nil
+}
+
+// rgbaImageData compresses a frame as 8-bit non-premultiplied RGBA scanlines, each filtered
+// against the one above
+func rgbaImageData(frame image.Image) ([]byte, error) {
+	bounds := frame.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), frame, bounds.Min, draw.Src)
+
+	var buf bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&buf, zlib.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	rowLen := 4 * bounds.Dx()
+	row := make([]byte, 1+rowLen)
+	for y := 0; y < bounds.Dy(); y++ {
+		cur := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+rowLen]
+		if y == 0 {
+			row[0] = 0
+			copy(row[1:], cur)
+		} else {
+			prev := nrgba.Pix[(y-1)*nrgba.Stride : (y-1)*nrgba.Stride+rowLen]
+			row[0] = 2 // Up
+			for i := range cur {
+				row[1+i] = cur[i] - prev[i]
+			}
+		}
+		if _, err := zw.Write(row); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// serveAnimTile serves an animated tile stepping the sea level from one level to another
+func serveAnimTile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	from, _ := strconv.Atoi(vars["from"])
+	to, _ := strconv.Atoi(vars["to"])
+	step, _ := strconv.Atoi(vars["step"])
+	zoom, _ := strconv.Atoi(vars["z"])
+	levels, err := animLevels(from, to, step)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	delay := 500
+	if s := r.URL.Query().Get("delay"); s != "" {
+		if delay, err = strconv.Atoi(s); err != nil || delay < 20 || delay > 10000 {
+			http.Error(w, "Invalid delay: must be 20 to 10000 milliseconds", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Frames come from the tile cache like any other tile
+	opts := defaultTileOptions()
+	opts.priority = requestPriority(r)
+	opts.timing = &serverTiming{}
+	var frames []image.Image
+	for _, level := range levels {
+		data, err := generateSeaLevelTile(level, vars["z"], vars["x"], vars["y"], opts)
+		if err == errElevationMissing {
+			http.Error(w, "No elevation data for this tile", http.StatusNotFound)
+			return
+		}
+		if err == errUpstreamUnavailable {
+			w.Header().Set("Retry-After", fmt.Sprint(int(breakerCooldown.Seconds())))
+			http.Error(w, "Elevation source unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to generate tile", http.StatusInternalServerError)
+			log.Printf("Error generating animation frame: %v", err)
+			return
+		}
+		frame, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			http.Error(w, "Failed to generate tile", http.StatusInternalServerError)
+			log.Printf("Error decoding animation frame: %v", err)
+			return
+		}
+		frames = append(frames, frame)
+	}
+
+	data, err := encodeAPNG(frames, delay)
+	if err != nil {
+		http.Error(w, "Failed to encode animation", http.StatusInternalServerError)
+		log.Printf("Error encoding animation: %v", err)
+		return
+	}
+	metrics.incr("anim_tiles", "frames:"+strconv.Itoa(len(frames)))
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(cachePolicy.maxAge(levels[0], zoom).Seconds())))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(data)
+}
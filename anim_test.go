@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// apngFrames reassembles each frame of an animated PNG as a standalone PNG and decodes it
+func apngFrames(t *testing.T, data []byte) (ihdr []byte, frames []image.Image) {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		t.Fatal("missing PNG signature")
+	}
+	var frameData [][]byte
+	for rest := data[8:]; len(rest) > 0; {
+		length := binary.BigEndian.Uint32(rest)
+		kind, body := string(rest[4:8]), rest[8:8+length]
+		if crc32.ChecksumIEEE(rest[4:8+length]) != binary.BigEndian.Uint32(rest[8+length:]) {
+			t.Fatalf("bad CRC on %s chunk", kind)
+		}
+		switch kind {
+		case "IHDR":
+			ihdr = body
+		case "fcTL":
+			frameData = append(frameData, nil)
+		case "IDAT":
+			frameData[len(frameData)-1] = append(frameData[len(frameData)-1], body...)
+		case "fdAT":
+			frameData[len(frameData)-1] = append(frameData[len(frameData)-1], body[4:]...)
+		}
+		rest = rest[12+length:]
+	}
+
+	for i, idat := range frameData {
+		var buf bytes.Buffer
+		buf.WriteString("\x89PNG\r\n\x1a\n")
+		for _, chunk := range []struct {
+			kind string
+			data []byte
+		}{{"IHDR", ihdr}, {"IDAT", idat}, {"IEND", nil}} {
+			binary.Write(&buf, binary.BigEndian, uint32(len(chunk.data)))
+			buf.WriteString(chunk.kind)
+			buf.Write(chunk.data)
+			binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(chunk.kind), chunk.data...)))
+		}
+		frame, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		frames = append(frames, frame)
+	}
+	return ihdr, frames
+}
+
+func TestEncodeAPNG(t *testing.T) {
+	// An opaque frame first, as the PNG encoder would write it as RGB
+	opaque := image.NewRGBA(image.Rect(0, 0, 5, 3))
+	for i := range opaque.Pix {
+		opaque.Pix[i] = 255
+	}
+	transparent := image.NewNRGBA(image.Rect(0, 0, 5, 3))
+	transparent.SetNRGBA(2, 1, color.NRGBA{0, 50, 120, 128})
+	offset := image.NewNRGBA(image.Rect(10, 10, 15, 13))
+	offset.SetNRGBA(10, 10, color.NRGBA{1, 2, 3, 4})
+
+	data, err := encodeAPNG([]image.Image{opaque, transparent, offset}, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ihdr, frames := apngFrames(t, data)
+	if ihdr[8] != 8 || ihdr[9] != 6 {
+		t.Errorf("IHDR bit depth %d, color type %d, want 8-bit RGBA (6)", ihdr[8], ihdr[9])
+	}
+	if len(frames) != 3 {
+		t.Fatalf("got %d frames, want 3", len(frames))
+	}
+
+	want := []struct {
+		x, y int
+		c    color.NRGBA
+	}{{0, 0, color.NRGBA{255, 255, 255, 255}}, {2, 1, color.NRGBA{0, 50, 120, 128}}, {0, 0, color.NRGBA{1, 2, 3, 4}}}
+	for i, w := range want {
+		if got := color.NRGBAModel.Convert(frames[i].At(w.x, w.y)); got != w.c {
+			t.Errorf("frame %d at %d,%d = %v, want %v", i, w.x, w.y, got, w.c)
+		}
+	}
+	if _, _, _, a := frames[1].At(0, 0).RGBA(); a != 0 {
+		t.Errorf("frame 1 should be transparent away from its one pixel, has alpha %d", a)
+	}
+
+	// Viewers without APNG support show the first frame
+	first, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := color.NRGBAModel.Convert(first.At(4, 2)); got != (color.NRGBA{255, 255, 255, 255}) {
+		t.Errorf("first frame as plain PNG = %v, want opaque white", got)
+	}
+}
+
+func TestEncodeAPNGRejectsMismatchedFrames(t *testing.T) {
+	frames := []image.Image{image.NewNRGBA(image.Rect(0, 0, 4, 4)), image.NewNRGBA(image.Rect(0, 0, 4, 5))}
+	if _, err := encodeAPNG(frames, 100); err == nil {
+		t.Error("expected an error for frames of different sizes")
+	}
+	if _, err := encodeAPNG(nil, 100); err == nil {
+		t.Error("expected an error for no frames")
+	}
+}
+
+func TestAnimLevels(t *testing.T) {
+	levels, err := animLevels(0, 30, 10)
+	if err != nil || len(levels) != 4 || levels[0] != 0 || levels[3] != 30 {
+		t.Errorf("animLevels(0, 30, 10) = %v, %v", levels, err)
+	}
+	levels, err = animLevels(30, 0, 10)
+	if err != nil || len(levels) != 4 || levels[0] != 30 || levels[3] != 0 {
+		t.Errorf("animLevels(30, 0, 10) = %v, %v", levels, err)
+	}
+	if _, err := animLevels(0, 30, 0); err == nil {
+		t.Error("expected an error for a zero step")
+	}
+}
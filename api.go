@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// pointZoom is the zoom level point queries sample elevations at by default, about 10 m per pixel
+const pointZoom = 14
+
+// parsePoint reads the lat and lon query parameters, which are required, and an optional zoom
+func parsePoint(r *http.Request) (lat, lon float64, zoom int, err error) {
+	query := r.URL.Query()
+	if lat, err = strconv.ParseFloat(query.Get("lat"), 64); err != nil || lat < -maxMercatorLat || lat > maxMercatorLat {
+		return 0, 0, 0, fmt.Errorf("Invalid latitude")
+	}
+	if lon, err = strconv.ParseFloat(query.Get("lon"), 64); err != nil || lon < -180 || lon > 180 {
+		return 0, 0, 0, fmt.Errorf("Invalid longitude")
+	}
+	zoom = pointZoom
+	if s := query.Get("zoom"); s != "" {
+		if zoom, err = strconv.Atoi(s); err != nil || zoom < 0 || zoom > maxLayerZoom {
+			return 0, 0, 0, fmt.Errorf("Invalid zoom level")
+		}
+	}
+	return lat, lon, zoom, nil
+}
+
+// lookupPoint finds the elevation at a point, responding with an error if there isn't one
+func lookupPoint(w http.ResponseWriter, r *http.Request, lat, lon float64, zoom int) (int, bool) {
+	elevation, err := pointElevation(lat, lon, zoom)
+	if err == errElevationMissing || (err == nil && elevation == noElevation) {
+		http.Error(w, "No elevation data at this point", http.StatusNotFound)
+		return 0, false
+	}
+	if err == errUpstreamUnavailable {
+		w.Header().Set("Retry-After", fmt.Sprint(int(breakerCooldown.Seconds())))
+		http.Error(w, "Elevation source unavailable", http.StatusServiceUnavailable)
+		return 0, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch elevation", http.StatusBadGateway)
+		log.Printf("Error fetching elevation for %s: %v", r.URL.Path, err)
+		return 0, false
+	}
+	return elevation, true
+}
+
+// writeJSON sends a response as JSON that can be cached for a day
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(v)
+}
+
+// serveElevation returns the elevation in metres at ?lat= and ?lon=
+func serveElevation(w http.ResponseWriter, r *http.Request) {
+	lat, lon, zoom, err := parsePoint(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	elevation, ok := lookupPoint(w, r, lat, lon, zoom)
+	if !ok {
+		return
+	}
+	metrics.incr("api_requests", "endpoint:elevation")
+	writeJSON(w, map[string]interface{}{
+		"lat":       lat,
+		"lon":       lon,
+		"zoom":      zoom,
+		"elevation": elevation,
+	})
+}
+
+// firstFloodedLevel returns the lowest sea level tiles are rendered at that floods ground at an
+// elevation, and false if it stays dry at every level
+func firstFloodedLevel(elevation int) (int, bool) {
+	level := floorDiv(elevation, 10)*10 + 10
+	if level > 1000 {
+		return 0, false
+	}
+	return max(level, -1000), true
+}
+
+// connectedFloodLevel returns the lowest rendered sea level from which the open ocean reaches a
+// pixel, searching upwards from the level that first floods it. Higher levels only ever flood
+// more, so a binary search is enough.
+func connectedFloodLevel(z, x, y, i, from int) (int, bool, error) {
+	lo, hi := from/10, 1000/10
+	found := false
+	for lo <= hi {
+		mid := floorDiv(lo+hi, 2)
+		flooded, err := connectedFlood(z, x, y, mid*10)
+		if err != nil {
+			return 0, false, err
+		}
+		if flooded[i] {
+			found = true
+			hi = mid - 1
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo * 10, found, nil
+}
+
+// serveFloodLevel returns the lowest sea level that floods the point at ?lat= and ?lon=. Pixels
+// flood when they're below the sea level, so "level" is one metre above the ground and
+// "tile_level" is the first of the 10 m steps tiles are drawn at to show it flooded. With
+// connected flooding configured, "connected_level" is the first step at which the open ocean
+// reaches it; null means it never floods up to +1000 m.
+func serveFloodLevel(w http.ResponseWriter, r *http.Request) {
+	lat, lon, zoom, err := parsePoint(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	elevation, ok := lookupPoint(w, r, lat, lon, zoom)
+	if !ok {
+		return
+	}
+	resp := map[string]interface{}{
+		"lat":        lat,
+		"lon":        lon,
+		"zoom":       zoom,
+		"elevation":  elevation,
+		"level":      elevation + 1,
+		"tile_level": nil,
+	}
+	first, floods := firstFloodedLevel(elevation)
+	if floods {
+		resp["tile_level"] = first
+	}
+
+	if oceanSeeds != nil {
+		resp["connected_level"] = nil
+		if floods {
+			x, y, i := pointPixel(lat, lon, zoom)
+			renderPool.acquire(requestPriority(r))
+			level, found, err := connectedFloodLevel(zoom, x, y, i, first)
+			renderPool.release()
+			if err == errUpstreamUnavailable {
+				w.Header().Set("Retry-After", fmt.Sprint(int(breakerCooldown.Seconds())))
+				http.Error(w, "Elevation source unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Failed to compute connected flooding", http.StatusBadGateway)
+				log.Printf("Error computing connected flooding for %s: %v", r.URL.Path, err)
+				return
+			}
+			if found {
+				resp["connected_level"] = level
+			}
+		}
+	}
+	metrics.incr("api_requests", "endpoint:flood_level")
+	writeJSON(w, resp)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxSeaLevel is the highest sea level that can be requested
+const maxSeaLevel = 1000
+
+// areaStep is the global impact of one sea level step
+type areaStep struct {
+	Level int `json:"level"`
+
+	// Net land area flooded compared to today; negative when land is exposed
+	FloodedKm2 float64 `json:"floodedKm2"`
+
+	// Change in flooded area since the previous step
+	StepKm2 float64 `json:"stepKm2"`
+}
+
+// areaTable is the global flooded area at every sea level step
+type areaTable struct {
+	Zoom  int        `json:"zoom"`
+	Steps []areaStep `json:"steps"`
+}
+
+var (
+	areaTableMu  sync.RWMutex
+	areaTableJob *seedJob
+
+	// The table never changes once computed, so its responses are compressed once
+	areaTableJSON *compressedAsset
+	areaTableCSV  *compressedAsset
+)
+
+// setAreaTable makes a computed table available, preparing its JSON and CSV responses
+func setAreaTable(t *areaTable) {
+	data, _ := json.Marshal(t)
+	var csvBuf bytes.Buffer
+	cw := csv.NewWriter(&csvBuf)
+	cw.Write([]string{"level", "flooded_km2", "step_km2"})
+	for _, s := range t.Steps {
+		cw.Write([]string{
+			strconv.Itoa(s.Level),
+			strconv.FormatFloat(s.FloodedKm2, 'f', 0, 64),
+			strconv.FormatFloat(s.StepKm2, 'f', 0, 64),
+		})
+	}
+	cw.Flush()
+
+	now := time.Now()
+	areaTableMu.Lock()
+	defer areaTableMu.Unlock()
+	areaTableJSON = newCompressedAsset(data, "application/json", now)
+	areaTableCSV = newCompressedAsset(csvBuf.Bytes(), "text/csv", now)
+}
+
+// areaTableZoom is the zoom level elevation is sampled at; each extra level is 4x the fetches
+var areaTableZoom = 5
+
+// elevationHistogram accumulates area in km² per metre of elevation between the lowest
+// and highest sea levels
+type elevationHistogram [maxSeaLevel - minSeaLevel]float64
+
+// add accumulates the area of every pixel in a tile
+func (h *elevationHistogram) add(grid *elevationGrid, z, y int) {
+	for py := 0; py < tileSize; py++ {
+		mpp := metersPerPixel(tileLatitude(z, float64(y)+(float64(py)+0.5)/tileSize), z)
+		area := mpp * mpp / 1e6
+		for px := 0; px < tileSize; px++ {
+			elevation := int(grid[py*tileSize+px])
+			if elevation >= minSeaLevel && elevation < maxSeaLevel {
+				h[elevation-minSeaLevel] += area
+			}
+		}
+	}
+}
+
+// table turns the histogram into flooded areas at every selectable sea level
+func (h *elevationHistogram) table(z int) *areaTable {
+	// below[i] is the area with elevation under minSeaLevel+i
+	var below [maxSeaLevel - minSeaLevel + 1]float64
+	for i, area := range h {
+		below[i+1] = below[i] + area
+	}
+	today := below[-minSeaLevel]
+
+	t := &areaTable{Zoom: z}
+	for level := minSeaLevel; level <= maxSeaLevel; level += 10 {
+		step := areaStep{Level: level, FloodedKm2: math.Round(below[level-minSeaLevel] - today)}
+		if len(t.Steps) > 0 {
+			step.StepKm2 = step.FloodedKm2 - t.Steps[len(t.Steps)-1].FloodedKm2
+		}
+		t.Steps = append(t.Steps, step)
+	}
+	return t
+}
+
+// buildAreaTable samples the whole world's elevation with the seeding engine
+func buildAreaTable(z int) (*areaTable, error) {
+	var mu sync.Mutex
+	var hist elevationHistogram
+
+	job := &seedJob{
+		name:        "area-table",
+		area:        worldBBox,
+		minZoom:     z,
+		maxZoom:     z,
+		concurrency: 8,
+		visit: func(z, x, y int) error {
+			// Deep ocean has nothing within the range of sea levels
+			if oceanMask.contains(z, x, y) {
+				return nil
+			}
+			grid, err := loadElevation(z, x, y, nil)
+			if err != nil {
+				return err
+			}
+			var tile elevationHistogram
+			tile.add(grid, z, y)
+
+			mu.Lock()
+			defer mu.Unlock()
+			for i, area := range tile {
+				hist[i] += area
+			}
+			return nil
+		},
+	}
+	areaTableMu.Lock()
+	areaTableJob = job
+	areaTableMu.Unlock()
+
+	// A table with holes in it would be misleading, so only keep complete ones
+	if failed := job.run(); failed > 0 {
+		return nil, fmt.Errorf("%d tiles failed", failed)
+	}
+	return hist.table(z), nil
+}
+
+// loadAreaTable reads a previously computed table, or computes and saves one in the background
+func loadAreaTable(path string, z int) {
+	if data, err := os.ReadFile(path); err == nil && len(data) > 0 {
+		var t areaTable
+		if err := json.Unmarshal(data, &t); err != nil {
+			log.Printf("Ignoring invalid area table %s: %v", path, err)
+		} else if t.Zoom == z {
+			setAreaTable(&t)
+			log.Printf("Loaded area table from %s", path)
+			return
+		}
+	}
+
+	go func() {
+		t, err := buildAreaTable(z)
+		if err != nil {
+			reportError("area-table", fmt.Errorf("failed to build area table: %v", err), nil)
+			return
+		}
+		setAreaTable(t)
+
+		data, _ := json.Marshal(t)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			reportError("area-table", fmt.Errorf("failed to save area table: %v", err), nil)
+			return
+		}
+		log.Printf("Saved area table to %s", path)
+	}()
+}
+
+// serveAreaTable serves the global flooded area at every sea level as JSON or CSV
+func serveAreaTable(w http.ResponseWriter, r *http.Request) {
+	areaTableMu.RLock()
+	job, asset := areaTableJob, areaTableJSON
+	if mux.Vars(r)["ext"] == "csv" {
+		asset = areaTableCSV
+	}
+	areaTableMu.RUnlock()
+
+	if asset == nil {
+		if job == nil {
+			http.Error(w, "Area table not enabled", http.StatusNotFound)
+			return
+		}
+		done, total := job.progress()
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, fmt.Sprintf("Area table is being computed (%d/%d tiles)", done, total), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	asset.serve(w, r)
+}
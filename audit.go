@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditLog records admin operations separately from the access log
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// AuditEntry is a single line in the audit log
+type AuditEntry struct {
+	Time   time.Time         `json:"time"`
+	Action string            `json:"action"`
+	Key    string            `json:"key,omitempty"`
+	IP     string            `json:"ip"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// audit is nil unless AUDIT_LOG is set, in which case entries are only logged locally
+var audit *AuditLog
+
+// openAuditLog opens (or creates) an append-only audit log file
+func openAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{file: f}, nil
+}
+
+// recordAudit notes who performed an admin action and with which parameters
+func recordAudit(r *http.Request, action string, params map[string]string) {
+	entry := AuditEntry{
+		Time:   time.Now().UTC(),
+		Action: action,
+		Key:    apiKeyFingerprint(r),
+		IP:     clientIP(r),
+		Params: params,
+	}
+
+	if audit == nil {
+		log.Printf("Audit: action=%s key=%s ip=%s params=%v", entry.Action, entry.Key, entry.IP, entry.Params)
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode audit entry: %v", err)
+		return
+	}
+
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	if _, err := audit.file.Write(append(line, '\n')); err != nil {
+		reportError("audit", err, map[string]string{"action": action})
+	}
+}
+
+// requestAPIKey returns the API key presented with a request, if any
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// apiKeyFingerprint identifies the caller's API key without writing the key itself to disk
+func apiKeyFingerprint(r *http.Request) string {
+	key := requestAPIKey(r)
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// clientIP returns the remote address of a request without the port. Requests from trusted
+// proxies are attributed to the last address in X-Forwarded-For that isn't a trusted proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !trustedProxies.contains(ip) {
+		return host
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			break
+		}
+		host = addr
+		if !trustedProxies.contains(ip) {
+			break
+		}
+	}
+	return host
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// maxColorBands limits how many bands can be requested for one tile
+const maxColorBands = 16
+
+// colorBand colors pixels lower than threshold metres above the sea level, unless a lower band
+// already has
+type colorBand struct {
+	threshold int
+	color     color.RGBA
+}
+
+// parseHexColor parses a CSS-style hex color of 3, 4, 6 or 8 digits, with or without a "#"
+func parseHexColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	switch len(hex) {
+	case 3, 4:
+		// Expand shorthand, e.g. "36c" to "3366cc"
+		var long strings.Builder
+		for _, c := range hex {
+			long.WriteRune(c)
+			long.WriteRune(c)
+		}
+		hex = long.String()
+	case 6, 8:
+	default:
+		return color.RGBA{}, fmt.Errorf("Invalid color: %q", s)
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("Invalid color: %q", s)
+	}
+	return color.RGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
+
+// parseBands parses an ordered list of bands such as "0:004,2:36c,5:9cf"
+func parseBands(s string) ([]colorBand, error) {
+	var bands []colorBand
+	for _, part := range strings.Split(s, ",") {
+		threshold, hex, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("Invalid band %q: expected threshold:color", part)
+		}
+		t, err := strconv.Atoi(threshold)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid band threshold: %q", threshold)
+		}
+		c, err := parseHexColor(hex)
+		if err != nil {
+			return nil, err
+		}
+		if len(bands) > 0 && t <= bands[len(bands)-1].threshold {
+			return nil, fmt.Errorf("Band thresholds must be in increasing order")
+		}
+		bands = append(bands, colorBand{threshold: t, color: c})
+	}
+	if len(bands) > maxColorBands {
+		return nil, fmt.Errorf("Too many bands: at most %d", maxColorBands)
+	}
+	return bands, nil
+}
+
+// colorKey formats a color as 8 hex digits, the canonical form parseHexColor accepts
+func colorKey(c color.RGBA) string {
+	return fmt.Sprintf("%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
+
+// bandsKey formats bands canonically, so equivalent requests share a cache entry
+func bandsKey(bands []colorBand) string {
+	parts := make([]string, len(bands))
+	for i, b := range bands {
+		parts[i] = strconv.Itoa(b.threshold) + ":" + colorKey(b.color)
+	}
+	return strings.Join(parts, ",")
+}
+
+// renderBands colors each pixel by the first band whose threshold above the sea level it is below
+func renderBands(grid *elevationGrid, seaLevel int, bands []colorBand) *image.RGBA {
+	outputImg := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+
+	for i, elevation := range grid {
+		for _, band := range bands {
+			if int(elevation) < seaLevel+band.threshold {
+				c := band.color
+				offset := i * 4
+				outputImg.Pix[offset] = c.R
+				outputImg.Pix[offset+1] = c.G
+				outputImg.Pix[offset+2] = c.B
+				outputImg.Pix[offset+3] = c.A
+				break
+			}
+		}
+	}
+	return outputImg
+}
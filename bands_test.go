@@ -0,0 +1,54 @@
+package main
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestParseHexColor(t *testing.T) {
+	tests := []struct {
+		s    string
+		want color.RGBA
+	}{
+		{"#36c", color.RGBA{0x33, 0x66, 0xcc, 0xff}},
+		{"36c8", color.RGBA{0x33, 0x66, 0xcc, 0x88}},
+		{"#003278", color.RGBA{0x00, 0x32, 0x78, 0xff}},
+		{"00327880", color.RGBA{0x00, 0x32, 0x78, 0x80}},
+		{"ABCDEF", color.RGBA{0xab, 0xcd, 0xef, 0xff}},
+	}
+	for _, test := range tests {
+		got, err := parseHexColor(test.s)
+		if err != nil || got != test.want {
+			t.Errorf("parseHexColor(%q) = %v, %v, want %v", test.s, got, err, test.want)
+		}
+		if again, _ := parseHexColor(colorKey(got)); again != got {
+			t.Errorf("colorKey(%v) = %s doesn't parse back", got, colorKey(got))
+		}
+	}
+	for _, s := range []string{"", "#", "12", "12345", "#ggg", "1234567", "-12345"} {
+		if _, err := parseHexColor(s); err == nil {
+			t.Errorf("parseHexColor(%q) should have failed", s)
+		}
+	}
+}
+
+func TestParseBands(t *testing.T) {
+	bands, err := parseBands("0:004, 2:36c,5:9cf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bands) != 3 || bands[0].threshold != 0 || bands[2].threshold != 5 || bands[1].color != (color.RGBA{0x33, 0x66, 0xcc, 0xff}) {
+		t.Errorf("parseBands = %v", bands)
+	}
+	if key := bandsKey(bands); key != "0:000044ff,2:3366ccff,5:99ccffff" {
+		t.Errorf("bandsKey = %s", key)
+	}
+
+	invalid := []string{"", "0", "a:004", "0:xyz", "2:004,2:36c", "5:004,2:36c",
+		"0:0,1:0,2:0,3:0,4:0,5:0,6:0,7:0,8:0,9:0,10:0,11:0,12:0,13:0,14:0,15:0,16:0"}
+	for _, s := range invalid {
+		if _, err := parseBands(s); err == nil {
+			t.Errorf("parseBands(%q) should have failed", s)
+		}
+	}
+}
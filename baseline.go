@@ -0,0 +1,73 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// waterMask marks water today, such as the sea, lakes and rivers; the dry land and inland water
+// modes are unavailable without it
+var waterMask *maskSource
+
+// dryLandColor marks land below the sea level that is dry today, like polders and much of New
+// Orleans behind their defences
+var dryLandColor = color.RGBA{70, 170, 160, 255}
+
+// paintDryLand recolors flooded pixels that aren't water today. A missing mask tile is taken as
+// having no water.
+func paintDryLand(img *image.RGBA, grid *elevationGrid, seaLevel int, water *tileMask, c color.RGBA) {
+	c = premultiply(c)
+	for i, elevation := range grid {
+		if int(elevation) >= seaLevel || (water != nil && water[i]) {
+			continue
+		}
+		offset := i * 4
+		img.Pix[offset] = c.R
+		img.Pix[offset+1] = c.G
+		img.Pix[offset+2] = c.B
+		img.Pix[offset+3] = c.A
+	}
+}
+
+// paintInlandWater colors water today that's above the sea level, like lakes and rivers inland,
+// so it doesn't show as land
+func paintInlandWater(img *image.RGBA, grid *elevationGrid, seaLevel int, water *tileMask, c color.RGBA) {
+	if water == nil {
+		return
+	}
+	c = premultiply(c)
+	for i, elevation := range grid {
+		if !water[i] || (elevation != noElevation && int(elevation) < seaLevel) {
+			continue
+		}
+		offset := i * 4
+		img.Pix[offset] = c.R
+		img.Pix[offset+1] = c.G
+		img.Pix[offset+2] = c.B
+		img.Pix[offset+3] = c.A
+	}
+}
+
+// oceanPolygons marks the sea today, rasterized from OSM ocean polygons; the coastline
+// correction is unavailable without it
+var oceanPolygons *maskSource
+
+// correctCoastline returns a copy of a grid whose level 0 shoreline follows the mapped coast
+// rather than the elevation data, which is noisy around tidal flats and estuaries. Sea today is
+// lowered just below 0 and land today is raised to 0, so other sea levels still flood by
+// elevation. A missing mask tile is taken as having no sea.
+func correctCoastline(grid *elevationGrid, sea *tileMask) *elevationGrid {
+	corrected := *grid
+	for i, elevation := range corrected {
+		if elevation == noElevation {
+			continue
+		}
+		isSea := sea != nil && sea[i]
+		if isSea && elevation >= 0 {
+			corrected[i] = -1
+		} else if !isSea && elevation < 0 {
+			corrected[i] = 0
+		}
+	}
+	return &corrected
+}
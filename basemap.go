@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg" // Some basemap providers serve JPEG tiles
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultBasemapURL         = "https://tile.openstreetmap.org/{z}/{x}/{y}.png"
+	defaultBasemapAttribution = "© OpenStreetMap contributors"
+)
+
+// basemapURL returns the basemap tile URL for z/x/y
+func basemapURL(z, x, y int) string {
+	template := os.Getenv("BASEMAP_URL")
+	if template == "" {
+		template = defaultBasemapURL
+	}
+	return strings.NewReplacer(
+		"{z}", fmt.Sprint(z),
+		"{x}", fmt.Sprint(x),
+		"{y}", fmt.Sprint(y),
+	).Replace(template)
+}
+
+// basemapAttribution returns the attribution text required by the basemap provider
+func basemapAttribution() string {
+	if attribution := os.Getenv("BASEMAP_ATTRIBUTION"); attribution != "" {
+		return attribution
+	}
+	return defaultBasemapAttribution
+}
+
+var basemapCache = newTileCache("basemap")
+
+// basemapCacheTTL is how long basemap tiles are kept (0 means until evicted)
+var basemapCacheTTL time.Duration
+
+// fetchBasemapTile fetches and decodes a single basemap tile
+func fetchBasemapTile(z, x, y int) (image.Image, error) {
+	data, err := getBasemapTile(z, x, y)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode basemap tile: %v", err)
+	}
+	return img, nil
+}
+
+// getBasemapTile returns the raw bytes of a basemap tile, from the cache if possible
+func getBasemapTile(z, x, y int) ([]byte, error) {
+	cacheKey := fmt.Sprintf("%d/%d/%d", z, x, y)
+
+	for {
+		cached, exists := basemapCache.get(cacheKey)
+		if exists {
+			metrics.incr("basemap_cache_lookups", "result:hit")
+			return cached.data, nil
+		}
+
+		// Wait for any in-flight fetch of the same tile, then check the cache again
+		basemapCache.flightMu.Lock()
+		ch, inFlight := basemapCache.inFlight[cacheKey]
+		if !inFlight {
+			basemapCache.inFlight[cacheKey] = make(chan []byte)
+			basemapCache.flightMu.Unlock()
+			break
+		}
+		basemapCache.flightMu.Unlock()
+		<-ch
+
+		// If the other fetch failed then we try ourselves
+		_, exists = basemapCache.get(cacheKey)
+		if !exists {
+			return fetchBasemapTileData(z, x, y)
+		}
+	}
+	metrics.incr("basemap_cache_lookups", "result:miss")
+
+	defer func() {
+		basemapCache.flightMu.Lock()
+		close(basemapCache.inFlight[cacheKey])
+		delete(basemapCache.inFlight, cacheKey)
+		basemapCache.flightMu.Unlock()
+	}()
+
+	data, err := fetchBasemapTileData(z, x, y)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	basemapCache.put(cacheKey, CachedTile{
+		data:      data,
+		timestamp: now,
+		expires:   expiresAfter(now, basemapCacheTTL),
+	})
+
+	return data, nil
+}
+
+// fetchBasemapTileData downloads a basemap tile from the configured provider
+func fetchBasemapTileData(z, x, y int) ([]byte, error) {
+	req, err := http.NewRequest("GET", basemapURL(z, x, y), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	authorizeUpstream(req)
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch basemap tile: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("basemap tile request failed with status: %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read basemap tile: %v", err)
+	}
+	return data, nil
+}
+
+// serveBasemap proxies basemap tiles so clients only need to reach this server
+func serveBasemap(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	z, _ := strconv.Atoi(vars["z"])
+	x, _ := strconv.Atoi(vars["x"])
+	y, _ := strconv.Atoi(vars["y"])
+
+	if z > 19 || x >= 1<<z || y >= 1<<z {
+		http.Error(w, "Invalid tile coordinates", http.StatusBadRequest)
+		return
+	}
+
+	data, err := getBasemapTile(z, x, y)
+	if err != nil {
+		http.Error(w, "Failed to fetch basemap tile", http.StatusBadGateway)
+		log.Printf("Error fetching basemap tile: %v", err)
+		return
+	}
+
+	// The provider's terms usually require attribution wherever its tiles are shown
+	w.Header().Set("X-Tile-Attribution", normalizeText(basemapAttribution()))
+	if license := os.Getenv("BASEMAP_LICENSE_URL"); license != "" {
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"license\"", license))
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Tile-Attribution")
+	w.Write(data)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"time"
+)
+
+// bathymetrySource merges a bathymetry grid such as GEBCO or ETOPO into land elevations.
+// Terrarium tiles flatten most of the sea floor, so without it lowering the sea drains the
+// oceans onto a featureless plain. Wherever the land source is at or below zero the deeper of
+// the two is used, so polders and other land below sea level keep their surveyed heights.
+type bathymetrySource struct {
+	land elevationSource
+	sea  elevationSource
+}
+
+func (s *bathymetrySource) name() string {
+	return s.land.name()
+}
+
+func (s *bathymetrySource) nativeMaxZoom() int {
+	return sourceMaxZoom(s.land)
+}
+
+func (s *bathymetrySource) describe() string {
+	return s.land.describe() + " + bathymetry " + s.sea.name() + ":" + s.sea.describe()
+}
+
+// tile fetches the land tile, then bathymetry only if part of it is under water or missing
+func (s *bathymetrySource) tile(z, x, y int, timing *serverTiming) (*elevationGrid, error) {
+	grid, err := s.land.tile(z, x, y, timing)
+	if err != nil && err != errElevationMissing {
+		return nil, err
+	}
+	if grid != nil && !hasSeaFloor(grid) {
+		return grid, nil
+	}
+
+	start := time.Now()
+	sea, seaErr := s.sea.tile(z, x, y, nil)
+	metrics.timing("bathymetry_fetch", time.Since(start))
+	if seaErr != nil {
+		if seaErr != errElevationMissing && seaErr != errUpstreamUnavailable {
+			reportError("bathymetry", seaErr, map[string]string{"source": s.sea.describe()})
+		}
+		return grid, err
+	}
+	if grid == nil {
+		metrics.incr("bathymetry_tiles", "result:replaced")
+		return sea, nil
+	}
+
+	for i, elevation := range grid {
+		depth := sea[i]
+		if depth == noElevation {
+			continue
+		}
+		if elevation == noElevation || elevation <= 0 && depth < elevation {
+			grid[i] = depth
+		}
+	}
+	metrics.incr("bathymetry_tiles", "result:merged")
+	return grid, nil
+}
+
+// hasSeaFloor checks whether any of a tile is at or below sea level, or has no data
+func hasSeaFloor(grid *elevationGrid) bool {
+	for _, elevation := range grid {
+		if elevation <= 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"time"
+)
+
+// bedrockSource has the elevation of the ground under today's ice sheets, such as BedMachine
+// Greenland and Antarctica; the bedrock mode is unavailable without it. ELEVATION_BEDROCK lists
+// sources as for ELEVATION_SOURCES.
+var bedrockSource elevationSource
+
+// bedrockCache keeps surface grids with the bedrock merged in. Tiles away from the ice sheets
+// are kept as the surface grid itself, so they aren't looked up again.
+var bedrockCache = newElevationCache(256)
+
+// loadBedrock returns the elevation grid for a tile with the ice removed, using the bedrock
+// wherever it has data and the surface elsewhere
+func loadBedrock(z, x, y int, timing *serverTiming) (*elevationGrid, error) {
+	surface, err := loadElevation(z, x, y, timing)
+	if err != nil {
+		return nil, err
+	}
+	key := elevationKey(z, x, y)
+	if grid, exists := bedrockCache.get(key); exists {
+		metrics.incr("bedrock_cache", "result:hit")
+		return grid, nil
+	}
+	metrics.incr("bedrock_cache", "result:miss")
+
+	start := time.Now()
+	bedrock, err := bedrockSource.tile(z, x, y, nil)
+	metrics.timing("bedrock_fetch", time.Since(start))
+	timing.since("fetch", start)
+	if err == errElevationMissing {
+		bedrockCache.put(key, surface)
+		return surface, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	merged := *surface
+	for i, elevation := range bedrock {
+		if elevation != noElevation {
+			merged[i] = elevation
+		}
+	}
+	bedrockCache.put(key, &merged)
+	return &merged, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// CachePolicy decides how long tiles are kept, server-side and by clients, based on zoom and level.
+// It is loaded from CACHE_POLICY_FILE, for example:
+//
+//	{"rules": [
+//	  {"maxZoom": 6, "ttl": "720h", "maxAge": "168h", "pin": true},
+//	  {"levelMultiple": 100, "ttl": "168h", "maxAge": "24h", "priority": 1},
+//	  {"minZoom": 13, "ttl": "1h", "maxAge": "10m", "priority": -1}
+//	]}
+//
+// When the tile cache is full, lower priority tiles are evicted first and pinned tiles never are.
+// The first matching rule wins; tiles matching no rule use the defaults.
+type CachePolicy struct {
+	mu    sync.RWMutex // Guards Rules, which the admin API can reload
+	Rules []CacheRule  `json:"rules"`
+}
+
+// CacheRule sets cache lifetimes for tiles in a zoom band and/or set of levels
+type CacheRule struct {
+	MinZoom       *int     `json:"minZoom,omitempty"`
+	MaxZoom       *int     `json:"maxZoom,omitempty"`
+	Levels        []int    `json:"levels,omitempty"`
+	LevelMultiple int      `json:"levelMultiple,omitempty"`
+	TTL           Duration `json:"ttl"`
+	MaxAge        Duration `json:"maxAge"`
+	Priority      int      `json:"priority,omitempty"`
+	Pin           bool     `json:"pin,omitempty"`
+}
+
+// Duration is a time.Duration that reads from JSON strings like "24h"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"24h\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+const defaultTileMaxAge = time.Hour
+
+// defaultTileTTL applies to tiles matching no rule (0 means forever)
+var defaultTileTTL time.Duration
+
+var cachePolicy = &CachePolicy{}
+
+// loadCachePolicy reads a cache policy from a JSON file
+func loadCachePolicy(path string) (*CachePolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy CachePolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("invalid cache policy %s: %v", path, err)
+	}
+	return &policy, nil
+}
+
+func (r *CacheRule) matches(level, z int) bool {
+	if r.MinZoom != nil && z < *r.MinZoom {
+		return false
+	}
+	if r.MaxZoom != nil && z > *r.MaxZoom {
+		return false
+	}
+	if r.LevelMultiple != 0 && level%r.LevelMultiple != 0 {
+		return false
+	}
+	if len(r.Levels) > 0 {
+		found := false
+		for _, l := range r.Levels {
+			if l == level {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// replace swaps in the rules of a newly loaded policy
+func (p *CachePolicy) replace(policy *CachePolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Rules = policy.Rules
+}
+
+// rule returns the first rule matching a tile, or nil
+func (p *CachePolicy) rule(level, z int) *CacheRule {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for i := range p.Rules {
+		if p.Rules[i].matches(level, z) {
+			return &p.Rules[i]
+		}
+	}
+	return nil
+}
+
+// ttl returns how long a tile may stay in the server cache (0 means forever)
+func (p *CachePolicy) ttl(level, z int) time.Duration {
+	if rule := p.rule(level, z); rule != nil {
+		return time.Duration(rule.TTL)
+	}
+	return defaultTileTTL
+}
+
+// retention returns a tile's eviction priority and whether it is pinned in the cache
+func (p *CachePolicy) retention(level, z int) (int, bool) {
+	if rule := p.rule(level, z); rule != nil {
+		return rule.Priority, rule.Pin
+	}
+	return 0, false
+}
+
+// tileRetention applies the cache policy to tile cache keys
+func tileRetention(key string) (int, bool) {
+	level, z, _, _, ok := parseTileKey(key)
+	if !ok {
+		return 0, false
+	}
+	return cachePolicy.retention(level, z)
+}
+
+// maxAge returns the Cache-Control lifetime for a tile
+func (p *CachePolicy) maxAge(level, z int) time.Duration {
+	if rule := p.rule(level, z); rule != nil && rule.MaxAge > 0 {
+		return time.Duration(rule.MaxAge)
+	}
+	return defaultTileMaxAge
+}
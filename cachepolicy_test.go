@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// examplePolicy is the example from the CachePolicy doc comment
+const examplePolicy = `{"rules": [
+	{"maxZoom": 6, "ttl": "720h", "maxAge": "168h", "pin": true},
+	{"levelMultiple": 100, "ttl": "168h", "maxAge": "24h", "priority": 1},
+	{"minZoom": 13, "ttl": "1h", "maxAge": "10m", "priority": -1}
+]}`
+
+func TestCachePolicyRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(examplePolicy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := loadCachePolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		level, z int
+		ttl      time.Duration
+		maxAge   time.Duration
+		priority int
+		pinned   bool
+	}{
+		{level: 30, z: 4, ttl: 720 * time.Hour, maxAge: 168 * time.Hour, pinned: true},
+		{level: 100, z: 6, ttl: 720 * time.Hour, maxAge: 168 * time.Hour, pinned: true}, // The first match wins
+		{level: 100, z: 14, ttl: 168 * time.Hour, maxAge: 24 * time.Hour, priority: 1},
+		{level: -200, z: 10, ttl: 168 * time.Hour, maxAge: 24 * time.Hour, priority: 1},
+		{level: 30, z: 13, ttl: time.Hour, maxAge: 10 * time.Minute, priority: -1},
+		{level: 30, z: 10, ttl: defaultTileTTL, maxAge: defaultTileMaxAge},
+	}
+	for _, test := range tests {
+		if got := policy.ttl(test.level, test.z); got != test.ttl {
+			t.Errorf("ttl(%d, %d) = %v, want %v", test.level, test.z, got, test.ttl)
+		}
+		if got := policy.maxAge(test.level, test.z); got != test.maxAge {
+			t.Errorf("maxAge(%d, %d) = %v, want %v", test.level, test.z, got, test.maxAge)
+		}
+		priority, pinned := policy.retention(test.level, test.z)
+		if priority != test.priority || pinned != test.pinned {
+			t.Errorf("retention(%d, %d) = %d, %v, want %d, %v", test.level, test.z, priority, pinned, test.priority, test.pinned)
+		}
+	}
+}
+
+func TestCacheRuleLevels(t *testing.T) {
+	var rule CacheRule
+	if err := json.Unmarshal([]byte(`{"levels": [10, 50], "minZoom": 3, "maxZoom": 8, "ttl": "1h"}`), &rule); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		level, z int
+		want     bool
+	}{{10, 3, true}, {50, 8, true}, {20, 5, false}, {10, 2, false}, {50, 9, false}}
+	for _, test := range tests {
+		if got := rule.matches(test.level, test.z); got != test.want {
+			t.Errorf("matches(%d, %d) = %v, want %v", test.level, test.z, got, test.want)
+		}
+	}
+}
+
+func TestCachePolicyInvalid(t *testing.T) {
+	for _, policy := range []string{
+		`{"rules": [{"ttl": 3600}]}`,
+		`{"rules": [{"ttl": "an hour"}]}`,
+		`{"rules": `,
+	} {
+		path := filepath.Join(t.TempDir(), "policy.json")
+		if err := os.WriteFile(path, []byte(policy), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadCachePolicy(path); err == nil {
+			t.Errorf("expected an error loading %s", policy)
+		}
+	}
+}
+
+func TestCachePolicyReplace(t *testing.T) {
+	policy := &CachePolicy{}
+	if got := policy.maxAge(0, 5); got != defaultTileMaxAge {
+		t.Fatalf("empty policy maxAge = %v, want the default", got)
+	}
+	policy.replace(&CachePolicy{Rules: []CacheRule{{MaxAge: Duration(time.Minute)}}})
+	if got := policy.maxAge(0, 5); got != time.Minute {
+		t.Errorf("maxAge after replace = %v, want 1m", got)
+	}
+}
+
+func TestTileCacheRetention(t *testing.T) {
+	// Pinned tiles outlast recently used ones, and low priority tiles go first
+	c := newTileCache("test")
+	c.setLimits(0, 3)
+	c.retention = func(key string) (int, bool) {
+		switch key {
+		case "pinned":
+			return 0, true
+		case "low":
+			return -1, false
+		}
+		return 0, false
+	}
+	for _, key := range []string{"pinned", "a", "low", "b", "c"} {
+		c.put(key, CachedTile{data: []byte(key)})
+	}
+	for key, want := range map[string]bool{"pinned": true, "a": false, "low": false, "b": true, "c": true} {
+		if _, exists := c.get(key); exists != want {
+			t.Errorf("%s cached = %v, want %v", key, exists, want)
+		}
+	}
+}
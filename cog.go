@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// cogHeaderSize is how much of a remote GeoTIFF is read up front. Cloud-Optimized GeoTIFFs keep
+// every directory at the start of the file, so the header and overviews are parsed from this
+// without further requests.
+const cogHeaderSize = 64 << 10
+
+// rangeReader reads a remote file with HTTP range requests
+type rangeReader struct {
+	url  string
+	head []byte
+}
+
+func newRangeReader(url string) (*rangeReader, error) {
+	r := &rangeReader{url: url}
+	head, err := r.fetch(0, cogHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	r.head = head
+	return r, nil
+}
+
+func (r *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) <= int64(len(r.head)) {
+		return copy(p, r.head[off:]), nil
+	}
+	data, err := r.fetch(off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fetch requests length bytes from off, returning fewer at the end of the file, and
+// errElevationMissing if there's no file at all
+func (r *rangeReader) fetch(off int64, length int) ([]byte, error) {
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(length)-1))
+	req.Header.Set("User-Agent", userAgent)
+	authorizeUpstream(req)
+
+	start := time.Now()
+	resp, err := upstreamRetry.do(upstreamClient, elevationLimiter, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", r.url, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && off == 0:
+		// Small files may be sent whole
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		return nil, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errElevationMissing
+	case resp.StatusCode == http.StatusOK:
+		return nil, fmt.Errorf("%s doesn't support range requests", r.url)
+	default:
+		return nil, fmt.Errorf("reading %s failed with status: %d", r.url, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(length)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", r.url, err)
+	}
+	metrics.timing("cog_range_fetch", time.Since(start))
+	return data, nil
+}
+
+// newCOGSource reads Cloud-Optimized GeoTIFFs over HTTP from a comma-separated list of URLs,
+// such as Copernicus DEM tiles or a custom DEM in object storage, fetching only the blocks
+// of the overview each tile needs
+func newCOGSource(spec string) (*geoTIFFSource, error) {
+	s := &geoTIFFSource{kind: "cog", spec: spec}
+	for _, u := range strings.Split(spec, ",") {
+		u = strings.TrimSpace(u)
+		if err := checkURL(u); err != nil {
+			return nil, fmt.Errorf("invalid COG URL %q: %v", u, err)
+		}
+		r, err := newRangeReader(u)
+		if err == errElevationMissing {
+			return nil, fmt.Errorf("%s not found", u)
+		} else if err != nil {
+			return nil, err
+		}
+		g, err := parseGeoTIFF(u, r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", u, err)
+		}
+		s.files = append(s.files, g)
+	}
+	return s, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// compressedAsset is a response body kept alongside compressed copies of itself, so repeated
+// requests don't recompress it every time
+type compressedAsset struct {
+	contentType string
+	modTime     time.Time
+	etag        string
+	identity    []byte
+	gzip        []byte
+	brotli      []byte // Only available if built ahead of time, as there's no brotli encoder in the standard library
+}
+
+// newCompressedAsset compresses a response body ready for serving
+func newCompressedAsset(data []byte, contentType string, modTime time.Time) *compressedAsset {
+	a := &compressedAsset{
+		contentType: contentType,
+		modTime:     modTime,
+		etag:        sha256Hex(data)[:16],
+		identity:    data,
+	}
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	zw.Write(data)
+	zw.Close()
+
+	// Tiny bodies can get bigger when compressed
+	if buf.Len() < len(data) {
+		a.gzip = buf.Bytes()
+	}
+	return a
+}
+
+// encodingQuality returns the q-value an Accept-Encoding header gives a coding, or 0 if not acceptable
+func encodingQuality(acceptEncoding, coding string) float64 {
+	best := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != coding && name != "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		best = max(best, q)
+	}
+	return best
+}
+
+// serve writes the smallest variant the client accepts
+func (a *compressedAsset) serve(w http.ResponseWriter, r *http.Request) {
+	acceptEncoding := r.Header.Get("Accept-Encoding")
+	body, coding := a.identity, ""
+	if a.brotli != nil && encodingQuality(acceptEncoding, "br") > 0 {
+		body, coding = a.brotli, "br"
+	} else if a.gzip != nil && encodingQuality(acceptEncoding, "gzip") > 0 {
+		body, coding = a.gzip, "gzip"
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", a.contentType)
+	h.Add("Vary", "Accept-Encoding")
+	if coding != "" {
+		h.Set("Content-Encoding", coding)
+		h.Set("ETag", fmt.Sprintf("\"%s-%s\"", a.etag, coding))
+	} else {
+		h.Set("ETag", fmt.Sprintf("\"%s\"", a.etag))
+	}
+
+	// ServeContent handles conditional and range requests
+	http.ServeContent(w, r, "", a.modTime, bytes.NewReader(body))
+}
+
+// staticAsset is a file served from disk, reloaded whenever it changes
+type staticAsset struct {
+	mu          sync.Mutex
+	path        string
+	contentType string
+	asset       *compressedAsset
+}
+
+// load returns the compressed asset, rereading the file if it has changed. A pre-built
+// brotli copy is picked up from the same path with ".br" appended.
+func (s *staticAsset) load() (*compressedAsset, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.asset != nil && s.asset.modTime.Equal(info.ModTime()) {
+		return s.asset, nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	asset := newCompressedAsset(data, s.contentType, info.ModTime())
+	if br, err := os.Stat(s.path + ".br"); err == nil && !br.ModTime().Before(info.ModTime()) {
+		if asset.brotli, err = os.ReadFile(s.path + ".br"); err != nil {
+			return nil, err
+		}
+	}
+	s.asset = asset
+	return asset, nil
+}
+
+func (s *staticAsset) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	asset, err := s.load()
+	if err != nil {
+		reportError("static", err, map[string]string{"path": s.path})
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	asset.serve(w, r)
+}
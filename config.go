@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// basePath is the path prefix all routes are mounted under, e.g. "/sealevel", or "" for the root
+var basePath string
+
+// normalizeBasePath turns "sealevel/" or "/sealevel/" into "/sealevel", and "/" into ""
+func normalizeBasePath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+	return "/" + path
+}
+
+// appURL returns the absolute path of a route, including the base path
+func appURL(path string) string {
+	return basePath + path
+}
+
+// envString returns an environment variable, or def if it is unset
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt returns an integer environment variable, or def if it is unset
+func envInt(name string, def int) int {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatalf("Invalid %s: %q is not an integer", name, s)
+	}
+	return v
+}
+
+// envFloat returns a numeric environment variable such as "2.5", or def if it is unset
+func envFloat(name string, def float64) float64 {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %q is not a number", name, s)
+	}
+	return v
+}
+
+// envDuration returns a duration environment variable such as "2s", or def if it is unset
+func envDuration(name string, def time.Duration) time.Duration {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		log.Fatalf("Invalid %s: %q is not a duration", name, s)
+	}
+	return v
+}
+
+// envBool returns a boolean environment variable such as "1" or "true", or def if it is unset
+func envBool(name string, def bool) bool {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		log.Fatalf("Invalid %s: %q is not a boolean", name, s)
+	}
+	return v
+}
+
+// envBytes returns a size environment variable such as "512MB", or def if it is unset
+func envBytes(name string, def int64) int64 {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	v, err := parseByteSize(s)
+	if err != nil {
+		log.Fatalf("Invalid %s: %q is not a size", name, s)
+	}
+	return v
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// oceanSeeds marks open ocean on coarse tiles; the connected flooding mode is unavailable
+// without it
+var oceanSeeds *maskSource
+
+// connectedBaseZoom is the zoom at and below which flooding is seeded from oceanSeeds. Above it
+// each tile is seeded along its edges from its parent, so the sea reaches a tile the way it
+// reached the tiles around it.
+var connectedBaseZoom = 4
+
+// connectedMasks caches connected flooding masks, packed one bit per pixel, by sea level and tile
+var connectedMasks = newTileCache("connected")
+
+// connectedFlood returns the pixels of a tile below the sea level that the open ocean can reach,
+// leaving out inland basins like the Caspian, Death Valley and polders behind dykes. Connections
+// narrower than a pixel at the zoom they cross a tile edge at are missed.
+func connectedFlood(z, x, y, seaLevel int) (*tileMask, error) {
+	key := fmt.Sprintf("%d/%s", seaLevel, elevationKey(z, x, y))
+	if cached, exists := connectedMasks.get(key); exists {
+		metrics.incr("connected_masks", "result:hit")
+		return unpackMask(cached.data), nil
+	}
+	metrics.incr("connected_masks", "result:miss")
+
+	var grid *elevationGrid
+	if oceanMask.contains(z, x, y) {
+		grid = deepOceanGrid
+	} else {
+		var err error
+		if grid, err = loadElevation(z, x, y, nil); err == errElevationMissing {
+			// Nothing is known to flood here, so nothing can pass through to the tiles beyond
+			return new(tileMask), nil
+		} else if err != nil {
+			return nil, err
+		}
+		grid = smoothElevation(grid)
+	}
+
+	seeds := new(tileMask)
+	if z <= connectedBaseZoom {
+		ocean, err := oceanSeeds.load(z, x, y)
+		if err != nil {
+			return nil, err
+		}
+		if ocean != nil {
+			seeds = ocean
+		}
+	} else {
+		parent, err := connectedFlood(z-1, x/2, y/2, seaLevel)
+		if err != nil {
+			return nil, err
+		}
+		// Only the edges are seeded, so basins inside the tile must be reached through it
+		offsetX, offsetY := (x%2)*tileSize/2, (y%2)*tileSize/2
+		for i := 0; i < tileSize; i++ {
+			for _, p := range [4][2]int{{i, 0}, {i, tileSize - 1}, {0, i}, {tileSize - 1, i}} {
+				seeds[p[1]*tileSize+p[0]] = parent[(offsetY+p[1]/2)*tileSize+offsetX+p[0]/2]
+			}
+		}
+	}
+
+	start := time.Now()
+	flooded := floodFrom(grid, seeds, seaLevel)
+	metrics.timing("connected_flood", time.Since(start))
+	connectedMasks.put(key, CachedTile{data: packMask(flooded), timestamp: time.Now()})
+	return flooded, nil
+}
+
+// floodFrom spreads water from the seeds below the sea level to every pixel below it that they
+// reach, moving only between pixels that share an edge so that water doesn't leak diagonally
+// through dykes
+func floodFrom(grid *elevationGrid, seeds *tileMask, seaLevel int) *tileMask {
+	flooded := new(tileMask)
+	var queue []int
+	for i, seed := range seeds {
+		if seed && int(grid[i]) < seaLevel {
+			flooded[i] = true
+			queue = append(queue, i)
+		}
+	}
+	for len(queue) > 0 {
+		i := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		px, py := i%tileSize, i/tileSize
+		for _, d := range [4][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+			nx, ny := px+d[0], py+d[1]
+			if nx < 0 || ny < 0 || nx >= tileSize || ny >= tileSize {
+				continue
+			}
+			j := ny*tileSize + nx
+			if !flooded[j] && int(grid[j]) < seaLevel {
+				flooded[j] = true
+				queue = append(queue, j)
+			}
+		}
+	}
+	return flooded
+}
+
+// drainBasins returns a copy of a grid with every pixel below the sea level that isn't flooded
+// raised to it, so it renders as dry land
+func drainBasins(grid *elevationGrid, flooded *tileMask, seaLevel int) *elevationGrid {
+	drained := *grid
+	for i, elevation := range drained {
+		if int(elevation) < seaLevel && !flooded[i] {
+			drained[i] = int16(seaLevel)
+		}
+	}
+	return &drained
+}
+
+func packMask(mask *tileMask) []byte {
+	packed := make([]byte, len(mask)/8)
+	for i, set := range mask {
+		if set {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+	return packed
+}
+
+func unpackMask(packed []byte) *tileMask {
+	mask := new(tileMask)
+	for i := range mask {
+		mask[i] = packed[i/8]&(1<<(i%8)) != 0
+	}
+	return mask
+}
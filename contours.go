@@ -0,0 +1,165 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// maxContourLevels limits how many isolines are traced in one tile; in steep terrain at low
+// zooms the interval is doubled until it fits
+const maxContourLevels = 64
+
+var (
+	contourColor    = color.RGBA{120, 90, 60, 255}
+	seaContourColor = color.RGBA{200, 40, 40, 255}
+)
+
+// contourSegment is part of an isoline crossing one cell between four pixel centres
+type contourSegment struct {
+	x0, y0, x1, y1 float64
+}
+
+// traceContour finds the isoline at a level with marching squares. Pixels at or above the level
+// count as above it, matching the sea level test used for flooding.
+func traceContour(grid *elevationGrid, level int) []contourSegment {
+	v := float64(level)
+	var segments []contourSegment
+	for y := 0; y < tileSize-1; y++ {
+		for x := 0; x < tileSize-1; x++ {
+			a, b := grid[y*tileSize+x], grid[y*tileSize+x+1]
+			d, c := grid[(y+1)*tileSize+x], grid[(y+1)*tileSize+x+1]
+			if a == noElevation || b == noElevation || c == noElevation || d == noElevation {
+				continue
+			}
+			fa, fb, fc, fd := float64(a), float64(b), float64(c), float64(d)
+			above := [4]bool{fa >= v, fb >= v, fc >= v, fd >= v}
+			if above[0] == above[1] && above[1] == above[2] && above[2] == above[3] {
+				continue
+			}
+
+			// Where the level crosses each edge, between pixel centres
+			cx, cy := float64(x)+0.5, float64(y)+0.5
+			cross := func(e1, e2 float64) float64 {
+				return (v - e1) / (e2 - e1)
+			}
+			var top, right, bottom, left [2]float64
+			if above[0] != above[1] {
+				top = [2]float64{cx + cross(fa, fb), cy}
+			}
+			if above[1] != above[2] {
+				right = [2]float64{cx + 1, cy + cross(fb, fc)}
+			}
+			if above[3] != above[2] {
+				bottom = [2]float64{cx + cross(fd, fc), cy + 1}
+			}
+			if above[0] != above[3] {
+				left = [2]float64{cx, cy + cross(fa, fd)}
+			}
+			segment := func(p, q [2]float64) {
+				segments = append(segments, contourSegment{p[0], p[1], q[0], q[1]})
+			}
+
+			if above[0] == above[2] && above[1] == above[3] {
+				// A saddle, resolved by the average of the corners
+				centreAbove := (fa+fb+fc+fd)/4 >= v
+				if centreAbove == above[0] {
+					segment(top, right)
+					segment(bottom, left)
+				} else {
+					segment(left, top)
+					segment(right, bottom)
+				}
+				continue
+			}
+			var points [][2]float64
+			for i, crosses := range [4]bool{above[0] != above[1], above[1] != above[2], above[3] != above[2], above[0] != above[3]} {
+				if crosses {
+					points = append(points, [4][2]float64{top, right, bottom, left}[i])
+				}
+			}
+			segment(points[0], points[1])
+		}
+	}
+	return segments
+}
+
+// contourLevels lists the multiples of interval within the tile's elevations, doubling the
+// interval until there are at most maxContourLevels. The lines kept are still multiples of the
+// requested interval, so they meet the same lines in neighbouring tiles.
+func contourLevels(grid *elevationGrid, interval int) []int {
+	lowest, highest := math.MaxInt, math.MinInt
+	for _, elevation := range grid {
+		if elevation != noElevation {
+			lowest = min(lowest, int(elevation))
+			highest = max(highest, int(elevation))
+		}
+	}
+	if lowest > highest {
+		return nil
+	}
+	for (highest-lowest)/interval >= maxContourLevels {
+		interval *= 2
+	}
+	// Only levels with pixels on both sides, lowest < level <= highest, have a contour
+	var levels []int
+	first := (int(math.Floor(float64(lowest)/float64(interval))) + 1) * interval
+	for level := first; level <= highest; level += interval {
+		levels = append(levels, level)
+	}
+	return levels
+}
+
+// renderContours draws isolines every interval metres, and the one at the sea level thicker
+// and in red if emphasize is set
+func renderContours(grid *elevationGrid, interval int, seaLevel int, emphasize bool) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	for _, level := range contourLevels(grid, interval) {
+		if emphasize && level == seaLevel {
+			continue
+		}
+		for _, s := range traceContour(grid, level) {
+			drawLine(img, s.x0, s.y0, s.x1, s.y1, 1, contourColor)
+		}
+	}
+	if emphasize {
+		for _, s := range traceContour(grid, seaLevel) {
+			drawLine(img, s.x0, s.y0, s.x1, s.y1, 2, seaContourColor)
+		}
+	}
+	return img
+}
+
+// serveContours serves a tile of contour lines, with ?level= picking out the contour at a sea
+// level
+func serveContours(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	interval, _ := strconv.Atoi(vars["interval"])
+	if interval < 1 {
+		http.Error(w, "Contour interval must be at least 1m", http.StatusBadRequest)
+		return
+	}
+	z, x, y, ok := parseLayerTile(w, r)
+	if !ok {
+		return
+	}
+	seaLevel, emphasize := 0, false
+	if s := r.URL.Query().Get("level"); s != "" {
+		level, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "Invalid sea level", http.StatusBadRequest)
+			return
+		}
+		seaLevel, emphasize = clampSeaLevel(level), true
+	}
+
+	grid, ok := loadLayerElevation(w, r, z, x, y)
+	if !ok {
+		return
+	}
+	writeLayerTile(w, "contours", renderContours(grid, interval, seaLevel, emphasize))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	valid := []string{"* * * * *", "*/15 0-6 1,15 * 1-5", "0 3 * * 0", "@daily", "@hourly", "5-55/10 * * 1-12/3 *"}
+	for _, expr := range valid {
+		if _, err := parseCron(expr); err != nil {
+			t.Errorf("parseCron(%q): %v", expr, err)
+		}
+	}
+	invalid := []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 7",
+		"*/0 * * * *", "5-1 * * * *", "a * * * *", "1-b * * * *", "@yearly"}
+	for _, expr := range invalid {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) should have failed", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2026, 3, 11, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 3, 11, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 3, 11, 10, 15, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 3, 12, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * * 0", time.Date(2026, 3, 15, 2, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"10/20 9-11 * * *", time.Date(2026, 3, 11, 10, 10, 0, 0, time.UTC)},
+
+		// With both days restricted, either one matches, as in cron
+		{"0 0 20 * 5", time.Date(2026, 3, 13, 0, 0, 0, 0, time.UTC)},
+
+		// Never within a year
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		s, err := parseCron(test.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", test.expr, err)
+		}
+		if got := s.next(from); !got.Equal(test.want) {
+			t.Errorf("%q next after %v = %v, want %v", test.expr, from, got, test.want)
+		}
+	}
+}
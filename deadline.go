@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"time"
+)
+
+// renderDeadline is how long a request waits for a tile before getting a placeholder (0 waits forever)
+var renderDeadline time.Duration
+
+// placeholderTile is a transparent tile served when rendering misses the deadline
+var placeholderTile = func() []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, tileSize, tileSize)))
+	return buf.Bytes()
+}()
+
+type tileResult struct {
+	data []byte
+	err  error
+}
+
+// generateWithDeadline generates a tile but gives up waiting after renderDeadline,
+// returning the placeholder while the real tile carries on rendering into the cache
+func generateWithDeadline(seaLevel int, z, x, y string, opts tileOptions) ([]byte, bool, error) {
+	if renderDeadline <= 0 {
+		data, err := generateSeaLevelTile(seaLevel, z, x, y, opts)
+		return data, false, err
+	}
+
+	done := make(chan tileResult, 1)
+	go func() {
+		data, err := generateSeaLevelTile(seaLevel, z, x, y, opts)
+		done <- tileResult{data, err}
+	}()
+
+	timer := time.NewTimer(renderDeadline)
+	defer timer.Stop()
+
+	select {
+	case res := <-done:
+		return res.data, false, res.err
+	case <-timer.C:
+		metrics.incr("render_deadline_exceeded")
+		return placeholderTile, true, nil
+	}
+}
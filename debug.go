@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"time"
+)
+
+var (
+	debugColor     = color.RGBA{220, 0, 0, 255}
+	debugHaloColor = color.RGBA{255, 255, 255, 255}
+)
+
+// debugTile draws a border, the tile's coordinates and sea level, where it came from and how
+// long fetching and rendering took over a copy of a PNG tile
+func debugTile(data []byte, level, z int, x, y string, placeholder bool, timing *serverTiming) ([]byte, error) {
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(decoded.Bounds())
+	draw.Draw(img, img.Bounds(), decoded, image.Point{}, draw.Src)
+
+	bounds := img.Bounds()
+	for _, edge := range []image.Rectangle{
+		image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Min.Y+1),
+		image.Rect(bounds.Min.X, bounds.Max.Y-1, bounds.Max.X, bounds.Max.Y),
+		image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Min.X+1, bounds.Max.Y),
+		image.Rect(bounds.Max.X-1, bounds.Min.Y, bounds.Max.X, bounds.Max.Y),
+	} {
+		fillRect(img, edge, debugColor)
+	}
+
+	status := "MISS"
+	timing.mu.Lock()
+	if timing.cache != "" {
+		status = timing.cache
+	}
+	timing.mu.Unlock()
+	if placeholder {
+		status = "PLACEHOLDER"
+	}
+	ms := func(d time.Duration) string {
+		return fmt.Sprintf("%.1fms", float64(d.Microseconds())/1000)
+	}
+	lines := []string{
+		fmt.Sprintf("%d/%s/%s", z, x, y),
+		fmt.Sprintf("level %+dm", level),
+		status,
+		"fetch " + ms(timing.get("fetch")),
+		"render " + ms(timing.get("render")),
+		"total " + ms(timing.get("total")),
+	}
+	lineHeight := textHeight(1) + 3
+	for i, line := range lines {
+		drawTextHalo(img, 4, 4+i*lineHeight, line, 1, debugColor, debugHaloColor)
+	}
+	return encodePNG(img)
+}
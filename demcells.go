@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+)
+
+// cellSource reads a global DEM published as one Cloud-Optimized GeoTIFF per 1° cell, like
+// Copernicus DEM and NASADEM, opening cells as tiles need them. The URL template names a cell by
+// its south-west corner with {NS}{lat}{EW}{lon}, like N51 and W001, or {ns} and {ew} for lower
+// case.
+type cellSource struct {
+	urlTemplate string
+
+	mu    sync.Mutex
+	cells map[[2]int]*geoTIFF // nil for cells with no file, such as open ocean
+}
+
+// maxCellsPerTile limits how many cells a tile may open; lower zooms are left to the next
+// source in a chain
+const maxCellsPerTile = 16
+
+func newCellSource(urlTemplate string) (*cellSource, error) {
+	if !strings.Contains(urlTemplate, "{lat}") || !strings.Contains(urlTemplate, "{lon}") {
+		return nil, fmt.Errorf("cell URL template needs {lat} and {lon} placeholders")
+	}
+	if err := checkURL(urlTemplate); err != nil {
+		return nil, err
+	}
+	return &cellSource{urlTemplate: urlTemplate, cells: make(map[[2]int]*geoTIFF)}, nil
+}
+
+func (s *cellSource) name() string {
+	return "cells"
+}
+
+func (s *cellSource) describe() string {
+	return s.urlTemplate
+}
+
+func (s *cellSource) cellURL(lat, lon int) string {
+	ns, ew := "N", "E"
+	if lat < 0 {
+		ns = "S"
+	}
+	if lon < 0 {
+		ew = "W"
+	}
+	return strings.NewReplacer(
+		"{NS}", ns, "{ns}", strings.ToLower(ns),
+		"{EW}", ew, "{ew}", strings.ToLower(ew),
+		"{lat}", fmt.Sprintf("%02d", max(lat, -lat)),
+		"{lon}", fmt.Sprintf("%03d", max(lon, -lon)),
+	).Replace(s.urlTemplate)
+}
+
+// cell opens the file for a cell, or returns nil if there isn't one
+func (s *cellSource) cell(lat, lon int) (*geoTIFF, error) {
+	key := [2]int{lat, lon}
+	s.mu.Lock()
+	g, opened := s.cells[key]
+	s.mu.Unlock()
+	if opened {
+		return g, nil
+	}
+
+	u := s.cellURL(lat, lon)
+	r, err := newRangeReader(u)
+	if err == errElevationMissing {
+		g = nil
+	} else if err != nil {
+		return nil, err
+	} else if g, err = parseGeoTIFF(u, r); err != nil {
+		return nil, fmt.Errorf("%s: %v", u, err)
+	}
+	s.mu.Lock()
+	s.cells[key] = g
+	s.mu.Unlock()
+	return g, nil
+}
+
+// tile samples a tile from the cells it overlaps
+func (s *cellSource) tile(z, x, y int, timing *serverTiming) (*elevationGrid, error) {
+	n := float64(int(1) << z)
+	west, east := float64(x)/n*360-180, float64(x+1)/n*360-180
+	north, south := tileLatitude(z, float64(y)), tileLatitude(z, float64(y+1))
+	lat0, lat1 := int(math.Floor(south)), int(math.Ceil(north))-1
+	lon0, lon1 := int(math.Floor(west)), int(math.Ceil(east))-1
+	if (lat1-lat0+1)*(lon1-lon0+1) > maxCellsPerTile {
+		return nil, errElevationMissing
+	}
+
+	source := &geoTIFFSource{kind: "cells"}
+	for lat := lat0; lat <= lat1; lat++ {
+		for lon := lon0; lon <= lon1; lon++ {
+			g, err := s.cell(lat, lon)
+			if err != nil {
+				return nil, err
+			}
+			if g != nil {
+				source.files = append(source.files, g)
+			}
+		}
+	}
+	if len(source.files) == 0 {
+		return nil, errElevationMissing
+	}
+	return source.tile(z, x, y, timing)
+}
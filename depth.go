@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// maxDepthStops limits how many stops a depth ramp may have
+const maxDepthStops = 16
+
+// depthStop is the color of water depth metres below the sea level; colors between stops are
+// interpolated
+type depthStop struct {
+	depth int
+	color color.RGBA
+}
+
+// depthRamp is used for ?depth=1, by default grading from light blue at the new shoreline to
+// dark blue 50m down; DEPTH_RAMP overrides it
+var depthRamp = []depthStop{
+	{0, color.RGBA{140, 200, 240, 255}},
+	{10, color.RGBA{60, 130, 200, 255}},
+	{50, color.RGBA{0, 50, 120, 255}},
+}
+
+// parseDepthRamp parses stops of increasing depth such as "0:8cc8f0,10:3c82c8,50:003278"
+func parseDepthRamp(s string) ([]depthStop, error) {
+	var ramp []depthStop
+	for _, part := range strings.Split(s, ",") {
+		depth, hex, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("Invalid depth stop %q: expected depth:color", part)
+		}
+		d, err := strconv.Atoi(depth)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("Invalid depth: %q", depth)
+		}
+		c, err := parseHexColor(hex)
+		if err != nil {
+			return nil, err
+		}
+		if len(ramp) > 0 && d <= ramp[len(ramp)-1].depth {
+			return nil, fmt.Errorf("Depths must be in increasing order")
+		}
+		ramp = append(ramp, depthStop{depth: d, color: c})
+	}
+	if len(ramp) > maxDepthStops {
+		return nil, fmt.Errorf("Too many depth stops: at most %d", maxDepthStops)
+	}
+	return ramp, nil
+}
+
+// depthRampKey formats a ramp canonically, so equivalent requests share a cache entry
+func depthRampKey(ramp []depthStop) string {
+	parts := make([]string, len(ramp))
+	for i, stop := range ramp {
+		parts[i] = strconv.Itoa(stop.depth) + ":" + colorKey(stop.color)
+	}
+	return strings.Join(parts, ",")
+}
+
+// depthColors looks up the color of every whole depth from 0 to the deepest stop, beyond which
+// the last color is used
+func depthColors(ramp []depthStop) []color.RGBA {
+	colors := make([]color.RGBA, ramp[len(ramp)-1].depth+1)
+	stop := 0
+	for d := range colors {
+		for stop < len(ramp)-1 && d > ramp[stop+1].depth {
+			stop++
+		}
+		switch {
+		case d <= ramp[0].depth:
+			colors[d] = ramp[0].color
+		case stop == len(ramp)-1:
+			colors[d] = ramp[stop].color
+		default:
+			a, b := ramp[stop], ramp[stop+1]
+			colors[d] = lerpColor(a.color, b.color, float64(d-a.depth)/float64(b.depth-a.depth))
+		}
+	}
+	return colors
+}
+
+// renderDepth colors every pixel below the sea level, or marked in extra, by how deep the water
+// over it would be, and leaves the rest transparent
+func renderDepth(grid *elevationGrid, seaLevel int, extra *tileMask, ramp []depthStop) *image.RGBA {
+	outputImg := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	colors := depthColors(ramp)
+
+	for i, elevation := range grid {
+		depth := seaLevel - int(elevation)
+		cover := 1.0
+		if depth <= 0 {
+			// Above the sea level, but perhaps partly covered at the shoreline or backed up a river
+			if extra == nil || !extra[i] {
+				if cover = floodCoverage(grid, seaLevel, i%tileSize, i/tileSize); cover == 0 {
+					continue
+				}
+			}
+			depth = 0
+		} else if cover = floodCoverage(grid, seaLevel, i%tileSize, i/tileSize); cover == 0 {
+			cover = 1
+		}
+		c := fadeColor(premultiply(colors[min(depth, len(colors)-1)]), cover)
+		offset := i * 4
+		outputImg.Pix[offset] = c.R
+		outputImg.Pix[offset+1] = c.G
+		outputImg.Pix[offset+2] = c.B
+		outputImg.Pix[offset+3] = c.A
+	}
+	return outputImg
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestParseDepthRamp(t *testing.T) {
+	ramp, err := parseDepthRamp("0:8cc8f0, 10:3c82c8,50:003278")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ramp) != 3 || ramp[1].depth != 10 || ramp[2].color != (color.RGBA{0x00, 0x32, 0x78, 0xff}) {
+		t.Errorf("parseDepthRamp = %v", ramp)
+	}
+	if key := depthRampKey(ramp); key != "0:8cc8f0ff,10:3c82c8ff,50:003278ff" {
+		t.Errorf("depthRampKey = %s", key)
+	}
+
+	for _, s := range []string{"", "0", "-1:fff", "x:fff", "0:fff,0:000", "10:fff,5:000", "0:zzz"} {
+		if _, err := parseDepthRamp(s); err == nil {
+			t.Errorf("parseDepthRamp(%q) should have failed", s)
+		}
+	}
+}
+
+func TestDepthColors(t *testing.T) {
+	ramp := []depthStop{{0, color.RGBA{0, 0, 0, 255}}, {10, color.RGBA{200, 100, 0, 255}}}
+	colors := depthColors(ramp)
+	if len(colors) != 11 {
+		t.Fatalf("got %d colors, want one per metre to the deepest stop", len(colors))
+	}
+	if colors[0] != ramp[0].color || colors[10] != ramp[1].color {
+		t.Errorf("stops = %v and %v, want %v and %v", colors[0], colors[10], ramp[0].color, ramp[1].color)
+	}
+	if c := colors[5]; c.R < 95 || c.R > 105 || c.G < 45 || c.G > 55 {
+		t.Errorf("halfway = %v, want about {100 50 0}", c)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultDepthBands are the edges, in metres of water, that flooded area is broken down by
+var defaultDepthBands = []int{1, 2, 5, 10, 20, 50, 100}
+
+// depthBandArea is the flooded area between two depths; Max is nil for the deepest band
+type depthBandArea struct {
+	Min     int     `json:"min"`
+	Max     *int    `json:"max"`
+	AreaKm2 float64 `json:"areaKm2"`
+}
+
+// parseDepthBands parses increasing band edges like "1,2,5"
+func parseDepthBands(s string) ([]int, error) {
+	var edges []int
+	for _, part := range strings.Split(s, ",") {
+		edge, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || edge <= 0 || (len(edges) > 0 && edge <= edges[len(edges)-1]) {
+			return nil, fmt.Errorf("Invalid bands %q: use increasing depths in metres, like 1,2,5", s)
+		}
+		edges = append(edges, edge)
+	}
+	if len(edges) > 32 {
+		return nil, fmt.Errorf("Too many bands: at most 32")
+	}
+	return edges, nil
+}
+
+// depthBandIndex returns which band a depth falls in
+func depthBandIndex(edges []int, depth int) int {
+	for i, edge := range edges {
+		if depth < edge {
+			return i
+		}
+	}
+	return len(edges)
+}
+
+// measureDepthBands adds up the area within a bbox under water at a sea level, by depth. Only
+// land that's dry today counts unless sea is set.
+func measureDepthBands(area bbox, z, level int, edges []int, connected, sea bool) ([]float64, error) {
+	x0, y0, x1, y1 := area.tileRange(z)
+	minX, minY := mercatorPixel(area.minLon, area.maxLat, z)
+	maxX, maxY := mercatorPixel(area.maxLon, area.minLat, z)
+
+	totals := make([]float64, len(edges)+1)
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 8)
+	for ty := y0; ty <= y1; ty++ {
+		for tx := x0; tx <= x1; tx++ {
+			tx, ty := tx, ty
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				var grid *elevationGrid
+				var flooded *tileMask
+				var err error
+				if oceanMask.contains(z, tx, ty) {
+					grid = deepOceanGrid
+				} else if grid, err = loadElevation(z, tx, ty, nil); err == nil {
+					grid = smoothElevation(grid)
+					if connected {
+						flooded, err = connectedFlood(z, tx, ty, level)
+					}
+				}
+				if err == errElevationMissing {
+					return
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+
+				tile := make([]float64, len(totals))
+				for py := 0; py < tileSize; py++ {
+					gy := float64(ty*tileSize+py) + 0.5
+					if gy < minY || gy > maxY {
+						continue
+					}
+					mpp := metersPerPixel(tileLatitude(z, gy/tileSize), z)
+					pixelArea := mpp * mpp / 1e6
+					for px := 0; px < tileSize; px++ {
+						gx := float64(tx*tileSize+px) + 0.5
+						if gx < minX || gx > maxX {
+							continue
+						}
+						i := py*tileSize + px
+						elevation := int(grid[i])
+						if grid[i] == noElevation || elevation >= level || (!sea && elevation < 0) {
+							continue
+						}
+						if flooded != nil && !flooded[i] {
+							continue
+						}
+						// Elevations are whole metres, so a pixel one metre below the level is up
+						// to a metre deep
+						tile[depthBandIndex(edges, level-elevation-1)] += pixelArea
+					}
+				}
+				mu.Lock()
+				for i, a := range tile {
+					totals[i] += a
+				}
+				mu.Unlock()
+			}()
+		}
+	}
+	wg.Wait()
+	return totals, firstErr
+}
+
+// serveDepthBands breaks down the area under water at ?level= within ?bbox= by depth, in bands
+// with edges at ?bands= (1,2,5,10,20,50,100 m by default). Only land that's dry today is
+// counted unless ?sea=1, and ?connected=1 only counts what the open ocean reaches.
+func serveDepthBands(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	area, err := parseBBox(query.Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	level, err := strconv.Atoi(query.Get("level"))
+	if err != nil {
+		http.Error(w, "Invalid sea level", http.StatusBadRequest)
+		return
+	}
+	level = clampSeaLevel(level)
+	edges := defaultDepthBands
+	if s := query.Get("bands"); s != "" {
+		if edges, err = parseDepthBands(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	sea := query.Get("sea") == "1"
+	connected := query.Get("connected") == "1"
+	if connected && oceanSeeds == nil {
+		http.Error(w, "Connected flooding mode is not configured", http.StatusBadRequest)
+		return
+	}
+
+	zoom := upstreamMaxZoom
+	for zoom > 0 && area.tileCount(zoom, zoom) > maxFloodPolyTiles {
+		zoom--
+	}
+	renderPool.acquire(requestPriority(r))
+	totals, err := measureDepthBands(area, zoom, level, edges, connected, sea)
+	renderPool.release()
+	if err == errUpstreamUnavailable {
+		w.Header().Set("Retry-After", fmt.Sprint(int(breakerCooldown.Seconds())))
+		http.Error(w, "Elevation source unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch elevation", http.StatusBadGateway)
+		log.Printf("Error fetching elevation for %s: %v", r.URL.Path, err)
+		return
+	}
+
+	bands := make([]depthBandArea, len(totals))
+	total := 0.0
+	for i, a := range totals {
+		bands[i].AreaKm2 = math.Round(a*100) / 100
+		if i > 0 {
+			bands[i].Min = edges[i-1]
+		}
+		if i < len(edges) {
+			bands[i].Max = &edges[i]
+		}
+		total += a
+	}
+	metrics.incr("api_requests", "endpoint:depth_bands")
+	writeJSON(w, map[string]interface{}{
+		"level":     level,
+		"zoom":      zoom,
+		"connected": connected,
+		"sea":       sea,
+		"totalKm2":  math.Round(total*100) / 100,
+		"bands":     bands,
+	})
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDepthBands(t *testing.T) {
+	edges, err := parseDepthBands("1, 2,5")
+	if err != nil || !reflect.DeepEqual(edges, []int{1, 2, 5}) {
+		t.Errorf("parseDepthBands = %v, %v", edges, err)
+	}
+	for _, s := range []string{"", "0", "-1", "2,1", "1,1", "a"} {
+		if _, err := parseDepthBands(s); err == nil {
+			t.Errorf("parseDepthBands(%q) should have failed", s)
+		}
+	}
+}
+
+func TestDepthBandIndex(t *testing.T) {
+	edges := []int{1, 2, 5}
+	for depth, want := range map[int]int{0: 0, 1: 1, 4: 2, 5: 3, 100: 3} {
+		if got := depthBandIndex(edges, depth); got != want {
+			t.Errorf("depthBandIndex(%d) = %d, want %d", depth, got, want)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minFreeSpace is the free space below which doctor warns about a data directory
+const minFreeSpace = 1 << 30
+
+// doctor collects findings from pre-deployment checks
+type doctor struct {
+	failures int
+	warnings int
+}
+
+func (d *doctor) ok(format string, args ...interface{}) {
+	fmt.Printf("[ OK ] %s\n", fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) warn(format string, args ...interface{}) {
+	d.warnings++
+	fmt.Printf("[WARN] %s\n", fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) fail(format string, args ...interface{}) {
+	d.failures++
+	fmt.Printf("[FAIL] %s\n", fmt.Sprintf(format, args...))
+}
+
+// configVar describes how to validate an environment variable
+type configVar struct {
+	name  string
+	check func(string) error
+}
+
+func checkInt(s string) error {
+	_, err := strconv.Atoi(s)
+	return err
+}
+
+func checkFloat(s string) error {
+	_, err := strconv.ParseFloat(s, 64)
+	return err
+}
+
+func checkDuration(s string) error {
+	_, err := time.ParseDuration(s)
+	return err
+}
+
+func checkBool(s string) error {
+	_, err := strconv.ParseBool(s)
+	return err
+}
+
+func checkByteSize(s string) error {
+	_, err := parseByteSize(s)
+	return err
+}
+
+func checkURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("not an absolute URL")
+	}
+	return nil
+}
+
+// checkTileURLTemplate checks for an absolute URL with {z}, {x} and {y} placeholders
+func checkTileURLTemplate(s string) error {
+	if err := checkURL(s); err != nil {
+		return err
+	}
+	for _, placeholder := range []string{"{z}", "{x}", "{y}"} {
+		if !strings.Contains(s, placeholder) {
+			return fmt.Errorf("missing %s placeholder", placeholder)
+		}
+	}
+	return nil
+}
+
+func checkHostPort(s string) error {
+	_, _, err := net.SplitHostPort(s)
+	return err
+}
+
+func checkIPList(s string) error {
+	_, err := parseIPList(s)
+	return err
+}
+
+func checkCachePolicy(s string) error {
+	_, err := loadCachePolicy(s)
+	return err
+}
+
+func checkResampling(s string) error {
+	if s != "bilinear" && s != "bicubic" {
+		return fmt.Errorf("must be bilinear or bicubic")
+	}
+	return nil
+}
+
+func checkSentryDSN(s string) error {
+	_, err := newSentryReporter(s)
+	return err
+}
+
+// configVars lists every setting with a fixed format
+var configVars = []configVar{
+	{"PORT", checkInt},
+	{"SENTRY_DSN", checkSentryDSN},
+	{"STATSD_ADDR", checkHostPort},
+	{"STATSD_DOGSTATSD", checkBool},
+	{"IP_ALLOW", checkIPList},
+	{"IP_DENY", checkIPList},
+	{"ADMIN_IP_ALLOW", checkIPList},
+	{"ADMIN_IP_DENY", checkIPList},
+	{"TRUSTED_PROXIES", checkIPList},
+	{"BASEMAP_URL", checkURL},
+	{"BASEMAP_LICENSE_URL", checkURL},
+	{"RENDER_DEADLINE", checkDuration},
+	{"RENDER_CONCURRENCY", checkInt},
+	{"UPSTREAM_AUTH_FILE", func(s string) error {
+		_, err := loadUpstreamAuth(s)
+		return err
+	}},
+	{"UPSTREAM_TIMEOUT", checkDuration},
+	{"UPSTREAM_DIAL_TIMEOUT", checkDuration},
+	{"UPSTREAM_TLS_TIMEOUT", checkDuration},
+	{"UPSTREAM_MAX_IDLE_PER_HOST", checkInt},
+	{"CACHE_S3_ENDPOINT", checkURL},
+	{"CACHE_S3_PATH_STYLE", checkBool},
+	{"TILE_CACHE_MAX_BYTES", checkByteSize},
+	{"TILE_CACHE_MAX_ENTRIES", checkInt},
+	{"TILE_CACHE_ADMISSION", checkAdmission},
+	{"BASEMAP_CACHE_MAX_BYTES", checkByteSize},
+	{"BASEMAP_CACHE_TTL", checkDuration},
+	{"TILE_CACHE_SPILL", checkBool},
+	{"TILE_CACHE_TTL", checkDuration},
+	{"CACHE_SWEEP_INTERVAL", checkDuration},
+	{"TILE_CACHE_STALE", checkDuration},
+	{"SHUTDOWN_TIMEOUT", checkDuration},
+	{"STALE_REFRESH_CONCURRENCY", checkInt},
+	{"WATER_MASK_URL", checkTileURLTemplate},
+	{"OCEAN_POLYGON_MASK_URL", checkTileURLTemplate},
+	{"BOUNDARIES_FILE", func(s string) error {
+		_, err := loadBoundaries(s)
+		return err
+	}},
+	{"OSM_EXTRACT_FILE", func(s string) error {
+		_, err := os.Stat(s)
+		return err
+	}},
+	{"POPULATION_FILE", func(s string) error {
+		_, err := openPopulation(s)
+		return err
+	}},
+	{"OCEAN_SEED_MASK_URL", checkTileURLTemplate},
+	{"CONNECTED_BASE_ZOOM", checkInt},
+	{"CONNECTED_CACHE_ENTRIES", checkInt},
+	{"PALETTES_FILE", func(s string) error {
+		_, err := loadPalettes(s)
+		return err
+	}},
+	{"DEPTH_RAMP", func(s string) error {
+		_, err := parseDepthRamp(s)
+		return err
+	}},
+	{"ELEVATION_URL", checkTileURLTemplate},
+	{"ELEVATION_ENCODING", func(s string) error {
+		if _, ok := elevationEncodings[s]; !ok {
+			return fmt.Errorf("must be terrarium or mapbox")
+		}
+		return nil
+	}},
+	{"ELEVATION_GEOTIFF", func(s string) error {
+		_, err := newGeoTIFFSource(s)
+		return err
+	}},
+	{"ELEVATION_COG", func(s string) error {
+		_, err := newCOGSource(s)
+		return err
+	}},
+	{"ELEVATION_SRTM_DIR", func(s string) error {
+		_, err := newSRTMSource(s)
+		return err
+	}},
+	{"ELEVATION_MBTILES", func(s string) error {
+		_, err := newMBTilesSource(s, os.Getenv("ELEVATION_MBTILES_ENCODING"))
+		return err
+	}},
+	{"ELEVATION_MBTILES_ENCODING", func(s string) error {
+		if _, ok := elevationEncodings[s]; !ok {
+			return fmt.Errorf("must be terrarium or mapbox")
+		}
+		return nil
+	}},
+	{"ELEVATION_PRESET", func(s string) error {
+		_, err := lookupDEMPreset(s)
+		return err
+	}},
+	{"ELEVATION_SOURCES", func(s string) error {
+		_, err := newChainSource(s)
+		return err
+	}},
+	{"ELEVATION_BATHYMETRY", func(s string) error {
+		_, err := newElevationSource(s)
+		return err
+	}},
+	{"ELEVATION_BEDROCK", func(s string) error {
+		_, err := newChainSource(s)
+		return err
+	}},
+	{"BEDROCK_CACHE_ENTRIES", checkInt},
+	{"ELEVATION_RESAMPLE_ZOOM", checkInt},
+	{"ELEVATION_RESAMPLING", checkResampling},
+	{"ELEVATION_RETRIES", checkInt},
+	{"ELEVATION_RETRY_BACKOFF", checkDuration},
+	{"ELEVATION_RETRY_JITTER", checkDuration},
+	{"ELEVATION_RATE_LIMIT", checkFloat},
+	{"ELEVATION_RATE_BURST", checkInt},
+	{"ELEVATION_MAX_ZOOM", checkInt},
+	{"ELEVATION_BREAKER_FAILURES", checkInt},
+	{"ELEVATION_BREAKER_COOLDOWN", checkDuration},
+	{"ELEVATION_PROBE_INTERVAL", checkDuration},
+	{"ELEVATION_PROBE_TILE", func(s string) error {
+		_, _, _, err := parseProbeTile(s)
+		return err
+	}},
+	{"ELEVATION_RAW_TTL", checkDuration},
+	{"ELEVATION_CACHE_ENTRIES", checkInt},
+	{"ELEVATION_MISS_TTL", checkDuration},
+	{"CACHE_POLICY_FILE", checkCachePolicy},
+	{"OCEAN_MASK_MAX_ZOOM", checkInt},
+	{"RIVER_MASK_URL", checkURL},
+	{"RIVER_BACKWATER_LENGTH", checkInt},
+	{"REPLICATE_FROM", checkURL},
+	{"CACHE_PEER_SELF", checkURL},
+	{"SEED_SCHEDULE_FILE", func(s string) error {
+		_, err := loadSeedSchedule(s)
+		return err
+	}},
+	{"AREA_TABLE_ZOOM", checkInt},
+	{"GAZETTEER_FILE", setupPlaces},
+	{"BRUUN_CLOSURE_DEPTH", checkInt},
+	{"BRUUN_BERM_HEIGHT", checkInt},
+	{"DEM_SMOOTHING", func(s string) error { return checkSmoothing(s, 1) }},
+	{"DEM_SMOOTHING_RADIUS", func(s string) error {
+		radius, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		return checkSmoothing("", radius)
+	}},
+}
+
+// writableFiles lists settings naming files the server appends to
+var writableFiles = []string{
+	"AUDIT_LOG",
+	"OCEAN_MASK_FILE",
+	"AREA_TABLE_FILE",
+	"STORE_PATH",
+	"CACHE_SNAPSHOT_FILE",
+}
+
+// runDoctor checks the configuration and environment, returning the process exit code
+func runDoctor() int {
+	d := &doctor{}
+
+	fmt.Println("Configuration:")
+	for _, v := range configVars {
+		value := os.Getenv(v.name)
+		if value == "" {
+			continue
+		}
+		if err := v.check(value); err != nil {
+			d.fail("%s=%q is invalid: %v", v.name, value, err)
+		} else {
+			d.ok("%s is valid", v.name)
+		}
+	}
+	if _, err := os.Stat("index.html"); err != nil {
+		d.fail("index.html not found in the current directory; run the server from the repository root")
+	} else {
+		d.ok("index.html found")
+	}
+
+	fmt.Println("Files and directories:")
+	for _, name := range writableFiles {
+		path := os.Getenv(name)
+		if path == "" {
+			continue
+		}
+		d.checkWritableFile(name, path)
+	}
+
+	for _, name := range []string{"CACHE_DIR", "ELEVATION_RAW_DIR", "MBTILES_DIR"} {
+		if dir := os.Getenv(name); dir != "" {
+			d.checkCacheDir(name, dir)
+		}
+	}
+	if os.Getenv("CACHE_S3_BUCKET") != "" {
+		d.checkTileStore()
+	}
+
+	fmt.Println("Upstream sources:")
+	if path := os.Getenv("UPSTREAM_AUTH_FILE"); path != "" {
+		upstreamAuths, _ = loadUpstreamAuth(path)
+	}
+	d.checkElevation()
+	d.checkBasemap()
+
+	fmt.Printf("\n%d failures, %d warnings\n", d.failures, d.warnings)
+	if d.failures > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkWritableFile makes sure a file can be appended to and has room to grow
+func (d *doctor) checkWritableFile(name, path string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		d.fail("%s: can't write to %s: %v; check the directory exists and permissions", name, path, err)
+		return
+	}
+	f.Close()
+	d.ok("%s: %s is writable", name, path)
+	d.checkFreeSpace(name, filepath.Dir(path))
+}
+
+// checkCacheDir makes sure files can be written to a cache directory
+func (d *doctor) checkCacheDir(name, dir string) {
+	store, err := newDiskStore(dir)
+	if err != nil {
+		d.fail("%s: can't create %s: %v", name, dir, err)
+		return
+	}
+	if err := store.put("doctor/check", []byte("ok")); err != nil {
+		d.fail("%s: can't write to %s: %v; check permissions", name, dir, err)
+		return
+	}
+	os.RemoveAll(filepath.Join(dir, "doctor"))
+	d.ok("%s: %s is writable", name, dir)
+	d.checkFreeSpace(name, dir)
+}
+
+// checkTileStore makes sure tiles can be written to and read back from the persistent store
+func (d *doctor) checkTileStore() {
+	if err := setupTileStore(); err != nil {
+		d.fail("Tile store: %v", err)
+		return
+	}
+	if err := persistentStore.put("doctor/check", []byte("ok")); err != nil {
+		d.fail("Tile store %s: can't write: %v; check the bucket and credentials", persistentStore.name(), err)
+		return
+	}
+	if _, _, exists, err := persistentStore.get("doctor/check"); err != nil || !exists {
+		d.fail("Tile store %s: can't read back a tile just written (err=%v)", persistentStore.name(), err)
+		return
+	}
+	d.ok("Tile store %s is readable and writable", persistentStore.name())
+}
+
+// checkFreeSpace warns when a directory's filesystem is nearly full
+func (d *doctor) checkFreeSpace(name, dir string) {
+	free, err := diskFree(dir)
+	if err != nil {
+		d.warn("%s: couldn't check free space in %s: %v", name, dir, err)
+		return
+	}
+	if free < minFreeSpace {
+		d.warn("%s: only %d MB free in %s", name, free>>20, dir)
+		return
+	}
+	d.ok("%s: %d MB free in %s", name, free>>20, dir)
+}
+
+// checkElevation makes sure the elevation source, or each in a chain, can be used
+func (d *doctor) checkElevation() {
+	if err := setupElevationSource(); err != nil {
+		d.fail("Elevation source: %v", err)
+		return
+	}
+	d.checkElevationSource(elevationUpstream)
+}
+
+// checkElevationSource fetches the world tile and makes sure it decodes to plausible elevations
+func (d *doctor) checkElevationSource(source elevationSource) {
+	switch s := source.(type) {
+	case *chainSource:
+		for _, source := range s.sources {
+			d.checkElevationSource(source)
+		}
+		return
+	case *bathymetrySource:
+		d.checkElevationSource(s.land)
+		d.checkElevationSource(s.sea)
+		return
+	}
+
+	// Local data was checked as it was opened, and needn't cover the whole world
+	if _, remote := source.(*terrariumSource); !remote {
+		d.ok("Elevation source %s: %s", source.name(), source.describe())
+		return
+	}
+	start := time.Now()
+	grid, err := source.tile(0, 0, 0, nil)
+	if err != nil {
+		d.fail("Elevation source %s unreachable: %v; check network access to the upstream", source.describe(), err)
+		return
+	}
+	d.ok("Elevation source %s reachable (%v)", source.describe(), time.Since(start).Round(time.Millisecond))
+
+	lowest, highest := math.MaxInt16, math.MinInt16
+	for _, elevation := range grid {
+		lowest = min(lowest, int(elevation))
+		highest = max(highest, int(elevation))
+	}
+
+	// The whole world includes both deep ocean trenches and high mountains
+	if lowest > -5000 || highest < 4000 || highest > 9000 {
+		d.fail("Elevation tile decoded to an implausible range %d..%d m; is the source really %s-encoded?", lowest, highest, source.name())
+		return
+	}
+	d.ok("Elevation tile decodes correctly (%d..%d m)", lowest, highest)
+}
+
+// checkBasemap makes sure the basemap proxy can reach its provider
+func (d *doctor) checkBasemap() {
+	if _, err := fetchBasemapTile(0, 0, 0); err != nil {
+		d.warn("Basemap source unreachable: %v; previews, exports and /basemap will lack a basemap", err)
+		return
+	}
+	d.ok("Basemap source reachable")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// fillRect blends a color over a rectangle of the image
+func fillRect(img *image.RGBA, rect image.Rectangle, c color.RGBA) {
+	rect = rect.Intersect(img.Bounds())
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			blendPixel(img, x, y, c)
+		}
+	}
+}
+
+// blendPixel draws a non-premultiplied color over a single pixel
+func blendPixel(img *image.RGBA, x, y int, c color.RGBA) {
+	if !(image.Point{x, y}.In(img.Bounds())) {
+		return
+	}
+	i := img.PixOffset(x, y)
+	a := uint32(c.A)
+	if a == 255 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, 255
+		return
+	}
+	inv := 255 - a
+	img.Pix[i] = uint8((uint32(c.R)*a + uint32(img.Pix[i])*inv) / 255)
+	img.Pix[i+1] = uint8((uint32(c.G)*a + uint32(img.Pix[i+1])*inv) / 255)
+	img.Pix[i+2] = uint8((uint32(c.B)*a + uint32(img.Pix[i+2])*inv) / 255)
+	img.Pix[i+3] = uint8(a + uint32(img.Pix[i+3])*inv/255)
+}
+
+// drawLine blends a line of the given width between two points
+func drawLine(img *image.RGBA, x0, y0, x1, y1 float64, width int, c color.RGBA) {
+	steps := int(math.Ceil(max(math.Abs(x1-x0), math.Abs(y1-y0))))
+	for i := 0; i <= steps; i++ {
+		t := 0.0
+		if steps > 0 {
+			t = float64(i) / float64(steps)
+		}
+		x := int(math.Floor(x0 + (x1-x0)*t))
+		y := int(math.Floor(y0 + (y1-y0)*t))
+		fillRect(img, image.Rect(x-(width-1)/2, y-(width-1)/2, x+width/2+1, y+width/2+1), c)
+	}
+}
+
+// fillPolygon fills a convex or concave polygon using the even-odd rule
+func fillPolygon(img *image.RGBA, points []image.Point, c color.RGBA) {
+	if len(points) < 3 {
+		return
+	}
+	minY, maxY := points[0].Y, points[0].Y
+	for _, p := range points {
+		minY = min(minY, p.Y)
+		maxY = max(maxY, p.Y)
+	}
+
+	for y := minY; y <= maxY; y++ {
+		// Sample at the pixel centre to find edge crossings
+		fy := float64(y) + 0.5
+		var xs []float64
+		for i := range points {
+			a, b := points[i], points[(i+1)%len(points)]
+			if (float64(a.Y) <= fy) == (float64(b.Y) <= fy) {
+				continue
+			}
+			t := (fy - float64(a.Y)) / float64(b.Y-a.Y)
+			xs = append(xs, float64(a.X)+t*float64(b.X-a.X))
+		}
+		sort.Float64s(xs)
+		for i := 0; i+1 < len(xs); i += 2 {
+			for x := int(math.Round(xs[i])); x < int(math.Round(xs[i+1])); x++ {
+				blendPixel(img, x, y, c)
+			}
+		}
+	}
+}
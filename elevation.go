@@ -0,0 +1,688 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	_ "golang.org/x/image/webp"
+)
+
+// elevationGrid holds decoded elevations in meters for one tile, row by row
+type elevationGrid [tileSize * tileSize]int16
+
+// elevationSource provides the elevations for tiles
+type elevationSource interface {
+	name() string
+
+	// describe identifies the data, so tiles are re-rendered when it changes
+	describe() string
+
+	tile(z, x, y int, timing *serverTiming) (*elevationGrid, error)
+}
+
+// defaultElevationURL is the public terrarium tileset
+const defaultElevationURL = "https://s3.amazonaws.com/elevation-tiles-prod/terrarium/{z}/{x}/{y}.png"
+
+// elevationUpstream is where elevations come from when they aren't cached
+var elevationUpstream elevationSource = newTerrariumSource(defaultElevationURL, "terrarium")
+
+// noElevation marks pixels a source has no data for
+const noElevation = math.MinInt16
+
+// upstreamMaxZoom is the highest zoom level the terrarium tiles are available at
+const upstreamMaxZoom = 15
+
+// terrariumMaxZoom is the highest zoom fetched from a terrarium source, set by ELEVATION_MAX_ZOOM
+// for mirrors with more or fewer levels; tiles beyond it are upsampled from their ancestors
+var terrariumMaxZoom = upstreamMaxZoom
+
+// elevationResampleZoom, if set by ELEVATION_RESAMPLE_ZOOM, upsamples tiles beyond it from their
+// ancestors even where the source has them. Terrarium tiles past about zoom 12 are blown up
+// from coarser data, and thresholding their stair-steps leaves blocky coastlines.
+var elevationResampleZoom = 0
+
+// elevationResampling is "bilinear" or "bicubic", set by ELEVATION_RESAMPLING
+var elevationResampling = "bilinear"
+
+// zoomLimitedSource is implemented by sources that only have tiles up to some zoom
+type zoomLimitedSource interface {
+	nativeMaxZoom() int
+}
+
+// sourceMaxZoom returns the highest zoom a source has its own tiles for
+func sourceMaxZoom(source elevationSource) int {
+	if limited, ok := source.(zoomLimitedSource); ok {
+		return limited.nativeMaxZoom()
+	}
+	return math.MaxInt
+}
+
+// ElevationCache keeps recently decoded elevation grids, evicting the least recently used
+type ElevationCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	grids      map[string]*list.Element
+	order      *list.List
+
+	inFlight map[string]*elevationFetch // Fetches under way, shared by every sea level
+	flightMu sync.Mutex
+}
+
+type elevationEntry struct {
+	key  string
+	grid *elevationGrid
+}
+
+// elevationFetch is the result of a fetch, ready once done is closed
+type elevationFetch struct {
+	done chan struct{}
+	grid *elevationGrid
+	err  error
+}
+
+func newElevationCache(maxEntries int) *ElevationCache {
+	return &ElevationCache{
+		maxEntries: maxEntries,
+		grids:      make(map[string]*list.Element),
+		order:      list.New(),
+		inFlight:   make(map[string]*elevationFetch),
+	}
+}
+
+var elevationCache = newElevationCache(512)
+
+func (c *ElevationCache) get(key string) (*elevationGrid, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, exists := c.grids[key]; exists {
+		c.order.MoveToFront(el)
+		return el.Value.(*elevationEntry).grid, true
+	}
+	return nil, false
+}
+
+func (c *ElevationCache) put(key string, grid *elevationGrid) {
+	if c.maxEntries <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, exists := c.grids[key]; exists {
+		el.Value.(*elevationEntry).grid = grid
+		c.order.MoveToFront(el)
+		return
+	}
+	c.grids[key] = c.order.PushFront(&elevationEntry{key: key, grid: grid})
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.grids, oldest.Value.(*elevationEntry).key)
+	}
+}
+
+// loadTileGrid returns the elevation a tile is rendered from: deep ocean if the ocean mask
+// knows it to be, otherwise the tile's elevation (or bedrock) with any smoothing applied. Point
+// queries use it too, so they agree with what the map shows.
+func loadTileGrid(z, x, y int, bedrock bool, timing *serverTiming) (*elevationGrid, error) {
+	if oceanMask.contains(z, x, y) {
+		metrics.incr("deep_ocean_tiles")
+		return deepOceanGrid, nil
+	}
+	var grid *elevationGrid
+	var err error
+	if bedrock {
+		grid, err = loadBedrock(z, x, y, timing)
+	} else {
+		grid, err = loadElevation(z, x, y, timing)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Bedrock under the ice can be far below the sea without it being ocean
+	if !bedrock {
+		oceanMask.learn(z, x, y, grid)
+	}
+	return smoothElevation(grid), nil
+}
+
+// removeMatching removes every grid whose key match returns true, returning how many there were
+func (c *ElevationCache) removeMatching(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for key, el := range c.grids {
+		if match(key) {
+			c.order.Remove(el)
+			delete(c.grids, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// errElevationMissing means the upstream source has no tile at those coordinates
+var errElevationMissing = errors.New("elevation tile not found upstream")
+
+// elevationMisses remembers tiles the upstream source doesn't have, so they aren't requested
+// again until elevationMissTTL has passed
+var elevationMisses = newTileCache("elevation_misses")
+
+var elevationMissTTL = 5 * time.Minute
+
+func elevationKey(z, x, y int) string {
+	return fmt.Sprintf("%d/%d/%d", z, x, y)
+}
+
+// loadElevation returns the elevation grid for a tile, from the cache or derived from cached
+// children where possible, so rendering more sea levels for a tile needn't fetch and decode it
+// again. Grids are shared, so callers must not modify them.
+func loadElevation(z, x, y int, timing *serverTiming) (*elevationGrid, error) {
+	top := sourceMaxZoom(elevationUpstream)
+	if elevationResampleZoom > 0 {
+		top = min(top, elevationResampleZoom)
+	}
+	if z > top {
+		return overzoomElevation(z, x, y, top, timing)
+	}
+	key := elevationKey(z, x, y)
+	if grid, exists := elevationCache.get(key); exists {
+		metrics.incr("elevation_cache", "result:hit")
+		return grid, nil
+	}
+	if _, missing := elevationMisses.get(key); missing {
+		metrics.incr("elevation_cache", "result:negative")
+		return nil, errElevationMissing
+	}
+	metrics.incr("elevation_cache", "result:miss")
+
+	if grid := elevationFromChildren(z, x, y); grid != nil {
+		metrics.incr("elevation_derived")
+		log.Printf("Derived elevation from cached children: z=%d, x=%d, y=%d", z, x, y)
+		elevationCache.put(key, grid)
+		return grid, nil
+	}
+
+	// Requests for other sea levels of the tile wait for the same fetch
+	c := elevationCache
+	c.flightMu.Lock()
+	if fetch, exists := c.inFlight[key]; exists {
+		c.flightMu.Unlock()
+		metrics.incr("elevation_coalesced")
+		waitStart := time.Now()
+		<-fetch.done
+		timing.since("wait", waitStart)
+		return fetch.grid, fetch.err
+	}
+	fetch := &elevationFetch{done: make(chan struct{})}
+	c.inFlight[key] = fetch
+	c.flightMu.Unlock()
+	defer func() {
+		c.flightMu.Lock()
+		delete(c.inFlight, key)
+		c.flightMu.Unlock()
+		close(fetch.done)
+	}()
+
+	fetch.grid, fetch.err = fetchElevation(z, x, y, timing)
+	if fetch.err == errElevationMissing && elevationMissTTL > 0 {
+		now := time.Now()
+		elevationMisses.put(key, CachedTile{timestamp: now, expires: now.Add(elevationMissTTL)})
+	}
+	if fetch.err != nil {
+		return nil, fetch.err
+	}
+	c.put(key, fetch.grid)
+	return fetch.grid, nil
+}
+
+// overzoomElevation upsamples the part of an ancestor at the source's highest zoom that a tile
+// covers, so the overlay keeps working when zoomed in past the elevation data. The result is
+// cheap to make again, so isn't cached in place of real tiles.
+func overzoomElevation(z, x, y, top int, timing *serverTiming) (*elevationGrid, error) {
+	shift := z - top
+	parent, err := loadElevation(top, x>>shift, y>>shift, timing)
+	if err != nil {
+		return nil, err
+	}
+	metrics.incr("elevation_overzoomed")
+
+	// Map each pixel centre into the parent's pixel coordinates
+	scale := float64(int(1) << shift)
+	originX := float64(x&(1<<shift-1)) * tileSize / scale
+	originY := float64(y&(1<<shift-1)) * tileSize / scale
+	grid := new(elevationGrid)
+	for py := 0; py < tileSize; py++ {
+		sy := originY + (float64(py)+0.5)/scale - 0.5
+		for px := 0; px < tileSize; px++ {
+			sx := originX + (float64(px)+0.5)/scale - 0.5
+			if elevationResampling == "bicubic" {
+				grid[py*tileSize+px] = sampleGridBicubic(parent, sx, sy)
+			} else {
+				grid[py*tileSize+px] = sampleGrid(parent, sx, sy)
+			}
+		}
+	}
+	return grid, nil
+}
+
+// sampleGrid interpolates bilinearly between pixels, clamping at the edges and taking the
+// nearest pixel next to gaps in the data
+func sampleGrid(grid *elevationGrid, x, y float64) int16 {
+	return int16(math.Round(interpolateGrid(grid, x, y)))
+}
+
+// sampleGridBicubic interpolates with Catmull-Rom splines through the surrounding 4x4 pixels,
+// which keeps slopes continuous across pixels where bilinear interpolation leaves creases, and
+// falls back to sampleGrid near gaps in the data
+func sampleGridBicubic(grid *elevationGrid, x, y float64) int16 {
+	x = max(0, min(tileSize-1, x))
+	y = max(0, min(tileSize-1, y))
+	x0, y0 := int(x), int(y)
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	var rows [4]float64
+	for j := range rows {
+		py := max(0, min(tileSize-1, y0+j-1))
+		var p [4]float64
+		for i := range p {
+			e := grid[py*tileSize+max(0, min(tileSize-1, x0+i-1))]
+			if e == noElevation {
+				return sampleGrid(grid, x, y)
+			}
+			p[i] = float64(e)
+		}
+		rows[j] = catmullRom(p, fx)
+	}
+	v := catmullRom(rows, fy)
+	return int16(max(math.MinInt16+1, min(math.MaxInt16, math.Round(v))))
+}
+
+// catmullRom interpolates between p[1] and p[2] at t from 0 to 1
+func catmullRom(p [4]float64, t float64) float64 {
+	return p[1] + 0.5*t*(p[2]-p[0]+t*(2*p[0]-5*p[1]+4*p[2]-p[3]+t*(3*(p[1]-p[2])+p[3]-p[0])))
+}
+
+// interpolateGrid is sampleGrid without rounding to whole metres
+func interpolateGrid(grid *elevationGrid, x, y float64) float64 {
+	x = max(0, min(tileSize-1, x))
+	y = max(0, min(tileSize-1, y))
+	x0, y0 := int(x), int(y)
+	x1, y1 := min(x0+1, tileSize-1), min(y0+1, tileSize-1)
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	a, b := grid[y0*tileSize+x0], grid[y0*tileSize+x1]
+	c, d := grid[y1*tileSize+x0], grid[y1*tileSize+x1]
+	if a == noElevation || b == noElevation || c == noElevation || d == noElevation {
+		return float64(grid[int(math.Round(y))*tileSize+int(math.Round(x))])
+	}
+	upper := float64(a)*(1-fx) + float64(b)*fx
+	lower := float64(c)*(1-fx) + float64(d)*fx
+	return upper*(1-fy) + lower*fy
+}
+
+// elevationFromChildren downsamples the four child grids of a tile if they are all cached
+func elevationFromChildren(z, x, y int) *elevationGrid {
+	if z >= sourceMaxZoom(elevationUpstream) {
+		return nil
+	}
+
+	var children [4]*elevationGrid
+	for i := range children {
+		grid, exists := elevationCache.get(elevationKey(z+1, 2*x+i%2, 2*y+i/2))
+		if !exists {
+			return nil
+		}
+		children[i] = grid
+	}
+
+	// Each child covers one quadrant; average the valid pixels in each 2x2 block, so gaps in the
+	// data stay gaps rather than dragging their neighbours' elevations down
+	half := tileSize / 2
+	grid := new(elevationGrid)
+	for py := 0; py < tileSize; py++ {
+		for px := 0; px < tileSize; px++ {
+			child := children[(py/half)*2+px/half]
+			cx := (px % half) * 2
+			cy := (py % half) * 2
+			sum, n := 0, 0
+			for _, e := range [4]int16{
+				child[cy*tileSize+cx], child[cy*tileSize+cx+1],
+				child[(cy+1)*tileSize+cx], child[(cy+1)*tileSize+cx+1],
+			} {
+				if e != noElevation {
+					sum += int(e)
+					n++
+				}
+			}
+			if n == 0 {
+				grid[py*tileSize+px] = noElevation
+			} else {
+				grid[py*tileSize+px] = int16(sum / n)
+			}
+		}
+	}
+	return grid
+}
+
+// setupElevationSource configures where elevations come from, optionally merging in
+// bathymetry from ELEVATION_BATHYMETRY
+func setupElevationSource() error {
+	source, err := landElevationSource()
+	if err != nil {
+		return err
+	}
+	elevationCredit = envString("ELEVATION_ATTRIBUTION", elevationCredit)
+	if spec := os.Getenv("ELEVATION_BATHYMETRY"); spec != "" {
+		sea, err := newElevationSource(spec)
+		if err != nil {
+			return fmt.Errorf("bathymetry: %v", err)
+		}
+		source = &bathymetrySource{land: source, sea: sea}
+	}
+	if list := os.Getenv("ELEVATION_BEDROCK"); list != "" {
+		if bedrockSource, err = newChainSource(list); err != nil {
+			return fmt.Errorf("bedrock: %v", err)
+		}
+		bedrockCache = newElevationCache(envInt("BEDROCK_CACHE_ENTRIES", 256))
+	}
+	elevationUpstream = source
+	return nil
+}
+
+// landElevationSource opens a public DEM named by ELEVATION_PRESET, an ordered chain with
+// ELEVATION_SOURCES, an MBTiles file with
+// ELEVATION_MBTILES, a directory of SRTM files with ELEVATION_SRTM_DIR, a local GeoTIFF or VRT
+// mosaic with ELEVATION_GEOTIFF, remote Cloud-Optimized GeoTIFFs with ELEVATION_COG, otherwise
+// terrarium tiles from ELEVATION_URL
+func landElevationSource() (elevationSource, error) {
+	if name := os.Getenv("ELEVATION_PRESET"); name != "" {
+		preset, err := lookupDEMPreset(name)
+		if err != nil {
+			return nil, err
+		}
+		elevationCredit = preset.attribution
+		return newChainSource(preset.sources)
+	}
+	if list := os.Getenv("ELEVATION_SOURCES"); list != "" {
+		return newChainSource(list)
+	}
+	if path := os.Getenv("ELEVATION_MBTILES"); path != "" {
+		return newMBTilesSource(path, os.Getenv("ELEVATION_MBTILES_ENCODING"))
+	}
+	if dir := os.Getenv("ELEVATION_SRTM_DIR"); dir != "" {
+		return newSRTMSource(dir)
+	}
+	if path := os.Getenv("ELEVATION_GEOTIFF"); path != "" {
+		return newGeoTIFFSource(path)
+	}
+	if urls := os.Getenv("ELEVATION_COG"); urls != "" {
+		return newCOGSource(urls)
+	}
+	encoding := envString("ELEVATION_ENCODING", "terrarium")
+	if _, ok := elevationEncodings[encoding]; !ok {
+		return nil, fmt.Errorf("unsupported ELEVATION_ENCODING %q; use terrarium or mapbox", encoding)
+	}
+	return newTerrariumSource(envString("ELEVATION_URL", defaultElevationURL), encoding), nil
+}
+
+// fetchElevation gets a tile's elevations from the upstream source, bypassing the caches
+func fetchElevation(z, x, y int, timing *serverTiming) (*elevationGrid, error) {
+	return elevationUpstream.tile(z, x, y, timing)
+}
+
+// rawElevationStore keeps the PNGs downloaded from terrarium sources, laid out as z/x/y.png so
+// that it can be served as a mirror; it is nil unless ELEVATION_RAW_DIR is set
+var rawElevationStore *diskStore
+
+// rawElevationTTL is how long raw tiles are used before being revalidated with the upstream,
+// set by ELEVATION_RAW_TTL; 0 keeps them forever
+var rawElevationTTL time.Duration
+
+// terrariumSource downloads terrarium-encoded PNG tiles; ELEVATION_URL can point it at a mirror
+// or another provider, and ELEVATION_ENCODING=mapbox at one serving Terrain-RGB tiles instead
+type terrariumSource struct {
+	urlTemplate string
+	encoding    string
+	breaker     *circuitBreaker
+}
+
+func newTerrariumSource(urlTemplate, encoding string) *terrariumSource {
+	return &terrariumSource{urlTemplate: urlTemplate, encoding: encoding, breaker: newCircuitBreaker(urlTemplate)}
+}
+
+func (s *terrariumSource) name() string {
+	return s.encoding
+}
+
+func (s *terrariumSource) nativeMaxZoom() int {
+	return terrariumMaxZoom
+}
+
+func (s *terrariumSource) describe() string {
+	return fmt.Sprintf("%s (%s, z0-%d)", s.urlTemplate, s.encoding, terrariumMaxZoom)
+}
+
+// tile downloads and decodes a tile
+func (s *terrariumSource) tile(z, x, y int, timing *serverTiming) (*elevationGrid, error) {
+	data, err := s.raw(z, x, y, timing)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode the elevation image
+	decodeStart := time.Now()
+	defer timing.since("decode", decodeStart)
+	return decodeElevationImage(data, s.encoding)
+}
+
+// raw returns a tile's PNG from the raw elevation store if it's there, otherwise downloads it
+// and keeps a copy. Copies older than rawElevationTTL are revalidated with a conditional
+// request, and still used if the upstream can't be reached.
+func (s *terrariumSource) raw(z, x, y int, timing *serverTiming) ([]byte, error) {
+	if rawElevationStore == nil || s.encoding != "terrarium" {
+		data, _, err := s.download(z, x, y, timing, nil)
+		return data, err
+	}
+	path := fmt.Sprintf("%d/%d/%d.png", z, x, y)
+	data, stored, exists, err := rawElevationStore.get(path)
+	if err != nil {
+		reportError("raw_elevation", err, nil)
+	} else if exists && (rawElevationTTL == 0 || time.Since(stored) < rawElevationTTL) {
+		metrics.incr("raw_elevation", "result:hit")
+		return data, nil
+	}
+
+	var held *rawValidators
+	if exists {
+		etag, _, _, _ := rawElevationStore.get(path + ".etag")
+		held = &rawValidators{etag: string(etag), modified: stored}
+	}
+	fresh, etag, err := s.download(z, x, y, timing, held)
+	switch {
+	case err == errNotModified:
+		metrics.incr("raw_elevation", "result:revalidated")
+		if err := rawElevationStore.touch(path); err != nil {
+			reportError("raw_elevation", err, nil)
+		}
+		return data, nil
+	case err != nil && exists && err != errElevationMissing:
+		metrics.incr("raw_elevation", "result:stale")
+		log.Printf("Using expired raw elevation tile z=%d, x=%d, y=%d: %v", z, x, y, err)
+		return data, nil
+	case err != nil:
+		return nil, err
+	}
+	if exists {
+		metrics.incr("raw_elevation", "result:refreshed")
+	} else {
+		metrics.incr("raw_elevation", "result:miss")
+	}
+
+	if err := rawElevationStore.put(path, fresh); err != nil {
+		reportError("raw_elevation", err, nil)
+	}
+	if etag != "" {
+		if err := rawElevationStore.put(path+".etag", []byte(etag)); err != nil {
+			reportError("raw_elevation", err, nil)
+		}
+	}
+	return fresh, nil
+}
+
+// rawValidators identify the copy of a tile already held, for a conditional request
+type rawValidators struct {
+	etag     string
+	modified time.Time
+}
+
+// errNotModified means the copy of a tile already held is still current
+var errNotModified = errors.New("elevation tile not modified")
+
+// download fetches a tile's PNG from the upstream, returning its ETag. If held is set, the
+// request is conditional and errNotModified returned if that copy is current.
+func (s *terrariumSource) download(z, x, y int, timing *serverTiming, held *rawValidators) ([]byte, string, error) {
+	elevationURL := strings.NewReplacer(
+		"{z}", fmt.Sprint(z),
+		"{x}", fmt.Sprint(x),
+		"{y}", fmt.Sprint(y),
+	).Replace(s.urlTemplate)
+
+	log.Printf("Fetching upstream tile: z=%d, x=%d, y=%d", z, x, y)
+	fetchStart := time.Now()
+
+	// Create HTTP request with user-agent
+	req, err := http.NewRequest("GET", elevationURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	authorizeUpstream(req)
+	if held != nil {
+		if held.etag != "" {
+			req.Header.Set("If-None-Match", held.etag)
+		}
+		req.Header.Set("If-Modified-Since", held.modified.UTC().Format(http.TimeFormat))
+	}
+
+	// Execute the request, unless the source has been failing
+	if !s.breaker.allow() {
+		return nil, "", errUpstreamUnavailable
+	}
+	resp, err := upstreamRetry.do(upstreamClient, elevationLimiter, req)
+	s.breaker.record(err == nil && resp.StatusCode < 500)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch elevation tile: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && held != nil {
+		metrics.incr("upstream_not_modified")
+		return nil, "", errNotModified
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		metrics.incr("upstream_not_found")
+		return nil, "", errElevationMissing
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("elevation tile request failed with status: %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read elevation tile: %v", err)
+	}
+	fetchDuration := time.Since(fetchStart)
+	metrics.timing("upstream_fetch", fetchDuration)
+	timing.add("fetch", fetchDuration)
+	log.Printf("Upstream fetch completed in %v: z=%d, x=%d, y=%d", fetchDuration, z, x, y)
+	return data, resp.Header.Get("ETag"), nil
+}
+
+// decodeElevationImage decodes an upstream tile in whichever image format it arrived in, PNG or
+// WebP. 16-bit grayscale images hold meters directly, as signed values, rather than in an
+// encoding.
+func decodeElevationImage(data []byte, encoding string) (*elevationGrid, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err == image.ErrFormat {
+		return nil, fmt.Errorf("unsupported elevation tile format %s", http.DetectContentType(data))
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to decode elevation image: %v", err)
+	}
+	if gray, ok := img.(*image.Gray16); ok {
+		return decodeGray16(gray)
+	}
+	return elevationEncodings[encoding](img)
+}
+
+// decodeGray16 reads elevations from a 16-bit grayscale image
+func decodeGray16(img *image.Gray16) (*elevationGrid, error) {
+	bounds := img.Bounds()
+	if bounds.Dx() != tileSize || bounds.Dy() != tileSize {
+		return nil, fmt.Errorf("unexpected elevation tile size: %dx%d", bounds.Dx(), bounds.Dy())
+	}
+	grid := new(elevationGrid)
+	for y := 0; y < tileSize; y++ {
+		for x := 0; x < tileSize; x++ {
+			grid[y*tileSize+x] = int16(img.Gray16At(bounds.Min.X+x, bounds.Min.Y+y).Y)
+		}
+	}
+	return grid, nil
+}
+
+// decodeTerrarium converts a terrarium-encoded image to elevations
+func decodeTerrarium(img image.Image) (*elevationGrid, error) {
+	// elevation = (R * 256 + G + B / 256) - 32768
+	return decodeRGBElevation(img, func(r, g, b int) int16 {
+		return int16(r*256 + g + b/256 - 32768)
+	})
+}
+
+// decodeTerrainRGB converts an image in Mapbox's Terrain-RGB encoding to elevations
+func decodeTerrainRGB(img image.Image) (*elevationGrid, error) {
+	// elevation = -10000 + (R * 256 * 256 + G * 256 + B) * 0.1
+	return decodeRGBElevation(img, func(r, g, b int) int16 {
+		elevation := -10000 + (r*65536+g*256+b)/10
+		return int16(max(math.MinInt16+1, min(math.MaxInt16, elevation)))
+	})
+}
+
+// decodeRGBElevation converts a tile with elevations packed into its colour channels
+func decodeRGBElevation(img image.Image, decode func(r, g, b int) int16) (*elevationGrid, error) {
+	bounds := img.Bounds()
+	if bounds.Dx() != tileSize || bounds.Dy() != tileSize {
+		return nil, fmt.Errorf("unexpected elevation tile size: %dx%d", bounds.Dx(), bounds.Dy())
+	}
+
+	// Convert to RGBA if it's not already
+	var rgbaImg *image.RGBA
+	if rgba, ok := img.(*image.RGBA); ok {
+		rgbaImg = rgba
+	} else {
+		rgbaImg = image.NewRGBA(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				rgbaImg.Set(x, y, img.At(x, y))
+			}
+		}
+	}
+
+	grid := new(elevationGrid)
+	for y := 0; y < tileSize; y++ {
+		for x := 0; x < tileSize; x++ {
+			offset := y*rgbaImg.Stride + x*4
+			grid[y*tileSize+x] = decode(int(rgbaImg.Pix[offset]), int(rgbaImg.Pix[offset+1]), int(rgbaImg.Pix[offset+2]))
+		}
+	}
+	return grid, nil
+}
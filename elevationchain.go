@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chainSource tries several elevation sources in order, falling through to the next when a
+// tile is missing or a source fails, and filling any gaps in local data from later sources.
+// ELEVATION_SOURCES lists them separated by spaces, like
+// "mbtiles:/data/dem.mbtiles https://mirror.example/{z}/{x}/{y}.png terrarium:default".
+type chainSource struct {
+	sources []elevationSource
+}
+
+// newElevationSource opens a source from a spec like "srtm:/data/hgt" or
+// "mapbox:https://example.com/{z}/{x}/{y}.png" for Terrain-RGB tiles; a bare URL is terrarium
+func newElevationSource(spec string) (elevationSource, error) {
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		return newTerrariumSource(spec, "terrarium"), checkTileURLTemplate(spec)
+	}
+	kind, arg, ok := strings.Cut(spec, ":")
+	if !ok || arg == "" {
+		return nil, fmt.Errorf("elevation source %q should look like kind:location", spec)
+	}
+	switch kind {
+	case "terrarium", "mapbox":
+		if arg == "default" {
+			arg = defaultElevationURL
+		}
+		return newTerrariumSource(arg, kind), checkTileURLTemplate(arg)
+	case "mbtiles":
+		return newMBTilesSource(arg, "")
+	case "geotiff":
+		return newGeoTIFFSource(arg)
+	case "srtm":
+		return newSRTMSource(arg)
+	case "cog":
+		return newCOGSource(arg)
+	case "cells":
+		return newCellSource(arg)
+	}
+	return nil, fmt.Errorf("unknown elevation source kind %q; use terrarium, mapbox, mbtiles, geotiff, srtm, cog or cells", kind)
+}
+
+func newChainSource(list string) (*chainSource, error) {
+	c := &chainSource{}
+	for _, spec := range strings.Fields(list) {
+		source, err := newElevationSource(spec)
+		if err != nil {
+			return nil, err
+		}
+		c.sources = append(c.sources, source)
+	}
+	if len(c.sources) == 0 {
+		return nil, fmt.Errorf("no elevation sources listed")
+	}
+	return c, nil
+}
+
+func (c *chainSource) name() string {
+	return "chain"
+}
+
+// nativeMaxZoom is the highest of any source, as the rest fall through to the next
+func (c *chainSource) nativeMaxZoom() int {
+	top := 0
+	for _, source := range c.sources {
+		top = max(top, sourceMaxZoom(source))
+	}
+	return top
+}
+
+func (c *chainSource) describe() string {
+	descriptions := make([]string, len(c.sources))
+	for i, source := range c.sources {
+		descriptions[i] = source.name() + ":" + source.describe()
+	}
+	return strings.Join(descriptions, " > ")
+}
+
+// tile returns the first tile found, with gaps filled from the sources after it. Failures only
+// surface if no source had the tile, so a flaky mirror doesn't cache a miss.
+func (c *chainSource) tile(z, x, y int, timing *serverTiming) (*elevationGrid, error) {
+	var grid *elevationGrid
+	var lastErr error
+	for i, source := range c.sources {
+		tags := []string{"source:" + source.name(), "position:" + strconv.Itoa(i)}
+		start := time.Now()
+		next, err := source.tile(z, x, y, timing)
+		metrics.timing("elevation_source_fetch", time.Since(start), tags...)
+		if err == errElevationMissing {
+			metrics.incr("elevation_source_tiles", append(tags, "result:missing")...)
+			continue
+		}
+		if err != nil {
+			metrics.incr("elevation_source_tiles", append(tags, "result:error")...)
+			if err != errUpstreamUnavailable {
+				reportError("elevation_source", err, map[string]string{"source": source.describe()})
+			}
+			lastErr = err
+			continue
+		}
+
+		if grid == nil {
+			grid = next
+			metrics.incr("elevation_source_tiles", append(tags, "result:served")...)
+		} else {
+			for j, elevation := range grid {
+				if elevation == noElevation {
+					grid[j] = next[j]
+				}
+			}
+			metrics.incr("elevation_source_tiles", append(tags, "result:filled")...)
+		}
+		if !hasGaps(grid) {
+			return grid, nil
+		}
+	}
+	if grid != nil {
+		return grid, nil
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, errElevationMissing
+}
+
+func hasGaps(grid *elevationGrid) bool {
+	for _, elevation := range grid {
+		if elevation == noElevation {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Bruun rule parameters: the beach profile is assumed to be active from the berm crest down
+// to the depth of closure, beyond which waves no longer move sediment
+var (
+	bruunClosureDepth = 8.0 // meters below the sea level
+	bruunBermHeight   = 2.0 // meters above the sea level
+)
+
+// maxBruunRetreat caps the estimate, which is meaningless far beyond today's sandy coasts
+const maxBruunRetreat = 5000.0 // meters
+
+// erosionColor marks land estimated to be lost to shoreline retreat
+var erosionColor = color.RGBA{200, 120, 40, 200}
+
+// bruunErosion estimates land lost to shoreline retreat beyond the static inundation extent,
+// using the Bruun rule R = S * L / (B + h). S is the rise above today's sea level, L the width
+// of the active profile measured from each shore pixel out to the depth of closure h, and B the
+// berm height. Retreat is measured inland from the new shoreline. This is an experimental
+// estimate: it assumes an erodible sandy coast everywhere and only considers the tile itself.
+func bruunErosion(grid *elevationGrid, seaLevel, z, y int) *tileMask {
+	eroded := new(tileMask)
+	if seaLevel <= 0 {
+		return eroded
+	}
+	rise := float64(seaLevel)
+	mpp := metersPerPixel(tileLatitude(z, float64(y)+0.5), z)
+	flooded := func(i int) bool { return int(grid[i]) < seaLevel }
+
+	// Distance from every pixel to water deeper than the depth of closure
+	toDeep := make([]float64, len(grid))
+	var queue []int
+	for i := range grid {
+		if float64(grid[i]) < float64(seaLevel)-bruunClosureDepth {
+			queue = append(queue, i)
+		} else {
+			toDeep[i] = math.Inf(1)
+		}
+	}
+	queue = relaxDistances(queue, toDeep, mpp, flooded)
+
+	// Each shore pixel can push the shoreline back by its own retreat distance; remaining
+	// holds the furthest that any of them can still reach at each land pixel
+	remaining := make([]float64, len(grid))
+	for i := range remaining {
+		remaining[i] = math.Inf(-1)
+	}
+	for i := range grid {
+		if !flooded(i) || !touchesLand(grid, seaLevel, i) {
+			continue
+		}
+		width := toDeep[i]
+		if math.IsInf(width, 1) {
+			// Closure depth isn't reached within the tile; assume a gently sloping profile
+			width = maxBruunRetreat
+		}
+		remaining[i] = min(maxBruunRetreat, rise*width/(bruunBermHeight+bruunClosureDepth))
+		queue = append(queue, i)
+	}
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		px, py := i%tileSize, i/tileSize
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				nx, ny := px+dx, py+dy
+				if nx < 0 || ny < 0 || nx >= tileSize || ny >= tileSize {
+					continue
+				}
+				j := ny*tileSize + nx
+				if flooded(j) {
+					continue
+				}
+				left := remaining[i] - mpp*math.Hypot(float64(dx), float64(dy))
+				if left < 0 || left <= remaining[j] {
+					continue
+				}
+				remaining[j] = left
+				eroded[j] = true
+				queue = append(queue, j)
+			}
+		}
+	}
+
+	return eroded
+}
+
+// relaxDistances spreads distances in meters outwards from the queued pixels through pixels
+// accepted by pass, returning the emptied queue for reuse
+func relaxDistances(queue []int, dist []float64, mpp float64, pass func(int) bool) []int {
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		px, py := i%tileSize, i/tileSize
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				nx, ny := px+dx, py+dy
+				if nx < 0 || ny < 0 || nx >= tileSize || ny >= tileSize {
+					continue
+				}
+				j := ny*tileSize + nx
+				d := dist[i] + mpp*math.Hypot(float64(dx), float64(dy))
+				if !pass(j) || d >= dist[j] {
+					continue
+				}
+				dist[j] = d
+				queue = append(queue, j)
+			}
+		}
+	}
+	return queue
+}
+
+// touchesLand reports whether any neighbour of a pixel is above the sea level
+func touchesLand(grid *elevationGrid, seaLevel, i int) bool {
+	px, py := i%tileSize, i/tileSize
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			nx, ny := px+dx, py+dy
+			if nx < 0 || ny < 0 || nx >= tileSize || ny >= tileSize {
+				continue
+			}
+			if int(grid[ny*tileSize+nx]) >= seaLevel {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// paintMask colors every pixel set in a mask
+func paintMask(img *image.RGBA, mask *tileMask, c color.RGBA) {
+	for i, set := range mask {
+		if set {
+			offset := i * 4
+			img.Pix[offset] = c.R
+			img.Pix[offset+1] = c.G
+			img.Pix[offset+2] = c.B
+			img.Pix[offset+3] = c.A
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultExportWidth  = 1600
+	defaultExportHeight = 1000
+	maxExportSize       = 4096
+
+	// maxExportPixels bounds the tiles one image needs to fewer than 100
+	maxExportPixels = 2048 * 2048
+
+	// maxExportsPerClient is how many images one address may have rendering at once
+	maxExportsPerClient = 2
+)
+
+var (
+	exportInk  = color.RGBA{34, 34, 34, 255}
+	exportHalo = color.RGBA{255, 255, 255, 255}
+)
+
+// exportsInFlight counts the images being rendered for each client address
+var exportsInFlight = struct {
+	sync.Mutex
+	clients map[string]int
+}{clients: make(map[string]int)}
+
+// acquireExport reserves one of a client's export slots, or returns false if they are all in use
+func acquireExport(r *http.Request) bool {
+	ip := clientIP(r)
+	exportsInFlight.Lock()
+	defer exportsInFlight.Unlock()
+	if exportsInFlight.clients[ip] >= maxExportsPerClient {
+		metrics.incr("exports_rejected")
+		return false
+	}
+	exportsInFlight.clients[ip]++
+	return true
+}
+
+// releaseExport frees a slot taken by acquireExport
+func releaseExport(r *http.Request) {
+	ip := clientIP(r)
+	exportsInFlight.Lock()
+	defer exportsInFlight.Unlock()
+	if exportsInFlight.clients[ip]--; exportsInFlight.clients[ip] <= 0 {
+		delete(exportsInFlight.clients, ip)
+	}
+}
+
+// elevationAttribution credits the elevation data used for the overlay
+func elevationAttribution() string {
+	return "Elevation: " + elevationCredit
+}
+
+// serveExport renders an annotated map image suitable for sharing or printing
+func serveExport(w http.ResponseWriter, r *http.Request) {
+	level, err := strconv.Atoi(mux.Vars(r)["level"])
+	if err != nil {
+		http.Error(w, "Invalid sea level", http.StatusBadRequest)
+		return
+	}
+	level = clampSeaLevel(level)
+
+	lat, lon, zoom, err := parseViewParams(r, 15)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	width, height, err := parseExportSize(r, defaultExportWidth, defaultExportHeight)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !acquireExport(r) {
+		http.Error(w, "Too many exports in progress, try again when one has finished", http.StatusTooManyRequests)
+		return
+	}
+	defer releaseExport(r)
+
+	img := renderView(mapView{
+		level:    level,
+		lat:      lat,
+		lon:      lon,
+		zoom:     zoom,
+		width:    width,
+		height:   height,
+		priority: priorityPrefetch,
+	}, 0.7)
+
+	// Scale text with the image so small and large exports both look right
+	scale := max(2, min(width, height)/400)
+	margin := 6 * scale
+
+	drawSeaLevelLabel(img, margin, margin, level, scale)
+	drawNorthArrow(img, width-margin-8*scale, margin, scale)
+	drawScaleBar(img, margin, height-margin-textHeight(scale)*2-4*scale, metersPerPixel(lat, zoom), width/4, scale)
+
+	attribution := basemapAttribution() + " | " + elevationAttribution()
+	drawTextHalo(img, width-textWidth(attribution, 1)-margin, height-textHeight(1)-margin, attribution, 1, exportInk, exportHalo)
+	stampWatermark(img, margin+textHeight(1)+4)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		reportError("render", err, map[string]string{"endpoint": "export"})
+		http.Error(w, "Failed to render export", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"sea-level-%d.png\"", level))
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(buf.Bytes())
+
+	log.Printf("Served export: level=%d, lat=%f, lon=%f, zoom=%d, size=%dx%d", level, lat, lon, zoom, width, height)
+}
+
+// parseSizeParam reads an image dimension from the query string
+func parseSizeParam(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 64 || v > maxExportSize {
+		return 0, fmt.Errorf("Invalid %s: must be between 64 and %d", name, maxExportSize)
+	}
+	return v, nil
+}
+
+// parseExportSize reads ?width= and ?height=, keeping the image within maxExportPixels
+func parseExportSize(r *http.Request, defWidth, defHeight int) (width, height int, err error) {
+	if width, err = parseSizeParam(r, "width", defWidth); err != nil {
+		return 0, 0, err
+	}
+	if height, err = parseSizeParam(r, "height", defHeight); err != nil {
+		return 0, 0, err
+	}
+	if width*height > maxExportPixels {
+		return 0, 0, fmt.Errorf("Image too large: width x height must be at most %d pixels", maxExportPixels)
+	}
+	return width, height, nil
+}
+
+// drawSeaLevelLabel draws the sea level caption on a white panel
+func drawSeaLevelLabel(img *image.RGBA, x, y, level, scale int) {
+	caption := seaLevelCaption(level)
+	labelScale := scale * 2
+	pad := 3 * scale
+	fillRect(img, image.Rect(x, y, x+textWidth(caption, labelScale)+2*pad, y+textHeight(labelScale)+2*pad),
+		color.RGBA{255, 255, 255, 220})
+	drawText(img, x+pad, y+pad, caption, labelScale, color.RGBA{0, 50, 120, 255})
+}
+
+// drawNorthArrow draws an arrow pointing up with an "N" beneath it, centred on x
+func drawNorthArrow(img *image.RGBA, x, y, scale int) {
+	h := 10 * scale
+	half := 4 * scale
+	fillPolygon(img, []image.Point{{x, y - scale}, {x + half + scale, y + h + scale}, {x - half - scale, y + h + scale}}, exportHalo)
+	fillPolygon(img, []image.Point{{x, y}, {x + half, y + h}, {x, y + h*3/4}, {x - half, y + h}}, exportInk)
+	drawTextHalo(img, x-textWidth("N", scale)/2, y+h+2*scale, "N", scale, exportInk, exportHalo)
+}
+
+// drawScaleBar draws a bar of a round length no longer than maxWidth pixels
+func drawScaleBar(img *image.RGBA, x, y int, metersPerPixel float64, maxWidth, scale int) {
+	meters := niceDistance(metersPerPixel * float64(maxWidth))
+	width := int(meters / metersPerPixel)
+
+	label := fmt.Sprintf("%g m", meters)
+	if meters >= 1000 {
+		label = fmt.Sprintf("%g km", meters/1000)
+	}
+	drawTextHalo(img, x, y, label, scale, exportInk, exportHalo)
+
+	barY := y + textHeight(scale) + 2*scale
+	fillRect(img, image.Rect(x-1, barY-1, x+width+1, barY+2*scale+1), exportHalo)
+	fillRect(img, image.Rect(x, barY, x+width/2, barY+2*scale), exportInk)
+	fillRect(img, image.Rect(x+width/2, barY, x+width, barY+2*scale), color.RGBA{136, 136, 136, 255})
+}
+
+// niceDistance rounds a distance down to 1, 2 or 5 times a power of ten
+func niceDistance(d float64) float64 {
+	if d <= 0 {
+		return 0
+	}
+	pow := math.Pow(10, math.Floor(math.Log10(d)))
+	for _, m := range []float64{5, 2, 1} {
+		if m*pow <= d {
+			return m * pow
+		}
+	}
+	return pow
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// exposureIndexZoom is the zoom of the tiles exposure features are bucketed by
+const exposureIndexZoom = 10
+
+// Kinds of feature counted for exposure
+const (
+	exposureBuilding = iota
+	exposureRoad
+	exposureRail
+)
+
+// exposureRoads are the highway values counted as roads, leaving out paths and tracks
+var exposureRoads = map[string]bool{
+	"motorway": true, "motorway_link": true, "trunk": true, "trunk_link": true,
+	"primary": true, "primary_link": true, "secondary": true, "secondary_link": true,
+	"tertiary": true, "tertiary_link": true, "unclassified": true, "residential": true,
+	"living_street": true, "service": true,
+}
+
+// exposureRailways are the railway values counted as rail lines
+var exposureRailways = map[string]bool{
+	"rail": true, "light_rail": true, "narrow_gauge": true, "tram": true, "subway": true,
+}
+
+// exposureFeature is a building, as the centre of its outline, or a road or rail line
+type exposureFeature struct {
+	kind   int
+	points []point // Longitude and latitude
+}
+
+// exposureIndex holds the features of an OSM extract, bucketed by the tiles they touch
+type exposureIndex struct {
+	features []exposureFeature
+	buckets  map[int][]int32
+}
+
+var (
+	exposureMu     sync.RWMutex
+	exposure       *exposureIndex
+	exposureLoaded bool // Whether OSM_EXTRACT_FILE has been read, even if it failed
+)
+
+// exposureKind classifies a way by its tags, returning false for ways that aren't counted
+func exposureKind(tags map[string]string) (int, bool) {
+	if b, ok := tags["building"]; ok && b != "no" {
+		return exposureBuilding, true
+	}
+	if exposureRoads[tags["highway"]] {
+		return exposureRoad, true
+	}
+	if exposureRailways[tags["railway"]] {
+		return exposureRail, true
+	}
+	return 0, false
+}
+
+// loadExposureIndex reads the buildings, roads and railways of an OSM PBF extract. The file is
+// read twice, first for the ways and then for just the nodes they use, as extracts are too big
+// to keep every node's position. Buildings mapped as relations aren't included.
+func loadExposureIndex(path string) (*exposureIndex, error) {
+	type pendingWay struct {
+		kind int
+		refs []int64
+	}
+	var ways []pendingWay
+	needed := make(map[int64]point)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	err = readOSMPBF(f, osmHandler{way: func(id int64, tags map[string]string, refs []int64) {
+		if kind, ok := exposureKind(tags); ok && len(refs) >= 2 {
+			ways = append(ways, pendingWay{kind, refs})
+			for _, ref := range refs {
+				needed[ref] = point{math.NaN(), math.NaN()}
+			}
+		}
+	}})
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if f, err = os.Open(path); err != nil {
+		return nil, err
+	}
+	err = readOSMPBF(f, osmHandler{node: func(id int64, lat, lon float64) {
+		if _, ok := needed[id]; ok {
+			needed[id] = point{lon, lat}
+		}
+	}})
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	index := &exposureIndex{buckets: make(map[int][]int32)}
+	for _, way := range ways {
+		var points []point
+		for _, ref := range way.refs {
+			if p := needed[ref]; !math.IsNaN(p.X) {
+				points = append(points, p)
+			}
+		}
+		if len(points) < 2 {
+			continue
+		}
+		if way.kind == exposureBuilding {
+			// Outlines are closed, so the last point repeats the first
+			var c point
+			outline := points[:len(points)-1]
+			for _, p := range outline {
+				c.X += p.X / float64(len(outline))
+				c.Y += p.Y / float64(len(outline))
+			}
+			points = []point{c}
+		}
+		index.add(exposureFeature{kind: way.kind, points: points})
+	}
+	return index, nil
+}
+
+// add files a feature under every tile its bounds touch
+func (x *exposureIndex) add(f exposureFeature) {
+	b := bbox{minLon: 180, minLat: 90, maxLon: -180, maxLat: -90}
+	for _, p := range f.points {
+		b.minLon, b.maxLon = min(b.minLon, p.X), max(b.maxLon, p.X)
+		b.minLat, b.maxLat = min(b.minLat, p.Y), max(b.maxLat, p.Y)
+	}
+	id := int32(len(x.features))
+	x.features = append(x.features, f)
+	x0, y0, x1, y1 := b.tileRange(exposureIndexZoom)
+	for ty := y0; ty <= y1; ty++ {
+		for tx := x0; tx <= x1; tx++ {
+			key := ty<<exposureIndexZoom | tx
+			x.buckets[key] = append(x.buckets[key], id)
+		}
+	}
+}
+
+// near returns the features that might be within a bbox
+func (x *exposureIndex) near(area bbox) []exposureFeature {
+	seen := make(map[int32]bool)
+	var out []exposureFeature
+	x0, y0, x1, y1 := area.tileRange(exposureIndexZoom)
+	for ty := y0; ty <= y1; ty++ {
+		for tx := x0; tx <= x1; tx++ {
+			for _, id := range x.buckets[ty<<exposureIndexZoom|tx] {
+				if !seen[id] {
+					seen[id] = true
+					out = append(out, x.features[id])
+				}
+			}
+		}
+	}
+	return out
+}
+
+func (b bbox) contains(p point) bool {
+	return p.X >= b.minLon && p.X <= b.maxLon && p.Y >= b.minLat && p.Y <= b.maxLat
+}
+
+// exposureTotals counts buildings, or measures lines in kilometres, in a bbox and under water
+type exposureTotals struct {
+	Flooded float64 `json:"flooded"`
+	Total   float64 `json:"total"`
+}
+
+// measureExposure adds up the features in a bbox, and how much of them the mask has flooded.
+// Lines are split into steps no longer than a pixel, each flooded or not by its middle.
+func measureExposure(features []exposureFeature, area bbox, flooded *floodMask, originX, originY, zoom int) [3]exposureTotals {
+	var totals [3]exposureTotals
+	isFlooded := func(p point) bool {
+		px, py := mercatorPixel(p.X, p.Y, zoom)
+		return flooded.at(int(px)-originX, int(py)-originY)
+	}
+	for _, f := range features {
+		t := &totals[f.kind]
+		if f.kind == exposureBuilding {
+			if area.contains(f.points[0]) {
+				t.Total++
+				if isFlooded(f.points[0]) {
+					t.Flooded++
+				}
+			}
+			continue
+		}
+		for i := 1; i < len(f.points); i++ {
+			a, b := f.points[i-1], f.points[i]
+			ax, ay := mercatorPixel(a.X, a.Y, zoom)
+			bx, by := mercatorPixel(b.X, b.Y, zoom)
+			steps := max(1, int(math.Ceil(math.Hypot(bx-ax, by-ay))))
+			length := haversine(a.X, a.Y, b.X, b.Y) / 1000 / float64(steps)
+			for s := 0; s < steps; s++ {
+				frac := (float64(s) + 0.5) / float64(steps)
+				mid := point{a.X + (b.X-a.X)*frac, a.Y + (b.Y-a.Y)*frac}
+				if !area.contains(mid) {
+					continue
+				}
+				t.Total += length
+				if isFlooded(mid) {
+					t.Flooded += length
+				}
+			}
+		}
+	}
+	return totals
+}
+
+// loadExposure reads OSM_EXTRACT_FILE in the background, as big extracts take a while
+func loadExposure(path string) {
+	go func() {
+		start := time.Now()
+		index, err := loadExposureIndex(path)
+		exposureMu.Lock()
+		exposure, exposureLoaded = index, true
+		exposureMu.Unlock()
+		if err != nil {
+			reportError("exposure", err, nil)
+			return
+		}
+		log.Printf("Loaded %d exposure features from %s in %v", len(index.features), path, time.Since(start).Round(time.Second))
+	}()
+}
+
+// serveExposure reports how many buildings and how many kilometres of road and rail within
+// ?bbox= are below ?level=, from the tiles at the most detailed zoom that needs at most
+// maxFloodPolyTiles
+func serveExposure(w http.ResponseWriter, r *http.Request) {
+	exposureMu.RLock()
+	index, loaded := exposure, exposureLoaded
+	exposureMu.RUnlock()
+	if os.Getenv("OSM_EXTRACT_FILE") == "" {
+		http.Error(w, "Exposure estimates are not configured", http.StatusNotFound)
+		return
+	}
+	if !loaded {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Still loading the OSM extract", http.StatusServiceUnavailable)
+		return
+	}
+	if index == nil {
+		http.Error(w, "Failed to load the OSM extract", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	area, err := parseBBox(query.Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	level, err := strconv.Atoi(query.Get("level"))
+	if err != nil {
+		http.Error(w, "Invalid sea level", http.StatusBadRequest)
+		return
+	}
+	level = clampSeaLevel(level)
+	connected := query.Get("connected") == "1"
+	if connected && oceanSeeds == nil {
+		http.Error(w, "Connected flooding mode is not configured", http.StatusBadRequest)
+		return
+	}
+
+	zoom := upstreamMaxZoom
+	for zoom > 0 && area.tileCount(zoom, zoom) > maxFloodPolyTiles {
+		zoom--
+	}
+	renderPool.acquire(requestPriority(r))
+	mask, originX, originY, err := loadFloodMask(area, zoom, level, connected)
+	renderPool.release()
+	if err == errUpstreamUnavailable {
+		w.Header().Set("Retry-After", fmt.Sprint(int(breakerCooldown.Seconds())))
+		http.Error(w, "Elevation source unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch elevation", http.StatusBadGateway)
+		log.Printf("Error fetching elevation for %s: %v", r.URL.Path, err)
+		return
+	}
+
+	totals := measureExposure(index.near(area), area, mask, originX, originY, zoom)
+	round := func(t exposureTotals) exposureTotals {
+		return exposureTotals{math.Round(t.Flooded*100) / 100, math.Round(t.Total*100) / 100}
+	}
+	metrics.incr("api_requests", "endpoint:exposure")
+	writeJSON(w, map[string]interface{}{
+		"level":     level,
+		"zoom":      zoom,
+		"connected": connected,
+		"buildings": totals[exposureBuilding],
+		"road_km":   round(totals[exposureRoad]),
+		"rail_km":   round(totals[exposureRail]),
+	})
+}
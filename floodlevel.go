@@ -0,0 +1,40 @@
+package main
+
+import (
+	"image"
+	"net/http"
+)
+
+// renderFloodLevels encodes, for each pixel, the lowest sea level that floods it, in the same
+// RGB encoding as terrarium tiles: level = R*256 + G + B/256 - 32768. A pixel floods at any sea
+// level at or above its value, so clients can re-threshold the tile as the sea level changes
+// without fetching a tile per level. Pixels without elevation are transparent.
+func renderFloodLevels(grid *elevationGrid) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	for i, elevation := range grid {
+		if elevation == noElevation {
+			continue
+		}
+		// Pixels flood when they're below the sea level, so the first level to flood is one above
+		v := int(elevation) + 1 + 32768
+		offset := i * 4
+		img.Pix[offset] = uint8(v >> 8)
+		img.Pix[offset+1] = uint8(v)
+		img.Pix[offset+2] = 0
+		img.Pix[offset+3] = 255
+	}
+	return img
+}
+
+// serveFloodLevels serves a tile of the lowest sea level flooding each pixel
+func serveFloodLevels(w http.ResponseWriter, r *http.Request) {
+	z, x, y, ok := parseLayerTile(w, r)
+	if !ok {
+		return
+	}
+	grid, ok := loadLayerElevation(w, r, z, x, y)
+	if !ok {
+		return
+	}
+	writeLayerTile(w, "flood_level", renderFloodLevels(grid))
+}
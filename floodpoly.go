@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// maxFloodPolyTiles limits how many tiles one flood polygon request traces across
+const maxFloodPolyTiles = 64
+
+// floodMask is the flooded pixels across a block of tiles, row by row
+type floodMask struct {
+	width, height int
+	pixels        []bool
+}
+
+func (m *floodMask) at(x, y int) bool {
+	return x >= 0 && y >= 0 && x < m.width && y < m.height && m.pixels[y*m.width+x]
+}
+
+// Directions along pixel edges, clockwise on screen
+var edgeSteps = [4][2]int{{1, 0}, {0, 1}, {-1, 0}, {0, -1}}
+
+// traceMask returns the outlines of the flooded pixels as rings of pixel corners, with the
+// flooded side on the right on screen. Outlines of areas are clockwise and holes anticlockwise
+// on screen, and diagonal neighbours are kept apart, as flooding only spreads between pixels
+// sharing an edge.
+func traceMask(m *floodMask) [][][2]int {
+	stride := m.width + 1
+	edges := make(map[int]uint8) // Directions leaving each corner, as bits
+	var corners []int            // Corners in scan order, so the output is stable
+	addEdge := func(x, y, dir int) {
+		key := y*stride + x
+		if edges[key] == 0 {
+			corners = append(corners, key)
+		}
+		edges[key] |= 1 << dir
+	}
+	for y := 0; y < m.height; y++ {
+		for x := 0; x < m.width; x++ {
+			if !m.at(x, y) {
+				continue
+			}
+			if !m.at(x, y-1) {
+				addEdge(x, y, 0)
+			}
+			if !m.at(x+1, y) {
+				addEdge(x+1, y, 1)
+			}
+			if !m.at(x, y+1) {
+				addEdge(x+1, y+1, 2)
+			}
+			if !m.at(x-1, y) {
+				addEdge(x, y+1, 3)
+			}
+		}
+	}
+
+	var rings [][][2]int
+	for _, start := range corners {
+		for edges[start] != 0 {
+			first := 0
+			for edges[start]&(1<<first) == 0 {
+				first++
+			}
+			edges[start] &^= 1 << first
+			var r [][2]int
+			key, dir := start, first
+			for {
+				x, y := key%stride, key/stride
+				key = (y+edgeSteps[dir][1])*stride + x + edgeSteps[dir][0]
+
+				// Turn right where there's a choice, hugging the pixel just passed
+				next := -1
+				for _, turn := range [3]int{1, 0, 3} {
+					d := (dir + turn) % 4
+					if key == start && d == first {
+						next = d
+						break
+					}
+					if edges[key]&(1<<d) != 0 {
+						next = d
+						break
+					}
+				}
+				if next != dir {
+					r = append(r, [2]int{key % stride, key / stride})
+				}
+				if key == start && next == first {
+					break
+				}
+				edges[key] &^= 1 << next
+				dir = next
+			}
+			rings = append(rings, r)
+		}
+	}
+	return rings
+}
+
+// ringParents finds the ring immediately enclosing each traced ring, or -1, from the regions of
+// the mask they separate. Each ring divides one flooded region, joined through pixel edges, from
+// one dry region, joined through edges and corners. A hole's parent is the outline of its
+// flooded region, and an outline's parent is the outermost hole around its dry region, unless
+// that region reaches the edge of the mask.
+func ringParents(m *floodMask, traced [][][2]int) []int {
+	labels, stride := labelRegions(m)
+	label := func(x, y int) int32 { return labels[(y+1)*stride+x+1] }
+	exterior := label(-1, -1)
+
+	// The pixels either side of each ring's first edge, which heads from a turn at r[0]
+	wet := make([]int32, len(traced))
+	dry := make([]int32, len(traced))
+	areas := make([]int, len(traced))
+	for i, r := range traced {
+		x, y := r[0][0], r[0][1]
+		switch {
+		case r[1][0] > x:
+			wet[i], dry[i] = label(x, y), label(x, y-1)
+		case r[1][1] > y:
+			wet[i], dry[i] = label(x-1, y), label(x, y)
+		case r[1][0] < x:
+			wet[i], dry[i] = label(x-1, y-1), label(x-1, y)
+		default:
+			wet[i], dry[i] = label(x, y-1), label(x-1, y-1)
+		}
+		for j := range r {
+			a, b := r[j], r[(j+1)%len(r)]
+			areas[i] += a[0]*b[1] - b[0]*a[1]
+		}
+	}
+
+	outlines := make(map[int32]int) // By flooded region
+	holes := make(map[int32]int)    // Outermost, by dry region
+	for i, area := range areas {
+		if area > 0 {
+			outlines[wet[i]] = i
+		} else if h, ok := holes[dry[i]]; !ok || area < areas[h] {
+			holes[dry[i]] = i
+		}
+	}
+
+	parents := make([]int, len(traced))
+	for i, area := range areas {
+		parents[i] = -1
+		if area < 0 {
+			if outline, ok := outlines[wet[i]]; ok {
+				parents[i] = outline
+			}
+		} else if dry[i] != exterior {
+			if hole, ok := holes[dry[i]]; ok {
+				parents[i] = hole
+			}
+		}
+	}
+	return parents
+}
+
+// labelRegions numbers the connected flooded and dry regions of a mask, padded by a dry border
+// so that everything reaching the edge is one region. It returns the labels, row by row, and the
+// padded width.
+func labelRegions(m *floodMask) ([]int32, int) {
+	stride, rows := m.width+2, m.height+2
+	labels := make([]int32, stride*rows)
+	var next int32
+	var stack []int
+	for start := range labels {
+		if labels[start] != 0 {
+			continue
+		}
+		next++
+		labels[start] = next
+		flooded := m.at(start%stride-1, start/stride-1)
+		stack = append(stack[:0], start)
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			x, y := i%stride, i/stride
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					// Flooding only spreads between pixels sharing an edge
+					if (dx == 0 && dy == 0) || (flooded && dx != 0 && dy != 0) {
+						continue
+					}
+					nx, ny := x+dx, y+dy
+					if nx < 0 || ny < 0 || nx >= stride || ny >= rows {
+						continue
+					}
+					j := ny*stride + nx
+					if labels[j] == 0 && m.at(nx-1, ny-1) == flooded {
+						labels[j] = next
+						stack = append(stack, j)
+					}
+				}
+			}
+		}
+	}
+	return labels, stride
+}
+
+// ringsToPolygons groups rings into polygons, each an outline followed by the holes inside it,
+// skipping rings that simplifying dropped
+func ringsToPolygons(rings []ring, parents []int) [][]ring {
+	var polygons [][]ring
+	index := make(map[int]int)
+	for i, r := range rings {
+		if r != nil && ringArea(r) > 0 {
+			index[i] = len(polygons)
+			polygons = append(polygons, []ring{r})
+		}
+	}
+	for i, r := range rings {
+		if r == nil || ringArea(r) > 0 {
+			continue
+		}
+		if p, ok := index[parents[i]]; ok {
+			polygons[p] = append(polygons[p], r)
+		}
+	}
+	return polygons
+}
+
+// loadFloodMask marks the pixels flooded at a sea level within a bbox, across the tiles
+// covering it at a zoom level
+func loadFloodMask(area bbox, z, level int, connected bool) (*floodMask, int, int, error) {
+	x0, y0, x1, y1 := area.tileRange(z)
+	m := &floodMask{width: (x1 - x0 + 1) * tileSize, height: (y1 - y0 + 1) * tileSize}
+	m.pixels = make([]bool, m.width*m.height)
+
+	// Only pixels whose centres are inside the bbox count
+	minX, minY := mercatorPixel(area.minLon, area.maxLat, z)
+	maxX, maxY := mercatorPixel(area.maxLon, area.minLat, z)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, 8)
+	for ty := y0; ty <= y1; ty++ {
+		for tx := x0; tx <= x1; tx++ {
+			tx, ty := tx, ty
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				var flooded *tileMask
+				var grid *elevationGrid
+				var err error
+				if connected {
+					flooded, err = connectedFlood(z, tx, ty, level)
+				} else if oceanMask.contains(z, tx, ty) {
+					grid = deepOceanGrid
+				} else if grid, err = loadElevation(z, tx, ty, nil); err == nil {
+					grid = smoothElevation(grid)
+				}
+				if err == errElevationMissing {
+					return
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+				for py := 0; py < tileSize; py++ {
+					gy := ty*tileSize + py
+					if float64(gy)+0.5 < minY || float64(gy)+0.5 > maxY {
+						continue
+					}
+					for px := 0; px < tileSize; px++ {
+						gx := tx*tileSize + px
+						if float64(gx)+0.5 < minX || float64(gx)+0.5 > maxX {
+							continue
+						}
+						i := py*tileSize + px
+						if (flooded != nil && flooded[i]) || (grid != nil && int(grid[i]) < level) {
+							m.pixels[(gy-y0*tileSize)*m.width+gx-x0*tileSize] = true
+						}
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	return m, x0 * tileSize, y0 * tileSize, firstErr
+}
+
+// serveFloodPolygons returns the area flooded at ?level= within ?bbox= as a GeoJSON
+// MultiPolygon, traced from the tiles at ?zoom= (by default the most detailed zoom that needs
+// at most maxFloodPolyTiles) and merged across their edges. ?simplify= is the most, in pixels,
+// that simplifying may move the outline, 1 by default and 0 for the exact pixel outline.
+// ?connected=1 only includes what the open ocean reaches.
+func serveFloodPolygons(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	area, err := parseBBox(query.Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	level, err := strconv.Atoi(query.Get("level"))
+	if err != nil {
+		http.Error(w, "Invalid sea level", http.StatusBadRequest)
+		return
+	}
+	level = clampSeaLevel(level)
+
+	zoom := upstreamMaxZoom
+	for zoom > 0 && area.tileCount(zoom, zoom) > maxFloodPolyTiles {
+		zoom--
+	}
+	if s := query.Get("zoom"); s != "" {
+		if zoom, err = strconv.Atoi(s); err != nil || zoom < 0 || zoom > upstreamMaxZoom {
+			http.Error(w, fmt.Sprintf("Invalid zoom level: must be 0 to %d", upstreamMaxZoom), http.StatusBadRequest)
+			return
+		}
+		if count := area.tileCount(zoom, zoom); count > maxFloodPolyTiles {
+			http.Error(w, fmt.Sprintf("Too many tiles (%d): at most %d per request", count, maxFloodPolyTiles), http.StatusBadRequest)
+			return
+		}
+	}
+	simplify := 1.0
+	if s := query.Get("simplify"); s != "" {
+		if simplify, err = strconv.ParseFloat(s, 64); err != nil || simplify < 0 || simplify > 100 {
+			http.Error(w, "Invalid simplify: must be 0 to 100 pixels", http.StatusBadRequest)
+			return
+		}
+	}
+	connected := query.Get("connected") == "1"
+	if connected && oceanSeeds == nil {
+		http.Error(w, "Connected flooding mode is not configured", http.StatusBadRequest)
+		return
+	}
+
+	renderPool.acquire(requestPriority(r))
+	mask, originX, originY, err := loadFloodMask(area, zoom, level, connected)
+	renderPool.release()
+	if err == errUpstreamUnavailable {
+		w.Header().Set("Retry-After", fmt.Sprint(int(breakerCooldown.Seconds())))
+		http.Error(w, "Elevation source unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch elevation", http.StatusBadGateway)
+		log.Printf("Error fetching elevation for %s: %v", r.URL.Path, err)
+		return
+	}
+
+	// Simplify in pixels, before projecting, so the outline moves by the same amount on screen
+	// everywhere
+	traced := traceMask(mask)
+	rings := make([]ring, len(traced))
+	for i, corners := range traced {
+		rings[i] = make(ring, len(corners))
+		for j, c := range corners {
+			rings[i][j] = point{float64(originX + c[0]), float64(originY + c[1])}
+		}
+	}
+	parents := ringParents(mask, traced)
+	rings = simplifyRings(rings, parents, simplify)
+
+	// Pixels to longitude and latitude, reversed so outlines become anticlockwise
+	worldSize := float64(tileSize) * math.Exp2(float64(zoom))
+	round := func(v float64) float64 {
+		return math.Round(v*1e6) / 1e6
+	}
+	coordinates := [][][][2]float64{}
+	for _, polygon := range ringsToPolygons(rings, parents) {
+		var p [][][2]float64
+		for _, r := range polygon {
+			c := make([][2]float64, len(r), len(r)+1)
+			for i, v := range r {
+				c[len(r)-1-i] = [2]float64{round(v.X/worldSize*360 - 180), round(tileLatitude(zoom, v.Y/tileSize))}
+			}
+			p = append(p, append(c, c[0]))
+		}
+		coordinates = append(coordinates, p)
+	}
+
+	metrics.incr("api_requests", "endpoint:floodpoly")
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type": "FeatureCollection",
+		"features": []interface{}{map[string]interface{}{
+			"type":       "Feature",
+			"properties": map[string]interface{}{"level": level, "zoom": zoom, "connected": connected},
+			"geometry":   map[string]interface{}{"type": "MultiPolygon", "coordinates": coordinates},
+		}},
+	})
+}
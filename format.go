@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// tileFormat is an output encoding that tiles can be served in
+type tileFormat struct {
+	name        string
+	contentType string
+	encode      func(img image.Image) ([]byte, error)
+}
+
+// formatPreference lists known formats from most to least compact for typical tiles, which are
+// mostly flat color and compress best losslessly
+var formatPreference = []string{"webp", "avif", "png"}
+
+// tileFormats holds the formats an encoder is available for; PNG and WebP are always present
+var tileFormats = map[string]*tileFormat{
+	"png":  {name: "png", contentType: "image/png", encode: encodePNG},
+	"webp": {name: "webp", contentType: "image/webp", encode: encodeWebP},
+}
+
+var pngFormat = tileFormats["png"]
+
+func encodePNG(img image.Image) ([]byte, error) {
+	// Tiles rarely have more than a handful of colors, and an indexed PNG of them is much smaller
+	if rgba, ok := img.(*image.RGBA); ok {
+		if paletted := toPaletted(rgba); paletted != nil {
+			img = paletted
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeWebP encodes losslessly, as tiles are mostly flat color with hard edges
+func encodeWebP(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := nativewebp.Encode(&buf, img, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// toPaletted converts an image with at most 256 colors to an indexed one, or returns nil if it
+// has more
+func toPaletted(img *image.RGBA) *image.Paletted {
+	bounds := img.Bounds()
+	paletted := image.NewPaletted(bounds, nil)
+	indices := make(map[[4]uint8]uint8)
+	var last [4]uint8
+	lastIndex := -1
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, y):]
+		out := paletted.Pix[paletted.PixOffset(bounds.Min.X, y):]
+		for x := 0; x < bounds.Dx(); x++ {
+			c := [4]uint8{row[x*4], row[x*4+1], row[x*4+2], row[x*4+3]}
+			if c != last || lastIndex < 0 {
+				i, ok := indices[c]
+				if !ok {
+					if len(paletted.Palette) == 256 {
+						return nil
+					}
+					i = uint8(len(paletted.Palette))
+					indices[c] = i
+					paletted.Palette = append(paletted.Palette, color.RGBA{c[0], c[1], c[2], c[3]})
+				}
+				last, lastIndex = c, int(i)
+			}
+			out[x] = uint8(lastIndex)
+		}
+	}
+	return paletted
+}
+
+// registerTileFormat makes an additional output format available for negotiation, for encoders
+// that don't build on every platform
+func registerTileFormat(f *tileFormat) {
+	tileFormats[f.name] = f
+}
+
+// negotiateFormat picks the output format from the format parameter or the Accept header. Asking
+// for a format the server can't produce gets PNG, which every client can display.
+func negotiateFormat(r *http.Request) *tileFormat {
+	if name := r.URL.Query().Get("format"); name != "" {
+		if f, ok := tileFormats[strings.ToLower(name)]; ok {
+			return f
+		}
+		return pngFormat
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return pngFormat
+	}
+
+	// Score each available format by the q-value the client gives it by name. Wildcards aren't
+	// enough: clients sending */* include tools and service workers that expect the PNG the URL
+	// says, so they get PNG.
+	type candidate struct {
+		format *tileFormat
+		q      float64
+		rank   int
+	}
+	var candidates []candidate
+	for rank, name := range formatPreference {
+		f, ok := tileFormats[name]
+		if !ok {
+			continue
+		}
+		q := acceptQuality(accept, f.contentType)
+		if q > 0 {
+			candidates = append(candidates, candidate{f, q, rank})
+		}
+	}
+	if len(candidates) == 0 {
+		// Clients that only ask for formats we can't produce still get something they can probably use
+		return pngFormat
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].q != candidates[j].q {
+			return candidates[i].q > candidates[j].q
+		}
+		return candidates[i].rank < candidates[j].rank
+	})
+	return candidates[0].format
+}
+
+// acceptQuality returns the q-value an Accept header gives a content type by name, or 0 if it
+// isn't listed or isn't acceptable
+func acceptQuality(accept, contentType string) float64 {
+	best := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if mediaType != contentType {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(s, 64); err == nil {
+				q = v
+			}
+		}
+		best = max(best, q)
+	}
+	return best
+}
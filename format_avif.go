@@ -0,0 +1,27 @@
+//go:build !freebsd && !openbsd
+
+package main
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/gen2brain/avif"
+)
+
+// The AVIF encoder runs libavif compiled to WebAssembly, but it also links purego to use a system
+// libavif when there is one, and purego doesn't build on FreeBSD or OpenBSD. Clients there are
+// negotiated down to WebP or PNG.
+func init() {
+	registerTileFormat(&tileFormat{name: "avif", contentType: "image/avif", encode: encodeAVIF})
+}
+
+// encodeAVIF encodes losslessly like WebP, as lossy AVIF smears the hard flood edge of mask
+// overlays
+func encodeAVIF(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := avif.Encode(&buf, img, avif.Options{Lossless: true, Speed: avif.DefaultSpeed}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
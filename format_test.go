@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptQuality(t *testing.T) {
+	tests := []struct {
+		accept, contentType string
+		want                float64
+	}{
+		{"image/webp", "image/webp", 1},
+		{"image/png, image/webp;q=0.5", "image/webp", 0.5},
+		{"image/webp;q=0", "image/webp", 0},
+		{"image/webp;q=0.2, image/webp;q=0.7", "image/webp", 0.7},
+		{"IMAGE/WEBP", "image/webp", 1},
+		{"*/*", "image/webp", 0},
+		{"image/*", "image/avif", 0},
+		{"image/*;q=0.8, */*", "image/png", 0},
+		{"text/html, image/png;q=0.9", "image/png", 0.9},
+		{"not a media type, image/png", "image/png", 1},
+		{"", "image/png", 0},
+	}
+	for _, test := range tests {
+		if got := acceptQuality(test.accept, test.contentType); got != test.want {
+			t.Errorf("acceptQuality(%q, %q) = %v, want %v", test.accept, test.contentType, got, test.want)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		query, accept string
+		want          string
+	}{
+		// Tools, WMTS clients and service workers send wildcards and expect the PNG the URL names
+		{"", "", "png"},
+		{"", "*/*", "png"},
+		{"", "image/*", "png"},
+		{"", "image/*,*/*;q=0.8", "png"},
+
+		// Browsers name the formats they support
+		{"", "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", "webp"},
+		{"", "image/webp,*/*", "webp"},
+		{"", "image/png,image/webp;q=0.5", "png"},
+		{"", "image/webp;q=0", "png"},
+		{"", "text/html", "png"},
+
+		// The format parameter wins over Accept
+		{"format=png", "image/webp", "png"},
+		{"format=WEBP", "*/*", "webp"},
+		{"format=jpeg", "image/webp", "png"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/tile/0/1/2/3.png?"+test.query, nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		if got := negotiateFormat(r).name; got != test.want {
+			t.Errorf("negotiateFormat(?%s, Accept: %q) = %s, want %s", test.query, test.accept, got, test.want)
+		}
+	}
+}
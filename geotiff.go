@@ -0,0 +1,823 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"container/list"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// geoTIFF reads elevations from a single-band GeoTIFF on demand, a strip or tile at a time, so
+// DEMs much larger than memory can be used. It handles the layouts GDAL writes by default:
+// striped or tiled, uncompressed, Deflate, LZW or PackBits, with integer or float samples, in
+// geographic coordinates or EPSG:3857. Other projections should be warped first, e.g. with
+// "gdalwarp -t_srs EPSG:4326".
+type geoTIFF struct {
+	path  string
+	f     io.ReaderAt // Opened on first use if nil
+	order binary.ByteOrder
+
+	// Reduced resolution copies of the image, from finest to coarsest, as GDAL writes with
+	// "gdaladdo" and in Cloud-Optimized GeoTIFFs
+	overviews []*geoTIFF
+
+	width, height   int
+	blockW, blockH  int
+	offsets         []uint64
+	counts          []uint64
+	compression     int
+	predictor       int
+	bitsPerSample   int
+	sampleFormat    int
+	samplesPerPixel int // Samples interleaved per pixel; only the first is used
+
+	// Georeferencing: the centre of pixel (col, row) is at (originX + col*scaleX, originY - row*scaleY)
+	mercator         bool // Coordinates are EPSG:3857 meters rather than degrees
+	originX, originY float64
+	scaleX, scaleY   float64
+
+	noData    float64
+	hasNoData bool
+
+	mu     sync.Mutex
+	blocks map[int]*list.Element
+	lru    *list.List
+}
+
+type geoTIFFBlock struct {
+	index int
+	data  []byte
+}
+
+// maxGeoTIFFBlocks is how many decoded strips or tiles each file keeps
+const maxGeoTIFFBlocks = 256
+
+// TIFF tags used here
+const (
+	tagNewSubfileType   = 254
+	tagImageWidth       = 256
+	tagImageLength      = 257
+	tagBitsPerSample    = 258
+	tagCompression      = 259
+	tagStripOffsets     = 273
+	tagSamplesPerPixel  = 277
+	tagRowsPerStrip     = 278
+	tagStripByteCounts  = 279
+	tagPredictor        = 317
+	tagTileWidth        = 322
+	tagTileLength       = 323
+	tagTileOffsets      = 324
+	tagTileByteCounts   = 325
+	tagSampleFormat     = 339
+	tagModelPixelScale  = 33550
+	tagModelTiepoint    = 33922
+	tagModelTransform   = 34264
+	tagGeoKeyDirectory  = 34735
+	tagGDALNoData       = 42113
+	geoKeyModelType     = 1024
+	geoKeyRasterType    = 1025
+	geoKeyProjectedType = 3072
+)
+
+// tiffEntry is one IFD entry with its value bytes
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	raw   []byte
+}
+
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// openGeoTIFF reads a GeoTIFF's header and georeferencing
+func openGeoTIFF(path string) (*geoTIFF, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	g, err := parseGeoTIFF(path, f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return g, nil
+}
+
+func parseGeoTIFF(path string, f io.ReaderAt) (*geoTIFF, error) {
+	g := &geoTIFF{path: path, f: f, blocks: make(map[int]*list.Element), lru: list.New()}
+
+	header := make([]byte, 8)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("not a TIFF file")
+	}
+	switch string(header[:2]) {
+	case "II":
+		g.order = binary.LittleEndian
+	case "MM":
+		g.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("not a TIFF file")
+	}
+	switch g.order.Uint16(header[2:]) {
+	case 42:
+	case 43:
+		return nil, fmt.Errorf("BigTIFF isn't supported; convert with gdal_translate -co BIGTIFF=NO")
+	default:
+		return nil, fmt.Errorf("not a TIFF file")
+	}
+
+	entries, next, err := g.readIFD(int64(g.order.Uint32(header[4:])))
+	if err != nil {
+		return nil, err
+	}
+	if err := g.readLayout(entries); err != nil {
+		return nil, err
+	}
+	if e, exists := entries[tagGDALNoData]; exists {
+		s := strings.TrimSpace(strings.TrimRight(string(e.raw), "\x00"))
+		if v, err := strconv.ParseFloat(s, 64); err == nil {
+			g.noData, g.hasNoData = v, true
+		}
+	}
+	if err := g.readGeoreferencing(entries); err != nil {
+		return nil, err
+	}
+
+	// Later directories may hold overviews, which cover the same area with fewer pixels
+	for i := 0; next != 0 && i < 32; i++ {
+		if entries, next, err = g.readIFD(next); err != nil {
+			break
+		}
+		if e, exists := entries[tagNewSubfileType]; !exists || len(g.uints(e)) == 0 || g.uints(e)[0] != 1 {
+			continue // Not a reduced resolution image, or a transparency mask
+		}
+		o := &geoTIFF{path: g.path, f: f, order: g.order, blocks: make(map[int]*list.Element), lru: list.New()}
+		if o.readLayout(entries) != nil || o.width >= g.width {
+			continue
+		}
+		o.mercator, o.noData, o.hasNoData = g.mercator, g.noData, g.hasNoData
+		o.scaleX = g.scaleX * float64(g.width) / float64(o.width)
+		o.scaleY = g.scaleY * float64(g.height) / float64(o.height)
+		o.originX = g.originX - g.scaleX/2 + o.scaleX/2
+		o.originY = g.originY + g.scaleY/2 - o.scaleY/2
+		g.overviews = append(g.overviews, o)
+	}
+	return g, nil
+}
+
+// readLayout reads the image size, sample format and strip or tile layout from a directory
+func (g *geoTIFF) readLayout(entries map[uint16]tiffEntry) error {
+	num := func(tag uint16, def int) int {
+		if e, exists := entries[tag]; exists {
+			if v := g.uints(e); len(v) > 0 {
+				return int(v[0])
+			}
+		}
+		return def
+	}
+
+	g.width = num(tagImageWidth, 0)
+	g.height = num(tagImageLength, 0)
+	g.bitsPerSample = num(tagBitsPerSample, 1)
+	g.compression = num(tagCompression, 1)
+	g.predictor = num(tagPredictor, 1)
+	g.sampleFormat = num(tagSampleFormat, 1)
+	g.samplesPerPixel = num(tagSamplesPerPixel, 1)
+	if g.width == 0 || g.height == 0 {
+		return fmt.Errorf("missing image size")
+	}
+	switch g.bitsPerSample {
+	case 8, 16, 32, 64:
+	default:
+		return fmt.Errorf("unsupported %d-bit samples", g.bitsPerSample)
+	}
+	if g.sampleFormat == 3 && g.bitsPerSample < 32 {
+		return fmt.Errorf("unsupported %d-bit floats", g.bitsPerSample)
+	}
+	switch g.compression {
+	case 1, 5, 8, 32773, 32946:
+	default:
+		return fmt.Errorf("unsupported compression %d: use none, Deflate, LZW or PackBits", g.compression)
+	}
+
+	if _, tiled := entries[tagTileOffsets]; tiled {
+		g.blockW = num(tagTileWidth, 0)
+		g.blockH = num(tagTileLength, 0)
+		g.offsets = g.uints(entries[tagTileOffsets])
+		g.counts = g.uints(entries[tagTileByteCounts])
+	} else {
+		g.blockW = g.width
+		g.blockH = min(num(tagRowsPerStrip, g.height), g.height)
+		g.offsets = g.uints(entries[tagStripOffsets])
+		g.counts = g.uints(entries[tagStripByteCounts])
+	}
+	blocks := ((g.width + g.blockW - 1) / max(g.blockW, 1)) * ((g.height + g.blockH - 1) / max(g.blockH, 1))
+	if g.blockW == 0 || g.blockH == 0 || len(g.offsets) < blocks || len(g.counts) < blocks {
+		return fmt.Errorf("missing strip or tile layout")
+	}
+
+	return nil
+}
+
+// readIFD reads the entries of an image file directory, and the offset of the next one
+func (g *geoTIFF) readIFD(offset int64) (map[uint16]tiffEntry, int64, error) {
+	countBuf := make([]byte, 2)
+	if _, err := g.f.ReadAt(countBuf, offset); err != nil {
+		return nil, 0, fmt.Errorf("truncated directory")
+	}
+	n := int(g.order.Uint16(countBuf))
+	buf := make([]byte, n*12+4)
+	if _, err := g.f.ReadAt(buf, offset+2); err != nil {
+		return nil, 0, fmt.Errorf("truncated directory")
+	}
+	next := int64(g.order.Uint32(buf[n*12:]))
+
+	entries := make(map[uint16]tiffEntry, n)
+	for i := 0; i < n; i++ {
+		b := buf[i*12 : i*12+12]
+		e := tiffEntry{typ: g.order.Uint16(b[2:]), count: g.order.Uint32(b[4:])}
+		size, known := tiffTypeSizes[e.typ]
+		if !known {
+			continue
+		}
+		length := size * int(e.count)
+		if length <= 4 {
+			e.raw = append([]byte(nil), b[8:8+length]...)
+		} else {
+			e.raw = make([]byte, length)
+			if _, err := g.f.ReadAt(e.raw, int64(g.order.Uint32(b[8:]))); err != nil {
+				return nil, 0, fmt.Errorf("truncated tag %d", g.order.Uint16(b))
+			}
+		}
+		entries[g.order.Uint16(b)] = e
+	}
+	return entries, next, nil
+}
+
+// uints reads an integer-valued entry
+func (g *geoTIFF) uints(e tiffEntry) []uint64 {
+	values := make([]uint64, e.count)
+	for i := range values {
+		switch e.typ {
+		case 1, 6, 7:
+			values[i] = uint64(e.raw[i])
+		case 3, 8:
+			values[i] = uint64(g.order.Uint16(e.raw[i*2:]))
+		case 4, 9:
+			values[i] = uint64(g.order.Uint32(e.raw[i*4:]))
+		default:
+			return nil
+		}
+	}
+	return values
+}
+
+// floats reads a double-valued entry
+func (g *geoTIFF) floats(e tiffEntry) []float64 {
+	if e.typ != 12 {
+		return nil
+	}
+	values := make([]float64, e.count)
+	for i := range values {
+		values[i] = math.Float64frombits(g.order.Uint64(e.raw[i*8:]))
+	}
+	return values
+}
+
+// readGeoreferencing works out where pixels are from the GeoTIFF tags
+func (g *geoTIFF) readGeoreferencing(entries map[uint16]tiffEntry) error {
+	keys := map[int]int{}
+	if e, exists := entries[tagGeoKeyDirectory]; exists {
+		dir := g.uints(e)
+		for i := 4; i+3 < len(dir); i += 4 {
+			if dir[i+1] == 0 {
+				keys[int(dir[i])] = int(dir[i+3])
+			}
+		}
+	}
+	switch keys[geoKeyModelType] {
+	case 2:
+	case 1:
+		if code := keys[geoKeyProjectedType]; code != 3857 && code != 900913 {
+			return fmt.Errorf("projection EPSG:%d isn't supported; warp to EPSG:4326 or EPSG:3857", code)
+		}
+		g.mercator = true
+	default:
+		return fmt.Errorf("missing or unsupported coordinate system; warp to EPSG:4326 or EPSG:3857")
+	}
+
+	var col, row float64
+	if transform := g.floats(entries[tagModelTransform]); len(transform) == 16 {
+		if transform[1] != 0 || transform[4] != 0 {
+			return fmt.Errorf("rotated rasters aren't supported")
+		}
+		g.scaleX, g.scaleY = transform[0], -transform[5]
+		g.originX, g.originY = transform[3], transform[7]
+	} else {
+		tiepoint := g.floats(entries[tagModelTiepoint])
+		scale := g.floats(entries[tagModelPixelScale])
+		if len(tiepoint) < 6 || len(scale) < 2 {
+			return fmt.Errorf("missing georeferencing")
+		}
+		col, row = tiepoint[0], tiepoint[1]
+		g.scaleX, g.scaleY = scale[0], scale[1]
+		g.originX, g.originY = tiepoint[3], tiepoint[4]
+	}
+	if g.scaleX <= 0 || g.scaleY <= 0 {
+		return fmt.Errorf("unsupported pixel scale")
+	}
+
+	// Shift the origin to the centre of pixel (0, 0); by default coordinates refer to pixel corners
+	g.originX -= col * g.scaleX
+	g.originY += row * g.scaleY
+	if keys[geoKeyRasterType] != 2 {
+		g.originX += g.scaleX / 2
+		g.originY -= g.scaleY / 2
+	}
+	return nil
+}
+
+// bounds returns the area covered, in the file's coordinates
+func (g *geoTIFF) bounds() (minX, minY, maxX, maxY float64) {
+	return g.originX - g.scaleX/2, g.originY - float64(g.height)*g.scaleY + g.scaleY/2,
+		g.originX + float64(g.width)*g.scaleX - g.scaleX/2, g.originY + g.scaleY/2
+}
+
+// file returns the open file, opening it on first use
+func (g *geoTIFF) file() (io.ReaderAt, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.f == nil {
+		f, err := os.Open(g.path)
+		if err != nil {
+			return nil, err
+		}
+		g.f = f
+	}
+	return g.f, nil
+}
+
+// block returns a decoded strip or tile
+func (g *geoTIFF) block(index int) ([]byte, error) {
+	g.mu.Lock()
+	if elem, exists := g.blocks[index]; exists {
+		g.lru.MoveToFront(elem)
+		g.mu.Unlock()
+		return elem.Value.(*geoTIFFBlock).data, nil
+	}
+	g.mu.Unlock()
+
+	f, err := g.file()
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, g.counts[index])
+	if _, err := f.ReadAt(raw, int64(g.offsets[index])); err != nil && err != io.EOF {
+		return nil, err
+	}
+	data, err := g.decompress(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: block %d: %v", g.path, index, err)
+	}
+	g.unpredict(data)
+
+	g.mu.Lock()
+	g.blocks[index] = g.lru.PushFront(&geoTIFFBlock{index: index, data: data})
+	for g.lru.Len() > maxGeoTIFFBlocks {
+		oldest := g.lru.Back()
+		g.lru.Remove(oldest)
+		delete(g.blocks, oldest.Value.(*geoTIFFBlock).index)
+	}
+	g.mu.Unlock()
+	return data, nil
+}
+
+func (g *geoTIFF) decompress(raw []byte) ([]byte, error) {
+	switch g.compression {
+	case 8, 32946:
+		r, err := zlib.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case 5:
+		return decodeTIFFLZW(raw)
+	case 32773:
+		return decodePackBits(raw)
+	}
+	return raw, nil
+}
+
+// unpredict undoes horizontal differencing, applied row by row before compression
+func (g *geoTIFF) unpredict(data []byte) {
+	size := g.bitsPerSample / 8
+	rowLen := g.blockW * g.samplesPerPixel * size
+	for start := 0; start+rowLen <= len(data); start += rowLen {
+		row := data[start : start+rowLen]
+		switch g.predictor {
+		case 2:
+			n := g.samplesPerPixel
+			for i := n; i < len(row)/size; i++ {
+				switch size {
+				case 1:
+					row[i] += row[i-n]
+				case 2:
+					g.order.PutUint16(row[i*2:], g.order.Uint16(row[i*2:])+g.order.Uint16(row[(i-n)*2:]))
+				case 4:
+					g.order.PutUint32(row[i*4:], g.order.Uint32(row[i*4:])+g.order.Uint32(row[(i-n)*4:]))
+				case 8:
+					g.order.PutUint64(row[i*8:], g.order.Uint64(row[i*8:])+g.order.Uint64(row[(i-n)*8:]))
+				}
+			}
+		case 3:
+			// Floating point: bytes are differenced, having been split into planes from most
+			// to least significant
+			n := g.samplesPerPixel
+			for i := n; i < len(row); i++ {
+				row[i] += row[i-n]
+			}
+			planes := append([]byte(nil), row...)
+			samples := len(row) / size
+			value := make([]byte, size)
+			for i := 0; i < samples; i++ {
+				for b := 0; b < size; b++ {
+					value[b] = planes[b*samples+i]
+				}
+				if g.order == binary.LittleEndian {
+					for b := 0; b < size; b++ {
+						row[i*size+b] = value[size-1-b]
+					}
+				} else {
+					copy(row[i*size:], value)
+				}
+			}
+		}
+	}
+}
+
+// pixel returns the value at a pixel, or false if it is outside the image or has no data
+func (g *geoTIFF) pixel(col, row int) (float64, bool) {
+	if col < 0 || row < 0 || col >= g.width || row >= g.height {
+		return 0, false
+	}
+	across := (g.width + g.blockW - 1) / g.blockW
+	data, err := g.block((row/g.blockH)*across + col/g.blockW)
+	if err != nil {
+		reportError("geotiff", err, nil)
+		return 0, false
+	}
+	size := g.bitsPerSample / 8
+	i := ((row%g.blockH)*g.blockW + col%g.blockW) * g.samplesPerPixel * size
+	if i+size > len(data) {
+		return 0, false
+	}
+
+	var v float64
+	b := data[i:]
+	switch {
+	case g.sampleFormat == 3 && size == 4:
+		v = float64(math.Float32frombits(g.order.Uint32(b)))
+	case g.sampleFormat == 3:
+		v = math.Float64frombits(g.order.Uint64(b))
+	case g.sampleFormat == 2 && size == 1:
+		v = float64(int8(b[0]))
+	case g.sampleFormat == 2 && size == 2:
+		v = float64(int16(g.order.Uint16(b)))
+	case g.sampleFormat == 2 && size == 4:
+		v = float64(int32(g.order.Uint32(b)))
+	case g.sampleFormat == 2:
+		v = float64(int64(g.order.Uint64(b)))
+	case size == 1:
+		v = float64(b[0])
+	case size == 2:
+		v = float64(g.order.Uint16(b))
+	case size == 4:
+		v = float64(g.order.Uint32(b))
+	default:
+		v = float64(g.order.Uint64(b))
+	}
+	if (g.hasNoData && v == g.noData) || math.IsNaN(v) {
+		return 0, false
+	}
+	return v, true
+}
+
+// level returns the coarsest overview with pixels no bigger than resolution, in the file's
+// units, or the full image if none are
+func (g *geoTIFF) level(resolution float64) *geoTIFF {
+	best := g
+	for _, o := range g.overviews {
+		if o.scaleX > resolution {
+			break
+		}
+		best = o
+	}
+	return best
+}
+
+// prefetch reads the blocks covering an area in parallel, so a remote file needs only one round
+// of requests per tile, and failures are reported rather than leaving holes
+func (g *geoTIFF) prefetch(minX, minY, maxX, maxY float64) error {
+	c0 := max(0, int(math.Floor((minX-g.originX)/g.scaleX)))
+	c1 := min(g.width-1, int(math.Ceil((maxX-g.originX)/g.scaleX))+1)
+	r0 := max(0, int(math.Floor((g.originY-maxY)/g.scaleY)))
+	r1 := min(g.height-1, int(math.Ceil((g.originY-minY)/g.scaleY))+1)
+	if c0 > c1 || r0 > r1 {
+		return nil
+	}
+	across := (g.width + g.blockW - 1) / g.blockW
+	var indexes []int
+	for br := r0 / g.blockH; br <= r1/g.blockH; br++ {
+		for bc := c0 / g.blockW; bc <= c1/g.blockW; bc++ {
+			indexes = append(indexes, br*across+bc)
+		}
+	}
+	// More than the cache holds are left to be read as they're sampled
+	if len(indexes) > maxGeoTIFFBlocks/2 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(indexes))
+	slots := make(chan struct{}, 8)
+	for _, index := range indexes {
+		index := index
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			if _, err := g.block(index); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// sample interpolates the elevation at a point in the file's coordinates
+func (g *geoTIFF) sample(x, y float64) (float64, bool) {
+	cx := (x - g.originX) / g.scaleX
+	cy := (g.originY - y) / g.scaleY
+	c0, r0 := int(math.Floor(cx)), int(math.Floor(cy))
+	fx, fy := cx-float64(c0), cy-float64(r0)
+
+	// Bilinear where all four neighbours have data, otherwise the nearest pixel
+	v00, ok00 := g.pixel(c0, r0)
+	v10, ok10 := g.pixel(c0+1, r0)
+	v01, ok01 := g.pixel(c0, r0+1)
+	v11, ok11 := g.pixel(c0+1, r0+1)
+	if ok00 && ok10 && ok01 && ok11 {
+		return (v00*(1-fx)+v10*fx)*(1-fy) + (v01*(1-fx)+v11*fx)*fy, true
+	}
+	return g.pixel(int(math.Round(cx)), int(math.Round(cy)))
+}
+
+// decodeTIFFLZW decompresses TIFF's variant of LZW, whose code width grows one code earlier
+// than GIF's
+func decodeTIFFLZW(src []byte) ([]byte, error) {
+	const clearCode, eoiCode = 256, 257
+	var out []byte
+	table := make([][]byte, 4096)
+	for i := 0; i < 256; i++ {
+		table[i] = []byte{byte(i)}
+	}
+	next, width := 258, 9
+	var prev []byte
+	var bitBuf uint32
+	bits := 0
+	pos := 0
+	for {
+		for bits < width {
+			if pos >= len(src) {
+				return out, nil
+			}
+			bitBuf = bitBuf<<8 | uint32(src[pos])
+			pos++
+			bits += 8
+		}
+		code := int(bitBuf>>(bits-width)) & (1<<width - 1)
+		bits -= width
+
+		switch {
+		case code == eoiCode:
+			return out, nil
+		case code == clearCode:
+			next, width, prev = 258, 9, nil
+			continue
+		}
+
+		var entry []byte
+		switch {
+		case code < next && table[code] != nil:
+			entry = table[code]
+		case code == next && prev != nil:
+			entry = append(append([]byte(nil), prev...), prev[0])
+		default:
+			return nil, errors.New("invalid LZW code")
+		}
+		out = append(out, entry...)
+		if prev != nil && next < len(table) {
+			table[next] = append(append([]byte(nil), prev...), entry[0])
+			next++
+		}
+		prev = entry
+		switch next + 1 {
+		case 512:
+			width = 10
+		case 1024:
+			width = 11
+		case 2048:
+			width = 12
+		}
+	}
+}
+
+// decodePackBits decompresses PackBits run-length encoding
+func decodePackBits(src []byte) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(src); {
+		n := int(int8(src[i]))
+		i++
+		switch {
+		case n >= 0:
+			if i+n+1 > len(src) {
+				return nil, errors.New("truncated PackBits data")
+			}
+			out = append(out, src[i:i+n+1]...)
+			i += n + 1
+		case n != -128:
+			if i >= len(src) {
+				return nil, errors.New("truncated PackBits data")
+			}
+			out = append(out, bytes.Repeat(src[i:i+1], 1-n)...)
+			i++
+		}
+	}
+	return out, nil
+}
+
+// geoTIFFSource renders elevation tiles from GeoTIFFs, local or remote, resampled to Web
+// Mercator on the fly, for offline use or with higher resolution national DEMs. Where files
+// overlap, the first listed wins.
+type geoTIFFSource struct {
+	kind  string
+	spec  string
+	files []*geoTIFF
+}
+
+// newGeoTIFFSource opens a GeoTIFF, a VRT mosaic of GeoTIFFs, or a comma-separated list of
+// either (with glob patterns allowed)
+func newGeoTIFFSource(spec string) (*geoTIFFSource, error) {
+	s := &geoTIFFSource{kind: "geotiff", spec: spec}
+	for _, pattern := range strings.Split(spec, ",") {
+		paths, err := filepath.Glob(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no files match %s", pattern)
+		}
+		for _, path := range paths {
+			if err := s.add(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// add opens a GeoTIFF, or each file in a VRT
+func (s *geoTIFFSource) add(path string) error {
+	if strings.EqualFold(filepath.Ext(path), ".vrt") {
+		sources, err := vrtSources(path)
+		if err != nil {
+			return err
+		}
+		for _, source := range sources {
+			if err := s.add(source); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	g, err := openGeoTIFF(path)
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, g)
+	return nil
+}
+
+// vrtSources lists the files making up the first band of a GDAL VRT mosaic
+func vrtSources(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	type source struct {
+		Filename struct {
+			Relative int    `xml:"relativeToVRT,attr"`
+			Path     string `xml:",chardata"`
+		} `xml:"SourceFilename"`
+	}
+	var vrt struct {
+		Bands []struct {
+			Simple  []source `xml:"SimpleSource"`
+			Complex []source `xml:"ComplexSource"`
+		} `xml:"VRTRasterBand"`
+	}
+	if err := xml.Unmarshal(data, &vrt); err != nil {
+		return nil, fmt.Errorf("invalid VRT %s: %v", path, err)
+	}
+	if len(vrt.Bands) == 0 {
+		return nil, fmt.Errorf("VRT %s has no bands", path)
+	}
+	var paths []string
+	for _, src := range append(vrt.Bands[0].Simple, vrt.Bands[0].Complex...) {
+		p := strings.TrimSpace(src.Filename.Path)
+		if src.Filename.Relative == 1 {
+			p = filepath.Join(filepath.Dir(path), p)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+func (s *geoTIFFSource) name() string {
+	return s.kind
+}
+
+func (s *geoTIFFSource) describe() string {
+	return s.spec
+}
+
+// webMercatorRadius is the sphere radius EPSG:3857 uses
+const webMercatorRadius = 6378137.0
+
+// tile samples every pixel centre of a tile from the first file covering it
+func (s *geoTIFFSource) tile(z, x, y int, timing *serverTiming) (*elevationGrid, error) {
+	n := float64(int(tileSize) << z)
+	lonAt := func(px float64) float64 { return px/n*360 - 180 }
+	latAt := func(py float64) float64 { return tileLatitude(z, py/tileSize) }
+	mercX := func(px float64) float64 { return (px/n - 0.5) * 2 * math.Pi * webMercatorRadius }
+	mercY := func(py float64) float64 { return (0.5 - py/n) * 2 * math.Pi * webMercatorRadius }
+
+	// Only consider files overlapping the tile, at the overview closest to the tile's resolution
+	left, top := float64(x*tileSize), float64(y*tileSize)
+	right, bottom := left+tileSize, top+tileSize
+	var files []*geoTIFF
+	for _, g := range s.files {
+		minX, minY, maxX, maxY := g.bounds()
+		tileMinX, tileMinY, tileMaxX, tileMaxY := lonAt(left), latAt(bottom), lonAt(right), latAt(top)
+		resolution := 360 / n
+		if g.mercator {
+			tileMinX, tileMinY, tileMaxX, tileMaxY = mercX(left), mercY(bottom), mercX(right), mercY(top)
+			resolution = 2 * math.Pi * webMercatorRadius / n
+		}
+		if minX < tileMaxX && maxX > tileMinX && minY < tileMaxY && maxY > tileMinY {
+			level := g.level(resolution)
+			if err := level.prefetch(tileMinX, tileMinY, tileMaxX, tileMaxY); err != nil {
+				return nil, err
+			}
+			files = append(files, level)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errElevationMissing
+	}
+
+	grid := new(elevationGrid)
+	for py := 0; py < tileSize; py++ {
+		gy := top + float64(py) + 0.5
+		lat, my := latAt(gy), mercY(gy)
+		for px := 0; px < tileSize; px++ {
+			gx := left + float64(px) + 0.5
+			elevation := float64(noElevation)
+			for _, g := range files {
+				sx, sy := lonAt(gx), lat
+				if g.mercator {
+					sx, sy = mercX(gx), my
+				}
+				if v, ok := g.sample(sx, sy); ok {
+					elevation = math.Round(v)
+					break
+				}
+			}
+			grid[py*tileSize+px] = int16(max(math.MinInt16, min(math.MaxInt16, elevation)))
+		}
+	}
+	return grid, nil
+}
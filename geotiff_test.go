@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/tiff/lzw"
+)
+
+// encodeTIFFLZW compresses data with TIFF's LZW, MSB first with the code width growing one
+// code early, for testing the decoder
+func encodeTIFFLZW(data []byte) []byte {
+	const clearCode, eoiCode = 256, 257
+	var out []byte
+	var bitBuf uint64
+	bits := 0
+	write := func(code, width int) {
+		bitBuf = bitBuf<<width | uint64(code)
+		bits += width
+		for bits >= 8 {
+			out = append(out, byte(bitBuf>>(bits-8)))
+			bits -= 8
+		}
+	}
+
+	table := map[string]int{}
+	next, width := 258, 9
+	write(clearCode, width)
+	var prefix []byte
+	for _, b := range data {
+		candidate := append(append([]byte(nil), prefix...), b)
+		if _, ok := table[string(candidate)]; ok || len(prefix) == 0 {
+			prefix = candidate
+			continue
+		}
+		code := int(prefix[0])
+		if len(prefix) > 1 {
+			code = table[string(prefix)]
+		}
+		write(code, width)
+		table[string(candidate)] = next
+		next++
+
+		// The decoder adds each entry a code later, so it widens when the encoder is one past
+		switch next {
+		case 512:
+			width = 10
+		case 1024:
+			width = 11
+		case 2048:
+			width = 12
+		}
+		if next == 4094 {
+			write(clearCode, width)
+			table, next, width = map[string]int{}, 258, 9
+		}
+		prefix = []byte{b}
+	}
+	if len(prefix) > 0 {
+		code := int(prefix[0])
+		if len(prefix) > 1 {
+			code = table[string(prefix)]
+		}
+		write(code, width)
+		if next+1 == 512 || next+1 == 1024 || next+1 == 2048 {
+			width++
+		}
+	}
+	write(eoiCode, width)
+	if bits > 0 {
+		out = append(out, byte(bitBuf<<(8-bits)))
+	}
+	return out
+}
+
+func TestDecodeTIFFLZW(t *testing.T) {
+	random := make([]byte, 20000)
+	rand.New(rand.NewSource(1)).Read(random)
+	elevations := make([]byte, 0, 40000)
+	for i := 0; i < 20000; i++ {
+		elevations = binary.LittleEndian.AppendUint16(elevations, uint16(100+i%37+i/500))
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":      {},
+		"one byte":   {42},
+		"repeats":    bytes.Repeat([]byte("ABABABA"), 200),
+		"kwkwk":      []byte("TOBEORNOTTOBEORTOBEORNOT#kwkwkwkwk"),
+		"random":     random,
+		"elevations": elevations,
+	} {
+		compressed := encodeTIFFLZW(data)
+
+		// Check the test encoder against an independent decoder first
+		reference, err := io.ReadAll(lzw.NewReader(bytes.NewReader(compressed), lzw.MSB, 8))
+		if err != nil || !bytes.Equal(reference, data) {
+			t.Fatalf("%s: test encoder doesn't round trip through x/image/tiff/lzw: %v", name, err)
+		}
+
+		got, err := decodeTIFFLZW(compressed)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: decoded %d bytes that differ from the %d encoded", name, len(got), len(data))
+		}
+	}
+}
+
+func TestDecodeTIFFLZWInvalid(t *testing.T) {
+	// A clear code then code 300, which isn't in the table yet
+	if _, err := decodeTIFFLZW([]byte{0x80, 0x4b, 0x00}); err == nil {
+		t.Error("expected an error for a code beyond the table")
+	}
+}
+
+func TestDecodePackBits(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     []byte
+		want    []byte
+		wantErr bool
+	}{
+		// The example from Apple's PackBits technical note
+		{
+			name: "technical note",
+			src:  []byte{0xFE, 0xAA, 0x02, 0x80, 0x00, 0x2A, 0xFD, 0xAA, 0x03, 0x80, 0x00, 0x2A, 0x22, 0xF7, 0xAA},
+			want: []byte{0xAA, 0xAA, 0xAA, 0x80, 0x00, 0x2A, 0xAA, 0xAA, 0xAA, 0xAA, 0x80, 0x00, 0x2A, 0x22,
+				0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA},
+		},
+		{name: "no-op header skipped", src: []byte{0x80, 0x00, 0x07}, want: []byte{0x07}},
+		{name: "longest run", src: []byte{0x81, 0x05}, want: bytes.Repeat([]byte{0x05}, 128)},
+		{name: "empty", src: nil, want: nil},
+		{name: "truncated literal", src: []byte{0x03, 0x01, 0x02}, wantErr: true},
+		{name: "truncated run", src: []byte{0xFE}, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := decodePackBits(test.src)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %x, %v, want %x", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestUnpredictHorizontal(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		// Two rows of three 16-bit samples, each differenced from the one before in its row
+		values := []uint16{100, 105, 95, 2000, 1990, 2010}
+		data := make([]byte, 12)
+		for row := 0; row < 2; row++ {
+			prev := uint16(0)
+			for col := 0; col < 3; col++ {
+				v := values[row*3+col]
+				order.PutUint16(data[(row*3+col)*2:], v-prev)
+				prev = v
+			}
+		}
+
+		g := &geoTIFF{order: order, predictor: 2, bitsPerSample: 16, samplesPerPixel: 1, blockW: 3}
+		g.unpredict(data)
+		for i, want := range values {
+			if got := order.Uint16(data[i*2:]); got != want {
+				t.Errorf("%v sample %d = %d, want %d", order, i, got, want)
+			}
+		}
+	}
+}
+
+func TestUnpredictFloatingPoint(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		// One row of four float32 samples, split into byte planes from most to least
+		// significant and then byte differenced, as predictor 3 is written
+		values := []float32{12.5, -3.25, 1000, 0.001}
+		planes := make([]byte, 16)
+		for i, v := range values {
+			bits := math.Float32bits(v)
+			for b := 0; b < 4; b++ {
+				planes[b*4+i] = byte(bits >> (24 - 8*b))
+			}
+		}
+		data := make([]byte, 16)
+		for i := len(planes) - 1; i > 0; i-- {
+			data[i] = planes[i] - planes[i-1]
+		}
+		data[0] = planes[0]
+
+		g := &geoTIFF{order: order, predictor: 3, bitsPerSample: 32, samplesPerPixel: 1, blockW: 4}
+		g.unpredict(data)
+		for i, want := range values {
+			if got := math.Float32frombits(order.Uint32(data[i*4:])); got != want {
+				t.Errorf("%v sample %d = %v, want %v", order, i, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ipList is a set of networks; single addresses are treated as /32 or /128 networks
+type ipList []*net.IPNet
+
+// parseIPList parses a comma-separated list of CIDRs or addresses
+func parseIPList(s string) (ipList, error) {
+	var list ipList
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", part)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			part = fmt.Sprintf("%s/%d", part, bits)
+		}
+		_, network, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", part)
+		}
+		list = append(list, network)
+	}
+	return list, nil
+}
+
+func (l ipList) contains(ip net.IP) bool {
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipRules blocks addresses on the deny list, and anything not on the allow list if there is one
+type ipRules struct {
+	allow ipList
+	deny  ipList
+}
+
+func (r ipRules) permits(ip net.IP) bool {
+	if ip == nil {
+		return len(r.allow) == 0 && len(r.deny) == 0
+	}
+	if r.deny.contains(ip) {
+		return false
+	}
+	return len(r.allow) == 0 || r.allow.contains(ip)
+}
+
+var (
+	// ipRulesAll applies to every request and ipRulesAdmin additionally to the admin API
+	ipRulesAll   ipRules
+	ipRulesAdmin ipRules
+
+	// trustedProxies may set X-Forwarded-For on behalf of clients
+	trustedProxies ipList
+)
+
+// loadIPRules reads the allow and deny lists for a scope from NAME_ALLOW and NAME_DENY
+func loadIPRules(prefix string) (ipRules, error) {
+	var rules ipRules
+	var err error
+	if rules.allow, err = parseIPList(envString(prefix+"_ALLOW", "")); err != nil {
+		return rules, fmt.Errorf("%s_ALLOW: %v", prefix, err)
+	}
+	if rules.deny, err = parseIPList(envString(prefix+"_DENY", "")); err != nil {
+		return rules, fmt.Errorf("%s_DENY: %v", prefix, err)
+	}
+	return rules, nil
+}
+
+// isAdminPath reports whether a request path belongs to the admin API
+func isAdminPath(path string) bool {
+	prefix := appURL("/admin")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// ipFilter rejects requests from addresses the allow and deny lists don't permit
+func ipFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(clientIP(r))
+		scope := ""
+		if !ipRulesAll.permits(ip) {
+			scope = "all"
+		} else if isAdminPath(r.URL.Path) && !ipRulesAdmin.permits(ip) {
+			scope = "admin"
+		}
+		if scope != "" {
+			metrics.incr("ip_blocked", "scope:"+scope)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxLayerZoom is the highest zoom the layers derived from elevation are served for
+const maxLayerZoom = 22
+
+// parseLayerTile reads the tile coordinates of a derived layer request, responding with an
+// error if they're out of range
+func parseLayerTile(w http.ResponseWriter, r *http.Request) (z, x, y int, ok bool) {
+	vars := mux.Vars(r)
+	z, _ = strconv.Atoi(vars["z"])
+	x, _ = strconv.Atoi(vars["x"])
+	y, _ = strconv.Atoi(vars["y"])
+	if z > maxLayerZoom || x >= 1<<z || y >= 1<<z {
+		http.Error(w, "Invalid tile coordinates", http.StatusBadRequest)
+		return 0, 0, 0, false
+	}
+	return z, x, y, true
+}
+
+// loadLayerElevation loads the smoothed elevation a derived layer is drawn from in a render
+// slot, responding with an error if it can't
+func loadLayerElevation(w http.ResponseWriter, r *http.Request, z, x, y int) (*elevationGrid, bool) {
+	renderPool.acquire(requestPriority(r))
+	grid, err := loadElevation(z, x, y, nil)
+	renderPool.release()
+	if err == errElevationMissing {
+		http.Error(w, "No elevation data for this tile", http.StatusNotFound)
+		return nil, false
+	}
+	if err == errUpstreamUnavailable {
+		w.Header().Set("Retry-After", fmt.Sprint(int(breakerCooldown.Seconds())))
+		http.Error(w, "Elevation source unavailable", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch elevation", http.StatusBadGateway)
+		log.Printf("Error fetching elevation for %s: %v", r.URL.Path, err)
+		return nil, false
+	}
+	return smoothElevation(grid), true
+}
+
+// writeLayerTile encodes and sends a derived layer tile
+func writeLayerTile(w http.ResponseWriter, layer string, img *image.RGBA) {
+	start := time.Now()
+	data, err := encodePNG(img)
+	if err != nil {
+		http.Error(w, "Failed to encode tile", http.StatusInternalServerError)
+		log.Printf("Error encoding %s tile: %v", layer, err)
+		return
+	}
+	metrics.timing("layer_encode", time.Since(start), "layer:"+layer)
+	metrics.incr("layer_tiles", "layer:"+layer)
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(data)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// legendEntry is one row of a legend: a color swatch and what it means
+type legendEntry struct {
+	Label string     `json:"label"`
+	Color color.RGBA `json:"-"`
+	Hex   string     `json:"color"`
+}
+
+// legendResponse is the JSON form of a legend
+type legendResponse struct {
+	Style   string        `json:"style"`
+	Level   int           `json:"level"`
+	Entries []legendEntry `json:"entries"`
+}
+
+func newLegendEntry(label string, c color.RGBA) legendEntry {
+	return legendEntry{Label: label, Color: c, Hex: fmt.Sprintf("#%02x%02x%02x%02x", c.R, c.G, c.B, c.A)}
+}
+
+// legendWater is the water color a tile request's color or palette parameter picks
+func legendWater(r *http.Request) (color.RGBA, error) {
+	if c := r.URL.Query().Get("color"); c != "" {
+		return parseHexColor(c)
+	}
+	if name := r.URL.Query().Get("palette"); name != "" {
+		p, err := lookupPalette(name)
+		if err != nil {
+			return color.RGBA{}, err
+		}
+		return p.fill, nil
+	}
+	return waterColor, nil
+}
+
+// legendFor builds the legend for a style at a sea level, using the same query parameters as tiles
+func legendFor(style string, level int, r *http.Request) ([]legendEntry, error) {
+	switch style {
+	case "flat":
+		water, err := legendWater(r)
+		if err != nil {
+			return nil, err
+		}
+		entries := []legendEntry{
+			newLegendEntry(fmt.Sprintf("Below %+d m", level), water),
+		}
+		if r.URL.Query().Get("dryland") == "1" {
+			entries = append(entries, newLegendEntry("Dry land today", dryLandColor))
+		}
+		if r.URL.Query().Get("erosion") == "1" {
+			entries = append(entries, newLegendEntry("Estimated erosion", erosionColor))
+		}
+		return entries, nil
+
+	case "depth":
+		ramp := depthRamp
+		if s := r.URL.Query().Get("ramp"); s != "" {
+			var err error
+			if ramp, err = parseDepthRamp(s); err != nil {
+				return nil, err
+			}
+		} else if name := r.URL.Query().Get("palette"); name != "" {
+			p, err := lookupPalette(name)
+			if err != nil {
+				return nil, err
+			}
+			if len(p.depth) > 0 {
+				ramp = p.depth
+			}
+		}
+		var entries []legendEntry
+		for _, stop := range ramp {
+			entries = append(entries, newLegendEntry(fmt.Sprintf("%d m deep", stop.depth), stop.color))
+		}
+		return entries, nil
+
+	case "stacked":
+		list := strconv.Itoa(level)
+		if extra := r.URL.Query().Get("levels"); extra != "" {
+			list += "," + extra
+		}
+		levels, err := parseLevelList(list)
+		if err != nil {
+			return nil, err
+		}
+		water, err := legendWater(r)
+		if err != nil {
+			return nil, err
+		}
+		var entries []legendEntry
+		for i, c := range stackedColors(len(levels), water) {
+			entries = append(entries, newLegendEntry(fmt.Sprintf("Floods at %+d m", levels[i]), c))
+		}
+		return entries, nil
+
+	case "bands":
+		bands, err := parseBands(r.URL.Query().Get("bands"))
+		if err != nil {
+			return nil, err
+		}
+		var entries []legendEntry
+		for _, b := range bands {
+			entries = append(entries, newLegendEntry(fmt.Sprintf("Below %+d m", level+b.threshold), b.color))
+		}
+		return entries, nil
+	}
+	return nil, fmt.Errorf("Unknown style: %s", style)
+}
+
+// serveLegend serves a legend as JSON or as a PNG image
+func serveLegend(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	level, err := strconv.Atoi(vars["level"])
+	if err != nil {
+		http.Error(w, "Invalid sea level", http.StatusBadRequest)
+		return
+	}
+	level = clampSeaLevel(level)
+
+	entries, err := legendFor(vars["style"], level, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if vars["ext"] == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(legendResponse{Style: vars["style"], Level: level, Entries: entries})
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, drawLegend(entries)); err != nil {
+		reportError("render", err, map[string]string{"endpoint": "legend"})
+		http.Error(w, "Failed to render legend", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+// drawLegend draws legend entries as swatches with labels on a white card
+func drawLegend(entries []legendEntry) *image.RGBA {
+	const (
+		scale  = 2
+		pad    = 8
+		swatch = 16
+		gap    = 6
+	)
+	labelWidth := 0
+	for _, e := range entries {
+		labelWidth = max(labelWidth, textWidth(e.Label, scale))
+	}
+	width := pad*2 + swatch + gap + labelWidth
+	height := pad*2 + len(entries)*swatch + (len(entries)-1)*gap
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{255, 255, 255, 230}), image.Point{}, draw.Src)
+
+	for i, e := range entries {
+		y := pad + i*(swatch+gap)
+		fillRect(img, image.Rect(pad, y, pad+swatch, y+swatch), color.RGBA{136, 136, 136, 255})
+		fillRect(img, image.Rect(pad+1, y+1, pad+swatch-1, y+swatch-1), e.Color)
+		drawText(img, pad+swatch+gap, y+(swatch-textHeight(scale))/2, e.Label, scale, color.RGBA{34, 34, 34, 255})
+	}
+	return img
+}
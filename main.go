@@ -1,40 +1,26 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"image"
-	"image/png"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	"sync"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
-// Cache structure for storing generated tiles
-type TileCache struct {
-	mu       sync.RWMutex
-	tiles    map[string]CachedTile
-	inFlight map[string]chan []byte // Track in-flight requests
-	flightMu sync.Mutex
-}
-
-type CachedTile struct {
-	data      []byte
-	timestamp time.Time
-}
-
-var cache = &TileCache{
-	tiles:    make(map[string]CachedTile),
-	inFlight: make(map[string]chan []byte),
-}
+var cache = newTileCache("tiles")
 
 const (
-	tileSize = 256
+	tileSize  = 256
+	userAgent = "SeaLevelMap/1.0 (https://github.com/jes/sea-level-map)"
 )
 
 // clampSeaLevel ensures the sea level is within valid bounds and rounded to 10m increments
@@ -52,19 +38,38 @@ func clampSeaLevel(level int) int {
 	return level
 }
 
+// tileCacheKey creates a cache key that includes sea level and rendering options
+func tileCacheKey(seaLevel int, z, x, y string, opts tileOptions) string {
+	return fmt.Sprintf("%d/%s/%s/%s%s", seaLevel, z, x, y, opts.key())
+}
+
 // generateSeaLevelTile fetches elevation data and creates a blue tile for areas above sea level
-func generateSeaLevelTile(seaLevel int, z, x, y string) ([]byte, error) {
-	// Create cache key that includes sea level
-	cacheKey := fmt.Sprintf("%d/%s/%s/%s", seaLevel, z, x, y)
-
-	// Check cache first
-	cache.mu.RLock()
-	if cached, exists := cache.tiles[cacheKey]; exists {
-		cache.mu.RUnlock()
+func generateSeaLevelTile(seaLevel int, z, x, y string, opts tileOptions) ([]byte, error) {
+	cacheKey := tileCacheKey(seaLevel, z, x, y, opts)
+
+	zi, _ := strconv.Atoi(z)
+	xi, _ := strconv.Atoi(x)
+	yi, _ := strconv.Atoi(y)
+
+	// Check cache first, treating tiles older than the policy's TTL as missing unless they can
+	// be served stale while a fresh copy renders in the background
+	ttl := cachePolicy.ttl(seaLevel, zi)
+	lookupStart := time.Now()
+	if cached, stale, exists := cache.getStale(cacheKey); exists && !opts.refresh {
+		opts.timing.since("cache", lookupStart)
+		if stale {
+			metrics.incr("cache_lookups", "result:stale")
+			opts.timing.setCache("STALE")
+			refresher.refresh(cacheKey, seaLevel, z, x, y, opts)
+		} else {
+			metrics.incr("cache_lookups", "result:hit")
+			opts.timing.setCache("HIT")
+		}
 		log.Printf("Cache hit for tile: level=%d, z=%s, x=%s, y=%s", seaLevel, z, x, y)
 		return cached.data, nil
 	}
-	cache.mu.RUnlock()
+	opts.timing.since("cache", lookupStart)
+	metrics.incr("cache_lookups", "result:miss")
 
 	// Check if another goroutine is already processing this tile
 	cache.flightMu.Lock()
@@ -72,8 +77,17 @@ func generateSeaLevelTile(seaLevel int, z, x, y string) ([]byte, error) {
 		// Another request is in flight, wait for it
 		cache.flightMu.Unlock()
 		log.Printf("Waiting for in-flight tile: level=%d, z=%s, x=%s, y=%s", seaLevel, z, x, y)
-		data := <-ch
-		return data, nil
+		waitStart := time.Now()
+		<-ch
+		opts.timing.since("wait", waitStart)
+		opts.timing.setCache("WAIT")
+
+		// The channel is only closed, so every waiter picks the result up from the cache
+		cached, exists := cache.get(cacheKey)
+		if !exists {
+			return nil, fmt.Errorf("in-flight tile generation failed")
+		}
+		return cached.data, nil
 	}
 
 	// Mark this request as in-flight
@@ -88,144 +102,206 @@ func generateSeaLevelTile(seaLevel int, z, x, y string) ([]byte, error) {
 		cache.flightMu.Unlock()
 	}()
 
-	// Fetch elevation data from terrarium tiles
-	elevationURL := fmt.Sprintf("https://s3.amazonaws.com/elevation-tiles-prod/terrarium/%s/%s/%s.png", z, x, y)
-
-	log.Printf("Fetching upstream tile: level=%d, z=%s, x=%s, y=%s", seaLevel, z, x, y)
-	fetchStart := time.Now()
+	// In a peer group, the tile's owner renders it and this node keeps a copy
+	if peers != nil && !opts.peer && !opts.refresh {
+		peerStart := time.Now()
+		data, fromPeer, err := peers.fetch(seaLevel, z, x, y, opts)
+		opts.timing.since("peer", peerStart)
+		if fromPeer && err == nil {
+			now := time.Now()
+			cache.put(cacheKey, CachedTile{data: data, timestamp: now, expires: expiresAfter(now, ttl)})
+			close(ch)
+			metrics.incr("peer_fetches", "result:ok")
+			opts.timing.setCache("PEER")
+			return data, nil
+		}
+		if err != nil {
+			metrics.incr("peer_fetches", "result:error")
+			log.Printf("Rendering locally instead: %v", err)
+		}
+	}
 
-	// Create HTTP request with user-agent
-	req, err := http.NewRequest("GET", elevationURL, nil)
-	if err != nil {
-		close(ch) // Signal waiting goroutines that we failed
-		return nil, fmt.Errorf("failed to create request: %v", err)
+	// Tiles rendered before a restart may be in the persistent store
+	storePath := tileStorePath(seaLevel, z, x, y, opts)
+	if persistentStore != nil && !opts.refresh {
+		storeStart := time.Now()
+		stored, exists := loadStoredTile(storePath, ttl)
+		opts.timing.since("store", storeStart)
+		if exists {
+			cache.put(cacheKey, stored)
+			close(ch)
+			opts.timing.setCache("STORE")
+			log.Printf("Loaded tile from %s store: level=%d, z=%s, x=%s, y=%s", persistentStore.name(), seaLevel, z, x, y)
+			return stored.data, nil
+		}
+	}
+	if mbtiles != nil && !opts.refresh {
+		storeStart := time.Now()
+		stored, exists := mbtiles.get(seaLevel, zi, xi, yi, opts, ttl)
+		opts.timing.since("store", storeStart)
+		if exists {
+			cache.put(cacheKey, stored)
+			close(ch)
+			opts.timing.setCache("STORE")
+			log.Printf("Loaded tile from MBTiles: level=%d, z=%s, x=%s, y=%s", seaLevel, z, x, y)
+			return stored.data, nil
+		}
 	}
 
-	// Set user-agent header
-	req.Header.Set("User-Agent", "SeaLevelMap/1.0 (https://github.com/jes/sea-level-map)")
+	// Wait for a free slot in the render pool
+	queueStart := time.Now()
+	renderPool.acquire(opts.priority)
+	defer renderPool.release()
+	opts.timing.since("queue", queueStart)
 
-	// Execute the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	// Fetch elevation data, unless the tile is known to be deep ocean
+	fetchStart := time.Now()
+	grid, err := loadTileGrid(zi, xi, yi, opts.bedrock, opts.timing)
 	if err != nil {
 		close(ch) // Signal waiting goroutines that we failed
-		return nil, fmt.Errorf("failed to fetch elevation tile: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		close(ch) // Signal waiting goroutines that we failed
-		return nil, fmt.Errorf("elevation tile request failed with status: %d", resp.StatusCode)
+		if err != errElevationMissing && err != errUpstreamUnavailable {
+			reportError("upstream", err, tileTags(seaLevel, z, x, y))
+		}
+		return nil, err
 	}
+	if grid != deepOceanGrid {
+		// Move the level 0 shoreline onto the mapped coast
+		if opts.coastline {
+			sea, err := oceanPolygons.load(zi, xi, yi)
+			if err != nil {
+				reportError("upstream", err, tileTags(seaLevel, z, x, y))
+			} else {
+				grid = correctCoastline(grid, sea)
+			}
+		}
 
-	// Decode the elevation PNG
-	elevationImg, err := png.Decode(resp.Body)
-	if err != nil {
-		close(ch) // Signal waiting goroutines that we failed
-		return nil, fmt.Errorf("failed to decode elevation PNG: %v", err)
+		// Keep basins the open ocean can't reach dry
+		if opts.connected {
+			flooded, err := connectedFlood(zi, xi, yi, seaLevel)
+			if err != nil {
+				close(ch) // Signal waiting goroutines that we failed
+				if err != errUpstreamUnavailable {
+					reportError("upstream", err, tileTags(seaLevel, z, x, y))
+				}
+				return nil, err
+			}
+			grid = drainBasins(grid, flooded, seaLevel)
+		}
 	}
 	fetchDuration := time.Since(fetchStart)
-	log.Printf("Upstream fetch completed in %v: level=%d, z=%s, x=%s, y=%s", fetchDuration, seaLevel, z, x, y)
 
 	// Start processing timer
 	processStart := time.Now()
 
-	// Convert to RGBA if it's not already
-	var rgbaImg *image.RGBA
-	if rgba, ok := elevationImg.(*image.RGBA); ok {
-		rgbaImg = rgba
-	} else {
-		bounds := elevationImg.Bounds()
-		rgbaImg = image.NewRGBA(bounds)
-		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-			for x := bounds.Min.X; x < bounds.Max.X; x++ {
-				rgbaImg.Set(x, y, elevationImg.At(x, y))
-			}
+	// Let the raised sea back up river channels if requested
+	var backwater *tileMask
+	if opts.rivers && grid != deepOceanGrid {
+		rivers, err := riverSource.load(zi, xi, yi)
+		if err != nil {
+			reportError("upstream", err, tileTags(seaLevel, z, x, y))
+		} else {
+			backwater = riverBackwater(grid, rivers, seaLevel, zi, yi)
 		}
 	}
 
-	// Create output image
-	outputImg := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
-
-	// Process image in parallel using goroutines
-	numWorkers := 8 // Adjust based on your CPU cores
-	rowsPerWorker := tileSize / numWorkers
-	var wg sync.WaitGroup
-
-	for worker := 0; worker < numWorkers; worker++ {
-		wg.Add(1)
-		go func(startRow, endRow int) {
-			defer wg.Done()
-
-			// Blue color for areas below sea level (underwater)
-			blue := [4]uint8{0, 50, 120, 255}
-			transparent := [4]uint8{0, 0, 0, 0}
-
-			for y := startRow; y < endRow && y < tileSize; y++ {
-				for x := 0; x < tileSize; x++ {
-					// Calculate pixel offset in the byte array
-					srcOffset := (y*rgbaImg.Stride + x*4)
-					dstOffset := (y*outputImg.Stride + x*4)
-
-					// Get RGB values directly from byte array
-					if srcOffset+2 < len(rgbaImg.Pix) {
-						rVal := rgbaImg.Pix[srcOffset]
-						gVal := rgbaImg.Pix[srcOffset+1]
-						bVal := rgbaImg.Pix[srcOffset+2]
-
-						// Decode terrarium format: elevation = (R * 256 + G + B / 256) - 32768
-						elevation := int(rVal)*256 + int(gVal) + int(bVal)/256 - 32768
-
-						// If elevation is below the specified sea level, make it blue, otherwise transparent
-						var color [4]uint8
-						if elevation < seaLevel {
-							color = blue
-						} else {
-							color = transparent
-						}
-
-						// Set pixel directly in byte array
-						if dstOffset+3 < len(outputImg.Pix) {
-							outputImg.Pix[dstOffset] = color[0]   // R
-							outputImg.Pix[dstOffset+1] = color[1] // G
-							outputImg.Pix[dstOffset+2] = color[2] // B
-							outputImg.Pix[dstOffset+3] = color[3] // A
-						}
+	var outputImg *image.RGBA
+	if opts.diff {
+		c := diffColor
+		if opts.water != waterColor {
+			c = opts.water
+		}
+		outputImg = renderDiff(grid, opts.diffFrom, seaLevel, c)
+	} else if opts.outline {
+		c := opts.water
+		if opts.edge.A > 0 {
+			c = opts.edge
+		}
+		outputImg = renderOutline(grid, seaLevel, c)
+	} else if len(opts.levels) > 0 {
+		outputImg = renderStacked(grid, opts.levels, opts.water)
+	} else if len(opts.bands) > 0 {
+		outputImg = renderBands(grid, seaLevel, opts.bands)
+	} else {
+		if len(opts.depth) > 0 {
+			outputImg = renderDepth(grid, seaLevel, backwater, opts.depth)
+		} else {
+			outputImg = renderFlood(grid, seaLevel, backwater, opts.water)
+		}
+		if (opts.dryLand || opts.inland) && grid != deepOceanGrid {
+			water, err := waterMask.load(zi, xi, yi)
+			if err != nil {
+				reportError("upstream", err, tileTags(seaLevel, z, x, y))
+			} else {
+				if opts.dryLand {
+					paintDryLand(outputImg, grid, seaLevel, water, dryLandColor)
+				}
+				if opts.inland {
+					// Shaded as shallow water when shading by depth
+					c := opts.water
+					if len(opts.depth) > 0 {
+						c = opts.depth[0].color
 					}
+					paintInlandWater(outputImg, grid, seaLevel, water, c)
 				}
 			}
-		}(worker*rowsPerWorker, (worker+1)*rowsPerWorker)
+		}
+		if opts.edge.A > 0 {
+			strokeShoreline(outputImg, grid, seaLevel, 1, opts.edge)
+		}
+		if opts.erosion && grid != deepOceanGrid {
+			paintMask(outputImg, bruunErosion(grid, seaLevel, zi, yi), erosionColor)
+		}
+	}
+	if opts.pattern != "" {
+		applyPattern(outputImg, opts.pattern, xi, yi)
+	}
+	applyOpacity(outputImg, opts.opacity)
+	if opts.watermark {
+		stampWatermark(outputImg, 2)
 	}
 
-	// Wait for all workers to complete
-	wg.Wait()
+	opts.timing.since("render", processStart)
 
-	// Encode to PNG bytes
-	var buf bytes.Buffer
-	err = png.Encode(&buf, outputImg)
+	// Encode in the requested format
+	encodeStart := time.Now()
+	tileData, err := opts.format.encode(outputImg)
+	opts.timing.since("encode", encodeStart)
 	if err != nil {
 		close(ch) // Signal waiting goroutines that we failed
-		return nil, fmt.Errorf("failed to encode output PNG: %v", err)
+		err = fmt.Errorf("failed to encode output %s: %v", opts.format.name, err)
+		reportError("render", err, tileTags(seaLevel, z, x, y))
+		return nil, err
 	}
 
-	tileData := buf.Bytes()
 	processDuration := time.Since(processStart)
+	metrics.timing("render", processDuration)
 	totalDuration := time.Since(fetchStart)
 
 	log.Printf("Image processing completed in %v: level=%d, z=%s, x=%s, y=%s", processDuration, seaLevel, z, x, y)
 	log.Printf("Total tile generation: %v (fetch: %v, process: %v): level=%d, z=%s, x=%s, y=%s",
 		totalDuration, fetchDuration, processDuration, seaLevel, z, x, y)
 
-	// Cache the result
-	cache.mu.Lock()
-	cache.tiles[cacheKey] = CachedTile{
+	// Cache the result, and pass it on to any standbys
+	now := time.Now()
+	tile := CachedTile{
 		data:      tileData,
-		timestamp: time.Now(),
+		timestamp: now,
+		expires:   expiresAfter(now, ttl),
+	}
+	if persistentStore != nil {
+		if cache.spill != nil {
+			tile.spillPath = storePath
+		} else {
+			saveStoredTile(storePath, tileData)
+		}
+	}
+	if mbtiles != nil {
+		mbtiles.put(seaLevel, zi, xi, yi, opts, tileData)
 	}
-	cache.mu.Unlock()
+	cache.put(cacheKey, tile)
+	replication.publish(cacheKey, tile)
 
 	// Notify waiting goroutines
-	ch <- tileData
 	close(ch)
 
 	log.Printf("Generated and cached tile: level=%d, z=%s, x=%s, y=%s", seaLevel, z, x, y)
@@ -234,11 +310,48 @@ func generateSeaLevelTile(seaLevel int, z, x, y string) ([]byte, error) {
 
 // serveIndex serves the index.html file
 func serveIndex(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "index.html")
+	indexAsset.ServeHTTP(w, r)
 }
 
+var indexAsset = &staticAsset{path: "index.html", contentType: "text/html; charset=utf-8"}
+
 // serveTile serves a sea level tile
 func serveTile(w http.ResponseWriter, r *http.Request) {
+	handleTileRequest(w, r, false)
+}
+
+// serveBandTile serves a tile of several sea levels given as a list in the path, each band of
+// land flooded by the next level shaded paler
+func serveBandTile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	first, rest, _ := strings.Cut(vars["levels"], ",")
+	vars["level"] = first
+	q := r.URL.Query()
+	q.Set("levels", rest)
+	r.URL.RawQuery = q.Encode()
+	handleTileRequest(w, mux.SetURLVars(r, vars), false)
+}
+
+// serveTMSTile serves a tile addressed with TMS rows, which count up from the south
+func serveTMSTile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	z, _ := strconv.Atoi(vars["z"])
+	y, _ := strconv.Atoi(vars["y"])
+	if z > 30 || y >= 1<<z {
+		http.Error(w, "Invalid tile coordinates", http.StatusBadRequest)
+		return
+	}
+	vars["y"] = strconv.Itoa(1<<z - 1 - y)
+	handleTileRequest(w, mux.SetURLVars(r, vars), false)
+}
+
+// serveDiffTile serves a tile of the land flooded between the sea levels from and level
+func serveDiffTile(w http.ResponseWriter, r *http.Request) {
+	handleTileRequest(w, r, false)
+}
+
+// handleTileRequest serves a tile, as immutable if its URL is tied to the tile version
+func handleTileRequest(w http.ResponseWriter, r *http.Request, immutable bool) {
 	vars := mux.Vars(r)
 	levelStr := vars["level"]
 	z := vars["z"]
@@ -255,7 +368,8 @@ func serveTile(w http.ResponseWriter, r *http.Request) {
 	// Clamp sea level to valid range and 10m increments
 	level = clampSeaLevel(level)
 
-	if _, err := strconv.Atoi(z); err != nil {
+	zoom, err := strconv.Atoi(z)
+	if err != nil {
 		http.Error(w, "Invalid zoom level", http.StatusBadRequest)
 		return
 	}
@@ -268,37 +382,665 @@ func serveTile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Pick the output format the client prefers
+	opts := defaultTileOptions()
+	opts.format = negotiateFormat(r)
+	opts.priority = requestPriority(r)
+	opts.timing = &serverTiming{}
+	requestStart := time.Now()
+
+	if r.URL.Query().Get("rivers") == "1" {
+		if riverSource == nil {
+			http.Error(w, "River backwater mode is not configured", http.StatusBadRequest)
+			return
+		}
+		opts.rivers = true
+	}
+
+	// Only flood what the open ocean can reach
+	if r.URL.Query().Get("connected") == "1" {
+		if oceanSeeds == nil {
+			http.Error(w, "Connected flooding mode is not configured", http.StatusBadRequest)
+			return
+		}
+		opts.connected = true
+	}
+
+	// Land below the sea level that's dry today, told apart from the water
+	if r.URL.Query().Get("dryland") == "1" {
+		if waterMask == nil {
+			http.Error(w, "Dry land mode is not configured", http.StatusBadRequest)
+			return
+		}
+		opts.dryLand = true
+	}
+
+	// Lakes and rivers today stay water even above the sea level
+	if r.URL.Query().Get("inland") == "1" {
+		if waterMask == nil {
+			http.Error(w, "Inland water mode is not configured", http.StatusBadRequest)
+			return
+		}
+		opts.inland = true
+	}
+
+	// Today's coast from mapped ocean polygons, with elevation only for the change from it
+	if r.URL.Query().Get("coastline") == "1" {
+		if oceanPolygons == nil {
+			http.Error(w, "Coastline correction is not configured", http.StatusBadRequest)
+			return
+		}
+		opts.coastline = true
+	}
+
+	// What if the ice sheets melted, showing the land under them
+	if r.URL.Query().Get("bedrock") == "1" {
+		if bedrockSource == nil {
+			http.Error(w, "Bedrock mode is not configured", http.StatusBadRequest)
+			return
+		}
+		if opts.connected {
+			http.Error(w, "Bedrock mode can't be combined with connected flooding", http.StatusBadRequest)
+			return
+		}
+		opts.bedrock = true
+	}
+
+	// Experimental shoreline retreat estimate
+	opts.erosion = r.URL.Query().Get("erosion") == "1"
+
+	// Just the shoreline, for overlaying on imagery
+	switch style := r.URL.Query().Get("style"); style {
+	case "", "fill":
+	case "outline":
+		if opts.rivers || opts.erosion || opts.dryLand || opts.inland {
+			http.Error(w, "River backwater, erosion, dry land and inland water modes can't be combined with the outline style", http.StatusBadRequest)
+			return
+		}
+		opts.outline = true
+	default:
+		http.Error(w, fmt.Sprintf("Unknown style: %s", style), http.StatusBadRequest)
+		return
+	}
+
+	// Only the band flooded since another level, for diff tiles
+	if from, ok := vars["from"]; ok {
+		if opts.rivers || opts.erosion || opts.outline || opts.connected || opts.dryLand || opts.inland {
+			http.Error(w, "River backwater, erosion, connected, dry land and inland water modes and the outline style can't be combined with diff tiles", http.StatusBadRequest)
+			return
+		}
+		opts.diffFrom, err = strconv.Atoi(from)
+		if err != nil {
+			http.Error(w, "Invalid sea level", http.StatusBadRequest)
+			return
+		}
+		opts.diffFrom, opts.diff = clampSeaLevel(opts.diffFrom), true
+	}
+
+	// Several levels at once, including the one in the path
+	if levels := r.URL.Query().Get("levels"); levels != "" {
+		if opts.rivers || opts.erosion || opts.diff || opts.outline || opts.connected || opts.dryLand || opts.inland {
+			http.Error(w, "River backwater, erosion, diff, outline, connected, dry land and inland water modes can't be combined with several levels", http.StatusBadRequest)
+			return
+		}
+		opts.levels, err = parseLevelList(levelStr + "," + levels)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Custom colors by height above the sea level
+	if bands := r.URL.Query().Get("bands"); bands != "" {
+		if opts.rivers || opts.erosion || opts.diff || opts.outline || opts.connected || opts.dryLand || opts.inland || len(opts.levels) > 0 {
+			http.Error(w, "Bands can't be combined with river backwater, erosion, diff, outline, connected, dry land or inland water modes or several levels", http.StatusBadRequest)
+			return
+		}
+		opts.bands, err = parseBands(bands)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Water color to suit the basemap underneath
+	if c := r.URL.Query().Get("color"); c != "" {
+		if len(opts.bands) > 0 {
+			http.Error(w, "Color can't be combined with bands", http.StatusBadRequest)
+			return
+		}
+		opts.water, err = parseHexColor(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Shade by depth, with DEPTH_RAMP or a ramp of the request's own
+	if ramp := r.URL.Query().Get("ramp"); ramp != "" || r.URL.Query().Get("depth") == "1" {
+		if opts.diff || opts.outline || len(opts.levels) > 0 || len(opts.bands) > 0 || opts.water != waterColor {
+			http.Error(w, "Depth shading can't be combined with diff tiles, outlines, several levels, bands or a color", http.StatusBadRequest)
+			return
+		}
+		opts.depth = depthRamp
+		if ramp != "" {
+			if opts.depth, err = parseDepthRamp(ramp); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	// A named style, from the built-in palettes or PALETTES_FILE
+	if name := r.URL.Query().Get("palette"); name != "" {
+		if len(opts.bands) > 0 || len(opts.depth) > 0 || opts.water != waterColor {
+			http.Error(w, "A palette can't be combined with bands, depth shading or a color", http.StatusBadRequest)
+			return
+		}
+		p, err := lookupPalette(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Diff tiles keep their contrasting color
+		if !opts.diff {
+			opts.water, opts.edge = p.fill, p.edge
+		}
+		if !opts.diff && !opts.outline && len(opts.levels) == 0 {
+			opts.depth = p.depth
+		}
+	}
+
+	// Hatched or dotted water, readable in grayscale print
+	if pattern := r.URL.Query().Get("pattern"); pattern != "" {
+		if err := checkFillPattern(pattern); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.pattern = pattern
+	}
+
+	// Semi-transparent water lets the basemap show through
+	if opacity := r.URL.Query().Get("opacity"); opacity != "" {
+		if opts.opacity, err = parseOpacity(opacity); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Diagnostics stamped on the tile; debug tiles are always PNG so they can be drawn on
+	debug := r.URL.Query().Get("debug") == "1"
+	if debug {
+		opts.format = pngFormat
+	}
+
 	// Generate sea level tile
-	tileData, err := generateSeaLevelTile(level, z, x, y)
+	tileData, placeholder, err := generateWithDeadline(level, z, x, y, opts)
+	if err == errElevationMissing {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(elevationMissTTL.Seconds())))
+		http.Error(w, "No elevation data for this tile", http.StatusNotFound)
+		return
+	}
+	if err == errUpstreamUnavailable {
+		w.Header().Set("Retry-After", fmt.Sprint(int(breakerCooldown.Seconds())))
+		http.Error(w, "Elevation source unavailable", http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to generate tile", http.StatusInternalServerError)
 		log.Printf("Error generating tile: %v", err)
 		return
 	}
 
+	// Stamp diagnostics on a copy of the tile, which is never cached
+	if debug {
+		opts.timing.since("total", requestStart)
+		data, err := debugTile(tileData, level, zoom, x, y, placeholder, opts.timing)
+		if err != nil {
+			http.Error(w, "Failed to draw debug tile", http.StatusInternalServerError)
+			log.Printf("Error drawing debug tile: %v", err)
+			return
+		}
+		w.Header().Set("Server-Timing", opts.timing.header())
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(data)
+		return
+	}
+
 	// Set appropriate headers
-	w.Header().Set("Content-Type", "image/png")
-	w.Header().Set("Cache-Control", "public, max-age=3600") // Cache for 1 hour
-	w.Header().Set("Access-Control-Allow-Origin", "*")      // Allow CORS
+	opts.timing.since("total", requestStart)
+	w.Header().Set("Server-Timing", opts.timing.header())
+	w.Header().Set("Timing-Allow-Origin", "*")
+	w.Header().Set("Vary", "Accept")
+	if placeholder {
+		w.Header().Set("Content-Type", "image/png")
+		// Make sure the client asks again soon, by which time the real tile should be cached
+		w.Header().Set("Cache-Control", "public, max-age=5")
+		w.Header().Set("X-Tile-Placeholder", "1")
+		log.Printf("Render deadline exceeded, serving placeholder: level=%d, z=%s, x=%s, y=%s", level, z, x, y)
+	} else if immutable {
+		w.Header().Set("Content-Type", opts.format.contentType)
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Content-Type", opts.format.contentType)
+		cacheControl := fmt.Sprintf("public, max-age=%d", int(cachePolicy.maxAge(level, zoom).Seconds()))
+		if cache.staleFor > 0 {
+			cacheControl += fmt.Sprintf(", stale-while-revalidate=%d", int(cache.staleFor.Seconds()))
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*") // Allow CORS
 
 	// Write the tile data
 	w.Write(tileData)
+	metrics.incr("tiles_served")
 
 	log.Printf("Served tile: level=%d, z=%s, x=%s, y=%s", level, z, x, y)
 }
 
 func main() {
+	// Diagnose the deployment instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(runDoctor())
+	}
+
 	// Check if index.html exists
 	if _, err := os.Stat("index.html"); os.IsNotExist(err) {
 		log.Fatal("index.html file not found in current directory")
 	}
 
-	// Create router
+	// Send errors to Sentry if configured
+	if dsn := os.Getenv("SENTRY_DSN"); dsn != "" {
+		sentry, err := newSentryReporter(dsn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reporter = sentry
+		log.Printf("Reporting errors to Sentry")
+	}
+
+	// Keep an audit trail of admin operations if configured
+	if path := os.Getenv("AUDIT_LOG"); path != "" {
+		var err error
+		audit, err = openAuditLog(path)
+		if err != nil {
+			log.Fatal("Failed to open audit log:", err)
+		}
+		log.Printf("Writing audit log to %s", path)
+	}
+
+	setupStatsd()
+
+	// Admin API keys, in addition to any in the store
+	adminAPIKeys = parseAPIKeys(os.Getenv("ADMIN_API_KEYS"))
+
+	// Restrict who may use the server, and the admin API in particular
+	var err error
+	if ipRulesAll, err = loadIPRules("IP"); err != nil {
+		log.Fatal("Invalid IP rules: ", err)
+	}
+	if ipRulesAdmin, err = loadIPRules("ADMIN_IP"); err != nil {
+		log.Fatal("Invalid IP rules: ", err)
+	}
+	if trustedProxies, err = parseIPList(os.Getenv("TRUSTED_PROXIES")); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES: ", err)
+	}
+
+	// Keep server-side state in an embedded database if configured
+	if path := os.Getenv("STORE_PATH"); path != "" {
+		var err error
+		store, err = openStore(path)
+		if err != nil {
+			log.Fatal("Failed to open store: ", err)
+		}
+		log.Printf("Using store at %s", path)
+	}
+
+	renderDeadline = envDuration("RENDER_DEADLINE", 0)
+	if path := os.Getenv("UPSTREAM_AUTH_FILE"); path != "" {
+		var err error
+		if upstreamAuths, err = loadUpstreamAuth(path); err != nil {
+			log.Fatal("Failed to load upstream auth: ", err)
+		}
+		log.Printf("Loaded credentials for %d upstream hosts from %s", len(upstreamAuths), path)
+	}
+	upstreamClient = newUpstreamClient(
+		envDuration("UPSTREAM_TIMEOUT", 30*time.Second),
+		envDuration("UPSTREAM_DIAL_TIMEOUT", 5*time.Second),
+		envDuration("UPSTREAM_TLS_TIMEOUT", 5*time.Second),
+		envInt("UPSTREAM_MAX_IDLE_PER_HOST", 32),
+	)
+
+	// Keep rendered tiles across restarts
+	if err := setupTileStore(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Build up offline tilesets as tiles are rendered
+	if dir := os.Getenv("MBTILES_DIR"); dir != "" {
+		mbtiles, err = newMBTilesArchive(dir)
+		if err != nil {
+			log.Fatalf("Failed to set up MBTiles archive: %v", err)
+		}
+		log.Printf("Writing tiles to MBTiles in %s", dir)
+	}
+
+	// Keep the tile cache within a memory budget
+	cache.setLimits(envBytes("TILE_CACHE_MAX_BYTES", 0), envInt("TILE_CACHE_MAX_ENTRIES", 0))
+
+	// With TILE_CACHE_ADMISSION=tinylfu, tiles requested once don't displace popular ones
+	admission := envString("TILE_CACHE_ADMISSION", "lru")
+	if err := checkAdmission(admission); err != nil {
+		log.Fatal("Invalid TILE_CACHE_ADMISSION: ", err)
+	}
+	if admission == "tinylfu" {
+		cache.useTinyLFU()
+	}
+
+	// With TILE_CACHE_SPILL, memory holds the hot tiles and the persistent store gets tiles
+	// only once they're evicted, rather than every tile as it's rendered
+	if envBool("TILE_CACHE_SPILL", false) {
+		if persistentStore == nil {
+			log.Fatal("TILE_CACHE_SPILL needs CACHE_DIR or CACHE_S3_BUCKET")
+		}
+		if cache.maxBytes == 0 && cache.maxEntries == 0 {
+			log.Printf("Warning: TILE_CACHE_SPILL is set without a tile cache limit, so tiles will never reach the %s store", persistentStore.name())
+		}
+		cache.spill = saveStoredTile
+		log.Printf("Spilling evicted tiles to the %s store", persistentStore.name())
+	}
+	basemapCache.setLimits(envBytes("BASEMAP_CACHE_MAX_BYTES", 0), 0)
+	basemapCacheTTL = envDuration("BASEMAP_CACHE_TTL", 0)
+
+	// Tiles matching no cache policy rule expire after TILE_CACHE_TTL (by default never)
+	defaultTileTTL = envDuration("TILE_CACHE_TTL", 0)
+	sweepInterval := envDuration("CACHE_SWEEP_INTERVAL", 10*time.Minute)
+
+	// Expired tiles may be served for TILE_CACHE_STALE longer while they're re-rendered
+	cache.staleFor = envDuration("TILE_CACHE_STALE", 0)
+	refresher = newBackgroundRefresher(envInt("STALE_REFRESH_CONCURRENCY", 4))
+	cache.startSweeper(sweepInterval)
+	basemapCache.startSweeper(sweepInterval)
+
+	terrariumMaxZoom = envInt("ELEVATION_MAX_ZOOM", terrariumMaxZoom)
+	elevationResampleZoom = envInt("ELEVATION_RESAMPLE_ZOOM", elevationResampleZoom)
+	elevationResampling = envString("ELEVATION_RESAMPLING", elevationResampling)
+	if err := checkResampling(elevationResampling); err != nil {
+		log.Fatal("Invalid ELEVATION_RESAMPLING: ", err)
+	}
+	breakerFailures = envInt("ELEVATION_BREAKER_FAILURES", breakerFailures)
+	breakerCooldown = envDuration("ELEVATION_BREAKER_COOLDOWN", breakerCooldown)
+	if dir := os.Getenv("ELEVATION_RAW_DIR"); dir != "" {
+		var err error
+		if rawElevationStore, err = newDiskStore(dir); err != nil {
+			log.Fatal("Failed to create raw elevation directory: ", err)
+		}
+		log.Printf("Keeping raw elevation tiles in %s", dir)
+		rawElevationTTL = envDuration("ELEVATION_RAW_TTL", 0)
+	}
+	if err := setupElevationSource(); err != nil {
+		log.Fatal("Failed to set up elevation source: ", err)
+	}
+	log.Printf("Elevation from %s: %s", elevationUpstream.name(), elevationUpstream.describe())
+	elevationCache = newElevationCache(envInt("ELEVATION_CACHE_ENTRIES", 512))
+	if rate := envFloat("ELEVATION_RATE_LIMIT", 0); rate > 0 {
+		elevationLimiter = newTokenBucket(rate, envInt("ELEVATION_RATE_BURST", 10))
+		log.Printf("Limiting upstream elevation requests to %g per second", rate)
+	}
+	upstreamRetry = retryPolicy{
+		retries: envInt("ELEVATION_RETRIES", upstreamRetry.retries),
+		backoff: envDuration("ELEVATION_RETRY_BACKOFF", upstreamRetry.backoff),
+		jitter:  envDuration("ELEVATION_RETRY_JITTER", upstreamRetry.jitter),
+	}
+
+	// Check each elevation source now and then for /status/sources
+	if interval := envDuration("ELEVATION_PROBE_INTERVAL", time.Minute); interval > 0 {
+		z, x, y, err := parseProbeTile(envString("ELEVATION_PROBE_TILE", "0/0/0"))
+		if err != nil {
+			log.Fatal("Invalid ELEVATION_PROBE_TILE: ", err)
+		}
+		prober = newSourceProber(elevationUpstream, z, x, y)
+		prober.start(interval)
+	}
+
+	// Tiles missing upstream are remembered for ELEVATION_MISS_TTL (0 disables this)
+	elevationMissTTL = envDuration("ELEVATION_MISS_TTL", elevationMissTTL)
+	elevationMisses.setLimits(0, 10000)
+	elevationMisses.startSweeper(sweepInterval)
+	renderPool = newRenderPool(envInt("RENDER_CONCURRENCY", 0))
+
+	// Learn which low-zoom tiles are entirely deep ocean, remembering them across restarts
+	if path := os.Getenv("OCEAN_MASK_FILE"); path != "" {
+		mask, err := loadOceanMask(path, envInt("OCEAN_MASK_MAX_ZOOM", 8))
+		if err != nil {
+			log.Fatal("Failed to load ocean mask:", err)
+		}
+		oceanMask = mask
+		log.Printf("Loaded %d deep ocean tiles from %s", len(mask.tiles), path)
+	}
+
+	// Per-zoom and per-level cache lifetimes
+	if path := os.Getenv("CACHE_POLICY_FILE"); path != "" {
+		policy, err := loadCachePolicy(path)
+		if err != nil {
+			log.Fatal("Failed to load cache policy:", err)
+		}
+		cachePolicy = policy
+		log.Printf("Loaded %d cache policy rules from %s", len(policy.Rules), path)
+	}
+	cache.retention = tileRetention
+
+	// Palettes of the deployment's own, alongside the built-in ones
+	if path := os.Getenv("PALETTES_FILE"); path != "" {
+		loaded, err := loadPalettes(path)
+		if err != nil {
+			log.Fatal("Failed to load palettes: ", err)
+		}
+		addPalettes(loaded)
+		log.Printf("Loaded %d palettes from %s", len(loaded), path)
+	}
+	if store != nil {
+		n, err := loadSavedStyles()
+		if err != nil {
+			log.Fatal("Failed to load saved styles: ", err)
+		}
+		log.Printf("Loaded %d saved styles from the store", n)
+	}
+
+	watermarkText = os.Getenv("WATERMARK_TEXT")
+	if ramp := os.Getenv("DEPTH_RAMP"); ramp != "" {
+		var err error
+		if depthRamp, err = parseDepthRamp(ramp); err != nil {
+			log.Fatal("Invalid DEPTH_RAMP: ", err)
+		}
+	}
+
+	// Bruun rule profile for the erosion mode
+	bruunClosureDepth = float64(envInt("BRUUN_CLOSURE_DEPTH", int(bruunClosureDepth)))
+	bruunBermHeight = float64(envInt("BRUUN_BERM_HEIGHT", int(bruunBermHeight)))
+
+	// Optional smoothing of noisy elevation data before thresholding
+	smoothingMethod = os.Getenv("DEM_SMOOTHING")
+	smoothingRadius = envInt("DEM_SMOOTHING_RADIUS", smoothingRadius)
+	if err := checkSmoothing(smoothingMethod, smoothingRadius); err != nil {
+		log.Fatal("Invalid DEM_SMOOTHING: ", err)
+	}
+	if smoothingMethod != "" {
+		log.Printf("Smoothing elevation with a %s filter of radius %d", smoothingMethod, smoothingRadius)
+	}
+
+	// River channels for the optional backwater mode
+	if url := os.Getenv("RIVER_MASK_URL"); url != "" {
+		riverSource = newMaskSource("river", url)
+		riverBackwaterLength = float64(envInt("RIVER_BACKWATER_LENGTH", int(riverBackwaterLength)))
+		log.Printf("River backwater mode enabled using %s", url)
+	}
+
+	// Water today, for telling dry land below the sea level apart
+	if url := os.Getenv("WATER_MASK_URL"); url != "" {
+		waterMask = newMaskSource("water", url)
+		log.Printf("Dry land mode enabled using %s", url)
+	}
+
+	// The sea today from OSM ocean polygons, for the optional coastline correction
+	if url := os.Getenv("OCEAN_POLYGON_MASK_URL"); url != "" {
+		oceanPolygons = newMaskSource("ocean polygon", url)
+		log.Printf("Coastline correction enabled using %s", url)
+	}
+
+	// People per pixel, for estimating how many live below a sea level
+	if path := os.Getenv("POPULATION_FILE"); path != "" {
+		g, err := openPopulation(path)
+		if err != nil {
+			log.Fatalf("Failed to open population grid: %v", err)
+		}
+		populationGrid = g
+		log.Printf("Population estimates enabled using %s", path)
+	}
+
+	// Country outlines, for flood summaries by country
+	if path := os.Getenv("BOUNDARIES_FILE"); path != "" {
+		loaded, err := loadBoundaries(path)
+		if err != nil {
+			log.Fatalf("Failed to load boundaries: %v", err)
+		}
+		boundaries = loaded
+		log.Printf("Country summaries enabled for %d codes using %s", len(loaded), path)
+	}
+
+	// Buildings, roads and railways, for estimating what lies below a sea level
+	if path := os.Getenv("OSM_EXTRACT_FILE"); path != "" {
+		loadExposure(path)
+		log.Printf("Exposure estimates enabled using %s", path)
+	}
+
+	// Open ocean on coarse tiles, seeding the optional connected flooding mode
+	if url := os.Getenv("OCEAN_SEED_MASK_URL"); url != "" {
+		oceanSeeds = newMaskSource("ocean seed", url)
+		connectedBaseZoom = envInt("CONNECTED_BASE_ZOOM", connectedBaseZoom)
+		connectedMasks.setLimits(0, envInt("CONNECTED_CACHE_ENTRIES", 1024))
+		log.Printf("Connected flooding mode enabled using %s", url)
+	}
+
+	// Global flooded area at every sea level, computed once and kept on disk
+	if path := os.Getenv("AREA_TABLE_FILE"); path != "" {
+		areaTableZoom = envInt("AREA_TABLE_ZOOM", areaTableZoom)
+		loadAreaTable(path, areaTableZoom)
+	}
+
+	// Towns and cities for the flooded places lookup
+	if err := setupPlaces(os.Getenv("GAZETTEER_FILE")); err != nil {
+		log.Fatal("Failed to load gazetteer: ", err)
+	}
+
+	refreshTileVersion()
+	log.Printf("Tile version: %s", tileVersion())
+
+	// Start with the tiles cached before the last shutdown
+	snapshotPath := os.Getenv("CACHE_SNAPSHOT_FILE")
+	if snapshotPath != "" {
+		loaded, err := loadCacheSnapshot(cache, snapshotPath)
+		if err != nil {
+			log.Printf("Not restoring the tile cache: %v", err)
+		} else if loaded > 0 {
+			log.Printf("Restored %d tiles from %s", loaded, snapshotPath)
+		}
+	}
+
+	// Seeding and refresh jobs that run at set times
+	if path := os.Getenv("SEED_SCHEDULE_FILE"); path != "" {
+		if err := seedScheduler.start(path); err != nil {
+			log.Fatal("Failed to load seed schedule: ", err)
+		}
+		log.Printf("Loaded %d scheduled jobs from %s", len(seedScheduler.jobs), path)
+	}
+
+	// Mirror a primary's tiles as a warm standby
+	if primary := os.Getenv("REPLICATE_FROM"); primary != "" {
+		go followPrimary(primary, os.Getenv("REPLICATE_API_KEY"))
+		log.Printf("Running as a warm standby for %s", primary)
+	}
+
+	// Share rendering with other instances, each tile being rendered by one of them
+	if list := os.Getenv("CACHE_PEERS"); list != "" {
+		peers, err = newPeerGroup(list, os.Getenv("CACHE_PEER_SELF"), os.Getenv("CACHE_PEER_API_KEY"))
+		if err != nil {
+			log.Fatalf("Invalid peer group: %v", err)
+		}
+		log.Printf("Sharing tiles with %d peers as %s", len(peers.peers)-1, peers.self)
+	}
+
+	// Create router, optionally mounting everything under a base path for reverse proxies
 	r := mux.NewRouter()
+	app := r
+	basePath = normalizeBasePath(os.Getenv("BASE_PATH"))
+	if basePath != "" {
+		app = r.PathPrefix(basePath).Subrouter()
+
+		// The frontend uses relative URLs so needs the trailing slash
+		r.Handle(basePath, http.RedirectHandler(basePath+"/", http.StatusMovedPermanently))
+	}
 
 	// Routes
-	r.HandleFunc("/", serveIndex).Methods("GET")
-	r.HandleFunc("/tile/{level:-?[0-9]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", serveTile).Methods("GET")
+	app.HandleFunc("/", serveIndex).Methods("GET")
+	app.HandleFunc("/metrics", serveMetrics).Methods("GET")
+	app.HandleFunc("/preview/{level:-?[0-9]+}", servePreview).Methods("GET")
+	app.HandleFunc("/export/{level:-?[0-9]+}", serveExport).Methods("GET")
+	app.HandleFunc("/legend/{style:[a-z]+}/{level:-?[0-9]+}.{ext:png|json}", serveLegend).Methods("GET")
+	app.HandleFunc("/manifest", serveManifest).Methods("GET")
+	app.HandleFunc("/stats/area.{ext:json|csv}", serveAreaTable).Methods("GET")
+	app.HandleFunc("/places", servePlaces).Methods("GET")
+	app.HandleFunc("/api/elevation", serveElevation).Methods("GET")
+	app.HandleFunc("/api/flood-level", serveFloodLevel).Methods("GET")
+	app.HandleFunc("/api/profile", serveProfile).Methods("POST")
+	app.HandleFunc("/api/staticmap", serveStaticMap).Methods("GET")
+	app.HandleFunc("/api/floodpoly", serveFloodPolygons).Methods("GET")
+	app.HandleFunc("/api/population", servePopulation).Methods("GET")
+	app.HandleFunc("/api/depth-bands", serveDepthBands).Methods("GET")
+	app.HandleFunc("/api/exposure", serveExposure).Methods("GET")
+	app.HandleFunc("/api/summary/{code:[A-Za-z]{2,3}}", serveSummary).Methods("GET")
+	app.HandleFunc("/status/sources", serveSourceStatus).Methods("GET")
+	app.HandleFunc("/share", serveShareCreate).Methods("POST")
+	app.HandleFunc("/s/{id:[0-9a-f]+}", serveShareLink).Methods("GET")
+	app.HandleFunc("/contours/{interval:[0-9]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", serveContours).Methods("GET")
+	app.HandleFunc("/elevation-tint/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", serveTint).Methods("GET")
+	app.HandleFunc("/flood-level/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", serveFloodLevels).Methods("GET")
+	app.HandleFunc("/slope/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", serveSlope).Methods("GET")
+	app.HandleFunc("/aspect/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", serveAspect).Methods("GET")
+	app.HandleFunc("/normals/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", serveNormals).Methods("GET")
+	app.HandleFunc("/basemap/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", serveBasemap).Methods("GET")
+	app.HandleFunc("/tile/{level:-?[0-9]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", serveTile).Methods("GET")
+	app.HandleFunc("/tms/{level:-?[0-9]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", serveTMSTile).Methods("GET")
+	app.HandleFunc("/tile/band/{levels:-?[0-9]+(?:,-?[0-9]+)*}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", serveBandTile).Methods("GET")
+	app.HandleFunc("/tile/diff/{from:-?[0-9]+}/{level:-?[0-9]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", serveDiffTile).Methods("GET")
+	app.HandleFunc("/tile/anim/{from:-?[0-9]+}/{to:-?[0-9]+}/{step:[0-9]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", serveAnimTile).Methods("GET")
+	app.HandleFunc("/tile/version", serveTileVersion).Methods("GET")
+	app.HandleFunc("/wmts", serveWMTS).Methods("GET")
+	app.HandleFunc("/tile/v/{hash:[0-9a-f]+}/{level:-?[0-9]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", serveVersionedTile).Methods("GET")
+
+	// Admin API
+	admin := app.PathPrefix("/admin").Subrouter()
+	admin.Use(requireAdmin)
+	admin.HandleFunc("/replication", serveReplication).Methods("GET")
+	admin.HandleFunc("/cache", serveCachePurge).Methods("DELETE")
+	admin.HandleFunc("/peer/{level:-?[0-9]+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}", servePeerTile).Methods("GET")
+	admin.HandleFunc("/schedule", serveSchedule).Methods("GET")
+	admin.HandleFunc("/schedule", serveScheduleAdd).Methods("POST")
+	admin.HandleFunc("/schedule/{name}", serveScheduleDelete).Methods("DELETE")
+	admin.HandleFunc("/schedule/{name}/run", serveScheduleRun).Methods("POST")
+	admin.HandleFunc("/styles/{name}", serveStyleSave).Methods("PUT")
+	admin.HandleFunc("/styles/{name}", serveStyleDelete).Methods("DELETE")
+	admin.HandleFunc("/keys", serveAPIKeyAdd).Methods("POST")
+	admin.HandleFunc("/keys/{name}", serveAPIKeyRevoke).Methods("DELETE")
+	admin.HandleFunc("/config/reload", serveConfigReload).Methods("POST")
+
+	// Report panics rather than dropping connections
+	r.Use(recoverPanics)
+
+	// Turn away blocked addresses before doing any work for them
+	r.Use(ipFilter)
 
 	// Add some logging middleware
 	r.Use(func(next http.Handler) http.Handler {
@@ -314,10 +1056,32 @@ func main() {
 	}
 
 	log.Printf("Starting sea level map server on port %s", port)
-	log.Printf("Visit http://localhost:%s to view the map", port)
-	log.Printf("Tile endpoint: http://localhost:%s/tile/{level}/{z}/{x}/{y}.png", port)
+	log.Printf("Visit http://localhost:%s%s/ to view the map", port, basePath)
+	log.Printf("Tile endpoint: http://localhost:%s%s/tile/{level}/{z}/{x}/{y}.png", port, basePath)
 
-	if err := http.ListenAndServe(":"+port, r); err != nil {
-		log.Fatal("Server failed to start:", err)
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Server failed to start:", err)
+		}
+	}()
+
+	// On SIGINT or SIGTERM, let requests finish and then save the cache for the next start
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Printf("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down: %v", err)
+	}
+	if snapshotPath != "" {
+		saved, err := saveCacheSnapshot(cache, snapshotPath)
+		if err != nil {
+			log.Printf("Failed to save the tile cache: %v", err)
+			return
+		}
+		log.Printf("Saved %d tiles to %s", saved, snapshotPath)
 	}
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	maxManifestTiles   = 20000
+	maxManifestRenders = 1000
+)
+
+// manifestTile describes one tile a client should download for offline use
+type manifestTile struct {
+	URL    string `json:"url"`
+	Z      int    `json:"z"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Size   int    `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type manifestResponse struct {
+	Level     int            `json:"level"`
+	Version   string         `json:"version"`
+	Count     int            `json:"count"`
+	TotalSize int            `json:"totalSize"`
+	Complete  bool           `json:"complete"`
+	Tiles     []manifestTile `json:"tiles"`
+}
+
+// serveManifest lists every tile covering a bbox and zoom range, so a service worker can
+// download a region for offline use. Sizes and hashes are included for tiles that are already
+// rendered; with render=1 missing tiles are rendered first (for smaller regions).
+func serveManifest(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	area, err := parseBBox(query.Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	level := 0
+	if s := query.Get("level"); s != "" {
+		if level, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "Invalid sea level", http.StatusBadRequest)
+			return
+		}
+	}
+	level = clampSeaLevel(level)
+
+	minZoom, maxZoom := 0, upstreamMaxZoom
+	if s := query.Get("minzoom"); s != "" {
+		if minZoom, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "Invalid minzoom", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("maxzoom"); s != "" {
+		if maxZoom, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "Invalid maxzoom", http.StatusBadRequest)
+			return
+		}
+	}
+	if minZoom < 0 || maxZoom > upstreamMaxZoom || minZoom > maxZoom {
+		http.Error(w, fmt.Sprintf("Invalid zoom range: must be within 0-%d", upstreamMaxZoom), http.StatusBadRequest)
+		return
+	}
+
+	count := area.tileCount(minZoom, maxZoom)
+	if count > maxManifestTiles {
+		http.Error(w, fmt.Sprintf("Too many tiles (%d): at most %d per manifest", count, maxManifestTiles), http.StatusBadRequest)
+		return
+	}
+	render := query.Get("render") == "1"
+	if render && count > maxManifestRenders {
+		http.Error(w, fmt.Sprintf("Too many tiles to render (%d): at most %d", count, maxManifestRenders), http.StatusBadRequest)
+		return
+	}
+
+	// Tile URLs are otherwise negotiated on Accept, so they pin PNG to serve exactly the bytes
+	// hashed here whatever the service worker sends
+	opts := defaultTileOptions()
+	opts.priority = priorityPrefetch
+
+	version := tileVersion()
+	tiles := make([]manifestTile, 0, count)
+	for z := minZoom; z <= maxZoom; z++ {
+		x0, y0, x1, y1 := area.tileRange(z)
+		for y := y0; y <= y1; y++ {
+			for x := x0; x <= x1; x++ {
+				tiles = append(tiles, manifestTile{
+					URL: appURL(fmt.Sprintf("/tile/v/%s/%d/%d/%d/%d.png?format=png", version, level, z, x, y)),
+					Z:   z,
+					X:   x,
+					Y:   y,
+				})
+			}
+		}
+	}
+
+	// Fill in sizes and hashes, rendering a few tiles at a time if asked to
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 4)
+	for i := range tiles {
+		t := &tiles[i]
+		z, x, y := strconv.Itoa(t.Z), strconv.Itoa(t.X), strconv.Itoa(t.Y)
+		if cached, exists := cache.get(tileCacheKey(level, z, x, y, opts)); exists {
+			t.Size, t.SHA256 = len(cached.data), sha256Hex(cached.data)
+			continue
+		}
+		if !render {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			data, err := generateSeaLevelTile(level, z, x, y, opts)
+			if err != nil {
+				log.Printf("Error rendering tile for manifest: %v", err)
+				return
+			}
+			t.Size, t.SHA256 = len(data), sha256Hex(data)
+		}()
+	}
+	wg.Wait()
+
+	resp := manifestResponse{
+		Level:    level,
+		Version:  version,
+		Count:    len(tiles),
+		Complete: true,
+		Tiles:    tiles,
+	}
+	for _, t := range tiles {
+		resp.TotalSize += t.Size
+		if t.SHA256 == "" {
+			resp.Complete = false
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/png"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tileMask marks pixels of a tile, row by row
+type tileMask [tileSize * tileSize]bool
+
+// maskSource provides masks from raster tiles in which opaque pixels are set
+type maskSource struct {
+	name        string
+	urlTemplate string
+	cache       *TileCache
+}
+
+func newMaskSource(name, urlTemplate string) *maskSource {
+	return &maskSource{
+		name:        name,
+		urlTemplate: urlTemplate,
+		cache:       newTileCache(name),
+	}
+}
+
+// load returns the mask for a tile, or nil if the source has no tile there
+func (m *maskSource) load(z, x, y int) (*tileMask, error) {
+	key := elevationKey(z, x, y)
+
+	cached, exists := m.cache.get(key)
+
+	if !exists {
+		data, err := m.fetch(z, x, y)
+		if err != nil {
+			return nil, err
+		}
+		cached = CachedTile{data: data, timestamp: time.Now()}
+		m.cache.put(key, cached)
+	}
+
+	// An empty entry records that the source has nothing for this tile
+	if len(cached.data) == 0 {
+		return nil, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(cached.data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s mask tile: %v", m.name, err)
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() != tileSize || bounds.Dy() != tileSize {
+		return nil, fmt.Errorf("unexpected %s mask tile size: %dx%d", m.name, bounds.Dx(), bounds.Dy())
+	}
+
+	mask := new(tileMask)
+	for py := 0; py < tileSize; py++ {
+		for px := 0; px < tileSize; px++ {
+			_, _, _, a := img.At(bounds.Min.X+px, bounds.Min.Y+py).RGBA()
+			mask[py*tileSize+px] = a >= 0x8000
+		}
+	}
+	return mask, nil
+}
+
+func (m *maskSource) fetch(z, x, y int) ([]byte, error) {
+	url := strings.NewReplacer(
+		"{z}", fmt.Sprint(z),
+		"{x}", fmt.Sprint(x),
+		"{y}", fmt.Sprint(y),
+	).Replace(m.urlTemplate)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	authorizeUpstream(req)
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s mask tile: %v", m.name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return []byte{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s mask tile request failed with status: %d", m.name, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// mbtilesArchive writes every rendered tile into an MBTiles file per sea level (and set of
+// options), building up offline tilesets that can be copied straight into mobile and desktop
+// GIS apps. After a restart tiles are served from them rather than rendered again.
+type mbtilesArchive struct {
+	dir   string
+	mu    sync.Mutex
+	files map[string]*sql.DB
+}
+
+// mbtiles is nil unless MBTILES_DIR is set
+var mbtiles *mbtilesArchive
+
+func newMBTilesArchive(dir string) (*mbtilesArchive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &mbtilesArchive{dir: dir, files: make(map[string]*sql.DB)}, nil
+}
+
+// mbtilesSchema follows the MBTiles 1.3 spec, plus an updated_at column so cache TTLs apply
+var mbtilesSchema = []string{
+	`CREATE TABLE IF NOT EXISTS metadata (name TEXT, value TEXT)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS name ON metadata (name)`,
+	`CREATE TABLE IF NOT EXISTS tiles (
+		zoom_level INTEGER,
+		tile_column INTEGER,
+		tile_row INTEGER,
+		tile_data BLOB,
+		updated_at INTEGER
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS tile_index ON tiles (zoom_level, tile_column, tile_row)`,
+}
+
+// open returns the tileset for a sea level and options, creating it if needed. Tiles from an
+// older renderer are cleared out, as they'd no longer match what the server produces.
+func (a *mbtilesArchive) open(seaLevel int, opts tileOptions) (*sql.DB, error) {
+	name := fmt.Sprintf("%d%s.mbtiles", seaLevel, opts.key())
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if db, exists := a.files[name]; exists {
+		return db, nil
+	}
+
+	db, err := a.connect(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var renderer string
+	db.QueryRow(`SELECT value FROM metadata WHERE name = 'renderer'`).Scan(&renderer)
+	if renderer != tileVersion() {
+		if renderer != "" {
+			log.Printf("Clearing %s, rendered by version %s", name, renderer)
+		}
+		if _, err := db.Exec(`DELETE FROM tiles`); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	metadata := map[string]string{
+		"name":        fmt.Sprintf("Sea level %+dm", seaLevel),
+		"format":      opts.format.name,
+		"type":        "overlay",
+		"bounds":      "-180,-85.0511,180,85.0511",
+		"attribution": elevationAttribution(),
+		"renderer":    tileVersion(),
+	}
+	for key, value := range metadata {
+		if _, err := db.Exec(`INSERT OR REPLACE INTO metadata (name, value) VALUES (?, ?)`, key, value); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	a.files[name] = db
+	return db, nil
+}
+
+// connect opens a tileset file, creating its tables if needed
+func (a *mbtilesArchive) connect(name string) (*sql.DB, error) {
+	db, err := sql.Open(storeDriver, filepath.Join(a.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	for _, stmt := range mbtilesSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create %s: %v", name, err)
+		}
+	}
+	return db, nil
+}
+
+// purge deletes the selected tiles from every tileset they could be in, so they are rendered
+// again rather than served from the archive
+func (a *mbtilesArchive) purge(p tilePurge) (int, error) {
+	names, err := filepath.Glob(filepath.Join(a.dir, "*.mbtiles"))
+	if err != nil {
+		return 0, err
+	}
+
+	where, args := "1 = 1", []any{}
+	if p.z != nil {
+		where, args = where+" AND zoom_level = ?", append(args, *p.z)
+	}
+	if p.x != nil {
+		where, args = where+" AND tile_column = ?", append(args, *p.x)
+	}
+	if p.y != nil {
+		where, args = where+" AND tile_row = ?", append(args, tmsRow(*p.z, *p.y))
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	removed := 0
+	for _, full := range names {
+		name := filepath.Base(full)
+		level, err := strconv.Atoi(leadingInt(name))
+		if err != nil || (p.level != nil && *p.level != level) {
+			continue
+		}
+
+		// Files not open yet are opened just for this, as opening them for serving also checks
+		// which renderer made them
+		db, open := a.files[name]
+		if !open {
+			if db, err = a.connect(name); err != nil {
+				return removed, err
+			}
+		}
+		result, err := db.Exec(`DELETE FROM tiles WHERE `+where, args...)
+		if !open {
+			db.Close()
+		}
+		if err != nil {
+			return removed, fmt.Errorf("failed to purge %s: %v", name, err)
+		}
+		n, _ := result.RowsAffected()
+		removed += int(n)
+	}
+	return removed, nil
+}
+
+// closeAll closes every open tileset, so each is checked against the tile version again when
+// next opened
+func (a *mbtilesArchive) closeAll() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for name, db := range a.files {
+		db.Close()
+		delete(a.files, name)
+	}
+}
+
+// get looks a tile up, treating tiles older than ttl as missing
+func (a *mbtilesArchive) get(seaLevel, z, x, y int, opts tileOptions, ttl time.Duration) (CachedTile, bool) {
+	db, err := a.open(seaLevel, opts)
+	if err != nil {
+		reportError("mbtiles", err, nil)
+		return CachedTile{}, false
+	}
+	var data []byte
+	var updated int64
+	err = db.QueryRow(`SELECT tile_data, COALESCE(updated_at, 0) FROM tiles
+		WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?`, z, x, tmsRow(z, y)).Scan(&data, &updated)
+	if err == sql.ErrNoRows {
+		return CachedTile{}, false
+	} else if err != nil {
+		reportError("mbtiles", err, nil)
+		return CachedTile{}, false
+	}
+	stored := time.Unix(updated, 0)
+	if ttl != 0 && time.Since(stored) >= ttl {
+		return CachedTile{}, false
+	}
+	return CachedTile{data: data, timestamp: stored, expires: expiresAfter(stored, ttl)}, true
+}
+
+// put writes a tile in the background
+func (a *mbtilesArchive) put(seaLevel, z, x, y int, opts tileOptions, data []byte) {
+	go func() {
+		db, err := a.open(seaLevel, opts)
+		if err == nil {
+			_, err = db.Exec(`INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data, updated_at)
+				VALUES (?, ?, ?, ?, ?)`, z, x, tmsRow(z, y), data, time.Now().Unix())
+		}
+		if err != nil {
+			reportError("mbtiles", err, map[string]string{"level": fmt.Sprint(seaLevel)})
+		}
+	}()
+}
+
+// tmsRow converts an XYZ row to the TMS numbering MBTiles uses, counting from the south
+func tmsRow(z, y int) int {
+	return (1 << z) - 1 - y
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"image"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// mbtilesSource reads elevation tiles from an MBTiles file, so the server can run with no
+// network access at all. Tiles may be terrarium or Mapbox Terrain-RGB encoded; the metadata's
+// "encoding" entry says which, as written by tools like rio-rgbify, and
+// ELEVATION_MBTILES_ENCODING overrides it.
+type mbtilesSource struct {
+	path     string
+	db       *sql.DB
+	encoding string
+	minZoom  int
+	maxZoom  int
+}
+
+// elevationEncodings decode each supported tile encoding
+var elevationEncodings = map[string]func(image.Image) (*elevationGrid, error){
+	"terrarium": decodeTerrarium,
+	"mapbox":    decodeTerrainRGB,
+}
+
+func newMBTilesSource(path, encoding string) (*mbtilesSource, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(storeDriver, "file:"+(&url.URL{Path: path}).EscapedPath()+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]string)
+	rows, err := db.Query(`SELECT name, value FROM metadata`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s is not an MBTiles file: %v", path, err)
+	}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err == nil {
+			metadata[name] = value
+		}
+	}
+	rows.Close()
+
+	s := &mbtilesSource{path: path, db: db, encoding: encoding, maxZoom: upstreamMaxZoom}
+	if s.encoding == "" {
+		s.encoding = metadata["encoding"]
+	}
+	if s.encoding == "" {
+		s.encoding = "terrarium"
+	}
+	if _, ok := elevationEncodings[s.encoding]; !ok {
+		db.Close()
+		return nil, fmt.Errorf("%s: unsupported elevation encoding %q; use terrarium or mapbox", path, s.encoding)
+	}
+	if format := metadata["format"]; format != "" && format != "png" && format != "webp" {
+		db.Close()
+		return nil, fmt.Errorf("%s: elevation tiles must be PNG or WebP, not %s", path, format)
+	}
+	if v, err := strconv.Atoi(metadata["minzoom"]); err == nil {
+		s.minZoom = v
+	}
+	if v, err := strconv.Atoi(metadata["maxzoom"]); err == nil {
+		s.maxZoom = v
+	}
+	return s, nil
+}
+
+func (s *mbtilesSource) name() string {
+	return "mbtiles"
+}
+
+func (s *mbtilesSource) nativeMaxZoom() int {
+	return s.maxZoom
+}
+
+func (s *mbtilesSource) describe() string {
+	return fmt.Sprintf("%s (%s, z%d-%d)", s.path, s.encoding, s.minZoom, s.maxZoom)
+}
+
+// tile reads and decodes a tile; tiles outside the file's zoom range or coverage are missing
+func (s *mbtilesSource) tile(z, x, y int, timing *serverTiming) (*elevationGrid, error) {
+	if z < s.minZoom || z > s.maxZoom {
+		return nil, errElevationMissing
+	}
+
+	start := time.Now()
+	var data []byte
+	err := s.db.QueryRow(`SELECT tile_data FROM tiles
+		WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?`, z, x, tmsRow(z, y)).Scan(&data)
+	if err == sql.ErrNoRows {
+		metrics.incr("upstream_not_found")
+		return nil, errElevationMissing
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read elevation tile from %s: %v", s.path, err)
+	}
+	timing.since("fetch", start)
+
+	decodeStart := time.Now()
+	defer timing.since("decode", decodeStart)
+	return decodeElevationImage(data, s.encoding)
+}
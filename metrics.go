@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics keeps counters and timings in memory for /metrics and optionally pushes them to statsd
+type Metrics struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	timings  map[string]*timingStat
+	statsd   *statsdClient
+}
+
+type timingStat struct {
+	count int64
+	sum   time.Duration
+}
+
+var metrics = &Metrics{
+	counters: make(map[string]int64),
+	timings:  make(map[string]*timingStat),
+}
+
+// incr increments a counter; tags are "key:value" strings
+func (m *Metrics) incr(name string, tags ...string) {
+	m.mu.Lock()
+	m.counters[metricKey(name, tags)]++
+	m.mu.Unlock()
+
+	if m.statsd != nil {
+		m.statsd.send(name, "1|c", tags)
+	}
+}
+
+// timing records how long something took
+func (m *Metrics) timing(name string, d time.Duration, tags ...string) {
+	m.mu.Lock()
+	key := metricKey(name, tags)
+	stat, exists := m.timings[key]
+	if !exists {
+		stat = &timingStat{}
+		m.timings[key] = stat
+	}
+	stat.count++
+	stat.sum += d
+	m.mu.Unlock()
+
+	if m.statsd != nil {
+		m.statsd.send(name, fmt.Sprintf("%d|ms", d.Milliseconds()), tags)
+	}
+}
+
+// metricKey renders a metric name and tags in Prometheus exposition format
+func metricKey(name string, tags []string) string {
+	name = "sealevel_" + name
+	if len(tags) == 0 {
+		return name
+	}
+	labels := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		k, v, _ := strings.Cut(tag, ":")
+		labels = append(labels, fmt.Sprintf("%s=%q", k, v))
+	}
+	sort.Strings(labels)
+	return name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// serveMetrics exposes the metrics in Prometheus text format
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics.mu.Lock()
+	var lines []string
+	for key, value := range metrics.counters {
+		lines = append(lines, fmt.Sprintf("%s %d", key, value))
+	}
+	for key, stat := range metrics.timings {
+		name, labels := key, ""
+		if i := strings.IndexByte(key, '{'); i >= 0 {
+			name, labels = key[:i], key[i:]
+		}
+		lines = append(lines, fmt.Sprintf("%s_seconds_count%s %d", name, labels, stat.count))
+		lines = append(lines, fmt.Sprintf("%s_seconds_sum%s %f", name, labels, stat.sum.Seconds()))
+	}
+	metrics.mu.Unlock()
+
+	// Cache sizes, to check limits are sensible
+	for _, c := range []*TileCache{cache, basemapCache} {
+		entries, bytes := c.size()
+		lines = append(lines, fmt.Sprintf("%s %d", metricKey("cache_entries", []string{"cache:" + c.name}), entries))
+		lines = append(lines, fmt.Sprintf("%s %d", metricKey("cache_bytes", []string{"cache:" + c.name}), bytes))
+	}
+
+	sort.Strings(lines)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, strings.Join(lines, "\n"))
+}
+
+// statsdClient pushes metrics over UDP, with dogstatsd tags if enabled
+type statsdClient struct {
+	conn      net.Conn
+	prefix    string
+	dogstatsd bool
+}
+
+func newStatsdClient(addr, prefix string, dogstatsd bool) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &statsdClient{conn: conn, prefix: prefix, dogstatsd: dogstatsd}, nil
+}
+
+// send writes a single metric; failures are ignored as statsd is best-effort
+func (c *statsdClient) send(name, value string, tags []string) {
+	line := c.prefix + name + ":" + value
+	if c.dogstatsd && len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	c.conn.Write([]byte(line))
+}
+
+// setupStatsd enables pushing metrics if STATSD_ADDR is set
+func setupStatsd() {
+	addr := os.Getenv("STATSD_ADDR")
+	if addr == "" {
+		return
+	}
+	prefix := os.Getenv("STATSD_PREFIX")
+	if prefix == "" {
+		prefix = "sealevel"
+	}
+	dogstatsd := os.Getenv("STATSD_DOGSTATSD") == "1"
+
+	client, err := newStatsdClient(addr, prefix, dogstatsd)
+	if err != nil {
+		log.Fatal("Failed to set up statsd:", err)
+	}
+	metrics.statsd = client
+	log.Printf("Pushing metrics to statsd at %s (dogstatsd tags: %v)", addr, dogstatsd)
+}
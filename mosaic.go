@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const maxMercatorLat = 85.0511
+
+// viewConcurrency is how many tiles of one view are fetched and rendered at once
+const viewConcurrency = 8
+
+// mapView describes a rectangular map image centred on a point
+type mapView struct {
+	level  int
+	lat    float64
+	lon    float64
+	zoom   int
+	width  int
+	height int
+
+	noBasemap bool // Just the overlay on a transparent background
+	priority  int  // Render pool priority for the view's tiles
+}
+
+// mercatorPixel converts longitude/latitude to global pixel coordinates at a zoom level
+func mercatorPixel(lon, lat float64, zoom int) (float64, float64) {
+	n := float64(tileSize) * math.Exp2(float64(zoom))
+	latRad := lat * math.Pi / 180
+	x := (lon + 180) / 360 * n
+	y := (1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * n
+	return x, y
+}
+
+// metersPerPixel returns the ground resolution at a latitude and zoom level
+func metersPerPixel(lat float64, zoom int) float64 {
+	return 40075016.686 * math.Cos(lat*math.Pi/180) / (float64(tileSize) * math.Exp2(float64(zoom)))
+}
+
+// parseViewParams reads lat, lon and zoom query parameters, with defaults for a world view
+func parseViewParams(r *http.Request, maxZoom int) (lat, lon float64, zoom int, err error) {
+	query := r.URL.Query()
+
+	if s := query.Get("lat"); s != "" {
+		if lat, err = strconv.ParseFloat(s, 64); err != nil || lat < -maxMercatorLat || lat > maxMercatorLat {
+			return 0, 0, 0, fmt.Errorf("Invalid latitude")
+		}
+	}
+	if s := query.Get("lon"); s != "" {
+		if lon, err = strconv.ParseFloat(s, 64); err != nil || lon < -180 || lon > 180 {
+			return 0, 0, 0, fmt.Errorf("Invalid longitude")
+		}
+	}
+	zoom = 2
+	if s := query.Get("zoom"); s != "" {
+		z, err := strconv.ParseFloat(s, 64)
+		if err != nil || z < 0 || z > float64(maxZoom) {
+			return 0, 0, 0, fmt.Errorf("Invalid zoom level")
+		}
+		zoom = int(math.Round(z))
+	}
+	return lat, lon, zoom, nil
+}
+
+// renderView composites basemap tiles with the flood overlay for a view
+func renderView(v mapView, overlayOpacity float64) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, v.width, v.height))
+	if !v.noBasemap {
+		draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{221, 221, 221, 255}), image.Point{}, draw.Src)
+	}
+
+	// Global pixel position of the top-left corner of the image
+	cx, cy := mercatorPixel(v.lon, v.lat, v.zoom)
+	ox := int(math.Floor(cx)) - v.width/2
+	oy := int(math.Floor(cy)) - v.height/2
+
+	tx0 := floorDiv(ox, tileSize)
+	ty0 := floorDiv(oy, tileSize)
+	tx1 := floorDiv(ox+v.width-1, tileSize)
+	ty1 := floorDiv(oy+v.height-1, tileSize)
+	n := 1 << v.zoom
+
+	type viewTile struct {
+		dst     image.Point
+		basemap image.Image
+		overlay image.Image
+	}
+	var tiles []*viewTile
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, viewConcurrency)
+
+	for ty := ty0; ty <= ty1; ty++ {
+		if ty < 0 || ty >= n {
+			continue
+		}
+		for tx := tx0; tx <= tx1; tx++ {
+			t := &viewTile{dst: image.Pt(tx*tileSize-ox, ty*tileSize-oy)}
+			tiles = append(tiles, t)
+
+			// Wrap around the antimeridian
+			x := ((tx % n) + n) % n
+			y := ty
+
+			wg.Add(1)
+			slots <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				if !v.noBasemap {
+					if img, err := fetchBasemapTile(v.zoom, x, y); err != nil {
+						log.Printf("Error fetching basemap tile for view: %v", err)
+					} else {
+						t.basemap = img
+					}
+				}
+
+				// The finished image gets a single watermark rather than one per tile
+				opts := defaultTileOptions()
+				opts.watermark = false
+				opts.priority = v.priority
+
+				data, err := generateSeaLevelTile(v.level, strconv.Itoa(v.zoom), strconv.Itoa(x), strconv.Itoa(y), opts)
+				if err != nil {
+					log.Printf("Error generating tile for view: %v", err)
+					return
+				}
+				if img, err := png.Decode(bytes.NewReader(data)); err == nil {
+					t.overlay = img
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	mask := image.NewUniform(color.Alpha{uint8(overlayOpacity * 255)})
+	for _, t := range tiles {
+		rect := image.Rectangle{t.dst, t.dst.Add(image.Pt(tileSize, tileSize))}
+		if t.basemap != nil {
+			draw.Draw(img, rect, t.basemap, t.basemap.Bounds().Min, draw.Src)
+		}
+		if t.overlay != nil {
+			draw.DrawMask(img, rect, t.overlay, t.overlay.Bounds().Min, mask, image.Point{}, draw.Over)
+		}
+	}
+
+	return img
+}
+
+// floorDiv divides rounding towards negative infinity
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// bbox is a geographic bounding box in degrees
+type bbox struct {
+	minLon, minLat, maxLon, maxLat float64
+}
+
+// parseBBox parses "minLon,minLat,maxLon,maxLat"
+func parseBBox(s string) (bbox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return bbox{}, fmt.Errorf("Invalid bbox: expected minLon,minLat,maxLon,maxLat")
+	}
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return bbox{}, fmt.Errorf("Invalid bbox: %q is not a number", part)
+		}
+		v[i] = f
+	}
+	b := bbox{
+		minLon: max(v[0], -180),
+		minLat: max(v[1], -maxMercatorLat),
+		maxLon: min(v[2], 180),
+		maxLat: min(v[3], maxMercatorLat),
+	}
+	if b.minLon >= b.maxLon || b.minLat >= b.maxLat {
+		return bbox{}, fmt.Errorf("Invalid bbox: empty area")
+	}
+	return b, nil
+}
+
+// tileRange returns the inclusive range of tile coordinates covering a bbox at a zoom level
+func (b bbox) tileRange(z int) (x0, y0, x1, y1 int) {
+	n := 1 << z
+	clampTile := func(v float64) int {
+		return max(0, min(n-1, int(math.Floor(v/tileSize))))
+	}
+	px0, py0 := mercatorPixel(b.minLon, b.maxLat, z)
+	px1, py1 := mercatorPixel(b.maxLon, b.minLat, z)
+	return clampTile(px0), clampTile(py0), clampTile(px1), clampTile(py1)
+}
+
+// tileCount returns how many tiles cover a bbox between two zoom levels
+func (b bbox) tileCount(minZoom, maxZoom int) int {
+	count := 0
+	for z := minZoom; z <= maxZoom; z++ {
+		x0, y0, x1, y1 := b.tileRange(z)
+		count += (x1 - x0 + 1) * (y1 - y0 + 1)
+	}
+	return count
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"image"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// renderNormals encodes the surface normal at each pixel as RGB, x east, y north and z up, each
+// mapped from -1..1 to 0..255 as in OpenGL normal maps. Elevations are scaled by exaggeration,
+// and below the sea level the water surface is flat.
+func renderNormals(grid *elevationGrid, z, y, seaLevel int, exaggeration float64) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	encode := func(v float64) uint8 {
+		return uint8(math.Round((v + 1) / 2 * 255))
+	}
+	for py := 0; py < tileSize; py++ {
+		mpp := metersPerPixel(tileLatitude(z, float64(y)+(float64(py)+0.5)/tileSize), z)
+		for px := 0; px < tileSize; px++ {
+			i := py*tileSize + px
+			nx, ny, nz := 0.0, 0.0, 1.0
+			if grid[i] != noElevation && int(grid[i]) >= seaLevel {
+				if east, south, ok := gradient(grid, px, py, mpp); ok {
+					nx, ny = -east*exaggeration, south*exaggeration
+					length := math.Sqrt(nx*nx + ny*ny + 1)
+					nx, ny, nz = nx/length, ny/length, 1/length
+				}
+			}
+			offset := i * 4
+			img.Pix[offset] = encode(nx)
+			img.Pix[offset+1] = encode(ny)
+			img.Pix[offset+2] = encode(nz)
+			img.Pix[offset+3] = 255
+		}
+	}
+	return img
+}
+
+// serveNormals serves a normal map of the terrain for 3D clients to light it with, with
+// ?level= flattening the water below a sea level and ?exaggeration= steepening the terrain
+func serveNormals(w http.ResponseWriter, r *http.Request) {
+	z, x, y, ok := parseLayerTile(w, r)
+	if !ok {
+		return
+	}
+	seaLevel := math.MinInt
+	if s := r.URL.Query().Get("level"); s != "" {
+		level, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "Invalid sea level", http.StatusBadRequest)
+			return
+		}
+		seaLevel = clampSeaLevel(level)
+	}
+	exaggeration := 1.0
+	if s := r.URL.Query().Get("exaggeration"); s != "" {
+		var err error
+		if exaggeration, err = strconv.ParseFloat(s, 64); err != nil || exaggeration < 0.1 || exaggeration > 100 {
+			http.Error(w, "Invalid exaggeration: must be 0.1 to 100", http.StatusBadRequest)
+			return
+		}
+	}
+
+	grid, ok := loadLayerElevation(w, r, z, x, y)
+	if !ok {
+		return
+	}
+	writeLayerTile(w, "normals", renderNormals(grid, z, y, seaLevel, exaggeration))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// minSeaLevel is the lowest sea level that can be requested; anything deeper floods at every level
+const minSeaLevel = -1000
+
+// OceanMask remembers low-zoom tiles that are entirely deep ocean, so they never need
+// fetching or rendering from real elevation data again
+type OceanMask struct {
+	mu      sync.RWMutex
+	tiles   map[string]bool
+	maxZoom int
+	file    *os.File
+}
+
+var oceanMask = &OceanMask{
+	tiles:   make(map[string]bool),
+	maxZoom: 8,
+}
+
+// deepOceanGrid stands in for the elevation of any tile in the ocean mask
+var deepOceanGrid = func() *elevationGrid {
+	grid := new(elevationGrid)
+	for i := range grid {
+		grid[i] = minSeaLevel - 1
+	}
+	return grid
+}()
+
+// loadOceanMask reads previously learnt deep ocean tiles and appends new ones to the same file
+func loadOceanMask(path string, maxZoom int) (*OceanMask, error) {
+	mask := &OceanMask{
+		tiles:   make(map[string]bool),
+		maxZoom: maxZoom,
+	}
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				mask.tiles[line] = true
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	mask.file = f
+	return mask, nil
+}
+
+// contains reports whether a tile is known to be entirely deep ocean
+func (m *OceanMask) contains(z, x, y int) bool {
+	if z > m.maxZoom {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tiles[elevationKey(z, x, y)]
+}
+
+// learn adds a tile to the mask if every pixel is below the lowest possible sea level
+func (m *OceanMask) learn(z, x, y int, grid *elevationGrid) {
+	if z > m.maxZoom {
+		return
+	}
+	for _, elevation := range grid {
+		// Gaps in the data aren't evidence of ocean
+		if elevation >= minSeaLevel || elevation == noElevation {
+			return
+		}
+	}
+
+	key := elevationKey(z, x, y)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tiles[key] {
+		return
+	}
+	m.tiles[key] = true
+	log.Printf("Added tile to deep ocean mask: z=%d, x=%d, y=%d", z, x, y)
+
+	if m.file != nil {
+		if _, err := fmt.Fprintln(m.file, key); err != nil {
+			reportError("ocean_mask", err, map[string]string{"tile": key})
+		}
+	}
+}
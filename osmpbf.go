@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxPBFBlobSize is the largest blob the OSM PBF format allows
+const maxPBFBlobSize = 32 << 20
+
+var errTruncatedProtobuf = errors.New("truncated protobuf message")
+
+// protobufFields calls fn for each field of an encoded protobuf message, with the value of
+// varint and fixed width fields in v and the bytes of length-delimited ones in data
+func protobufFields(b []byte, fn func(field, wire int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncatedProtobuf
+		}
+		b = b[n:]
+		field, wire := int(key>>3), int(key&7)
+		var v uint64
+		var data []byte
+		switch wire {
+		case 0:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errTruncatedProtobuf
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errTruncatedProtobuf
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return errTruncatedProtobuf
+			}
+			data, b = b[n:n+int(length)], b[n+int(length):]
+		case 5:
+			if len(b) < 4 {
+				return errTruncatedProtobuf
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", wire)
+		}
+		if err := fn(field, wire, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packedVarints decodes a packed repeated varint field
+func packedVarints(b []byte) ([]uint64, error) {
+	var out []uint64
+	for len(b) > 0 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errTruncatedProtobuf
+		}
+		out = append(out, v)
+		b = b[n:]
+	}
+	return out, nil
+}
+
+func zigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// osmHandler receives the nodes and ways of an OSM PBF file; either may be nil to skip decoding
+// them. Relations aren't read.
+type osmHandler struct {
+	node func(id int64, lat, lon float64)
+	way  func(id int64, tags map[string]string, refs []int64)
+}
+
+// readOSMPBF reads an OSM PBF file, passing its nodes and ways to h
+func readOSMPBF(r io.Reader, h osmHandler) error {
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(r, size[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		headerSize := binary.BigEndian.Uint32(size[:])
+		if headerSize > 64<<10 {
+			return fmt.Errorf("blob header too large: %d bytes", headerSize)
+		}
+		header := make([]byte, headerSize)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		var kind string
+		var dataSize uint64
+		err := protobufFields(header, func(field, wire int, v uint64, data []byte) error {
+			switch field {
+			case 1:
+				kind = string(data)
+			case 3:
+				dataSize = v
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if dataSize > maxPBFBlobSize {
+			return fmt.Errorf("blob too large: %d bytes", dataSize)
+		}
+		blob := make([]byte, dataSize)
+		if _, err := io.ReadFull(r, blob); err != nil {
+			return err
+		}
+		if kind != "OSMData" {
+			continue
+		}
+		block, err := decodePBFBlob(blob)
+		if err != nil {
+			return err
+		}
+		if err := readPrimitiveBlock(block, h); err != nil {
+			return err
+		}
+	}
+}
+
+// decodePBFBlob returns the contents of a blob, which are raw or zlib compressed
+func decodePBFBlob(blob []byte) ([]byte, error) {
+	var raw, compressed []byte
+	var rawSize uint64
+	err := protobufFields(blob, func(field, wire int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			raw = data
+		case 2:
+			rawSize = v
+		case 3:
+			compressed = data
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if raw != nil {
+		return raw, nil
+	}
+	if compressed == nil {
+		return nil, fmt.Errorf("unsupported blob compression")
+	}
+	if rawSize > maxPBFBlobSize {
+		return nil, fmt.Errorf("blob too large: %d bytes", rawSize)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out := make([]byte, rawSize)
+	if _, err := io.ReadFull(zr, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// readPrimitiveBlock decodes the nodes and ways of a block of OSM data
+func readPrimitiveBlock(block []byte, h osmHandler) error {
+	var table []string
+	var groups [][]byte
+	granularity, latOffset, lonOffset := int64(100), int64(0), int64(0)
+	err := protobufFields(block, func(field, wire int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			return protobufFields(data, func(field, wire int, v uint64, s []byte) error {
+				if field == 1 {
+					table = append(table, string(s))
+				}
+				return nil
+			})
+		case 2:
+			groups = append(groups, data)
+		case 17:
+			granularity = int64(v)
+		case 19:
+			latOffset = int64(v)
+		case 20:
+			lonOffset = int64(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	coord := func(offset, v int64) float64 {
+		return 1e-9 * float64(offset+granularity*v)
+	}
+	str := func(i uint64) string {
+		if i < uint64(len(table)) {
+			return table[i]
+		}
+		return ""
+	}
+
+	for _, group := range groups {
+		err := protobufFields(group, func(field, wire int, v uint64, data []byte) error {
+			switch {
+			case field == 1 && h.node != nil:
+				var id, lat, lon int64
+				err := protobufFields(data, func(field, wire int, v uint64, _ []byte) error {
+					switch field {
+					case 1:
+						id = zigzag(v)
+					case 8:
+						lat = zigzag(v)
+					case 9:
+						lon = zigzag(v)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				h.node(id, coord(latOffset, lat), coord(lonOffset, lon))
+
+			case field == 2 && h.node != nil:
+				var ids, lats, lons []uint64
+				err := protobufFields(data, func(field, wire int, v uint64, packed []byte) error {
+					var err error
+					switch field {
+					case 1:
+						ids, err = packedVarints(packed)
+					case 8:
+						lats, err = packedVarints(packed)
+					case 9:
+						lons, err = packedVarints(packed)
+					}
+					return err
+				})
+				if err != nil {
+					return err
+				}
+				if len(lats) != len(ids) || len(lons) != len(ids) {
+					return fmt.Errorf("dense nodes have mismatched lengths")
+				}
+				var id, lat, lon int64
+				for i := range ids {
+					id += zigzag(ids[i])
+					lat += zigzag(lats[i])
+					lon += zigzag(lons[i])
+					h.node(id, coord(latOffset, lat), coord(lonOffset, lon))
+				}
+
+			case field == 3 && h.way != nil:
+				var id int64
+				var keys, vals, refs []uint64
+				err := protobufFields(data, func(field, wire int, v uint64, packed []byte) error {
+					var err error
+					switch field {
+					case 1:
+						id = int64(v)
+					case 2:
+						keys, err = packedVarints(packed)
+					case 3:
+						vals, err = packedVarints(packed)
+					case 8:
+						refs, err = packedVarints(packed)
+					}
+					return err
+				})
+				if err != nil {
+					return err
+				}
+				tags := make(map[string]string, len(keys))
+				for i := 0; i < len(keys) && i < len(vals); i++ {
+					tags[str(keys[i])] = str(vals[i])
+				}
+				nodes := make([]int64, len(refs))
+				var ref int64
+				for i, delta := range refs {
+					ref += zigzag(delta)
+					nodes[i] = ref
+				}
+				h.way(id, tags, nodes)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
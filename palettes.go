@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// palette is a named style chosen with ?palette=, setting the water color, an optional
+// shoreline edge and optional depth shading
+type palette struct {
+	fill  color.RGBA
+	edge  color.RGBA  // Transparent for no edge
+	depth []depthStop // Empty for a flat fill
+}
+
+// paletteConfig is a palette as written in PALETTES_FILE, with colors in hex and the depth ramp
+// as for DEPTH_RAMP
+type paletteConfig struct {
+	Fill  string `json:"fill"`
+	Edge  string `json:"edge,omitempty"`
+	Depth string `json:"depth,omitempty"`
+}
+
+// palettesMu guards palettes, which the admin API changes while tiles are being rendered
+var palettesMu sync.RWMutex
+
+// palettes holds the built-in palettes, plus any from PALETTES_FILE and saved in the store
+var palettes = map[string]*palette{
+	"classic": {fill: waterColor},
+	"satellite": {
+		fill: color.RGBA{0, 150, 255, 110},
+		edge: color.RGBA{120, 230, 255, 255},
+	},
+	"print": {
+		fill: color.RGBA{160, 200, 235, 255},
+		edge: color.RGBA{0, 40, 90, 255},
+	},
+}
+
+// builtinPalettes can't be replaced or removed through the admin API
+var builtinPalettes = map[string]bool{"classic": true, "satellite": true, "print": true}
+
+// loadPalettes reads palettes from a JSON object of names to palettes
+func loadPalettes(path string) (map[string]*palette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs map[string]paletteConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("invalid palettes %s: %v", path, err)
+	}
+	loaded := make(map[string]*palette)
+	for name, config := range configs {
+		p, err := config.parse()
+		if err != nil {
+			return nil, fmt.Errorf("palette %q: %v", name, err)
+		}
+		loaded[name] = p
+	}
+	return loaded, nil
+}
+
+// addPalettes adds or replaces palettes by name
+func addPalettes(loaded map[string]*palette) {
+	palettesMu.Lock()
+	defer palettesMu.Unlock()
+	for name, p := range loaded {
+		palettes[name] = p
+	}
+}
+
+func (c paletteConfig) parse() (*palette, error) {
+	var p palette
+	var err error
+	if p.fill, err = parseHexColor(c.Fill); err != nil {
+		return nil, fmt.Errorf("fill: %v", err)
+	}
+	if c.Edge != "" {
+		if p.edge, err = parseHexColor(c.Edge); err != nil {
+			return nil, fmt.Errorf("edge: %v", err)
+		}
+	}
+	if c.Depth != "" {
+		if p.depth, err = parseDepthRamp(c.Depth); err != nil {
+			return nil, fmt.Errorf("depth: %v", err)
+		}
+	}
+	return &p, nil
+}
+
+// palettesKey describes every palette, for the tile version
+func palettesKey() string {
+	palettesMu.RLock()
+	defer palettesMu.RUnlock()
+	names := make([]string, 0, len(palettes))
+	for name := range palettes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		p := palettes[name]
+		parts[i] = fmt.Sprintf("%s:%s/%s/%s", name, colorKey(p.fill), colorKey(p.edge), depthRampKey(p.depth))
+	}
+	return strings.Join(parts, ";")
+}
+
+func lookupPalette(name string) (*palette, error) {
+	palettesMu.RLock()
+	defer palettesMu.RUnlock()
+	p, ok := palettes[name]
+	if !ok {
+		var names []string
+		for name := range palettes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Unknown palette %q: use one of %s", name, strings.Join(names, ", "))
+	}
+	return p, nil
+}
+
+// loadSavedStyles adds the palettes saved through the admin API
+func loadSavedStyles() (int, error) {
+	specs, err := store.styles()
+	if err != nil {
+		return 0, err
+	}
+	palettesMu.Lock()
+	defer palettesMu.Unlock()
+	for name, spec := range specs {
+		var config paletteConfig
+		if err := json.Unmarshal([]byte(spec), &config); err != nil {
+			return 0, fmt.Errorf("style %q: %v", name, err)
+		}
+		p, err := config.parse()
+		if err != nil {
+			return 0, fmt.Errorf("style %q: %v", name, err)
+		}
+		palettes[name] = p
+	}
+	return len(specs), nil
+}
+
+// serveStyleSave creates or replaces a saved style, taking a palette as written in PALETTES_FILE
+func serveStyleSave(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		http.Error(w, "Saving styles needs STORE_PATH", http.StatusNotFound)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if !adminNamePattern.MatchString(name) {
+		http.Error(w, "Style names are up to 64 lowercase letters, digits, _ and -", http.StatusBadRequest)
+		return
+	}
+	if builtinPalettes[name] {
+		http.Error(w, fmt.Sprintf("%q is a built-in palette", name), http.StatusConflict)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "Failed to read style", http.StatusBadRequest)
+		return
+	}
+	var config paletteConfig
+	if err := json.Unmarshal(body, &config); err != nil {
+		http.Error(w, "Invalid style: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, err := config.parse()
+	if err != nil {
+		http.Error(w, "Invalid style: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	spec, _ := json.Marshal(config)
+	if err := store.saveStyle(name, string(spec)); err != nil {
+		reportError("store", err, map[string]string{"style": name})
+		http.Error(w, "Failed to save style", http.StatusInternalServerError)
+		return
+	}
+
+	palettesMu.Lock()
+	palettes[name] = p
+	palettesMu.Unlock()
+	refreshTileVersion()
+	recordAudit(r, "style.save", map[string]string{"name": name, "spec": string(spec)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveStyleDelete removes a saved style
+func serveStyleDelete(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		http.Error(w, "Saving styles needs STORE_PATH", http.StatusNotFound)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if builtinPalettes[name] {
+		http.Error(w, fmt.Sprintf("%q is a built-in palette", name), http.StatusConflict)
+		return
+	}
+	deleted, err := store.deleteStyle(name)
+	if err != nil {
+		reportError("store", err, map[string]string{"style": name})
+		http.Error(w, "Failed to delete style", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "No such style", http.StatusNotFound)
+		return
+	}
+
+	palettesMu.Lock()
+	delete(palettes, name)
+	palettesMu.Unlock()
+	refreshTileVersion()
+	recordAudit(r, "style.delete", map[string]string{"name": name})
+	w.WriteHeader(http.StatusNoContent)
+}
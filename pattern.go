@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+// fillPatterns are the patterns flooded areas can be drawn with for grayscale print and
+// color-blind readers, each reporting whether a global pixel is on the pattern. Their periods
+// divide the tile size, and they're aligned to global pixel coordinates, so they continue
+// seamlessly across tiles.
+var fillPatterns = map[string]func(gx, gy int) bool{
+	"hatch": func(gx, gy int) bool {
+		return (gx+gy)%8 < 2
+	},
+	"crosshatch": func(gx, gy int) bool {
+		return (gx+gy)%8 < 2 || ((gx-gy)%8+8)%8 < 2
+	},
+	"dots": func(gx, gy int) bool {
+		return gx%4 < 2 && gy%4 < 2 && (gx/4+gy/4)%2 == 0
+	},
+}
+
+// patternBackground is the percentage of its opacity a flooded pixel off the pattern keeps, so
+// flooded areas still read as areas on screen
+const patternBackground = 25
+
+func checkFillPattern(name string) error {
+	if _, ok := fillPatterns[name]; !ok {
+		return fmt.Errorf("Unknown pattern: %s", name)
+	}
+	return nil
+}
+
+// applyPattern fades the pixels of a tile that are off a pattern
+func applyPattern(img *image.RGBA, name string, x, y int) {
+	onPattern := fillPatterns[name]
+	for py := 0; py < tileSize; py++ {
+		for px := 0; px < tileSize; px++ {
+			if onPattern(x*tileSize+px, y*tileSize+py) {
+				continue
+			}
+			offset := py*img.Stride + px*4
+			for i := offset; i < offset+4; i++ {
+				img.Pix[i] = uint8(int(img.Pix[i]) * patternBackground / 100)
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// peerGroup spreads rendering across several instances: each tile has one owner, chosen by
+// rendezvous hashing of its coordinates, which renders it and shares the result with the
+// others. Every sea level of a tile goes to the same owner, so its elevation grid is reused.
+// Peers authenticate with CACHE_PEER_API_KEY, which each must accept as an admin key.
+type peerGroup struct {
+	self   string
+	peers  []string // Base URLs, including self
+	apiKey string
+	client *http.Client
+}
+
+// peers is nil unless CACHE_PEERS is set
+var peers *peerGroup
+
+// newPeerGroup sets up a group from a comma-separated list of peer URLs, one of which is self
+func newPeerGroup(list, self, apiKey string) (*peerGroup, error) {
+	g := &peerGroup{
+		self:   strings.TrimRight(self, "/"),
+		apiKey: apiKey,
+		client: &http.Client{Timeout: time.Minute},
+	}
+	found := false
+	for _, peer := range strings.Split(list, ",") {
+		peer = strings.TrimRight(strings.TrimSpace(peer), "/")
+		if peer == "" {
+			continue
+		}
+		if u, err := url.Parse(peer); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid peer URL %q", peer)
+		}
+		found = found || peer == g.self
+		g.peers = append(g.peers, peer)
+	}
+	if !found {
+		return nil, fmt.Errorf("CACHE_PEER_SELF %q is not in CACHE_PEERS", self)
+	}
+	if apiKey == "" {
+		return nil, fmt.Errorf("CACHE_PEER_API_KEY must be set so peers can reach each other")
+	}
+	return g, nil
+}
+
+// owner returns the peer responsible for rendering a tile
+func (g *peerGroup) owner(z, x, y string) string {
+	var best string
+	var bestScore uint64
+	for _, peer := range g.peers {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%s|%s/%s/%s", peer, z, x, y)
+		if score := h.Sum64(); best == "" || score > bestScore {
+			best, bestScore = peer, score
+		}
+	}
+	return best
+}
+
+// fetch asks a tile's owner for it; ok is false if this node owns the tile itself
+func (g *peerGroup) fetch(seaLevel int, z, x, y string, opts tileOptions) (data []byte, ok bool, err error) {
+	owner := g.owner(z, x, y)
+	if owner == g.self {
+		return nil, false, nil
+	}
+
+	start := time.Now()
+	peerURL := fmt.Sprintf("%s/admin/peer/%d/%s/%s/%s?%s", owner, seaLevel, z, x, y, peerQuery(opts).Encode())
+	req, err := http.NewRequest("GET", peerURL, nil)
+	if err != nil {
+		return nil, true, err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.apiKey)
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to fetch tile from peer %s: %v", owner, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, true, fmt.Errorf("peer %s returned status %d", owner, resp.StatusCode)
+	}
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to read tile from peer %s: %v", owner, err)
+	}
+	metrics.timing("peer_fetch", time.Since(start))
+	return data, true, nil
+}
+
+// peerQuery encodes the options that change a tile, for the owner to render it the same way
+func peerQuery(opts tileOptions) url.Values {
+	q := url.Values{}
+	q.Set("format", opts.format.name)
+	if opts.rivers {
+		q.Set("rivers", "1")
+	}
+	if opts.erosion {
+		q.Set("erosion", "1")
+	}
+	if opts.connected {
+		q.Set("connected", "1")
+	}
+	if opts.dryLand {
+		q.Set("dryland", "1")
+	}
+	if opts.inland {
+		q.Set("inland", "1")
+	}
+	if opts.coastline {
+		q.Set("coastline", "1")
+	}
+	if opts.bedrock {
+		q.Set("bedrock", "1")
+	}
+	if len(opts.levels) > 0 {
+		strs := make([]string, len(opts.levels))
+		for i, level := range opts.levels {
+			strs[i] = strconv.Itoa(level)
+		}
+		q.Set("levels", strings.Join(strs, ","))
+	}
+	if len(opts.bands) > 0 {
+		q.Set("bands", bandsKey(opts.bands))
+	}
+	if opts.outline {
+		q.Set("style", "outline")
+	}
+	if opts.diff {
+		q.Set("diff", strconv.Itoa(opts.diffFrom))
+	}
+	if len(opts.depth) > 0 {
+		q.Set("ramp", depthRampKey(opts.depth))
+	}
+	if opts.water != waterColor {
+		q.Set("color", colorKey(opts.water))
+	}
+	if opts.edge.A > 0 {
+		q.Set("edge", colorKey(opts.edge))
+	}
+	if opts.pattern != "" {
+		q.Set("pattern", opts.pattern)
+	}
+	if opts.opacity != 100 {
+		q.Set("opacity", strconv.Itoa(opts.opacity))
+	}
+	if !opts.watermark {
+		q.Set("watermark", "0")
+	}
+	return q
+}
+
+// parsePeerQuery reverses peerQuery
+func parsePeerQuery(q url.Values) (tileOptions, error) {
+	opts := defaultTileOptions()
+	if name := q.Get("format"); name != "" {
+		f, ok := tileFormats[name]
+		if !ok {
+			return opts, fmt.Errorf("Unsupported format: %s", name)
+		}
+		opts.format = f
+	}
+	opts.rivers = q.Get("rivers") == "1"
+	opts.erosion = q.Get("erosion") == "1"
+	opts.connected = q.Get("connected") == "1"
+	opts.dryLand = q.Get("dryland") == "1"
+	opts.inland = q.Get("inland") == "1"
+	opts.coastline = q.Get("coastline") == "1"
+	opts.bedrock = q.Get("bedrock") == "1"
+	opts.watermark = q.Get("watermark") != "0"
+	opts.outline = q.Get("style") == "outline"
+	var err error
+	if levels := q.Get("levels"); levels != "" {
+		if opts.levels, err = parseLevelList(levels); err != nil {
+			return opts, err
+		}
+	}
+	if bands := q.Get("bands"); bands != "" {
+		if opts.bands, err = parseBands(bands); err != nil {
+			return opts, err
+		}
+	}
+	if from := q.Get("diff"); from != "" {
+		if opts.diffFrom, err = strconv.Atoi(from); err != nil {
+			return opts, fmt.Errorf("Invalid diff level: %q", from)
+		}
+		opts.diff = true
+	}
+	if ramp := q.Get("ramp"); ramp != "" {
+		if opts.depth, err = parseDepthRamp(ramp); err != nil {
+			return opts, err
+		}
+	}
+	if c := q.Get("color"); c != "" {
+		if opts.water, err = parseHexColor(c); err != nil {
+			return opts, err
+		}
+	}
+	if edge := q.Get("edge"); edge != "" {
+		if opts.edge, err = parseHexColor(edge); err != nil {
+			return opts, err
+		}
+	}
+	if pattern := q.Get("pattern"); pattern != "" {
+		if err := checkFillPattern(pattern); err != nil {
+			return opts, err
+		}
+		opts.pattern = pattern
+	}
+	if opacity := q.Get("opacity"); opacity != "" {
+		if opts.opacity, err = parseOpacity(opacity); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// servePeerTile renders a tile this node owns for another peer
+func servePeerTile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	level, _ := strconv.Atoi(vars["level"])
+	opts, err := parsePeerQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.peer = true
+
+	data, err := generateSeaLevelTile(level, vars["z"], vars["x"], vars["y"], opts)
+	if err == errElevationMissing {
+		http.Error(w, "No elevation data for this tile", http.StatusNotFound)
+		return
+	}
+	if err == errUpstreamUnavailable {
+		http.Error(w, "Elevation source unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("Error generating tile for peer: %v", err)
+		http.Error(w, "Failed to generate tile", http.StatusInternalServerError)
+		return
+	}
+	metrics.incr("peer_tiles_served")
+	w.Header().Set("Content-Type", opts.format.contentType)
+	w.Write(data)
+}
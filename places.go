@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// placesCSV is a small built-in gazetteer of major cities, used unless GAZETTEER_FILE is set
+//
+//go:embed places.csv
+var placesCSV string
+
+const (
+	// placesZoom is the zoom level place elevations are sampled at (about 40 m per pixel)
+	placesZoom = 12
+
+	// maxPlaceLookups limits how many places one request may look up, largest first
+	maxPlaceLookups = 200
+)
+
+// place is a populated place from the gazetteer
+type place struct {
+	Name       string  `json:"name"`
+	Country    string  `json:"country"`
+	Lat        float64 `json:"lat"`
+	Lon        float64 `json:"lon"`
+	Population int     `json:"population"`
+	Elevation  int     `json:"elevation"`
+}
+
+var (
+	places []place // Sorted by population, largest first
+
+	// Elevations of places looked up so far, by index into places
+	placeElevationsMu sync.Mutex
+	placeElevations   = make(map[int]int)
+)
+
+// loadPlaces reads the built-in gazetteer
+func loadPlaces() ([]place, error) {
+	records, err := csv.NewReader(strings.NewReader(placesCSV)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var out []place
+	for _, rec := range records[1:] {
+		p, err := parsePlace(rec[0], rec[1], rec[2], rec[3], rec[4])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// loadGeoNames reads a GeoNames cities file such as cities15000.txt
+func loadGeoNames(r io.Reader) ([]place, error) {
+	var out []place
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 15 {
+			continue
+		}
+		p, err := parsePlace(fields[1], fields[8], fields[4], fields[5], fields[14])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, scanner.Err()
+}
+
+func parsePlace(name, country, lat, lon, population string) (place, error) {
+	p := place{Name: name, Country: country}
+	var err error
+	if p.Lat, err = strconv.ParseFloat(lat, 64); err != nil {
+		return place{}, fmt.Errorf("invalid latitude for %s: %v", name, err)
+	}
+	if p.Lon, err = strconv.ParseFloat(lon, 64); err != nil {
+		return place{}, fmt.Errorf("invalid longitude for %s: %v", name, err)
+	}
+	if p.Population, err = strconv.Atoi(population); err != nil {
+		return place{}, fmt.Errorf("invalid population for %s: %v", name, err)
+	}
+	return p, nil
+}
+
+// setupPlaces loads the gazetteer from GAZETTEER_FILE, or the built-in one
+func setupPlaces(path string) error {
+	var loaded []place
+	var err error
+	if path == "" {
+		loaded, err = loadPlaces()
+	} else {
+		var f *os.File
+		if f, err = os.Open(path); err != nil {
+			return err
+		}
+		defer f.Close()
+		loaded, err = loadGeoNames(f)
+	}
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(loaded, func(i, j int) bool { return loaded[i].Population > loaded[j].Population })
+	places = loaded
+	return nil
+}
+
+// pointPixel returns the tile covering a point at a zoom level and the index of its pixel there
+func pointPixel(lat, lon float64, z int) (x, y, i int) {
+	px, py := mercatorPixel(lon, lat, z)
+	n := 1 << z
+	gx := max(0, min(n*tileSize-1, int(px)))
+	gy := max(0, min(n*tileSize-1, int(py)))
+	return gx / tileSize, gy / tileSize, (gy%tileSize)*tileSize + gx%tileSize
+}
+
+// pointElevation returns the elevation at a point, sampled from the tile covering it at a zoom
+// level as it is rendered
+func pointElevation(lat, lon float64, z int) (int, error) {
+	x, y, i := pointPixel(lat, lon, z)
+	grid, err := loadTileGrid(z, x, y, false, nil)
+	if err != nil {
+		return 0, err
+	}
+	return int(grid[i]), nil
+}
+
+// placeElevation looks up the elevation of a place, remembering it for next time
+func placeElevation(i int) (int, error) {
+	placeElevationsMu.Lock()
+	elevation, exists := placeElevations[i]
+	placeElevationsMu.Unlock()
+	if exists {
+		return elevation, nil
+	}
+
+	elevation, err := pointElevation(places[i].Lat, places[i].Lon, placesZoom)
+	if err != nil {
+		return 0, err
+	}
+	placeElevationsMu.Lock()
+	placeElevations[i] = elevation
+	placeElevationsMu.Unlock()
+	return elevation, nil
+}
+
+// servePlaces lists the places in a bbox that lie below a sea level, largest first
+func servePlaces(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	area, err := parseBBox(query.Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	level, err := strconv.Atoi(query.Get("level"))
+	if err != nil {
+		http.Error(w, "Invalid sea level", http.StatusBadRequest)
+		return
+	}
+	level = clampSeaLevel(level)
+
+	// Only the largest places in view are worth looking up
+	var candidates []int
+	for i, p := range places {
+		if p.Lon >= area.minLon && p.Lon <= area.maxLon && p.Lat >= area.minLat && p.Lat <= area.maxLat {
+			candidates = append(candidates, i)
+			if len(candidates) == maxPlaceLookups {
+				break
+			}
+		}
+	}
+
+	elevations := make([]int, len(candidates))
+	failed := make([]bool, len(candidates))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 8)
+	for n, i := range candidates {
+		n, i := n, i
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			elevation, err := placeElevation(i)
+			if err != nil {
+				reportError("upstream", err, map[string]string{"endpoint": "places"})
+				failed[n] = true
+				return
+			}
+			elevations[n] = elevation
+		}()
+	}
+	wg.Wait()
+
+	flooded := []place{}
+	complete := true
+	for n, i := range candidates {
+		if failed[n] {
+			complete = false
+		} else if elevations[n] < level {
+			p := places[i]
+			p.Elevation = elevations[n]
+			flooded = append(flooded, p)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"level":    level,
+		"places":   flooded,
+		"complete": complete,
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request priorities, highest first
+const (
+	priorityInteractive = iota
+	priorityPrefetch
+	numPriorities
+)
+
+// RenderPool limits how many tiles are generated at once; when it is full, waiting
+// requests are admitted highest priority first and in arrival order within a priority
+type RenderPool struct {
+	mu      sync.Mutex
+	size    int
+	running int
+	waiting [numPriorities][]chan struct{}
+}
+
+var renderPool = newRenderPool(0)
+
+// newRenderPool creates a pool running at most size generations at once (0 is unlimited)
+func newRenderPool(size int) *RenderPool {
+	return &RenderPool{size: size}
+}
+
+// acquire blocks until a generation slot is free for the given priority
+func (p *RenderPool) acquire(priority int) {
+	if p.size <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	if p.running < p.size {
+		p.running++
+		p.mu.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	p.waiting[priority] = append(p.waiting[priority], ch)
+	p.mu.Unlock()
+
+	start := time.Now()
+	<-ch
+	metrics.timing("render_queue_wait", time.Since(start), "priority:"+priorityName(priority))
+}
+
+// release frees a slot, handing it straight to the highest priority waiter if there is one
+func (p *RenderPool) release() {
+	if p.size <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for priority := range p.waiting {
+		if len(p.waiting[priority]) > 0 {
+			ch := p.waiting[priority][0]
+			p.waiting[priority] = p.waiting[priority][1:]
+			close(ch)
+			return
+		}
+	}
+	p.running--
+}
+
+// requestPriority reads the priority hint from the X-Tile-Priority header or priority parameter
+func requestPriority(r *http.Request) int {
+	hint := r.URL.Query().Get("priority")
+	if hint == "" {
+		hint = r.Header.Get("X-Tile-Priority")
+	}
+	switch strings.ToLower(strings.TrimSpace(hint)) {
+	case "prefetch", "low":
+		return priorityPrefetch
+	}
+	return priorityInteractive
+}
+
+func priorityName(priority int) string {
+	if priority == priorityPrefetch {
+		return "prefetch"
+	}
+	return "interactive"
+}
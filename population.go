@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// maxPopulationPixels limits how many population raster pixels one request adds up
+const maxPopulationPixels = 4000000
+
+// populationGrid is a gridded population count in EPSG:4326, such as WorldPop or GPW, with
+// people per pixel; population estimates are unavailable without it
+var populationGrid *geoTIFF
+
+// openPopulation opens POPULATION_FILE
+func openPopulation(path string) (*geoTIFF, error) {
+	g, err := openGeoTIFF(path)
+	if err != nil {
+		return nil, err
+	}
+	if g.mercator {
+		return nil, fmt.Errorf("%s: population grids must be in EPSG:4326", path)
+	}
+	return g, nil
+}
+
+// countPopulation adds up the people in a bbox, and those of them living where the mask is
+// flooded. Each population pixel counts as flooded or not by its centre.
+func countPopulation(g *geoTIFF, area bbox, flooded *floodMask, originX, originY, zoom int) (below, total float64, err error) {
+	c0 := max(0, int(math.Ceil((area.minLon-g.originX)/g.scaleX)))
+	c1 := min(g.width-1, int(math.Floor((area.maxLon-g.originX)/g.scaleX)))
+	r0 := max(0, int(math.Ceil((g.originY-area.maxLat)/g.scaleY)))
+	r1 := min(g.height-1, int(math.Floor((g.originY-area.minLat)/g.scaleY)))
+	if c0 > c1 || r0 > r1 {
+		return 0, 0, nil
+	}
+	if (c1-c0+1)*(r1-r0+1) > maxPopulationPixels {
+		return 0, 0, fmt.Errorf("Area too large: at most %d population cells", maxPopulationPixels)
+	}
+
+	for row := r0; row <= r1; row++ {
+		lat := g.originY - float64(row)*g.scaleY
+		for col := c0; col <= c1; col++ {
+			people, ok := g.pixel(col, row)
+			if !ok || people <= 0 {
+				continue
+			}
+			total += people
+			px, py := mercatorPixel(g.originX+float64(col)*g.scaleX, lat, zoom)
+			if flooded.at(int(px)-originX, int(py)-originY) {
+				below += people
+			}
+		}
+	}
+	return below, total, nil
+}
+
+// servePopulation estimates how many people live below ?level= within ?bbox=, from the tiles at
+// the most detailed zoom that needs at most maxFloodPolyTiles
+func servePopulation(w http.ResponseWriter, r *http.Request) {
+	if populationGrid == nil {
+		http.Error(w, "Population estimates are not configured", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	area, err := parseBBox(query.Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	level, err := strconv.Atoi(query.Get("level"))
+	if err != nil {
+		http.Error(w, "Invalid sea level", http.StatusBadRequest)
+		return
+	}
+	level = clampSeaLevel(level)
+	connected := query.Get("connected") == "1"
+	if connected && oceanSeeds == nil {
+		http.Error(w, "Connected flooding mode is not configured", http.StatusBadRequest)
+		return
+	}
+
+	zoom := upstreamMaxZoom
+	for zoom > 0 && area.tileCount(zoom, zoom) > maxFloodPolyTiles {
+		zoom--
+	}
+	renderPool.acquire(requestPriority(r))
+	mask, originX, originY, err := loadFloodMask(area, zoom, level, connected)
+	renderPool.release()
+	if err == errUpstreamUnavailable {
+		w.Header().Set("Retry-After", fmt.Sprint(int(breakerCooldown.Seconds())))
+		http.Error(w, "Elevation source unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch elevation", http.StatusBadGateway)
+		log.Printf("Error fetching elevation for %s: %v", r.URL.Path, err)
+		return
+	}
+
+	below, total, err := countPopulation(populationGrid, area, mask, originX, originY, zoom)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metrics.incr("api_requests", "endpoint:population")
+	writeJSON(w, map[string]interface{}{
+		"level":      level,
+		"zoom":       zoom,
+		"connected":  connected,
+		"population": math.Round(below),
+		"total":      math.Round(total),
+	})
+}
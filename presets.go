@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// demPreset is a ready-made elevation setup for a public DEM, chosen with ELEVATION_PRESET
+type demPreset struct {
+	sources     string // As for ELEVATION_SOURCES
+	attribution string
+}
+
+// demPresets lists the public DEMs known to work. The 1° cell DEMs only cover land and open too
+// many files at low zooms, so terrarium tiles fill in the oceans and zooms below about 6.
+var demPresets = map[string]demPreset{
+	"terrarium": {
+		sources:     "terrarium:default",
+		attribution: "Terrain Tiles (Mapzen, AWS)",
+	},
+	"copernicus30": {
+		sources:     "cells:https://copernicus-dem-30m.s3.amazonaws.com/Copernicus_DSM_COG_10_{NS}{lat}_00_{EW}{lon}_00_DEM/Copernicus_DSM_COG_10_{NS}{lat}_00_{EW}{lon}_00_DEM.tif terrarium:default",
+		attribution: "Copernicus DEM GLO-30 (© DLR e.V. 2010-2014 and © Airbus Defence and Space GmbH 2014-2018, provided under COPERNICUS by the European Union and ESA), Terrain Tiles (Mapzen, AWS)",
+	},
+	"copernicus90": {
+		sources:     "cells:https://copernicus-dem-90m.s3.amazonaws.com/Copernicus_DSM_COG_30_{NS}{lat}_00_{EW}{lon}_00_DEM/Copernicus_DSM_COG_30_{NS}{lat}_00_{EW}{lon}_00_DEM.tif terrarium:default",
+		attribution: "Copernicus DEM GLO-90 (© DLR e.V. 2010-2014 and © Airbus Defence and Space GmbH 2014-2018, provided under COPERNICUS by the European Union and ESA), Terrain Tiles (Mapzen, AWS)",
+	},
+	"nasadem": {
+		sources:     "cells:https://nasademeuwest.blob.core.windows.net/nasadem-cog/v001/NASADEM_HGT_{ns}{lat}{ew}{lon}.tif terrarium:default",
+		attribution: "NASADEM (NASA JPL), Terrain Tiles (Mapzen, AWS)",
+	},
+}
+
+// elevationCredit names the elevation data in attributions; ELEVATION_ATTRIBUTION overrides it
+var elevationCredit = demPresets["terrarium"].attribution
+
+func lookupDEMPreset(name string) (demPreset, error) {
+	preset, ok := demPresets[name]
+	if !ok {
+		var names []string
+		for name := range demPresets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return preset, fmt.Errorf("unknown preset %q; use one of %s", name, strings.Join(names, ", "))
+	}
+	return preset, nil
+}
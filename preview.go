@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Open Graph images are recommended to be 1200x630
+const (
+	previewWidth  = 1200
+	previewHeight = 630
+)
+
+// seaLevelCaption describes a sea level for humans, e.g. "+3 m sea level"
+func seaLevelCaption(level int) string {
+	if level == 0 {
+		return "Current sea level"
+	}
+	return fmt.Sprintf("%+d m sea level", level)
+}
+
+// servePreview renders a social media preview image of a flooded view
+func servePreview(w http.ResponseWriter, r *http.Request) {
+	level, err := strconv.Atoi(mux.Vars(r)["level"])
+	if err != nil {
+		http.Error(w, "Invalid sea level", http.StatusBadRequest)
+		return
+	}
+	level = clampSeaLevel(level)
+
+	lat, lon, zoom, err := parseViewParams(r, 15)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	img := renderView(mapView{
+		level:  level,
+		lat:    lat,
+		lon:    lon,
+		zoom:   zoom,
+		width:  previewWidth,
+		height: previewHeight,
+	}, 0.7)
+
+	// Caption panel in the bottom-left corner
+	caption := seaLevelCaption(level)
+	scale := 6
+	pad := 24
+	panel := image.Rect(0, previewHeight-textHeight(scale)-2*pad, textWidth(caption, scale)+2*pad, previewHeight)
+	fillRect(img, panel, color.RGBA{255, 255, 255, 220})
+	drawText(img, panel.Min.X+pad, panel.Min.Y+pad, caption, scale, color.RGBA{0, 50, 120, 255})
+
+	// Attribution in the bottom-right corner
+	attribution := basemapAttribution()
+	drawTextHalo(img, previewWidth-textWidth(attribution, 2)-8, previewHeight-textHeight(2)-8,
+		attribution, 2, color.RGBA{51, 51, 51, 255}, color.RGBA{255, 255, 255, 255})
+	stampWatermark(img, textHeight(2)+16)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		reportError("render", err, map[string]string{"endpoint": "preview"})
+		http.Error(w, "Failed to render preview", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(buf.Bytes())
+
+	log.Printf("Served preview: level=%d, lat=%f, lon=%f, zoom=%d", level, lat, lon, zoom)
+}
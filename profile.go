@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// maxProfileBytes limits the size of a posted line
+	maxProfileBytes = 1 << 20
+
+	// maxProfileSamples limits how many points along a line are looked up
+	maxProfileSamples = 2000
+
+	earthRadius = 6371008.8 // meters
+)
+
+// lineStringGeometry is a GeoJSON LineString, either bare or as the geometry of a Feature
+type lineStringGeometry struct {
+	Type        string              `json:"type"`
+	Coordinates [][]float64         `json:"coordinates"`
+	Geometry    *lineStringGeometry `json:"geometry"`
+}
+
+// profilePoint is one sample along a profile; elevation is null where there's no data, and
+// underwater is only given for a sea level
+type profilePoint struct {
+	Lon        float64 `json:"lon"`
+	Lat        float64 `json:"lat"`
+	Distance   float64 `json:"distance"`
+	Elevation  *int    `json:"elevation"`
+	Underwater *bool   `json:"underwater,omitempty"`
+}
+
+// haversine returns the great circle distance in meters between two points
+func haversine(lon1, lat1, lon2, lat2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// parseLineString checks a posted line and returns its vertices as [lon, lat]
+func parseLineString(g lineStringGeometry) ([][2]float64, error) {
+	if g.Type == "Feature" {
+		if g.Geometry == nil {
+			return nil, fmt.Errorf("Feature has no geometry")
+		}
+		g = *g.Geometry
+	}
+	if g.Type != "LineString" {
+		return nil, fmt.Errorf("Expected a GeoJSON LineString, not %q", g.Type)
+	}
+	if len(g.Coordinates) < 2 {
+		return nil, fmt.Errorf("LineString needs at least two positions")
+	}
+	line := make([][2]float64, len(g.Coordinates))
+	for i, c := range g.Coordinates {
+		if len(c) < 2 || c[0] < -180 || c[0] > 180 || c[1] < -maxMercatorLat || c[1] > maxMercatorLat {
+			return nil, fmt.Errorf("Invalid position %d", i)
+		}
+		line[i] = [2]float64{c[0], c[1]}
+	}
+	return line, nil
+}
+
+// sampleLine returns n points evenly spaced along a line, with their distances from its start.
+// Positions within each segment are interpolated linearly in longitude and latitude.
+func sampleLine(line [][2]float64, n int) (points [][2]float64, distances []float64) {
+	cumulative := make([]float64, len(line))
+	for i := 1; i < len(line); i++ {
+		cumulative[i] = cumulative[i-1] + haversine(line[i-1][0], line[i-1][1], line[i][0], line[i][1])
+	}
+	total := cumulative[len(line)-1]
+	segment := 1
+	for k := 0; k < n; k++ {
+		d := total * float64(k) / float64(n-1)
+		for segment < len(line)-1 && cumulative[segment] < d {
+			segment++
+		}
+		a, b := line[segment-1], line[segment]
+		t := 0.0
+		if length := cumulative[segment] - cumulative[segment-1]; length > 0 {
+			t = (d - cumulative[segment-1]) / length
+		}
+		points = append(points, [2]float64{a[0] + (b[0]-a[0])*t, a[1] + (b[1]-a[1])*t})
+		distances = append(distances, d)
+	}
+	return points, distances
+}
+
+// serveProfile samples elevations along a posted GeoJSON LineString, ?samples= of them (200 by
+// default), saying which are under water at ?level= if given
+func serveProfile(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	samples := 200
+	if s := query.Get("samples"); s != "" {
+		var err error
+		if samples, err = strconv.Atoi(s); err != nil || samples < 2 || samples > maxProfileSamples {
+			http.Error(w, fmt.Sprintf("Invalid samples: must be 2 to %d", maxProfileSamples), http.StatusBadRequest)
+			return
+		}
+	}
+	zoom := pointZoom
+	if s := query.Get("zoom"); s != "" {
+		var err error
+		if zoom, err = strconv.Atoi(s); err != nil || zoom < 0 || zoom > maxLayerZoom {
+			http.Error(w, "Invalid zoom level", http.StatusBadRequest)
+			return
+		}
+	}
+	var level *int
+	if s := query.Get("level"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "Invalid sea level", http.StatusBadRequest)
+			return
+		}
+		l = clampSeaLevel(l)
+		level = &l
+	}
+
+	var geometry lineStringGeometry
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxProfileBytes)).Decode(&geometry); err != nil {
+		http.Error(w, "Invalid GeoJSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	line, err := parseLineString(geometry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	positions, distances := sampleLine(line, samples)
+	points := make([]profilePoint, len(positions))
+	for i, p := range positions {
+		points[i] = profilePoint{Lon: p[0], Lat: p[1], Distance: math.Round(distances[i]*10) / 10}
+		elevation, err := pointElevation(p[1], p[0], zoom)
+		if err == errUpstreamUnavailable {
+			w.Header().Set("Retry-After", fmt.Sprint(int(breakerCooldown.Seconds())))
+			http.Error(w, "Elevation source unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil && err != errElevationMissing {
+			http.Error(w, "Failed to fetch elevation", http.StatusBadGateway)
+			log.Printf("Error fetching elevation for %s: %v", r.URL.Path, err)
+			return
+		}
+		if err == errElevationMissing || elevation == noElevation {
+			continue
+		}
+		points[i].Elevation = &elevation
+		if level != nil {
+			underwater := elevation < *level
+			points[i].Underwater = &underwater
+		}
+	}
+
+	metrics.incr("api_requests", "endpoint:profile")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"level":  level,
+		"length": math.Round(distances[len(distances)-1]*10) / 10,
+		"points": points,
+	})
+}
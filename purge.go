@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tilePurge selects tiles to remove from the caches; nil fields match everything, and x and y
+// narrow a zoom down to a column or single tile
+type tilePurge struct {
+	level, z, x, y *int
+}
+
+// parseTilePurge reads a purge selection from level, z, x and y query parameters
+func parseTilePurge(r *http.Request) (tilePurge, error) {
+	var p tilePurge
+	q := r.URL.Query()
+	for _, f := range []struct {
+		name  string
+		field **int
+	}{{"level", &p.level}, {"z", &p.z}, {"x", &p.x}, {"y", &p.y}} {
+		s := q.Get(f.name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return p, fmt.Errorf("invalid %s %q", f.name, s)
+		}
+		*f.field = &v
+	}
+	if p.x != nil && p.z == nil {
+		return p, fmt.Errorf("x needs z")
+	}
+	if p.y != nil && p.x == nil {
+		return p, fmt.Errorf("y needs z and x")
+	}
+	return p, nil
+}
+
+func (p tilePurge) matches(level, z, x, y int) bool {
+	return (p.level == nil || *p.level == level) &&
+		(p.z == nil || *p.z == z) &&
+		(p.x == nil || *p.x == x) &&
+		(p.y == nil || *p.y == y)
+}
+
+// matchesKey checks an in-memory cache key
+func (p tilePurge) matchesKey(key string) bool {
+	level, z, x, y, ok := parseTileKey(key)
+	return ok && p.matches(level, z, x, y)
+}
+
+// parseTileKey reads the coordinates from a tile cache key, like "50/8/130/85.rivers"
+func parseTileKey(key string) (level, z, x, y int, ok bool) {
+	parts := strings.SplitN(key, "/", 4)
+	if len(parts) != 4 {
+		return 0, 0, 0, 0, false
+	}
+	return parseTileNumbers(parts[0], parts[1], parts[2], leadingInt(parts[3]))
+}
+
+// coversElevation reports whether an elevation tile shares any ground with the selected tiles.
+// Grids are shared by every sea level, and are overzoomed into their descendants and averaged
+// into their ancestors, so a match at any zoom counts.
+func (p tilePurge) coversElevation(z, x, y int) bool {
+	if p.z == nil {
+		return true
+	}
+	common := min(z, *p.z)
+	return (p.x == nil || x>>(z-common) == *p.x>>(*p.z-common)) &&
+		(p.y == nil || y>>(z-common) == *p.y>>(*p.z-common))
+}
+
+// matchesElevationKey checks an elevation cache key, like "8/130/85"
+func (p tilePurge) matchesElevationKey(key string) bool {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 {
+		return false
+	}
+	_, z, x, y, ok := parseTileNumbers("0", parts[0], parts[1], parts[2])
+	return ok && p.coversElevation(z, x, y)
+}
+
+// matchesRawElevationPath checks a raw elevation store path, like "8/130/85.png" or its
+// "8/130/85.png.etag"
+func (p tilePurge) matchesRawElevationPath(path string) bool {
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 {
+		return false
+	}
+	_, z, x, y, ok := parseTileNumbers("0", parts[0], parts[1], leadingInt(parts[2]))
+	return ok && p.coversElevation(z, x, y)
+}
+
+// matchesPath checks a persistent store path, like "3f2a9c1b7e0d/8/130/85/50.rivers.png"
+func (p tilePurge) matchesPath(path string) bool {
+	parts := strings.Split(path, "/")
+	if len(parts) != 5 {
+		return false
+	}
+	level, z, x, y, ok := parseTileNumbers(leadingInt(parts[4]), parts[1], parts[2], parts[3])
+	return ok && p.matches(level, z, x, y)
+}
+
+func parseTileNumbers(level, z, x, y string) (int, int, int, int, bool) {
+	var n [4]int
+	for i, s := range []string{level, z, x, y} {
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, 0, 0, 0, false
+		}
+		n[i] = v
+	}
+	return n[0], n[1], n[2], n[3], true
+}
+
+// leadingInt returns the integer at the start of s, like "-20" from "-20.bands=...png"
+func leadingInt(s string) string {
+	end := 0
+	for end < len(s) && (s[end] >= '0' && s[end] <= '9' || end == 0 && s[end] == '-') {
+		end++
+	}
+	return s[:end]
+}
+
+// tilePurger is implemented by persistent stores that can delete tiles in bulk
+type tilePurger interface {
+	purge(match func(path string) bool) (int, error)
+}
+
+// purge deletes matching tiles of every version under the cache directory
+func (d *diskStore) purge(match func(path string) bool) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(d.dir, func(full string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(d.dir, full)
+		if err != nil || !match(filepath.ToSlash(rel)) {
+			return err
+		}
+		if err := os.Remove(full); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// serveCachePurge removes cached tiles, e.g. DELETE /admin/cache?level=50&z=8, after upstream
+// elevation data or the renderer changes, including from the MBTiles archive, along with the
+// elevation they were rendered from. Tiles in object storage can't be listed cheaply, so
+// are left to expire or be removed with a bucket lifecycle rule.
+func serveCachePurge(w http.ResponseWriter, r *http.Request) {
+	p, err := parseTilePurge(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := struct {
+		Memory       int  `json:"memory"`
+		Store        *int `json:"store,omitempty"`
+		MBTiles      *int `json:"mbtiles,omitempty"`
+		Elevation    int  `json:"elevation"`
+		RawElevation *int `json:"rawElevation,omitempty"`
+	}{}
+	result.Memory = cache.removeMatching(func(key string, tile CachedTile) bool {
+		return p.matchesKey(key)
+	})
+	if purger, ok := persistentStore.(tilePurger); ok {
+		removed, err := purger.purge(p.matchesPath)
+		result.Store = &removed
+		if err != nil {
+			reportError("purge", err, map[string]string{"store": persistentStore.name()})
+			http.Error(w, fmt.Sprintf("Purged %d tiles from memory but the store failed: %v", result.Memory, err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Purges usually follow a change in the upstream data, so the elevation the tiles would be
+	// rendered again from goes too, whatever the sea level
+	result.Elevation = elevationCache.removeMatching(p.matchesElevationKey)
+	elevationMisses.removeMatching(func(key string, tile CachedTile) bool {
+		return p.matchesElevationKey(key)
+	})
+	if rawElevationStore != nil {
+		removed, err := rawElevationStore.purge(p.matchesRawElevationPath)
+		result.RawElevation = &removed
+		if err != nil {
+			reportError("purge", err, map[string]string{"store": "raw_elevation"})
+			http.Error(w, fmt.Sprintf("Purged %d tiles from memory but the raw elevation store failed: %v", result.Memory, err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Tiles are served from the archive before being rendered, so they must go from there too
+	if mbtiles != nil {
+		removed, err := mbtiles.purge(p)
+		result.MBTiles = &removed
+		if err != nil {
+			reportError("purge", err, map[string]string{"store": "mbtiles"})
+			http.Error(w, fmt.Sprintf("Purged %d tiles from memory but the MBTiles archive failed: %v", result.Memory, err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	metrics.incr("cache_purges")
+	recordAudit(r, "cache.purge", map[string]string{"query": r.URL.RawQuery, "memory": strconv.Itoa(result.Memory)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTilePurge(t *testing.T) {
+	for query, valid := range map[string]bool{
+		"":                         true,
+		"level=50":                 true,
+		"z=8&x=130":                true,
+		"level=-20&z=8&x=130&y=85": true,
+		"x=130":                    false,
+		"z=8&y=85":                 false,
+		"z=eight":                  false,
+	} {
+		if _, err := parseTilePurge(httptest.NewRequest("DELETE", "/admin/cache?"+query, nil)); (err == nil) != valid {
+			t.Errorf("parseTilePurge(?%s) = %v", query, err)
+		}
+	}
+}
+
+func TestTilePurgeMatches(t *testing.T) {
+	p, err := parseTilePurge(httptest.NewRequest("DELETE", "/admin/cache?level=50&z=8&x=130", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{
+		"50/8/130/85.rivers": true,
+		"50/8/130/0":         true,
+		"20/8/130/85":        false,
+		"50/8/131/85":        false,
+		"50/9/130/85":        false,
+		"bogus":              false,
+	} {
+		if got := p.matchesKey(key); got != want {
+			t.Errorf("matchesKey(%s) = %v, want %v", key, got, want)
+		}
+	}
+	for path, want := range map[string]bool{
+		"3f2a9c1b7e0d/8/130/85/50.rivers.png": true,
+		"3f2a9c1b7e0d/8/130/85/5.png":         false,
+		"3f2a9c1b7e0d/8/130/85":               false,
+	} {
+		if got := p.matchesPath(path); got != want {
+			t.Errorf("matchesPath(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestTilePurgeCoversElevation(t *testing.T) {
+	// Tile 8/130/85 lies within 7/65/42 and covers 9/260-261/170-171
+	p, err := parseTilePurge(httptest.NewRequest("DELETE", "/admin/cache?level=50&z=8&x=130&y=85", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{
+		"8/130/85":  true,
+		"7/65/42":   true,
+		"0/0/0":     true,
+		"9/261/171": true,
+		"9/262/171": false,
+		"8/130/86":  false,
+		"7/64/42":   false,
+	} {
+		if got := p.matchesElevationKey(key); got != want {
+			t.Errorf("matchesElevationKey(%s) = %v, want %v", key, got, want)
+		}
+	}
+	for path, want := range map[string]bool{
+		"9/260/170.png":      true,
+		"9/260/170.png.etag": true,
+		"9/259/170.png":      false,
+	} {
+		if got := p.matchesRawElevationPath(path); got != want {
+			t.Errorf("matchesRawElevationPath(%s) = %v, want %v", path, got, want)
+		}
+	}
+
+	// A level alone says nothing about where, and every sea level shares the grids
+	all := tilePurge{level: p.level}
+	if !all.coversElevation(12, 1000, 2000) {
+		t.Error("a purge of one level should cover every elevation tile")
+	}
+}
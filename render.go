@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxStackedLevels limits how many sea levels can be rendered into one tile
+const maxStackedLevels = 8
+
+// tileOptions are the per-request settings that change a rendered tile
+type tileOptions struct {
+	format    *tileFormat
+	watermark bool
+	rivers    bool
+	erosion   bool  // Estimated shoreline retreat beyond the flooded area
+	connected bool  // Only flood what the open ocean can reach
+	dryLand   bool  // Mark flooded land that's dry today in its own color
+	inland    bool  // Show water today above the sea level, like lakes, as water
+	coastline bool  // Follow the mapped coast at sea level 0 rather than the elevation data
+	bedrock   bool  // Flood the ground under the ice sheets rather than the ice surface
+	levels    []int // Several sea levels rendered together, lowest first
+	bands     []colorBand
+	water     color.RGBA  // Flooded area color
+	depth     []depthStop // Shade flooded areas by depth rather than one color
+	opacity   int         // Percentage, so the basemap can show through
+	diff      bool        // Only the land flooded between diffFrom and the sea level
+	outline   bool        // Stroke the shoreline rather than filling the water
+	edge      color.RGBA  // Shoreline drawn over the water, unless transparent
+	pattern   string      // One of fillPatterns, or "" for solid
+	diffFrom  int
+
+	// These don't change the tile so aren't part of the key
+	priority int
+	timing   *serverTiming
+	refresh  bool // Render even if the tile is already cached
+	peer     bool // Requested by a peer, so render here rather than asking the owner
+}
+
+func defaultTileOptions() tileOptions {
+	return tileOptions{format: pngFormat, watermark: true, water: waterColor, opacity: 100}
+}
+
+// waterColor is the default color of flooded areas
+var waterColor = color.RGBA{0, 50, 120, 255}
+
+// key returns a cache key suffix identifying non-default options
+func (o tileOptions) key() string {
+	if o.format != pngFormat {
+		return "." + o.format.name + o.variant()
+	}
+	return o.variant()
+}
+
+// fileName names a tile file for a sea level, e.g. "20.png" or "20.rivers.webp"
+func (o tileOptions) fileName(seaLevel int) string {
+	return strconv.Itoa(seaLevel) + o.variant() + "." + o.format.name
+}
+
+// variant returns a suffix identifying non-default options other than the format
+func (o tileOptions) variant() string {
+	key := ""
+	if o.rivers {
+		key += ".rivers"
+	}
+	if o.erosion {
+		key += ".erosion"
+	}
+	if o.connected {
+		key += ".connected"
+	}
+	if o.dryLand {
+		key += ".dryland"
+	}
+	if o.inland {
+		key += ".inland"
+	}
+	if o.coastline {
+		key += ".coastline"
+	}
+	if o.bedrock {
+		key += ".bedrock"
+	}
+	if len(o.levels) > 0 {
+		strs := make([]string, len(o.levels))
+		for i, level := range o.levels {
+			strs[i] = strconv.Itoa(level)
+		}
+		key += ".levels=" + strings.Join(strs, ",")
+	}
+	if len(o.bands) > 0 {
+		key += ".bands=" + bandsKey(o.bands)
+	}
+	if o.outline {
+		key += ".outline"
+	}
+	if o.diff {
+		key += ".diff=" + strconv.Itoa(o.diffFrom)
+	}
+	if len(o.depth) > 0 {
+		key += ".depth=" + depthRampKey(o.depth)
+	}
+	if o.water != waterColor {
+		key += ".color=" + colorKey(o.water)
+	}
+	if o.edge.A > 0 {
+		key += ".edge=" + colorKey(o.edge)
+	}
+	if o.pattern != "" {
+		key += ".pattern=" + o.pattern
+	}
+	if o.opacity != 100 {
+		key += ".opacity=" + strconv.Itoa(o.opacity)
+	}
+	if !o.watermark && watermarkText != "" {
+		key += ".nowatermark"
+	}
+	return key
+}
+
+// renderFlood colors every pixel below the sea level, or marked in extra, with water and leaves the rest transparent
+func renderFlood(grid *elevationGrid, seaLevel int, extra *tileMask, water color.RGBA) *image.RGBA {
+	outputImg := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+
+	// Process image in parallel using goroutines
+	numWorkers := 8 // Adjust based on your CPU cores
+	rowsPerWorker := tileSize / numWorkers
+	var wg sync.WaitGroup
+
+	for worker := 0; worker < numWorkers; worker++ {
+		wg.Add(1)
+		go func(startRow, endRow int) {
+			defer wg.Done()
+
+			// Color for areas below sea level (underwater)
+			water := premultiply(water)
+
+			for y := startRow; y < endRow && y < tileSize; y++ {
+				for x := 0; x < tileSize; x++ {
+					dstOffset := y*outputImg.Stride + x*4
+
+					// Color as much of the pixel as is below the specified sea level, so the shoreline is smooth
+					var color [4]uint8
+					if extra != nil && extra[y*tileSize+x] {
+						color = [4]uint8{water.R, water.G, water.B, water.A}
+					} else if cover := floodCoverage(grid, seaLevel, x, y); cover > 0 {
+						c := fadeColor(water, cover)
+						color = [4]uint8{c.R, c.G, c.B, c.A}
+					}
+
+					// Set pixel directly in byte array
+					outputImg.Pix[dstOffset] = color[0]   // R
+					outputImg.Pix[dstOffset+1] = color[1] // G
+					outputImg.Pix[dstOffset+2] = color[2] // B
+					outputImg.Pix[dstOffset+3] = color[3] // A
+				}
+			}
+		}(worker*rowsPerWorker, (worker+1)*rowsPerWorker)
+	}
+
+	// Wait for all workers to complete
+	wg.Wait()
+
+	return outputImg
+}
+
+// outlineWidth is how many pixels wide the shoreline is drawn in the outline style
+const outlineWidth = 2
+
+// renderOutline draws just the shoreline at the sea level, to overlay on imagery without hiding it
+func renderOutline(grid *elevationGrid, seaLevel int, c color.RGBA) *image.RGBA {
+	outputImg := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	strokeShoreline(outputImg, grid, seaLevel, outlineWidth, c)
+	return outputImg
+}
+
+// strokeShoreline draws the shoreline at the sea level over an image
+func strokeShoreline(img *image.RGBA, grid *elevationGrid, seaLevel, width int, c color.RGBA) {
+	for _, s := range traceContour(grid, seaLevel) {
+		drawLine(img, s.x0, s.y0, s.x1, s.y1, width, c)
+	}
+}
+
+// diffColor marks land flooded between two sea levels, contrasting with the usual water
+var diffColor = color.RGBA{230, 80, 40, 255}
+
+// renderDiff colors the band of land that is dry at one sea level but underwater at the other,
+// whichever order they're given in
+func renderDiff(grid *elevationGrid, from, to int, c color.RGBA) *image.RGBA {
+	outputImg := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	low, high := min(from, to), max(from, to)
+	c = premultiply(c)
+	for i := range grid {
+		x, y := i%tileSize, i/tileSize
+		cover := floodCoverage(grid, high, x, y) - floodCoverage(grid, low, x, y)
+		if cover <= 0 {
+			continue
+		}
+		fc := fadeColor(c, cover)
+		offset := i * 4
+		outputImg.Pix[offset] = fc.R
+		outputImg.Pix[offset+1] = fc.G
+		outputImg.Pix[offset+2] = fc.B
+		outputImg.Pix[offset+3] = fc.A
+	}
+	return outputImg
+}
+
+// coverageSamples is the number of sub-pixel samples across each side of a shoreline pixel
+const coverageSamples = 4
+
+// floodCoverage estimates how much of a pixel is below the sea level by interpolating the
+// elevation between pixel centres at several points inside it, so that shorelines are
+// anti-aliased rather than stepped
+func floodCoverage(grid *elevationGrid, seaLevel, x, y int) float64 {
+	// Pixels away from the shoreline are entirely in or out, and gaps in the data are left sharp
+	elevation := int(grid[y*tileSize+x])
+	lowest, highest := elevation, elevation
+	for ny := max(y-1, 0); ny <= min(y+1, tileSize-1); ny++ {
+		for nx := max(x-1, 0); nx <= min(x+1, tileSize-1); nx++ {
+			e := int(grid[ny*tileSize+nx])
+			if e == noElevation {
+				if elevation < seaLevel {
+					return 1
+				}
+				return 0
+			}
+			lowest, highest = min(lowest, e), max(highest, e)
+		}
+	}
+	if highest < seaLevel {
+		return 1
+	}
+	if lowest >= seaLevel {
+		return 0
+	}
+
+	below := 0
+	for sy := 0; sy < coverageSamples; sy++ {
+		fy := float64(y) + (float64(sy)+0.5)/coverageSamples - 0.5
+		for sx := 0; sx < coverageSamples; sx++ {
+			fx := float64(x) + (float64(sx)+0.5)/coverageSamples - 0.5
+			if interpolateGrid(grid, fx, fy) < float64(seaLevel) {
+				below++
+			}
+		}
+	}
+	return float64(below) / (coverageSamples * coverageSamples)
+}
+
+// fadeColor scales a premultiplied color by a coverage fraction
+func fadeColor(c color.RGBA, cover float64) color.RGBA {
+	if cover >= 1 {
+		return c
+	}
+	scale := func(v uint8) uint8 {
+		return uint8(float64(v)*cover + 0.5)
+	}
+	return color.RGBA{scale(c.R), scale(c.G), scale(c.B), scale(c.A)}
+}
+
+// parseOpacity parses an opacity percentage from 0 to 100
+func parseOpacity(s string) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 || v > 100 {
+		return 0, fmt.Errorf("Invalid opacity %q: must be 0 to 100", s)
+	}
+	return v, nil
+}
+
+// parseLevelList parses a comma-separated list of sea levels, clamping, sorting and removing duplicates
+func parseLevelList(s string) ([]int, error) {
+	seen := make(map[int]bool)
+	var levels []int
+	for _, part := range strings.Split(s, ",") {
+		level, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid sea level in list: %q", part)
+		}
+		level = clampSeaLevel(level)
+		if !seen[level] {
+			seen[level] = true
+			levels = append(levels, level)
+		}
+	}
+	if len(levels) > maxStackedLevels {
+		return nil, fmt.Errorf("Too many sea levels: at most %d", maxStackedLevels)
+	}
+	sort.Ints(levels)
+	return levels, nil
+}
+
+// stackedColors grades from the water color for the lowest level to a paler one for the
+// highest, by default dark blue to light blue
+func stackedColors(n int, water color.RGBA) []color.RGBA {
+	dark := water
+	light := color.RGBA{140, 200, 240, 255}
+	if water != waterColor {
+		light = lerpColor(water, color.RGBA{255, 255, 255, water.A}, 0.6)
+	}
+	colors := make([]color.RGBA, n)
+	for i := range colors {
+		t := 0.0
+		if n > 1 {
+			t = float64(i) / float64(n-1)
+		}
+		colors[i] = lerpColor(dark, light, t)
+	}
+	return colors
+}
+
+// lerpColor interpolates between two colors
+func lerpColor(a, b color.RGBA, t float64) color.RGBA {
+	mix := func(x, y uint8) uint8 {
+		return uint8(float64(x) + (float64(y)-float64(x))*t + 0.5)
+	}
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), mix(a.A, b.A)}
+}
+
+// renderStacked colors each pixel by the lowest of several sea levels that floods it
+func renderStacked(grid *elevationGrid, levels []int, water color.RGBA) *image.RGBA {
+	outputImg := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	colors := stackedColors(len(levels), water)
+	for i, c := range colors {
+		colors[i] = premultiply(c)
+	}
+
+	for i, elevation := range grid {
+		for band, level := range levels {
+			if int(elevation) < level {
+				c := colors[band]
+				offset := i * 4
+				outputImg.Pix[offset] = c.R
+				outputImg.Pix[offset+1] = c.G
+				outputImg.Pix[offset+2] = c.B
+				outputImg.Pix[offset+3] = c.A
+				break
+			}
+		}
+	}
+	return outputImg
+}
+
+// premultiply scales a color by its alpha, as image.RGBA pixels are stored, so that colors
+// given with transparency, like "0032787f", encode as intended
+func premultiply(c color.RGBA) color.RGBA {
+	scale := func(v uint8) uint8 {
+		return uint8((int(v)*int(c.A) + 127) / 255)
+	}
+	return color.RGBA{scale(c.R), scale(c.G), scale(c.B), c.A}
+}
+
+// applyOpacity fades a whole rendered tile to a percentage of its opacity
+func applyOpacity(img *image.RGBA, percent int) {
+	if percent >= 100 {
+		return
+	}
+	for i, v := range img.Pix {
+		img.Pix[i] = uint8((int(v)*percent + 50) / 100)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replication streams newly generated tiles from a primary to warm standbys, so that a
+// standby which takes over doesn't start from a cold cache. Each tile is sent as a frame:
+//
+//	uint16 key length, key, int64 timestamp, int64 expiry, uint32 data length, data
+//
+// all big-endian, with times in unix nanoseconds and an expiry of 0 meaning never. A frame with an empty key is a heartbeat.
+
+const (
+	replicationHeartbeat = 30 * time.Second
+
+	// replicationBuffer is how many tiles a slow standby can fall behind before missing some
+	replicationBuffer = 256
+)
+
+// replicatedTile is a tile on its way to standbys
+type replicatedTile struct {
+	key  string
+	tile CachedTile
+}
+
+// ReplicationHub fans newly generated tiles out to every connected standby
+type ReplicationHub struct {
+	mu          sync.Mutex
+	subscribers map[chan replicatedTile]bool
+}
+
+var replication = &ReplicationHub{subscribers: make(map[chan replicatedTile]bool)}
+
+// publish offers a tile to every standby, dropping it for any that have fallen too far behind
+func (h *ReplicationHub) publish(key string, tile CachedTile) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- replicatedTile{key, tile}:
+		default:
+			metrics.incr("replication_dropped")
+		}
+	}
+}
+
+func (h *ReplicationHub) subscribe() chan replicatedTile {
+	ch := make(chan replicatedTile, replicationBuffer)
+	h.mu.Lock()
+	h.subscribers[ch] = true
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *ReplicationHub) unsubscribe(ch chan replicatedTile) {
+	h.mu.Lock()
+	delete(h.subscribers, ch)
+	h.mu.Unlock()
+}
+
+// writeReplicationFrame writes one tile, or a heartbeat if the key is empty
+func writeReplicationFrame(w io.Writer, key string, tile CachedTile) error {
+	var expires int64
+	if !tile.expires.IsZero() {
+		expires = tile.expires.UnixNano()
+	}
+	header := make([]byte, 0, 2+len(key)+8+8+4)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(key)))
+	header = append(header, key...)
+	header = binary.BigEndian.AppendUint64(header, uint64(tile.timestamp.UnixNano()))
+	header = binary.BigEndian.AppendUint64(header, uint64(expires))
+	header = binary.BigEndian.AppendUint32(header, uint32(len(tile.data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(tile.data)
+	return err
+}
+
+// readReplicationFrame reads one frame written by writeReplicationFrame
+func readReplicationFrame(r io.Reader) (string, CachedTile, error) {
+	var keyLen uint16
+	if err := binary.Read(r, binary.BigEndian, &keyLen); err != nil {
+		return "", CachedTile{}, err
+	}
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return "", CachedTile{}, err
+	}
+	var nanos, expires uint64
+	var dataLen uint32
+	if err := binary.Read(r, binary.BigEndian, &nanos); err != nil {
+		return "", CachedTile{}, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &expires); err != nil {
+		return "", CachedTile{}, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &dataLen); err != nil {
+		return "", CachedTile{}, err
+	}
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", CachedTile{}, err
+	}
+	tile := CachedTile{data: data, timestamp: time.Unix(0, int64(nanos))}
+	if expires != 0 {
+		tile.expires = time.Unix(0, int64(expires))
+	}
+	return string(key), tile, nil
+}
+
+// serveReplication streams newly generated tiles to a standby until it disconnects
+func serveReplication(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "replication.subscribe", nil)
+
+	ch := replication.subscribe()
+	defer replication.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Tile-Version", tileVersion())
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case t := <-ch:
+			err = writeReplicationFrame(w, t.key, t.tile)
+			metrics.incr("replication_sent")
+		case <-heartbeat.C:
+			err = writeReplicationFrame(w, "", CachedTile{timestamp: time.Now()})
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// followPrimary mirrors a primary's newly generated tiles into the local cache, reconnecting
+// with backoff whenever the stream breaks
+func followPrimary(primaryURL, apiKey string) {
+	backoff := time.Second
+	for {
+		connected, err := streamFromPrimary(primaryURL, apiKey)
+		if connected {
+			backoff = time.Second
+		}
+		reportError("replication", err, map[string]string{"primary": primaryURL})
+		log.Printf("Reconnecting to primary in %v", backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, time.Minute)
+	}
+}
+
+// streamFromPrimary copies tiles from one connection to the primary until it breaks
+func streamFromPrimary(primaryURL, apiKey string) (connected bool, err error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(primaryURL, "/")+"/admin/replication", nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	// No timeout: the stream is meant to stay open, and heartbeats show it is still alive
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to primary: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("primary refused replication with status: %d", resp.StatusCode)
+	}
+
+	// Tiles from a primary rendering differently would be wrong here
+	if version := resp.Header.Get("X-Tile-Version"); version != tileVersion() {
+		return false, fmt.Errorf("primary has tile version %s but this server has %s", version, tileVersion())
+	}
+	log.Printf("Replicating tiles from %s", primaryURL)
+
+	// Heartbeats arrive every replicationHeartbeat, so a longer silence means a dead connection
+	body := &deadlineReader{r: resp.Body, timeout: 3 * replicationHeartbeat}
+	reader := bufio.NewReader(body)
+	for {
+		key, tile, err := readReplicationFrame(reader)
+		if err != nil {
+			return true, fmt.Errorf("replication stream broke: %v", err)
+		}
+		if key == "" {
+			continue
+		}
+		cache.put(key, tile)
+		metrics.incr("replication_received")
+	}
+}
+
+// deadlineReader fails a read that takes longer than timeout, closing the underlying reader
+type deadlineReader struct {
+	r       io.ReadCloser
+	timeout time.Duration
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	timer := time.AfterFunc(d.timeout, func() { d.r.Close() })
+	defer timer.Stop()
+	return d.r.Read(p)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrorReporter receives errors that should be visible beyond the local log
+type ErrorReporter interface {
+	Report(err error, tags map[string]string)
+}
+
+// logReporter is the default reporter and just writes errors to the log
+type logReporter struct{}
+
+func (logReporter) Report(err error, tags map[string]string) {
+	log.Printf("Error reported: %v %v", err, tags)
+}
+
+var reporter ErrorReporter = logReporter{}
+
+// reportError sends an error to the configured reporter, tagged with the stage it happened in
+func reportError(stage string, err error, tags map[string]string) {
+	all := map[string]string{"stage": stage}
+	for k, v := range tags {
+		all[k] = v
+	}
+	metrics.incr("errors", "stage:"+stage)
+	reporter.Report(err, all)
+}
+
+// tileTags returns the tags identifying a single tile
+func tileTags(seaLevel int, z, x, y string) map[string]string {
+	return map[string]string{
+		"level": fmt.Sprint(seaLevel),
+		"z":     z,
+		"x":     x,
+		"y":     y,
+	}
+}
+
+// sentryReporter sends errors to a Sentry-compatible store endpoint
+type sentryReporter struct {
+	storeURL string
+	auth     string
+	client   *http.Client
+}
+
+// newSentryReporter parses a DSN of the form https://key@host/project
+func newSentryReporter(dsn string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Sentry DSN: %v", err)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("Sentry DSN has no public key")
+	}
+	project := strings.Trim(u.Path, "/")
+	if project == "" {
+		return nil, fmt.Errorf("Sentry DSN has no project id")
+	}
+
+	return &sentryReporter{
+		storeURL: fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project),
+		auth: fmt.Sprintf("Sentry sentry_version=7, sentry_client=sea-level-map/1.0, sentry_key=%s",
+			u.User.Username()),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *sentryReporter) Report(err error, tags map[string]string) {
+	// Always keep a local copy of the error as well
+	log.Printf("Error reported: %v %v", err, tags)
+
+	eventID := make([]byte, 16)
+	rand.Read(eventID)
+
+	event := map[string]interface{}{
+		"event_id":  hex.EncodeToString(eventID),
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+		"level":     "error",
+		"platform":  "go",
+		"logger":    "sea-level-map",
+		"message":   err.Error(),
+		"tags":      tags,
+		"exception": map[string]interface{}{
+			"values": []map[string]string{{
+				"type":  fmt.Sprintf("%T", err),
+				"value": err.Error(),
+			}},
+		},
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		event["server_name"] = hostname
+	}
+
+	body, jsonErr := json.Marshal(event)
+	if jsonErr != nil {
+		log.Printf("Failed to encode Sentry event: %v", jsonErr)
+		return
+	}
+
+	// Send in the background so reporting never slows down tile requests
+	go func() {
+		req, err := http.NewRequest("POST", s.storeURL, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Failed to create Sentry request: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sentry-Auth", s.auth)
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			log.Printf("Failed to send Sentry event: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("Sentry rejected event with status: %d", resp.StatusCode)
+		}
+	}()
+}
+
+// recoverPanics is middleware that reports panics in handlers instead of dropping the connection
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				reportError("panic", fmt.Errorf("panic: %v", v), map[string]string{
+					"method": r.Method,
+					"path":   r.URL.Path,
+				})
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// backgroundRefresher re-renders stale tiles after they've been served, running at most a
+// fixed number of refreshes at once and skipping any beyond that
+type backgroundRefresher struct {
+	mu      sync.Mutex
+	running map[string]bool
+	slots   chan struct{}
+}
+
+var refresher = newBackgroundRefresher(4)
+
+func newBackgroundRefresher(concurrency int) *backgroundRefresher {
+	return &backgroundRefresher{
+		running: make(map[string]bool),
+		slots:   make(chan struct{}, concurrency),
+	}
+}
+
+// refresh starts re-rendering a tile unless it's already being refreshed or too many are
+func (b *backgroundRefresher) refresh(cacheKey string, seaLevel int, z, x, y string, opts tileOptions) {
+	b.mu.Lock()
+	if b.running[cacheKey] {
+		b.mu.Unlock()
+		return
+	}
+	select {
+	case b.slots <- struct{}{}:
+	default:
+		b.mu.Unlock()
+		metrics.incr("stale_refreshes", "result:skipped")
+		return
+	}
+	b.running[cacheKey] = true
+	b.mu.Unlock()
+
+	opts.refresh = true
+	opts.priority = priorityPrefetch
+	opts.timing = nil
+	go func() {
+		defer func() {
+			b.mu.Lock()
+			delete(b.running, cacheKey)
+			b.mu.Unlock()
+			<-b.slots
+		}()
+		if _, err := generateSeaLevelTile(seaLevel, z, x, y, opts); err != nil {
+			metrics.incr("stale_refreshes", "result:error")
+			log.Printf("Failed to refresh stale tile: level=%d, z=%s, x=%s, y=%s: %v", seaLevel, z, x, y, err)
+			return
+		}
+		metrics.incr("stale_refreshes", "result:ok")
+	}()
+}
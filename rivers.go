@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+)
+
+// riverSource marks river channels; backwater flooding is unavailable without it
+var riverSource *maskSource
+
+// Backwater parameters: the full rise reaches the river mouth and tapers off linearly upstream
+var riverBackwaterLength = 20000.0 // meters
+
+// tileLatitude returns the latitude at a fractional tile row
+func tileLatitude(z int, y float64) float64 {
+	n := math.Pi - 2*math.Pi*y/math.Exp2(float64(z))
+	return 180 / math.Pi * math.Atan(math.Sinh(n))
+}
+
+// riverBackwater approximates how a raised sea backs up river channels: water enters a
+// channel wherever it touches the flooded area, and the channel's water surface rises by
+// the sea level rise, tapering to nothing riverBackwaterLength upstream. Land next to the
+// channel floods where it is lower than the raised river surface. This only considers
+// channels within the tile.
+func riverBackwater(grid *elevationGrid, rivers *tileMask, seaLevel, z, y int) *tileMask {
+	backwater := new(tileMask)
+	if seaLevel <= 0 || rivers == nil {
+		return backwater
+	}
+	rise := float64(seaLevel)
+	mpp := metersPerPixel(tileLatitude(z, float64(y)+0.5), z)
+
+	// Water surface reached at each pixel; NaN where there is none
+	surface := make([]float64, len(grid))
+	for i := range surface {
+		surface[i] = math.NaN()
+	}
+
+	// Walk up the channels from wherever they meet the sea
+	dist := make([]int, len(grid))
+	var queue []int
+	for i, elevation := range grid {
+		if rivers[i] && int(elevation) < seaLevel {
+			queue = append(queue, i)
+		}
+	}
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		px, py := i%tileSize, i/tileSize
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				nx, ny := px+dx, py+dy
+				if nx < 0 || ny < 0 || nx >= tileSize || ny >= tileSize {
+					continue
+				}
+				j := ny*tileSize + nx
+				if !rivers[j] || dist[j] != 0 || int(grid[j]) < seaLevel {
+					continue
+				}
+				dist[j] = dist[i] + 1
+				taper := 1 - float64(dist[j])*mpp/riverBackwaterLength
+				if taper <= 0 {
+					continue
+				}
+				surface[j] = float64(grid[j]) + rise*taper
+				backwater[j] = true
+				queue = append(queue, j)
+			}
+		}
+	}
+
+	// Spread the raised river surface over neighbouring land that lies below it
+	for i := range surface {
+		if backwater[i] {
+			queue = append(queue, i)
+		}
+	}
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		px, py := i%tileSize, i/tileSize
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				nx, ny := px+dx, py+dy
+				if nx < 0 || ny < 0 || nx >= tileSize || ny >= tileSize {
+					continue
+				}
+				j := ny*tileSize + nx
+				if rivers[j] || int(grid[j]) < seaLevel || float64(grid[j]) >= surface[i] {
+					continue
+				}
+				if backwater[j] && surface[j] >= surface[i] {
+					continue
+				}
+				surface[j] = surface[i]
+				backwater[j] = true
+				queue = append(queue, j)
+			}
+		}
+	}
+
+	return backwater
+}
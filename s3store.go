@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Store keeps tiles in an S3-compatible bucket. It works with AWS S3, and with MinIO, Google
+// Cloud Storage (using HMAC keys and https://storage.googleapis.com) and others via a custom
+// endpoint.
+type s3Store struct {
+	endpoint     *url.URL
+	bucket       string
+	prefix       string
+	region       string
+	pathStyle    bool
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+// newS3Store configures a bucket; an empty endpoint means AWS S3 in the region
+func newS3Store(endpoint, bucket, prefix, region string, pathStyle bool) (*s3Store, error) {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	return &s3Store{
+		endpoint:     u,
+		bucket:       bucket,
+		prefix:       strings.Trim(prefix, "/"),
+		region:       region,
+		pathStyle:    pathStyle,
+		accessKey:    envString("AWS_ACCESS_KEY_ID", ""),
+		secretKey:    envString("AWS_SECRET_ACCESS_KEY", ""),
+		sessionToken: envString("AWS_SESSION_TOKEN", ""),
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *s3Store) name() string {
+	return "s3"
+}
+
+// objectURL returns the URL of an object, in path or virtual-hosted style
+func (s *s3Store) objectURL(tilePath string) *url.URL {
+	key := tilePath
+	if s.prefix != "" {
+		key = s.prefix + "/" + tilePath
+	}
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = path.Join("/", u.Path, s.bucket, key)
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = path.Join("/", u.Path, key)
+	}
+
+	// Signatures cover the path as sent, which must be encoded the way S3 expects
+	u.RawPath = s3EscapePath(u.Path)
+	return &u
+}
+
+// s3EscapePath percent-encodes everything in a path except unreserved characters and slashes
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *s3Store) get(tilePath string) ([]byte, time.Time, bool, error) {
+	req, err := http.NewRequest("GET", s.objectURL(tilePath).String(), nil)
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	s.sign(req, nil)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, time.Time{}, false, fmt.Errorf("failed to fetch tile from S3: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, time.Time{}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, false, fmt.Errorf("S3 GET failed with status: %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, time.Time{}, false, fmt.Errorf("failed to read tile from S3: %v", err)
+	}
+	stored, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		stored = time.Now()
+	}
+	return data, stored, true, nil
+}
+
+func (s *s3Store) put(tilePath string, data []byte) error {
+	req, err := http.NewRequest("PUT", s.objectURL(tilePath).String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if contentType := mime.TypeByExtension(path.Ext(tilePath)); contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, data)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to store tile in S3: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("S3 PUT failed with status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sign adds AWS Signature Version 4 headers to a request, or does nothing for anonymous access
+func (s *s3Store) sign(req *http.Request, payload []byte) {
+	req.Header.Set("User-Agent", userAgent)
+	if s.accessKey == "" {
+		return
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	// Sign the host and every x-amz- header
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(values[0])
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
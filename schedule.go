@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SeedSchedule lists seeding jobs to run at set times. It is loaded from SEED_SCHEDULE_FILE,
+// for example:
+//
+//	{"jobs": [
+//	  {"name": "popular", "schedule": "0 3 * * *", "kind": "render", "levels": [0, 10, 50], "maxZoom": 6},
+//	  {"name": "elevation", "schedule": "0 4 * * 0", "kind": "elevation", "bbox": "-10,35,30,60", "maxZoom": 8}
+//	]}
+//
+// Render jobs re-render tiles at each level; elevation jobs refetch the raw elevation data.
+// Jobs cover the whole world unless they have a bbox.
+type SeedSchedule struct {
+	Jobs []*ScheduledJob `json:"jobs"`
+}
+
+// ScheduledJob is one entry in the seed schedule
+type ScheduledJob struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	Kind     string `json:"kind"`
+	Levels   []int  `json:"levels,omitempty"`
+	BBox     string `json:"bbox,omitempty"`
+	MinZoom  int    `json:"minZoom"`
+	MaxZoom  int    `json:"maxZoom"`
+
+	cron *cronSchedule
+	area bbox
+}
+
+// scheduledJobStatus is what the admin API reports about a job
+type scheduledJobStatus struct {
+	*ScheduledJob
+	NextRun  time.Time  `json:"nextRun"`
+	Running  bool       `json:"running"`
+	Done     int        `json:"done,omitempty"`
+	Total    int        `json:"total,omitempty"`
+	LastRun  *time.Time `json:"lastRun,omitempty"`
+	LastFail int        `json:"lastFailed,omitempty"`
+}
+
+// scheduler runs the jobs in the seed schedule when they are due
+type scheduler struct {
+	mu       sync.Mutex
+	jobs     map[string]*ScheduledJob
+	running  map[string]*seedJob
+	lastRun  map[string]time.Time
+	lastFail map[string]int
+	file     string
+}
+
+var seedScheduler = &scheduler{
+	jobs:     make(map[string]*ScheduledJob),
+	running:  make(map[string]*seedJob),
+	lastRun:  make(map[string]time.Time),
+	lastFail: make(map[string]int),
+}
+
+// validate checks a job and fills in its parsed fields
+func (j *ScheduledJob) validate() error {
+	if j.Name == "" {
+		return fmt.Errorf("job has no name")
+	}
+	var err error
+	if j.cron, err = parseCron(j.Schedule); err != nil {
+		return fmt.Errorf("job %s: %v", j.Name, err)
+	}
+	switch j.Kind {
+	case "render":
+		if len(j.Levels) == 0 {
+			return fmt.Errorf("job %s: render jobs need levels", j.Name)
+		}
+		for i, level := range j.Levels {
+			j.Levels[i] = clampSeaLevel(level)
+		}
+	case "elevation":
+	default:
+		return fmt.Errorf("job %s: kind must be render or elevation", j.Name)
+	}
+	if j.MinZoom < 0 || j.MaxZoom > upstreamMaxZoom || j.MinZoom > j.MaxZoom {
+		return fmt.Errorf("job %s: zoom range must be within 0-%d", j.Name, upstreamMaxZoom)
+	}
+	j.area = worldBBox
+	if j.BBox != "" {
+		if j.area, err = parseBBox(j.BBox); err != nil {
+			return fmt.Errorf("job %s: %v", j.Name, err)
+		}
+	}
+	return nil
+}
+
+// loadSeedSchedule reads a seed schedule from a JSON file
+func loadSeedSchedule(path string) (*SeedSchedule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var schedule SeedSchedule
+	if err := json.Unmarshal(data, &schedule); err != nil {
+		return nil, fmt.Errorf("invalid seed schedule %s: %v", path, err)
+	}
+	seen := make(map[string]bool)
+	for _, job := range schedule.Jobs {
+		if err := job.validate(); err != nil {
+			return nil, err
+		}
+		if seen[job.Name] {
+			return nil, fmt.Errorf("duplicate job name %s", job.Name)
+		}
+		seen[job.Name] = true
+	}
+	return &schedule, nil
+}
+
+// start loads the schedule and checks once a minute for jobs that are due
+func (s *scheduler) start(path string) error {
+	schedule, err := loadSeedSchedule(path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.file = path
+	for _, job := range schedule.Jobs {
+		s.jobs[job.Name] = job
+	}
+	s.mu.Unlock()
+
+	go func() {
+		for {
+			now := time.Now()
+			time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+			s.runDue(time.Now())
+		}
+	}()
+	return nil
+}
+
+// runDue starts every job scheduled for the minute containing t
+func (s *scheduler) runDue(t time.Time) {
+	s.mu.Lock()
+	var due []*ScheduledJob
+	for _, job := range s.jobs {
+		if job.cron.matches(t) {
+			due = append(due, job)
+		}
+	}
+	s.mu.Unlock()
+	for _, job := range due {
+		s.run(job)
+	}
+}
+
+// run starts a job in the background unless it is still running from last time
+func (s *scheduler) run(job *ScheduledJob) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[job.Name] != nil {
+		log.Printf("Skipping scheduled job %s: still running", job.Name)
+		return false
+	}
+
+	seed := &seedJob{
+		name:        job.Name,
+		area:        job.area,
+		minZoom:     job.MinZoom,
+		maxZoom:     job.MaxZoom,
+		concurrency: 4,
+		resumable:   true,
+		visit:       job.visitor(),
+	}
+	s.running[job.Name] = seed
+
+	go func() {
+		failed := seed.run()
+		s.mu.Lock()
+		delete(s.running, job.Name)
+		s.lastRun[job.Name] = time.Now()
+		s.lastFail[job.Name] = failed
+		s.mu.Unlock()
+	}()
+	return true
+}
+
+// visitor returns what a job does to each tile
+func (j *ScheduledJob) visitor() func(z, x, y int) error {
+	if j.Kind == "elevation" {
+		return func(z, x, y int) error {
+			grid, err := fetchElevation(z, x, y, nil)
+			if err != nil {
+				return err
+			}
+			elevationCache.put(elevationKey(z, x, y), grid)
+			return nil
+		}
+	}
+
+	levels := j.Levels
+	return func(z, x, y int) error {
+		opts := defaultTileOptions()
+		opts.priority = priorityPrefetch
+		opts.refresh = true
+		for _, level := range levels {
+			if _, err := generateSeaLevelTile(level, strconv.Itoa(z), strconv.Itoa(x), strconv.Itoa(y), opts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// save writes the schedule back to its file so admin changes survive restarts
+func (s *scheduler) save() error {
+	if s.file == "" {
+		return nil
+	}
+	schedule := SeedSchedule{Jobs: []*ScheduledJob{}}
+	for _, job := range s.jobs {
+		schedule.Jobs = append(schedule.Jobs, job)
+	}
+	sort.Slice(schedule.Jobs, func(i, j int) bool { return schedule.Jobs[i].Name < schedule.Jobs[j].Name })
+	data, err := json.MarshalIndent(schedule, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.file, data, 0644)
+}
+
+// status describes every job for the admin API
+func (s *scheduler) status() []scheduledJobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := []scheduledJobStatus{}
+	for _, job := range s.jobs {
+		st := scheduledJobStatus{ScheduledJob: job, NextRun: job.cron.next(time.Now())}
+		if seed := s.running[job.Name]; seed != nil {
+			st.Running = true
+			st.Done, st.Total = seed.progress()
+		}
+		if last, ok := s.lastRun[job.Name]; ok {
+			st.LastRun = &last
+			st.LastFail = s.lastFail[job.Name]
+		}
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// serveSchedule lists scheduled jobs with their next run times and progress
+func serveSchedule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(seedScheduler.status())
+}
+
+// serveScheduleAdd adds or replaces a scheduled job
+func serveScheduleAdd(w http.ResponseWriter, r *http.Request) {
+	var job ScheduledJob
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		http.Error(w, "Invalid job: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := job.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	seedScheduler.mu.Lock()
+	seedScheduler.jobs[job.Name] = &job
+	err := seedScheduler.save()
+	seedScheduler.mu.Unlock()
+	if err != nil {
+		reportError("schedule", err, nil)
+		http.Error(w, "Job added but failed to save the schedule", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "schedule.add", map[string]string{"name": job.Name, "schedule": job.Schedule, "kind": job.Kind})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveScheduleDelete removes a scheduled job; a run in progress carries on to completion
+func serveScheduleDelete(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	seedScheduler.mu.Lock()
+	_, exists := seedScheduler.jobs[name]
+	delete(seedScheduler.jobs, name)
+	err := seedScheduler.save()
+	seedScheduler.mu.Unlock()
+	if !exists {
+		http.Error(w, "No such job", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		reportError("schedule", err, nil)
+		http.Error(w, "Job removed but failed to save the schedule", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "schedule.delete", map[string]string{"name": name})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveScheduleRun runs a scheduled job now
+func serveScheduleRun(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	seedScheduler.mu.Lock()
+	job := seedScheduler.jobs[name]
+	seedScheduler.mu.Unlock()
+	if job == nil {
+		http.Error(w, "No such job", http.StatusNotFound)
+		return
+	}
+	if !seedScheduler.run(job) {
+		http.Error(w, "Job is already running", http.StatusConflict)
+		return
+	}
+	recordAudit(r, "schedule.run", map[string]string{"name": name})
+	w.WriteHeader(http.StatusAccepted)
+}
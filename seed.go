@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// worldBBox covers everything a web mercator map can show
+var worldBBox = bbox{-180, -maxMercatorLat, 180, maxMercatorLat}
+
+// seedCheckpointEvery is how many tiles a resumable job visits between checkpoints
+const seedCheckpointEvery = 256
+
+// seedJob visits every tile covering an area across a zoom range, a few tiles at a time
+type seedJob struct {
+	name        string
+	area        bbox
+	minZoom     int
+	maxZoom     int
+	concurrency int
+	visit       func(z, x, y int) error
+
+	// resumable jobs save checkpoints to the store and carry on from the last one after a
+	// restart; only jobs whose visits are independent of each other can be resumed
+	resumable bool
+
+	total  int
+	done   atomic.Int64
+	failed atomic.Int64
+}
+
+// progress returns how many tiles have been visited so far and how many there are in total
+func (j *seedJob) progress() (done, total int) {
+	return int(j.done.Load()), j.total
+}
+
+// run visits every tile, returning once they have all been visited. Tiles that fail are
+// reported and counted but don't stop the job.
+func (j *seedJob) run() (failed int) {
+	j.total = j.area.tileCount(j.minZoom, j.maxZoom)
+	start := time.Now()
+	log.Printf("Seeding %s: %d tiles at zoom %d-%d", j.name, j.total, j.minZoom, j.maxZoom)
+
+	params := fmt.Sprintf("bbox=%g,%g,%g,%g zoom=%d-%d", j.area.minLon, j.area.minLat, j.area.maxLon, j.area.maxLat, j.minZoom, j.maxZoom)
+	var jobID int64
+	if store != nil {
+		id, err := store.startJob("seed:"+j.name, params)
+		if err != nil {
+			reportError("store", err, nil)
+		}
+		jobID = id
+	}
+
+	// Skip everything up to the last checkpoint, unless the job has changed since and no
+	// longer visits the same tiles in the same order
+	var resumeZ, resumeX, resumeY int
+	resuming := false
+	if j.resumable && store != nil {
+		if resumeZ, resumeX, resumeY, resuming = store.checkpoint(j.name, params); resuming {
+			log.Printf("Resuming %s after tile %d/%d/%d", j.name, resumeZ, resumeX, resumeY)
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(1, j.concurrency))
+	sinceCheckpoint := 0
+	for z := j.minZoom; z <= j.maxZoom; z++ {
+		x0, y0, x1, y1 := j.area.tileRange(z)
+		for y := y0; y <= y1; y++ {
+			for x := x0; x <= x1; x++ {
+				if resuming {
+					j.done.Add(1)
+					resuming = z != resumeZ || y != resumeY || x != resumeX
+					continue
+				}
+
+				z, x, y := z, x, y
+				wg.Add(1)
+				sem <- struct{}{}
+				go func() {
+					defer wg.Done()
+					defer func() { <-sem }()
+					if err := j.visit(z, x, y); err != nil {
+						j.failed.Add(1)
+						metrics.incr("seed_errors", "job:"+j.name)
+						log.Printf("Error seeding %s tile %d/%d/%d: %v", j.name, z, x, y, err)
+					}
+					metrics.incr("seed_tiles", "job:"+j.name)
+					if done := j.done.Add(1); done%1000 == 0 {
+						log.Printf("Seeding %s: %d/%d tiles", j.name, done, j.total)
+					}
+				}()
+
+				// Wait for every tile so far to finish before recording a checkpoint
+				if sinceCheckpoint++; j.resumable && store != nil && sinceCheckpoint == seedCheckpointEvery {
+					wg.Wait()
+					sinceCheckpoint = 0
+					if err := store.saveCheckpoint(j.name, params, z, x, y); err != nil {
+						reportError("store", err, nil)
+					}
+				}
+			}
+		}
+	}
+	wg.Wait()
+
+	failed = int(j.failed.Load())
+	log.Printf("Seeded %s: %d tiles, %d failed in %v", j.name, j.total, failed, time.Since(start).Round(time.Second))
+
+	if store != nil {
+		if j.resumable {
+			if err := store.clearCheckpoint(j.name); err != nil {
+				reportError("store", err, nil)
+			}
+		}
+		var jobErr error
+		if failed > 0 {
+			jobErr = fmt.Errorf("%d tiles failed", failed)
+		}
+		if jobID != 0 {
+			if err := store.finishJob(jobID, jobErr); err != nil {
+				reportError("store", err, nil)
+			}
+		}
+	}
+	return failed
+}
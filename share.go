@@ -0,0 +1,67 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+)
+
+// shareViewPattern is what a shared map view may look like: the fragment the map page keeps in
+// its URL, zoom/lat/lon/level/basemap
+var shareViewPattern = regexp.MustCompile(`^-?[0-9.]+/-?[0-9.]+/-?[0-9.]+(/-?[0-9]+(/[a-z0-9_-]+)?)?$`)
+
+// serveShareCreate stores a map view under a short ID, e.g. POST /share {"view": "8.00/51.5/0.1/20"},
+// returning the link to it
+func serveShareCreate(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		http.Error(w, "Share links need STORE_PATH", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		View string `json:"view"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.View) > 200 || !shareViewPattern.MatchString(req.View) {
+		http.Error(w, "Invalid view: expected zoom/lat/lon/level/basemap", http.StatusBadRequest)
+		return
+	}
+
+	id, err := store.createShareLink(req.View)
+	if err != nil {
+		reportError("store", err, nil)
+		http.Error(w, "Failed to create share link", http.StatusInternalServerError)
+		return
+	}
+	metrics.incr("share_links_created")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"id": id, "url": appURL("/s/" + id)})
+}
+
+// serveShareLink sends a share link to the map page showing its view
+func serveShareLink(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		http.Error(w, "Share links need STORE_PATH", http.StatusNotFound)
+		return
+	}
+	view, err := store.shareLink(mux.Vars(r)["id"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		reportError("store", err, nil)
+		http.Error(w, "Failed to look up share link", http.StatusInternalServerError)
+		return
+	}
+	metrics.incr("share_links_followed")
+	http.Redirect(w, r, appURL("/#"+view), http.StatusFound)
+}
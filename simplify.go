@@ -0,0 +1,237 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// point is a coordinate in a vector output, in global pixels at the output's zoom level
+type point struct {
+	X, Y float64
+}
+
+// ring is a closed polygon boundary; the first point is not repeated at the end
+type ring []point
+
+// simplifyRings simplifies polygon rings that don't cross each other with Douglas-Peucker, in
+// pixels at the output zoom so the tolerance looks the same at every latitude. parents gives the
+// ring immediately enclosing each one, or -1. The result lines up with rings, with nil for rings
+// smaller than the tolerance; everything inside a dropped ring is dropped with it. Rings whose
+// simplified form would cross themselves or another ring are left as they were, so holes stay
+// inside their outlines and neighbours never overlap.
+func simplifyRings(rings []ring, parents []int, tolerance float64) []ring {
+	out := make([]ring, len(rings))
+	copy(out, rings)
+	if tolerance <= 0 {
+		return out
+	}
+
+	// A ring encloses its children so is larger, and is visited before them
+	areas := make([]float64, len(rings))
+	order := make([]int, len(rings))
+	for i, r := range rings {
+		areas[i] = math.Abs(ringArea(r))
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return areas[order[a]] > areas[order[b]] })
+
+	exact := make([]bool, len(rings))
+	for _, i := range order {
+		if areas[i] < tolerance*tolerance || (parents[i] >= 0 && out[parents[i]] == nil) {
+			out[i] = nil
+			continue
+		}
+		s := simplifyRing(rings[i], tolerance)
+		if len(s) == len(rings[i]) || len(s) < 3 || math.Signbit(ringArea(s)) != math.Signbit(ringArea(rings[i])) {
+			exact[i] = true
+			continue
+		}
+		out[i] = s
+	}
+
+	// The original rings never cross, so putting back the ones involved in crossings always
+	// ends with none
+	for {
+		crossing := crossingRings(out, exact)
+		if len(crossing) == 0 {
+			return out
+		}
+		for i := range crossing {
+			out[i], exact[i] = rings[i], true
+		}
+	}
+}
+
+// simplifyRing simplifies a closed ring, anchoring on its two most distant points so that
+// the result always keeps some extent in both halves
+func simplifyRing(r ring, tolerance float64) ring {
+	if len(r) <= 4 {
+		return r
+	}
+
+	far := 0
+	farDist := 0.0
+	for i, p := range r {
+		if d := sqDist(r[0], p); d > farDist {
+			far, farDist = i, d
+		}
+	}
+
+	keep := make([]bool, len(r))
+	keep[0] = true
+	keep[far] = true
+	closed := append(append(ring{}, r...), r[0])
+	douglasPeucker(closed, 0, far, tolerance*tolerance, keep)
+	douglasPeucker(closed, far, len(r), tolerance*tolerance, keep)
+
+	var out ring
+	for i, k := range keep {
+		if k {
+			out = append(out, r[i])
+		}
+	}
+	return out
+}
+
+// douglasPeucker marks the points between first and last that must be kept
+func douglasPeucker(pts []point, first, last int, sqTolerance float64, keep []bool) {
+	if last-first < 2 {
+		return
+	}
+	index := -1
+	maxDist := sqTolerance
+	for i := first + 1; i < last; i++ {
+		if d := sqSegmentDist(pts[i], pts[first], pts[last]); d > maxDist {
+			index, maxDist = i, d
+		}
+	}
+	if index < 0 {
+		return
+	}
+	keep[index%len(keep)] = true
+	douglasPeucker(pts, first, index, sqTolerance, keep)
+	douglasPeucker(pts, index, last, sqTolerance, keep)
+}
+
+// crossingRings returns the simplified rings (those not marked exact) that cross or touch
+// themselves or another ring anywhere but at a shared vertex. Nil rings are ignored.
+func crossingRings(rings []ring, exact []bool) map[int]bool {
+	// Bucket the edges into a grid so that only nearby edges are compared
+	const cellSize = 16.0
+	type edge struct{ ring, index int }
+	type cell struct{ simplified, exact []edge }
+	grid := make(map[[2]int]*cell)
+	for i, r := range rings {
+		for j := range r {
+			a, b := r[j], r[(j+1)%len(r)]
+			x0, x1 := int(math.Floor(min(a.X, b.X)/cellSize)), int(math.Floor(max(a.X, b.X)/cellSize))
+			y0, y1 := int(math.Floor(min(a.Y, b.Y)/cellSize)), int(math.Floor(max(a.Y, b.Y)/cellSize))
+			for cy := y0; cy <= y1; cy++ {
+				for cx := x0; cx <= x1; cx++ {
+					c := grid[[2]int{cx, cy}]
+					if c == nil {
+						c = &cell{}
+						grid[[2]int{cx, cy}] = c
+					}
+					if exact[i] {
+						c.exact = append(c.exact, edge{i, j})
+					} else {
+						c.simplified = append(c.simplified, edge{i, j})
+					}
+				}
+			}
+		}
+	}
+
+	crossing := make(map[int]bool)
+	check := func(e, f edge) {
+		r, s := rings[e.ring], rings[f.ring]
+		if segmentsCross(r[e.index], r[(e.index+1)%len(r)], s[f.index], s[(f.index+1)%len(s)]) {
+			crossing[e.ring] = true
+			if !exact[f.ring] {
+				crossing[f.ring] = true
+			}
+		}
+	}
+	for _, c := range grid {
+		for i, e := range c.simplified {
+			for _, f := range c.simplified[i+1:] {
+				check(e, f)
+			}
+			for _, f := range c.exact {
+				check(e, f)
+			}
+		}
+	}
+	return crossing
+}
+
+// segmentsCross reports whether segments a-b and c-d meet anywhere except at an end of both
+func segmentsCross(a, b, c, d point) bool {
+	o1, o2 := orientation(a, b, c), orientation(a, b, d)
+	o3, o4 := orientation(c, d, a), orientation(c, d, b)
+	if o1 == 0 && o2 == 0 && o3 == 0 && o4 == 0 {
+		// Collinear: they overlap unless they at most meet end to end
+		if a.X == b.X && c.X == d.X {
+			return min(max(a.Y, b.Y), max(c.Y, d.Y)) > max(min(a.Y, b.Y), min(c.Y, d.Y))
+		}
+		return min(max(a.X, b.X), max(c.X, d.X)) > max(min(a.X, b.X), min(c.X, d.X))
+	}
+	if o1*o2 < 0 && o3*o4 < 0 {
+		return true
+	}
+
+	// One touching the other part way along
+	return (o1 == 0 && c != a && c != b && onSegment(c, a, b)) ||
+		(o2 == 0 && d != a && d != b && onSegment(d, a, b)) ||
+		(o3 == 0 && a != c && a != d && onSegment(a, c, d)) ||
+		(o4 == 0 && b != c && b != d && onSegment(b, c, d))
+}
+
+// orientation returns the sign of the turn from a-b to a-c. Points are whole pixels, so this is
+// exact.
+func orientation(a, b, c point) float64 {
+	v := (b.X-a.X)*(c.Y-a.Y) - (b.Y-a.Y)*(c.X-a.X)
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+	return 0
+}
+
+// onSegment reports whether p, known to be collinear with a-b, lies between them
+func onSegment(p, a, b point) bool {
+	return p.X >= min(a.X, b.X) && p.X <= max(a.X, b.X) && p.Y >= min(a.Y, b.Y) && p.Y <= max(a.Y, b.Y)
+}
+
+// ringArea returns the signed area of a ring (positive when counter-clockwise with y up, or
+// clockwise on screen)
+func ringArea(r ring) float64 {
+	area := 0.0
+	for i := range r {
+		a, b := r[i], r[(i+1)%len(r)]
+		area += a.X*b.Y - b.X*a.Y
+	}
+	return area / 2
+}
+
+func sqDist(a, b point) float64 {
+	dx, dy := a.X-b.X, a.Y-b.Y
+	return dx*dx + dy*dy
+}
+
+// sqSegmentDist returns the squared distance from p to the segment a-b
+func sqSegmentDist(p, a, b point) float64 {
+	dx, dy := b.X-a.X, b.Y-a.Y
+	if dx != 0 || dy != 0 {
+		t := ((p.X-a.X)*dx + (p.Y-a.Y)*dy) / (dx*dx + dy*dy)
+		if t > 1 {
+			a = b
+		} else if t > 0 {
+			a = point{a.X + dx*t, a.Y + dy*t}
+		}
+	}
+	return sqDist(p, a)
+}
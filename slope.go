@@ -0,0 +1,133 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// slopeStops color slopes in degrees, from transparent flat ground to red cliffs
+var slopeStops = []struct {
+	degrees float64
+	color   color.RGBA
+}{
+	{0, color.RGBA{255, 255, 180, 0}},
+	{5, color.RGBA{255, 240, 120, 160}},
+	{15, color.RGBA{250, 170, 50, 200}},
+	{30, color.RGBA{220, 60, 30, 230}},
+	{45, color.RGBA{120, 0, 40, 255}},
+}
+
+// gradient returns the rise in elevation per metre eastwards and southwards at a pixel, with
+// Horn's method over its eight neighbours. It isn't known next to pixels without elevation.
+func gradient(grid *elevationGrid, px, py int, mpp float64) (east, south float64, ok bool) {
+	var e [3][3]float64
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			v := grid[clampPixel(py+dy)*tileSize+clampPixel(px+dx)]
+			if v == noElevation {
+				return 0, 0, false
+			}
+			e[dy+1][dx+1] = float64(v)
+		}
+	}
+	east = ((e[0][2] + 2*e[1][2] + e[2][2]) - (e[0][0] + 2*e[1][0] + e[2][0])) / (8 * mpp)
+	south = ((e[2][0] + 2*e[2][1] + e[2][2]) - (e[0][0] + 2*e[0][1] + e[0][2])) / (8 * mpp)
+	return east, south, true
+}
+
+// renderTerrain colors each pixel at or above the sea level from its slope in degrees and the
+// compass bearing it faces downhill
+func renderTerrain(grid *elevationGrid, z, y, seaLevel int, colorAt func(slope, aspect float64) color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	for py := 0; py < tileSize; py++ {
+		mpp := metersPerPixel(tileLatitude(z, float64(y)+(float64(py)+0.5)/tileSize), z)
+		for px := 0; px < tileSize; px++ {
+			i := py*tileSize + px
+			if grid[i] == noElevation || int(grid[i]) < seaLevel {
+				continue
+			}
+			east, south, ok := gradient(grid, px, py, mpp)
+			if !ok {
+				continue
+			}
+			slope := math.Atan(math.Hypot(east, south)) * 180 / math.Pi
+			aspect := math.Mod(math.Atan2(-east, south)*180/math.Pi+360, 360)
+			c := premultiply(colorAt(slope, aspect))
+			offset := i * 4
+			img.Pix[offset] = c.R
+			img.Pix[offset+1] = c.G
+			img.Pix[offset+2] = c.B
+			img.Pix[offset+3] = c.A
+		}
+	}
+	return img
+}
+
+func slopeColor(slope, _ float64) color.RGBA {
+	for i := 1; i < len(slopeStops); i++ {
+		a, b := slopeStops[i-1], slopeStops[i]
+		if slope < b.degrees {
+			return lerpColor(a.color, b.color, (slope-a.degrees)/(b.degrees-a.degrees))
+		}
+	}
+	return slopeStops[len(slopeStops)-1].color
+}
+
+// aspectColor shows the bearing as a hue, north red, east yellow-green, south cyan and west
+// purple, fading out on ground too flat to face anywhere
+func aspectColor(slope, aspect float64) color.RGBA {
+	h := aspect / 60
+	x := 1 - math.Abs(math.Mod(h, 2)-1)
+	var r, g, b float64
+	switch int(h) % 6 {
+	case 0:
+		r, g = 1, x
+	case 1:
+		r, g = x, 1
+	case 2:
+		g, b = 1, x
+	case 3:
+		g, b = x, 1
+	case 4:
+		r, b = x, 1
+	case 5:
+		r, b = 1, x
+	}
+	alpha := math.Min(1, slope/10)
+	return color.RGBA{uint8(r * 255), uint8(g * 255), uint8(b * 255), uint8(alpha * 255)}
+}
+
+// serveSlope and serveAspect serve the steepness and direction of the terrain, with ?level=
+// leaving out anything below a sea level so the new shoreline stands out
+func serveSlope(w http.ResponseWriter, r *http.Request) {
+	serveTerrain(w, r, "slope", slopeColor)
+}
+
+func serveAspect(w http.ResponseWriter, r *http.Request) {
+	serveTerrain(w, r, "aspect", aspectColor)
+}
+
+func serveTerrain(w http.ResponseWriter, r *http.Request, layer string, colorAt func(slope, aspect float64) color.RGBA) {
+	z, x, y, ok := parseLayerTile(w, r)
+	if !ok {
+		return
+	}
+	seaLevel := math.MinInt
+	if s := r.URL.Query().Get("level"); s != "" {
+		level, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "Invalid sea level", http.StatusBadRequest)
+			return
+		}
+		seaLevel = clampSeaLevel(level)
+	}
+
+	grid, ok := loadLayerElevation(w, r, z, x, y)
+	if !ok {
+		return
+	}
+	writeLayerTile(w, layer, renderTerrain(grid, z, y, seaLevel, colorAt))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Smoothing suppresses single-pixel speckles of flooding caused by noise in flat coastal DEMs
+var (
+	smoothingMethod string // "median", "gaussian" or "" for none
+	smoothingRadius = 1
+)
+
+const maxSmoothingRadius = 5
+
+// checkSmoothing validates a smoothing method and radius
+func checkSmoothing(method string, radius int) error {
+	if method != "" && method != "median" && method != "gaussian" {
+		return fmt.Errorf("unknown smoothing method %q: use median or gaussian", method)
+	}
+	if radius < 1 || radius > maxSmoothingRadius {
+		return fmt.Errorf("smoothing radius must be between 1 and %d", maxSmoothingRadius)
+	}
+	return nil
+}
+
+// smoothElevation returns a smoothed copy of a grid using the configured method, or the grid
+// itself if smoothing is disabled. Pixels beyond the tile edge are taken from the nearest edge
+// pixel, so tiles don't line up perfectly where smoothing moves a shoreline near the boundary.
+func smoothElevation(grid *elevationGrid) *elevationGrid {
+	switch smoothingMethod {
+	case "median":
+		return medianFilter(grid, smoothingRadius)
+	case "gaussian":
+		return gaussianFilter(grid, smoothingRadius)
+	}
+	return grid
+}
+
+// medianFilter replaces each pixel with the median of its square neighbourhood
+func medianFilter(grid *elevationGrid, radius int) *elevationGrid {
+	out := new(elevationGrid)
+	window := make([]int16, 0, (2*radius+1)*(2*radius+1))
+	for y := 0; y < tileSize; y++ {
+		for x := 0; x < tileSize; x++ {
+			window = window[:0]
+			for dy := -radius; dy <= radius; dy++ {
+				for dx := -radius; dx <= radius; dx++ {
+					window = append(window, grid[clampPixel(y+dy)*tileSize+clampPixel(x+dx)])
+				}
+			}
+			slices.Sort(window)
+			out[y*tileSize+x] = window[len(window)/2]
+		}
+	}
+	return out
+}
+
+// gaussianFilter blurs a grid with a separable Gaussian kernel reaching out to radius pixels
+func gaussianFilter(grid *elevationGrid, radius int) *elevationGrid {
+	sigma := float64(radius) / 2
+	kernel := make([]float64, 2*radius+1)
+	total := 0.0
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		total += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= total
+	}
+
+	// Horizontal pass, then vertical
+	var tmp [tileSize * tileSize]float64
+	for y := 0; y < tileSize; y++ {
+		for x := 0; x < tileSize; x++ {
+			sum := 0.0
+			for i, k := range kernel {
+				sum += k * float64(grid[y*tileSize+clampPixel(x+i-radius)])
+			}
+			tmp[y*tileSize+x] = sum
+		}
+	}
+	out := new(elevationGrid)
+	for y := 0; y < tileSize; y++ {
+		for x := 0; x < tileSize; x++ {
+			sum := 0.0
+			for i, k := range kernel {
+				sum += k * tmp[clampPixel(y+i-radius)*tileSize+x]
+			}
+			out[y*tileSize+x] = int16(math.Round(sum))
+		}
+	}
+	return out
+}
+
+// clampPixel clamps a pixel coordinate to the tile
+func clampPixel(v int) int {
+	return max(0, min(tileSize-1, v))
+}
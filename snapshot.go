@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Cache snapshots start with this line and then the tile version, followed by tiles in the
+// replication frame format, least recently used first so restoring keeps the LRU order
+const snapshotHeader = "sea-level-map cache snapshot 1\n"
+
+// entries returns every cached tile, least recently used first
+func (c *TileCache) entries() ([]string, []CachedTile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, c.lru.Len())
+	tiles := make([]CachedTile, 0, c.lru.Len())
+	for elem := c.lru.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*tileCacheEntry)
+		keys = append(keys, entry.key)
+		tiles = append(tiles, entry.tile)
+	}
+	return keys, tiles
+}
+
+// saveCacheSnapshot writes the tile cache to a file, via a temporary file so a failed save
+// never replaces a good snapshot
+func saveCacheSnapshot(c *TileCache, path string) (int, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "%s%s\n", snapshotHeader, tileVersion())
+	keys, tiles := c.entries()
+	saved := 0
+	for i, tile := range tiles {
+		if c.gone(tile) {
+			continue
+		}
+		if err := writeReplicationFrame(w, keys[i], tile); err != nil {
+			f.Close()
+			return 0, err
+		}
+		saved++
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return saved, os.Rename(tmp, path)
+}
+
+// loadCacheSnapshot fills the tile cache from a snapshot, ignoring it if it was taken with a
+// different renderer; a missing file isn't an error
+func loadCacheSnapshot(c *TileCache, path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header, err := r.ReadString('\n')
+	if err != nil || header != snapshotHeader {
+		return 0, fmt.Errorf("%s is not a cache snapshot", path)
+	}
+	version, err := r.ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("truncated snapshot %s", path)
+	}
+	if version = strings.TrimSuffix(version, "\n"); version != tileVersion() {
+		return 0, fmt.Errorf("snapshot %s is of tile version %s, not %s", path, version, tileVersion())
+	}
+
+	loaded := 0
+	for {
+		key, tile, err := readReplicationFrame(r)
+		if err == io.EOF {
+			return loaded, nil
+		} else if err != nil {
+			return loaded, fmt.Errorf("truncated snapshot %s: %v", path, err)
+		}
+		if !c.gone(tile) {
+			c.put(key, tile)
+			loaded++
+		}
+	}
+}
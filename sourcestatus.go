@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sourceProbe is the latest health check of one elevation source
+type sourceProbe struct {
+	Name        string     `json:"name"`
+	Source      string     `json:"source"`
+	Reachable   bool       `json:"reachable"`
+	LatencyMS   int64      `json:"latencyMs"`
+	Checked     *time.Time `json:"checked,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// sourceProber fetches a known tile from each elevation source in the background, bypassing
+// the caches, to tell a broken server apart from a broken upstream
+type sourceProber struct {
+	z, x, y int
+	sources []elevationSource
+
+	mu     sync.Mutex
+	probes []sourceProbe
+}
+
+// prober is nil unless ELEVATION_PROBE_INTERVAL is positive
+var prober *sourceProber
+
+func newSourceProber(root elevationSource, z, x, y int) *sourceProber {
+	p := &sourceProber{z: z, x: x, y: y, sources: leafSources(root)}
+	for _, source := range p.sources {
+		p.probes = append(p.probes, sourceProbe{Name: source.name(), Source: source.describe()})
+	}
+	return p
+}
+
+// leafSources lists the sources making up a chain or bathymetry merge
+func leafSources(source elevationSource) []elevationSource {
+	switch s := source.(type) {
+	case *chainSource:
+		var sources []elevationSource
+		for _, source := range s.sources {
+			sources = append(sources, leafSources(source)...)
+		}
+		return sources
+	case *bathymetrySource:
+		return append(leafSources(s.land), leafSources(s.sea)...)
+	}
+	return []elevationSource{source}
+}
+
+// parseProbeTile reads a tile like "8/130/85"
+func parseProbeTile(s string) (z, x, y int, err error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("tile should look like z/x/y")
+	}
+	var n [3]int
+	for i, part := range parts {
+		if n[i], err = strconv.Atoi(part); err != nil || n[i] < 0 {
+			return 0, 0, 0, fmt.Errorf("invalid tile %q", s)
+		}
+	}
+	if n[1] >= 1<<n[0] || n[2] >= 1<<n[0] {
+		return 0, 0, 0, fmt.Errorf("tile %q is out of range", s)
+	}
+	return n[0], n[1], n[2], nil
+}
+
+// start probes every source now and then every interval
+func (p *sourceProber) start(interval time.Duration) {
+	go func() {
+		for {
+			p.probeAll()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (p *sourceProber) probeAll() {
+	for i, source := range p.sources {
+		start := time.Now()
+		var err error
+		if remote, ok := source.(*terrariumSource); ok {
+			// Skip the raw elevation store, which would otherwise answer for the upstream
+			_, _, err = remote.download(p.z, p.x, p.y, nil, nil)
+		} else {
+			_, err = source.tile(p.z, p.x, p.y, nil)
+		}
+		latency := time.Since(start)
+		// A source that says it has no such tile is still answering
+		reachable := err == nil || err == errElevationMissing
+		metrics.timing("source_probe", latency, "source:"+source.name(), "position:"+strconv.Itoa(i))
+
+		p.mu.Lock()
+		probe := &p.probes[i]
+		if probe.Checked != nil && probe.Reachable != reachable {
+			if reachable {
+				log.Printf("Elevation source %s is reachable again", source.describe())
+			} else {
+				log.Printf("Elevation source %s is unreachable: %v", source.describe(), err)
+			}
+		}
+		probe.Reachable = reachable
+		probe.LatencyMS = latency.Milliseconds()
+		probe.Checked = &start
+		if reachable {
+			probe.LastSuccess = &start
+		} else {
+			probe.LastError = err.Error()
+			probe.LastErrorAt = &start
+		}
+		p.mu.Unlock()
+	}
+}
+
+// serveSourceStatus reports the latest probe of each elevation source
+func serveSourceStatus(w http.ResponseWriter, r *http.Request) {
+	if prober == nil {
+		http.Error(w, "Source probing is disabled", http.StatusNotFound)
+		return
+	}
+	prober.mu.Lock()
+	status := struct {
+		Tile    string        `json:"tile"`
+		Sources []sourceProbe `json:"sources"`
+	}{fmt.Sprintf("%d/%d/%d", prober.z, prober.x, prober.y), append([]sourceProbe(nil), prober.probes...)}
+	prober.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// srtmName matches SRTM tile names like N51W001.hgt, which give the south-west corner
+var srtmName = regexp.MustCompile(`^([NS])(\d{2})([EW])(\d{3})\.HGT$`)
+
+// srtmRowsPerBlock is how many rows of an .hgt file are read at once
+const srtmRowsPerBlock = 64
+
+// newSRTMSource indexes a directory of SRTM .hgt files, 1 or 3 arc-second, for sampling into
+// tiles. Each is a square grid of big-endian 16-bit elevations covering one degree, with
+// samples on the grid lines and -32768 for voids. Files are only opened when first needed.
+func newSRTMSource(dir string) (*geoTIFFSource, error) {
+	s := &geoTIFFSource{kind: "srtm", spec: dir}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		m := srtmName.FindStringSubmatch(strings.ToUpper(info.Name()))
+		if m == nil {
+			return nil
+		}
+
+		var size int
+		switch info.Size() {
+		case 1201 * 1201 * 2:
+			size = 1201
+		case 3601 * 3601 * 2:
+			size = 3601
+		default:
+			return fmt.Errorf("%s: unexpected size %d for an SRTM file", path, info.Size())
+		}
+		lat, _ := strconv.Atoi(m[2])
+		lon, _ := strconv.Atoi(m[4])
+		if m[1] == "S" {
+			lat = -lat
+		}
+		if m[3] == "W" {
+			lon = -lon
+		}
+		s.files = append(s.files, newHGTFile(path, size, lat, lon))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(s.files) == 0 {
+		return nil, fmt.Errorf("no .hgt files in %s", dir)
+	}
+	return s, nil
+}
+
+// newHGTFile describes an .hgt file as an uncompressed, striped raster
+func newHGTFile(path string, size, lat, lon int) *geoTIFF {
+	g := &geoTIFF{
+		path:            path,
+		order:           binary.BigEndian,
+		width:           size,
+		height:          size,
+		blockW:          size,
+		blockH:          srtmRowsPerBlock,
+		compression:     1,
+		predictor:       1,
+		bitsPerSample:   16,
+		sampleFormat:    2,
+		samplesPerPixel: 1,
+		originX:         float64(lon),
+		originY:         float64(lat + 1),
+		scaleX:          1 / float64(size-1),
+		scaleY:          1 / float64(size-1),
+		noData:          -32768,
+		hasNoData:       true,
+	}
+	g.blocks = make(map[int]*list.Element)
+	g.lru = list.New()
+	rowBytes := uint64(size * 2)
+	for row := 0; row < size; row += srtmRowsPerBlock {
+		rows := uint64(min(srtmRowsPerBlock, size-row))
+		g.offsets = append(g.offsets, uint64(row)*rowBytes)
+		g.counts = append(g.counts, rows*rowBytes)
+	}
+	return g
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultStaticWidth  = 800
+	defaultStaticHeight = 600
+)
+
+// fitBBox returns the centre of a bbox and the highest zoom level at which it fits in an image
+func fitBBox(b bbox, width, height, maxZoom int) (lat, lon float64, zoom int) {
+	for zoom = maxZoom; zoom > 0; zoom-- {
+		x0, y0 := mercatorPixel(b.minLon, b.maxLat, zoom)
+		x1, y1 := mercatorPixel(b.maxLon, b.minLat, zoom)
+		if x1-x0 <= float64(width) && y1-y0 <= float64(height) {
+			break
+		}
+	}
+	_, y0 := mercatorPixel(b.minLon, b.maxLat, zoom)
+	_, y1 := mercatorPixel(b.maxLon, b.minLat, zoom)
+	return tileLatitude(zoom, (y0+y1)/2/tileSize), (b.minLon + b.maxLon) / 2, zoom
+}
+
+// serveStaticMap renders a plain map image of a sea level for reports and emails, framing
+// ?bbox= or centred on ?lat=, ?lon= and ?zoom=. With ?basemap=0 only the overlay is drawn, on
+// a transparent background, and ?opacity= sets how strongly it covers the basemap.
+func serveStaticMap(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	level, err := strconv.Atoi(query.Get("level"))
+	if err != nil {
+		http.Error(w, "Invalid sea level", http.StatusBadRequest)
+		return
+	}
+	level = clampSeaLevel(level)
+
+	width, height, err := parseExportSize(r, defaultStaticWidth, defaultStaticHeight)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var lat, lon float64
+	var zoom int
+	if s := query.Get("bbox"); s != "" {
+		area, err := parseBBox(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lat, lon, zoom = fitBBox(area, width, height, upstreamMaxZoom)
+	} else if lat, lon, zoom, err = parseViewParams(r, upstreamMaxZoom); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	withBasemap := query.Get("basemap") != "0"
+	opacity := 0.7
+	if !withBasemap {
+		opacity = 1
+	}
+	if s := query.Get("opacity"); s != "" {
+		percent, err := parseOpacity(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opacity = float64(percent) / 100
+	}
+
+	if !acquireExport(r) {
+		http.Error(w, "Too many maps in progress, try again when one has finished", http.StatusTooManyRequests)
+		return
+	}
+	defer releaseExport(r)
+
+	img := renderView(mapView{
+		level:     level,
+		lat:       lat,
+		lon:       lon,
+		zoom:      zoom,
+		width:     width,
+		height:    height,
+		noBasemap: !withBasemap,
+		priority:  priorityPrefetch,
+	}, opacity)
+
+	attribution := elevationAttribution()
+	if withBasemap {
+		attribution = basemapAttribution() + " | " + attribution
+	}
+	drawTextHalo(img, width-textWidth(attribution, 1)-4, height-textHeight(1)-4, attribution, 1, exportInk, exportHalo)
+	stampWatermark(img, textHeight(1)+8)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		reportError("render", err, map[string]string{"endpoint": "staticmap"})
+		http.Error(w, "Failed to render map", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(buf.Bytes())
+
+	log.Printf("Served static map: level=%d, lat=%f, lon=%f, zoom=%d, size=%dx%d", level, lat, lon, zoom, width, height)
+}
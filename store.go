@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Store keeps server-side state that should survive restarts: saved styles, API keys, share
+// links, job records and seed checkpoints
+type Store struct {
+	db *sql.DB
+}
+
+// store is nil unless STORE_PATH is set, in which case state lives only in memory
+var store *Store
+
+// storeDriver is the database/sql driver for the store, registered by the pure Go
+// modernc.org/sqlite so the build needs no cgo
+const storeDriver = "sqlite"
+
+// migrations are applied in order, each exactly once; only ever append to this list
+var migrations = []string{
+	`CREATE TABLE styles (
+		name TEXT PRIMARY KEY,
+		spec TEXT NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE api_keys (
+		name TEXT PRIMARY KEY,
+		key_hash TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP
+	)`,
+	`CREATE TABLE share_links (
+		id TEXT PRIMARY KEY,
+		target TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind TEXT NOT NULL,
+		params TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT,
+		started_at TIMESTAMP NOT NULL,
+		finished_at TIMESTAMP
+	)`,
+	`CREATE TABLE seed_checkpoints (
+		job TEXT PRIMARY KEY,
+		z INTEGER NOT NULL,
+		x INTEGER NOT NULL,
+		y INTEGER NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	`ALTER TABLE seed_checkpoints ADD COLUMN params TEXT NOT NULL DEFAULT ''`,
+}
+
+// openStore opens (or creates) the store database and brings its schema up to date
+func openStore(path string) (*Store, error) {
+	db, err := sql.Open(storeDriver, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only allows one writer at a time
+	db.SetMaxOpenConns(1)
+
+	s := &Store{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate store: %v", err)
+	}
+	return s, nil
+}
+
+// migrate applies any migrations the database hasn't seen yet
+func (s *Store) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	var version int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database is at schema version %d but this build only knows %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_version (version) VALUES (?)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Applied store migration %d", i+1)
+	}
+	return nil
+}
+
+// saveStyle creates or replaces a named style
+func (s *Store) saveStyle(name, spec string) error {
+	_, err := s.db.Exec(`INSERT INTO styles (name, spec, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET spec = excluded.spec, updated_at = excluded.updated_at`,
+		name, spec, time.Now().UTC())
+	return err
+}
+
+// styles returns every saved style by name
+func (s *Store) styles() (map[string]string, error) {
+	rows, err := s.db.Query(`SELECT name, spec FROM styles`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	specs := make(map[string]string)
+	for rows.Next() {
+		var name, spec string
+		if err := rows.Scan(&name, &spec); err != nil {
+			return nil, err
+		}
+		specs[name] = spec
+	}
+	return specs, rows.Err()
+}
+
+// deleteStyle removes a saved style, reporting whether there was one
+func (s *Store) deleteStyle(name string) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM styles WHERE name = ?`, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// hashAPIKey is how API keys are stored, so a leaked database doesn't leak keys
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// addAPIKey stores a new named API key
+func (s *Store) addAPIKey(name, key string) error {
+	_, err := s.db.Exec(`INSERT INTO api_keys (name, key_hash, created_at) VALUES (?, ?, ?)`,
+		name, hashAPIKey(key), time.Now().UTC())
+	return err
+}
+
+// apiKeyName returns the name of a valid, unrevoked API key
+func (s *Store) apiKeyName(key string) (string, bool) {
+	var name string
+	err := s.db.QueryRow(`SELECT name FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL`, hashAPIKey(key)).Scan(&name)
+	if err != nil && err != sql.ErrNoRows {
+		reportError("store", err, nil)
+	}
+	return name, err == nil
+}
+
+// revokeAPIKey stops a named API key from working, reporting whether there was one to revoke
+func (s *Store) revokeAPIKey(name string) (bool, error) {
+	res, err := s.db.Exec(`UPDATE api_keys SET revoked_at = ? WHERE name = ? AND revoked_at IS NULL`, time.Now().UTC(), name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// createShareLink stores a target and returns a short random ID for it
+func (s *Store) createShareLink(target string) (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	_, err := s.db.Exec(`INSERT INTO share_links (id, target, created_at) VALUES (?, ?, ?)`, id, target, time.Now().UTC())
+	return id, err
+}
+
+// shareLink returns the target of a share link, or sql.ErrNoRows if there is none
+func (s *Store) shareLink(id string) (string, error) {
+	var target string
+	err := s.db.QueryRow(`SELECT target FROM share_links WHERE id = ?`, id).Scan(&target)
+	return target, err
+}
+
+// startJob records that a background job has started, returning its ID
+func (s *Store) startJob(kind, params string) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO jobs (kind, params, status, started_at) VALUES (?, ?, 'running', ?)`,
+		kind, params, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// finishJob records the outcome of a background job
+func (s *Store) finishJob(id int64, jobErr error) error {
+	status, message := "done", sql.NullString{}
+	if jobErr != nil {
+		status, message = "failed", sql.NullString{String: jobErr.Error(), Valid: true}
+	}
+	_, err := s.db.Exec(`UPDATE jobs SET status = ?, error = ?, finished_at = ? WHERE id = ?`,
+		status, message, time.Now().UTC(), id)
+	return err
+}
+
+// saveCheckpoint records the last tile a seed job finished, so it can resume after a restart.
+// params describe the tiles the job covers, as the job can be changed without being renamed.
+func (s *Store) saveCheckpoint(job, params string, z, x, y int) error {
+	_, err := s.db.Exec(`INSERT INTO seed_checkpoints (job, params, z, x, y, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (job) DO UPDATE SET params = excluded.params, z = excluded.z, x = excluded.x, y = excluded.y, updated_at = excluded.updated_at`,
+		job, params, z, x, y, time.Now().UTC())
+	return err
+}
+
+// checkpoint returns where a seed job got to, if it has run before covering the same tiles
+func (s *Store) checkpoint(job, params string) (z, x, y int, ok bool) {
+	err := s.db.QueryRow(`SELECT z, x, y FROM seed_checkpoints WHERE job = ? AND params = ?`, job, params).Scan(&z, &x, &y)
+	if err != nil && err != sql.ErrNoRows {
+		reportError("store", err, nil)
+	}
+	return z, x, y, err == nil
+}
+
+// clearCheckpoint forgets a seed job's progress once it has completed
+func (s *Store) clearCheckpoint(job string) error {
+	_, err := s.db.Exec(`DELETE FROM seed_checkpoints WHERE job = ?`, job)
+	return err
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxSummaryTiles limits how many tiles a country summary samples; big countries are
+	// summarized at a lower zoom
+	maxSummaryTiles = 256
+
+	// summaryRegions is how many of the largest flooded regions a summary lists
+	summaryRegions = 5
+)
+
+// boundary is a country or region's outline, as rings of longitude and latitude filled by the
+// even-odd rule, so holes need no special treatment
+type boundary struct {
+	name  string
+	rings []ring
+	area  bbox
+}
+
+// boundaries holds the outlines from BOUNDARIES_FILE by upper case ISO 3166 code; country
+// summaries are unavailable without it
+var boundaries map[string]*boundary
+
+// summaries caches computed summaries by code and sea level
+var summaries = newTileCache("summaries")
+
+// boundaryCodeProperties are the properties ISO 3166 codes are read from, as used by Natural
+// Earth and other common boundary datasets
+var boundaryCodeProperties = []string{"ISO_A3", "ISO_A2", "iso_a3", "iso_a2", "ISO3166-1", "ISO3166-1-Alpha-3", "ISO3166-1-Alpha-2", "iso3166"}
+
+// loadBoundaries reads a GeoJSON FeatureCollection of Polygon and MultiPolygon features
+func loadBoundaries(path string) (map[string]*boundary, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var collection struct {
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+			Geometry   struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &collection); err != nil {
+		return nil, fmt.Errorf("invalid boundaries %s: %v", path, err)
+	}
+
+	loaded := make(map[string]*boundary)
+	for i, f := range collection.Features {
+		var polygons [][][][]float64
+		switch f.Geometry.Type {
+		case "Polygon":
+			var polygon [][][]float64
+			err = json.Unmarshal(f.Geometry.Coordinates, &polygon)
+			polygons = [][][][]float64{polygon}
+		case "MultiPolygon":
+			err = json.Unmarshal(f.Geometry.Coordinates, &polygons)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("feature %d: %v", i, err)
+		}
+
+		b := &boundary{area: bbox{minLon: 180, minLat: 90, maxLon: -180, maxLat: -90}}
+		if name, ok := f.Properties["NAME"].(string); ok {
+			b.name = name
+		} else if name, ok := f.Properties["name"].(string); ok {
+			b.name = name
+		}
+		for _, polygon := range polygons {
+			for _, positions := range polygon {
+				var r ring
+				for _, p := range positions {
+					if len(p) < 2 {
+						return nil, fmt.Errorf("feature %d: invalid position", i)
+					}
+					lat := max(-maxMercatorLat, min(maxMercatorLat, p[1]))
+					r = append(r, point{p[0], lat})
+					b.area.minLon, b.area.maxLon = min(b.area.minLon, p[0]), max(b.area.maxLon, p[0])
+					b.area.minLat, b.area.maxLat = min(b.area.minLat, lat), max(b.area.maxLat, lat)
+				}
+				b.rings = append(b.rings, r)
+			}
+		}
+		for _, property := range boundaryCodeProperties {
+			// Natural Earth uses -99 where there's no code
+			if code, ok := f.Properties[property].(string); ok && code != "" && code != "-99" {
+				loaded[strings.ToUpper(code)] = b
+			}
+		}
+	}
+	return loaded, nil
+}
+
+// rasterize marks the pixels of a block of tiles whose centres are inside a boundary, filling
+// each row between pairs of edge crossings
+func (b *boundary) rasterize(z, originX, originY, width, height int) []bool {
+	type edge struct {
+		x0, y0, x1, y1 float64
+	}
+	var edges []edge
+	for _, r := range b.rings {
+		for i := range r {
+			a, c := r[i], r[(i+1)%len(r)]
+			ax, ay := mercatorPixel(a.X, a.Y, z)
+			cx, cy := mercatorPixel(c.X, c.Y, z)
+			if ay == cy {
+				continue
+			}
+			if ay > cy {
+				ax, ay, cx, cy = cx, cy, ax, ay
+			}
+			edges = append(edges, edge{ax - float64(originX), ay - float64(originY), cx - float64(originX), cy - float64(originY)})
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].y0 < edges[j].y0 })
+
+	inside := make([]bool, width*height)
+	var active []edge
+	next := 0
+	var crossings []float64
+	for row := 0; row < height; row++ {
+		y := float64(row) + 0.5
+		for next < len(edges) && edges[next].y0 <= y {
+			active = append(active, edges[next])
+			next++
+		}
+		kept := active[:0]
+		crossings = crossings[:0]
+		for _, e := range active {
+			if e.y1 <= y {
+				continue
+			}
+			kept = append(kept, e)
+			if e.y0 <= y {
+				crossings = append(crossings, e.x0+(y-e.y0)*(e.x1-e.x0)/(e.y1-e.y0))
+			}
+		}
+		active = kept
+		sort.Float64s(crossings)
+		for i := 0; i+1 < len(crossings); i += 2 {
+			from := max(0, int(math.Ceil(crossings[i]-0.5)))
+			to := min(width-1, int(math.Floor(crossings[i+1]-0.5)))
+			for x := from; x <= to; x++ {
+				inside[row*width+x] = true
+			}
+		}
+	}
+	return inside
+}
+
+// floodedRegion is a contiguous flooded area within a summary
+type floodedRegion struct {
+	AreaKm2 float64 `json:"areaKm2"`
+	Lon     float64 `json:"lon"`
+	Lat     float64 `json:"lat"`
+}
+
+type countrySummary struct {
+	Country        string          `json:"country"`
+	Name           string          `json:"name,omitempty"`
+	Level          int             `json:"level"`
+	Zoom           int             `json:"zoom"`
+	LandKm2        float64         `json:"landKm2"`
+	FloodedKm2     float64         `json:"floodedKm2"`
+	FloodedPercent float64         `json:"floodedPercent"`
+	ExposedKm2     float64         `json:"exposedKm2"`
+	Regions        []floodedRegion `json:"regions"`
+}
+
+// summarize measures how much of a country's land today is below a sea level, or how much sea
+// floor is exposed by a lower one, and finds its largest contiguous flooded regions
+func summarize(code string, b *boundary, level int) (*countrySummary, error) {
+	zoom := upstreamMaxZoom
+	for zoom > 0 && b.area.tileCount(zoom, zoom) > maxSummaryTiles {
+		zoom--
+	}
+	x0, y0, x1, y1 := b.area.tileRange(zoom)
+	originX, originY := x0*tileSize, y0*tileSize
+	width, height := (x1-x0+1)*tileSize, (y1-y0+1)*tileSize
+	inside := b.rasterize(zoom, originX, originY, width, height)
+
+	s := &countrySummary{Country: code, Name: b.name, Level: level, Zoom: zoom, Regions: []floodedRegion{}}
+	flooded := &floodMask{width: width, height: height, pixels: make([]bool, width*height)}
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 8)
+	for ty := y0; ty <= y1; ty++ {
+		for tx := x0; tx <= x1; tx++ {
+			tx, ty := tx, ty
+			offset := (ty-y0)*tileSize*width + (tx-x0)*tileSize
+			covered := false
+			for py := 0; py < tileSize && !covered; py++ {
+				for px := 0; px < tileSize; px++ {
+					if inside[offset+py*width+px] {
+						covered = true
+						break
+					}
+				}
+			}
+			if !covered || oceanMask.contains(zoom, tx, ty) {
+				continue
+			}
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				grid, err := loadElevation(zoom, tx, ty, nil)
+				if err == errElevationMissing {
+					return
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+				grid = smoothElevation(grid)
+				var land, below, exposed float64
+				for py := 0; py < tileSize; py++ {
+					mpp := metersPerPixel(tileLatitude(zoom, float64(ty)+(float64(py)+0.5)/tileSize), zoom)
+					area := mpp * mpp / 1e6
+					for px := 0; px < tileSize; px++ {
+						i := offset + py*width + px
+						elevation := grid[py*tileSize+px]
+						if !inside[i] || elevation == noElevation {
+							continue
+						}
+						if elevation >= 0 {
+							land += area
+							if int(elevation) < level {
+								below += area
+								flooded.pixels[i] = true
+							}
+						} else if int(elevation) >= level {
+							exposed += area
+						}
+					}
+				}
+				mu.Lock()
+				s.LandKm2 += land
+				s.FloodedKm2 += below
+				s.ExposedKm2 += exposed
+				mu.Unlock()
+			}()
+		}
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	s.Regions = largestRegions(flooded, zoom, originX, originY, summaryRegions)
+	if s.LandKm2 > 0 {
+		s.FloodedPercent = math.Round(s.FloodedKm2/s.LandKm2*10000) / 100
+	}
+	s.LandKm2, s.FloodedKm2, s.ExposedKm2 = math.Round(s.LandKm2), math.Round(s.FloodedKm2), math.Round(s.ExposedKm2)
+	return s, nil
+}
+
+// largestRegions finds the largest groups of flooded pixels sharing edges, with the centre of
+// each
+func largestRegions(m *floodMask, zoom, originX, originY, n int) []floodedRegion {
+	worldSize := float64(tileSize) * math.Exp2(float64(zoom))
+	rowArea := make([]float64, m.height)
+	for row := range rowArea {
+		mpp := metersPerPixel(tileLatitude(zoom, (float64(originY+row)+0.5)/tileSize), zoom)
+		rowArea[row] = mpp * mpp / 1e6
+	}
+
+	regions := []floodedRegion{}
+	seen := make([]bool, len(m.pixels))
+	var queue []int
+	for start, set := range m.pixels {
+		if !set || seen[start] {
+			continue
+		}
+		var area, sumX, sumY float64
+		seen[start] = true
+		queue = append(queue[:0], start)
+		for len(queue) > 0 {
+			i := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			x, y := i%m.width, i/m.width
+			area += rowArea[y]
+			sumX += float64(x) * rowArea[y]
+			sumY += float64(y) * rowArea[y]
+			for _, d := range [4][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+				nx, ny := x+d[0], y+d[1]
+				if j := ny*m.width + nx; m.at(nx, ny) && !seen[j] {
+					seen[j] = true
+					queue = append(queue, j)
+				}
+			}
+		}
+		cx, cy := float64(originX)+sumX/area+0.5, float64(originY)+sumY/area+0.5
+		regions = append(regions, floodedRegion{
+			AreaKm2: math.Round(area*100) / 100,
+			Lon:     math.Round((cx/worldSize*360-180)*1e4) / 1e4,
+			Lat:     math.Round(tileLatitude(zoom, cy/tileSize)*1e4) / 1e4,
+		})
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].AreaKm2 > regions[j].AreaKm2 })
+	if len(regions) > n {
+		regions = regions[:n]
+	}
+	return regions
+}
+
+// serveSummary reports how much of a country, by ISO 3166 code, floods at ?level=
+func serveSummary(w http.ResponseWriter, r *http.Request) {
+	if boundaries == nil {
+		http.Error(w, "Country summaries are not configured", http.StatusNotFound)
+		return
+	}
+	code := strings.ToUpper(mux.Vars(r)["code"])
+	b, ok := boundaries[code]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown country %q", code), http.StatusNotFound)
+		return
+	}
+	level, err := strconv.Atoi(r.URL.Query().Get("level"))
+	if err != nil {
+		http.Error(w, "Invalid sea level", http.StatusBadRequest)
+		return
+	}
+	level = clampSeaLevel(level)
+
+	key := fmt.Sprintf("%s/%d", code, level)
+	cached, exists := summaries.get(key)
+	if !exists {
+		start := time.Now()
+		renderPool.acquire(requestPriority(r))
+		s, err := summarize(code, b, level)
+		renderPool.release()
+		if err == errUpstreamUnavailable {
+			w.Header().Set("Retry-After", fmt.Sprint(int(breakerCooldown.Seconds())))
+			http.Error(w, "Elevation source unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to fetch elevation", http.StatusBadGateway)
+			log.Printf("Error fetching elevation for %s: %v", r.URL.Path, err)
+			return
+		}
+		metrics.timing("summary", time.Since(start))
+		data, _ := json.Marshal(s)
+		cached = CachedTile{data: data, timestamp: time.Now()}
+		summaries.put(key, cached)
+	}
+
+	metrics.incr("api_requests", "endpoint:summary")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(cached.data)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TileCache stores generated tiles in memory, evicting the least recently served once it
+// reaches its size limits. Tile data is stored by content, since many tiles (open ocean, or
+// land well above the sea) are byte-for-byte identical.
+type TileCache struct {
+	name string // For metrics
+
+	mu         sync.Mutex
+	tiles      map[string]*list.Element
+	lru        *list.List // Most recently used at the front
+	blobs      map[[sha256.Size]byte]*tileBlob
+	bytes      int64         // Of distinct tile data
+	maxBytes   int64         // 0 means no limit
+	maxEntries int           // 0 means no limit
+	staleFor   time.Duration // How long expired tiles may still be served while being refreshed
+
+	// retention, if set, gives each tile's eviction priority (lower goes first) and whether
+	// it's pinned, meaning it's never evicted
+	retention func(key string) (priority int, pinned bool)
+
+	// admission, if set, keeps new tiles out of a full cache unless they are requested more
+	// often than the tile they would replace
+	admission *frequencySketch
+
+	// spill, if set, is given evicted tiles that have a spillPath so they can move to the
+	// persistent store; it is called with the lock held so must not block
+	spill func(path string, data []byte)
+
+	inFlight map[string]chan []byte // Track in-flight requests
+	flightMu sync.Mutex
+}
+
+type CachedTile struct {
+	data      []byte
+	timestamp time.Time
+	expires   time.Time // Zero if the tile never expires
+	spillPath string    // Where to store the tile when it's evicted, if it isn't stored yet
+}
+
+// expired reports whether a tile has outlived its TTL
+func (t CachedTile) expired() bool {
+	return !t.expires.IsZero() && !time.Now().Before(t.expires)
+}
+
+// expiresAfter returns when a tile stored at a time expires, or the zero time for a ttl of 0
+func expiresAfter(stored time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return stored.Add(ttl)
+}
+
+type tileCacheEntry struct {
+	key      string
+	tile     CachedTile
+	sum      [sha256.Size]byte
+	priority int
+	pinned   bool
+}
+
+// tileBlob is tile data shared by every entry with the same bytes
+type tileBlob struct {
+	data []byte
+	refs int
+}
+
+func newTileCache(name string) *TileCache {
+	return &TileCache{
+		name:     name,
+		tiles:    make(map[string]*list.Element),
+		lru:      list.New(),
+		blobs:    make(map[[sha256.Size]byte]*tileBlob),
+		inFlight: make(map[string]chan []byte),
+	}
+}
+
+// setLimits caps the cache's total tile size in bytes and number of entries, evicting
+// straight away if it is already over
+func (c *TileCache) setLimits(maxBytes int64, maxEntries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxBytes = maxBytes
+	c.maxEntries = maxEntries
+	c.evict()
+}
+
+// get returns a cached tile, marking it recently used; expired tiles are missing
+func (c *TileCache) get(key string) (CachedTile, bool) {
+	tile, stale, exists := c.getStale(key)
+	if stale {
+		return CachedTile{}, false
+	}
+	return tile, exists
+}
+
+// getStale is like get, but also returns expired tiles still within the stale window, so they
+// can be served while a fresh copy is rendered; tiles past the window are removed
+func (c *TileCache) getStale(key string) (tile CachedTile, stale, exists bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.admission != nil {
+		c.admission.increment(key)
+	}
+	elem, exists := c.tiles[key]
+	if !exists {
+		return CachedTile{}, false, false
+	}
+	entry := elem.Value.(*tileCacheEntry)
+	if c.gone(entry.tile) {
+		c.remove(elem)
+		metrics.incr("cache_expired", "cache:"+c.name)
+		return CachedTile{}, false, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.tile, entry.tile.expired(), true
+}
+
+// gone reports whether a tile is past its expiry and any stale window
+func (c *TileCache) gone(tile CachedTile) bool {
+	return !tile.expires.IsZero() && !time.Now().Before(tile.expires.Add(c.staleFor))
+}
+
+// put stores a tile, evicting others if the cache is full
+func (c *TileCache) put(key string, tile CachedTile) {
+	sum := sha256.Sum256(tile.data)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tile.data = c.addRef(sum, tile.data)
+	if elem, exists := c.tiles[key]; exists {
+		entry := elem.Value.(*tileCacheEntry)
+		c.release(entry.sum)
+		entry.tile = tile
+		entry.sum = sum
+		c.lru.MoveToFront(elem)
+	} else {
+		entry := &tileCacheEntry{key: key, tile: tile, sum: sum}
+		if c.retention != nil {
+			entry.priority, entry.pinned = c.retention(key)
+		}
+		if !entry.pinned && !c.admit(key, len(tile.data)) {
+			c.release(sum)
+			metrics.incr("cache_rejections", "cache:"+c.name)
+			if c.spill != nil && tile.spillPath != "" {
+				c.spill(tile.spillPath, tile.data)
+			}
+			return
+		}
+		c.tiles[key] = c.lru.PushFront(entry)
+	}
+	c.evict()
+}
+
+// addRef records another entry using some tile data, returning the copy to share; the caller
+// must hold the lock
+func (c *TileCache) addRef(sum [sha256.Size]byte, data []byte) []byte {
+	if blob, exists := c.blobs[sum]; exists {
+		blob.refs++
+		metrics.incr("cache_dedup_hits", "cache:"+c.name)
+		return blob.data
+	}
+	c.blobs[sum] = &tileBlob{data: data, refs: 1}
+	c.bytes += int64(len(data))
+	return data
+}
+
+// release drops an entry's use of some tile data, freeing it once nothing uses it; the caller
+// must hold the lock
+func (c *TileCache) release(sum [sha256.Size]byte) {
+	blob := c.blobs[sum]
+	if blob.refs--; blob.refs == 0 {
+		delete(c.blobs, sum)
+		c.bytes -= int64(len(blob.data))
+	}
+}
+
+// evict removes least recently used tiles until the cache is within its limits
+func (c *TileCache) evict() {
+	for c.lru.Len() > 0 && ((c.maxBytes > 0 && c.bytes > c.maxBytes) || (c.maxEntries > 0 && c.lru.Len() > c.maxEntries)) {
+		elem := c.victim()
+		if elem == nil {
+			return // Everything left is pinned
+		}
+		tile := elem.Value.(*tileCacheEntry).tile
+		c.remove(elem)
+		metrics.incr("cache_evictions", "cache:"+c.name)
+		if c.spill != nil && tile.spillPath != "" && !tile.expired() {
+			c.spill(tile.spillPath, tile.data)
+			metrics.incr("cache_spills", "cache:"+c.name)
+		}
+	}
+}
+
+// admit decides whether a new tile may enter the cache; the caller must hold the lock
+func (c *TileCache) admit(key string, size int) bool {
+	full := (c.maxBytes > 0 && c.bytes+int64(size) > c.maxBytes) || (c.maxEntries > 0 && c.lru.Len() >= c.maxEntries)
+	if c.admission == nil || !full {
+		return true
+	}
+	victim := c.victim()
+	return victim == nil || c.admission.estimate(key) > c.admission.estimate(victim.Value.(*tileCacheEntry).key)
+}
+
+// useTinyLFU turns on frequency-based admission, sized for the cache's limits
+func (c *TileCache) useTinyLFU() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Assume tiles of about 8KB when only the size is limited
+	width := 10 * c.maxEntries
+	if width == 0 {
+		width = int(c.maxBytes / 8192 * 10)
+	}
+	c.admission = newFrequencySketch(width)
+}
+
+// evictionWindow is how many of the least recently used tiles are weighed against each other by
+// priority when one has to go
+const evictionWindow = 64
+
+// victim picks the tile to evict: the lowest priority of the least recently used few, and never
+// a pinned one. The caller must hold the lock.
+func (c *TileCache) victim() *list.Element {
+	var victim *list.Element
+	candidates := 0
+	elem := c.lru.Back()
+	for visited := 0; elem != nil && candidates < evictionWindow && visited < c.lru.Len(); visited++ {
+		prev := elem.Prev()
+		entry := elem.Value.(*tileCacheEntry)
+		if entry.pinned {
+			// Recency doesn't matter for pinned tiles, so move them out of the way of later searches
+			c.lru.MoveToFront(elem)
+		} else {
+			if victim == nil || entry.priority < victim.Value.(*tileCacheEntry).priority {
+				victim = elem
+			}
+			candidates++
+		}
+		elem = prev
+	}
+	return victim
+}
+
+// remove deletes an entry; the caller must hold the lock
+func (c *TileCache) remove(elem *list.Element) {
+	entry := elem.Value.(*tileCacheEntry)
+	c.lru.Remove(elem)
+	delete(c.tiles, entry.key)
+	c.release(entry.sum)
+}
+
+// removeMatching removes every tile for which match returns true, returning how many there were
+func (c *TileCache) removeMatching(match func(key string, tile CachedTile) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if entry := elem.Value.(*tileCacheEntry); match(entry.key, entry.tile) {
+			c.remove(elem)
+			removed++
+		}
+		elem = next
+	}
+	return removed
+}
+
+// sweep removes every expired tile, returning how many there were
+func (c *TileCache) sweep() int {
+	removed := c.removeMatching(func(key string, tile CachedTile) bool {
+		return c.gone(tile)
+	})
+	if removed > 0 {
+		metrics.incr("cache_swept", "cache:"+c.name)
+	}
+	return removed
+}
+
+// startSweeper periodically removes expired tiles, so they don't hold memory until evicted
+func (c *TileCache) startSweeper(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if removed := c.sweep(); removed > 0 {
+				log.Printf("Swept %d expired tiles from the %s cache", removed, c.name)
+			}
+		}
+	}()
+}
+
+// size returns how many tiles are cached and their total size in bytes
+func (c *TileCache) size() (entries int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len(), c.bytes
+}
+
+// parseByteSize parses a size such as "512MB", "2G" or "1048576"
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return v * multiplier, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// tileStore is a persistent cache layer behind the in-memory tile cache, so rendered tiles
+// survive restarts. Paths are relative, like "3f2a9c1b7e0d/10/512/340/20.png".
+type tileStore interface {
+	name() string
+
+	// get returns a stored tile and when it was stored; exists is false if there is none
+	get(path string) (data []byte, stored time.Time, exists bool, err error)
+
+	put(path string, data []byte) error
+}
+
+// persistentStore is nil unless a persistent cache is configured
+var persistentStore tileStore
+
+// tileStorePath lays tiles out by version, then z/x/y, then level and options, so tiles from
+// an older renderer are never served and can be deleted a version at a time
+func tileStorePath(seaLevel int, z, x, y string, opts tileOptions) string {
+	return fmt.Sprintf("%s/%s/%s/%s/%s", tileVersion(), z, x, y, opts.fileName(seaLevel))
+}
+
+// loadStoredTile looks a tile up in the persistent store, treating tiles older than ttl as missing
+func loadStoredTile(path string, ttl time.Duration) (CachedTile, bool) {
+	data, stored, exists, err := persistentStore.get(path)
+	if err != nil {
+		reportError("store", err, map[string]string{"store": persistentStore.name(), "path": path})
+		return CachedTile{}, false
+	}
+	if !exists || (ttl != 0 && time.Since(stored) >= ttl) {
+		metrics.incr("store_lookups", "store:"+persistentStore.name(), "result:miss")
+		return CachedTile{}, false
+	}
+	metrics.incr("store_lookups", "store:"+persistentStore.name(), "result:hit")
+	return CachedTile{data: data, timestamp: stored, expires: expiresAfter(stored, ttl)}, true
+}
+
+// saveStoredTile writes a tile to the persistent store in the background
+func saveStoredTile(path string, data []byte) {
+	go func() {
+		if err := persistentStore.put(path, data); err != nil {
+			reportError("store", err, map[string]string{"store": persistentStore.name(), "path": path})
+		}
+	}()
+}
+
+// diskStore keeps tiles as files under a directory
+type diskStore struct {
+	dir string
+}
+
+func newDiskStore(dir string) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &diskStore{dir: dir}, nil
+}
+
+func (d *diskStore) name() string {
+	return "disk"
+}
+
+func (d *diskStore) get(path string) ([]byte, time.Time, bool, error) {
+	full := filepath.Join(d.dir, filepath.FromSlash(path))
+	info, err := os.Stat(full)
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, false, nil
+	} else if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	data, err := os.ReadFile(full)
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, false, nil
+	}
+	return data, info.ModTime(), err == nil, err
+}
+
+// put writes a tile via a temporary file, so readers never see a partly written tile
+func (d *diskStore) put(path string, data []byte) error {
+	full := filepath.Join(d.dir, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+	tmp := full + ".tmp" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, full); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// touch marks a file as just stored, without rewriting it
+func (d *diskStore) touch(path string) error {
+	now := time.Now()
+	return os.Chtimes(filepath.Join(d.dir, filepath.FromSlash(path)), now, now)
+}
+
+// setupTileStore configures the persistent cache layer, if any
+func setupTileStore() error {
+	dir, bucket := os.Getenv("CACHE_DIR"), os.Getenv("CACHE_S3_BUCKET")
+	if dir != "" && bucket != "" {
+		return fmt.Errorf("CACHE_DIR and CACHE_S3_BUCKET can't both be set")
+	}
+
+	if bucket != "" {
+		endpoint := os.Getenv("CACHE_S3_ENDPOINT")
+		store, err := newS3Store(endpoint, bucket, os.Getenv("CACHE_S3_PREFIX"),
+			envString("CACHE_S3_REGION", "us-east-1"), envBool("CACHE_S3_PATH_STYLE", endpoint != ""))
+		if err != nil {
+			return err
+		}
+		persistentStore = store
+		log.Printf("Caching tiles in bucket %s at %s", bucket, store.endpoint)
+	}
+
+	if dir != "" {
+		store, err := newDiskStore(dir)
+		if err != nil {
+			return fmt.Errorf("failed to create cache directory: %v", err)
+		}
+		persistentStore = store
+		log.Printf("Caching tiles on disk in %s", dir)
+	}
+	return nil
+}
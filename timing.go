@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverTiming collects durations of the stages of a request for the Server-Timing header.
+// A nil *serverTiming ignores everything, so code that is also used outside requests can
+// record timings unconditionally.
+type serverTiming struct {
+	mu      sync.Mutex
+	entries []timingEntry
+	cache   string // Where the tile came from, for debug tiles; empty if it was rendered
+}
+
+type timingEntry struct {
+	name string
+	desc string
+	dur  time.Duration
+}
+
+// timingDescriptions explain the stage names shown in browser devtools
+var timingDescriptions = map[string]string{
+	"cache":  "Tile cache lookup",
+	"store":  "Persistent tile cache lookup",
+	"peer":   "Fetch from the peer that owns the tile",
+	"wait":   "Waiting for the same tile in another request",
+	"queue":  "Waiting for a render slot",
+	"fetch":  "Upstream elevation fetch",
+	"decode": "Elevation decode",
+	"render": "Render",
+	"encode": "Encode",
+	"total":  "Total",
+}
+
+// add records how long a stage took; stages recorded more than once are summed
+func (t *serverTiming) add(name string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.entries {
+		if t.entries[i].name == name {
+			t.entries[i].dur += d
+			return
+		}
+	}
+	t.entries = append(t.entries, timingEntry{name: name, desc: timingDescriptions[name], dur: d})
+}
+
+// get returns the total time recorded for a stage
+func (t *serverTiming) get(name string) time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, e := range t.entries {
+		if e.name == name {
+			return e.dur
+		}
+	}
+	return 0
+}
+
+// setCache records where the tile came from, like "HIT" or "STORE"
+func (t *serverTiming) setCache(status string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cache = status
+}
+
+// since records the time since start for a stage
+func (t *serverTiming) since(name string, start time.Time) {
+	t.add(name, time.Since(start))
+}
+
+// header formats the recorded stages as a Server-Timing header value
+func (t *serverTiming) header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parts := make([]string, len(t.entries))
+	for i, e := range t.entries {
+		parts[i] = fmt.Sprintf("%s;dur=%.1f", e.name, float64(e.dur.Microseconds())/1000)
+		if e.desc != "" {
+			parts[i] += fmt.Sprintf(";desc=%q", e.desc)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
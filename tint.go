@@ -0,0 +1,80 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"strconv"
+)
+
+// tintStop is the color of land height metres above the base, usually the sea level
+type tintStop struct {
+	height int
+	color  color.RGBA
+}
+
+// hypsometricTint runs from lowland green through browns to white peaks
+var hypsometricTint = []tintStop{
+	{0, color.RGBA{90, 160, 80, 255}},
+	{200, color.RGBA{160, 195, 100, 255}},
+	{500, color.RGBA{225, 215, 140, 255}},
+	{1000, color.RGBA{195, 150, 95, 255}},
+	{2000, color.RGBA{145, 105, 75, 255}},
+	{3500, color.RGBA{200, 195, 190, 255}},
+	{5000, color.RGBA{255, 255, 255, 255}},
+}
+
+// tintColor interpolates the tint for a height above the base
+func tintColor(height int) color.RGBA {
+	if height <= hypsometricTint[0].height {
+		return hypsometricTint[0].color
+	}
+	for i := 1; i < len(hypsometricTint); i++ {
+		a, b := hypsometricTint[i-1], hypsometricTint[i]
+		if height < b.height {
+			return lerpColor(a.color, b.color, float64(height-a.height)/float64(b.height-a.height))
+		}
+	}
+	return hypsometricTint[len(hypsometricTint)-1].color
+}
+
+// renderTint colors land by its height above the base, leaving anything below it transparent
+func renderTint(grid *elevationGrid, base int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	for i, elevation := range grid {
+		if elevation == noElevation || int(elevation) < base {
+			continue
+		}
+		c := tintColor(int(elevation) - base)
+		offset := i * 4
+		img.Pix[offset] = c.R
+		img.Pix[offset+1] = c.G
+		img.Pix[offset+2] = c.B
+		img.Pix[offset+3] = c.A
+	}
+	return img
+}
+
+// serveTint serves a hypsometric tint of the terrain, with ?level= moving the base of the
+// colors up to a sea level so the coast stays green as the sea rises
+func serveTint(w http.ResponseWriter, r *http.Request) {
+	z, x, y, ok := parseLayerTile(w, r)
+	if !ok {
+		return
+	}
+	base := 0
+	if s := r.URL.Query().Get("level"); s != "" {
+		level, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "Invalid sea level", http.StatusBadRequest)
+			return
+		}
+		base = clampSeaLevel(level)
+	}
+
+	grid, ok := loadLayerElevation(w, r, z, x, y)
+	if !ok {
+		return
+	}
+	writeLayerTile(w, "tint", renderTint(grid, base))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// frequencySketch estimates how often keys have been requested recently, in a fixed amount of
+// memory (a count-min sketch). Counts are halved every so often so that old popularity fades.
+// The tile cache uses it for TinyLFU admission: a new tile only displaces the tile that would be
+// evicted for it if it has been asked for more often, so one-off scans by seeding jobs and bots
+// don't push out tiles people keep coming back to.
+type frequencySketch struct {
+	rows      [4][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+// checkAdmission validates a tile cache admission policy
+func checkAdmission(policy string) error {
+	if policy != "lru" && policy != "tinylfu" {
+		return fmt.Errorf("unknown admission policy %q: use lru or tinylfu", policy)
+	}
+	return nil
+}
+
+// maxFrequency caps counters, which only need to compare popular keys with unpopular ones
+const maxFrequency = 15
+
+func newFrequencySketch(width int) *frequencySketch {
+	size := 1024
+	for size < width {
+		size *= 2
+	}
+	s := &frequencySketch{mask: uint64(size - 1), resetAt: 10 * size}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, size)
+	}
+	return s
+}
+
+// index returns a key's counter in a row, using double hashing to get independent positions
+func (s *frequencySketch) index(h uint64, row int) uint64 {
+	return (h + uint64(row)*(h>>32|1)) & s.mask
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// increment records a request for a key
+func (s *frequencySketch) increment(key string) {
+	h := hashKey(key)
+	for i := range s.rows {
+		if c := &s.rows[i][s.index(h, i)]; *c < maxFrequency {
+			*c++
+		}
+	}
+	if s.additions++; s.additions >= s.resetAt {
+		s.age()
+	}
+}
+
+// estimate returns roughly how often a key has been requested, never less than the truth
+func (s *frequencySketch) estimate(key string) uint8 {
+	h := hashKey(key)
+	min := uint8(maxFrequency)
+	for i := range s.rows {
+		if c := s.rows[i][s.index(h, i)]; c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// age halves every count
+func (s *frequencySketch) age() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] /= 2
+		}
+	}
+	s.additions /= 2
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFrequencySketch(t *testing.T) {
+	s := newFrequencySketch(1000)
+	counts := map[string]int{}
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("10/%d/%d/%d", i%7, i%50, i%3)
+		s.increment(key)
+		counts[key]++
+	}
+
+	// Estimates can overcount from collisions, but never undercount
+	for key, n := range counts {
+		if got := s.estimate(key); int(got) < min(n, maxFrequency) {
+			t.Errorf("estimate(%s) = %d, counted %d", key, got, n)
+		}
+	}
+	if got := s.estimate("never requested"); got > 1 {
+		t.Errorf("estimate of an unseen key = %d", got)
+	}
+
+	// Counters saturate rather than wrapping
+	for i := 0; i < 100; i++ {
+		s.increment("popular")
+	}
+	if got := s.estimate("popular"); got != maxFrequency {
+		t.Errorf("estimate after 100 requests = %d, want %d", got, maxFrequency)
+	}
+
+	s.age()
+	if got := s.estimate("popular"); got != maxFrequency/2 {
+		t.Errorf("estimate after ageing = %d, want %d", got, maxFrequency/2)
+	}
+}
+
+func TestFrequencySketchAgesItself(t *testing.T) {
+	s := newFrequencySketch(16)
+	for i := 0; i < 8; i++ {
+		s.increment("old")
+	}
+	// Enough other requests to reach the reset, which halves every count
+	for i := 8; i < s.resetAt; i++ {
+		s.increment("other")
+	}
+	if got := s.estimate("old"); got != 4 {
+		t.Errorf("estimate of an old key = %d, want 8 halved to 4", got)
+	}
+}
+
+func TestTinyLFUAdmission(t *testing.T) {
+	c := newTileCache("test")
+	c.setLimits(0, 4)
+	c.useTinyLFU()
+
+	// Tiles people keep coming back to
+	popular := []string{"0/1/0/0", "0/1/0/1", "0/1/1/0", "0/1/1/1"}
+	for _, key := range popular {
+		for i := 0; i < 5; i++ {
+			c.get(key)
+		}
+		c.put(key, CachedTile{data: []byte(key)})
+	}
+
+	// A seeding scan asks for each tile once, and shouldn't displace them
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("0/12/%d/%d", i, i)
+		c.get(key)
+		c.put(key, CachedTile{data: []byte(key)})
+	}
+	for _, key := range popular {
+		if _, exists := c.get(key); !exists {
+			t.Errorf("popular tile %s was evicted by a scan", key)
+		}
+	}
+
+	// A tile that becomes more popular than the least recently used one gets in
+	hot := "0/12/500/500"
+	for i := 0; i < 10; i++ {
+		c.get(hot)
+	}
+	c.put(hot, CachedTile{data: []byte(hot)})
+	if _, exists := c.get(hot); !exists {
+		t.Error("a frequently requested tile wasn't admitted")
+	}
+}
+
+func TestCheckAdmission(t *testing.T) {
+	for policy, valid := range map[string]bool{"lru": true, "tinylfu": true, "lfu": false, "": false} {
+		if err := checkAdmission(policy); (err == nil) != valid {
+			t.Errorf("checkAdmission(%q) = %v", policy, err)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// upstreamClient is shared by every request for elevation, basemap and mask tiles, so
+// connections to each provider are kept alive and reused between tiles
+var upstreamClient = newUpstreamClient(30*time.Second, 5*time.Second, 5*time.Second, 32)
+
+// newUpstreamClient makes a client that gives up on a request after timeout, including reading
+// the body, and on connecting or the TLS handshake after dialTimeout and tlsTimeout
+func newUpstreamClient(timeout, dialTimeout, tlsTimeout time.Duration, idlePerHost int) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout: tlsTimeout,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        4 * idlePerHost,
+			MaxIdleConnsPerHost: idlePerHost,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// upstreamAuth adds credentials to requests to one upstream host. They are loaded from
+// UPSTREAM_AUTH_FILE, keyed by host, with ${VARS} expanded from the environment so the secrets
+// themselves needn't be written to the file:
+//
+//	{
+//	  "api.maptiler.com": {"query": {"key": "${MAPTILER_KEY}"}},
+//	  "dem.example.com": {"headers": {"Authorization": "Bearer ${DEM_TOKEN}"}}
+//	}
+type upstreamAuth struct {
+	Headers map[string]string `json:"headers"`
+	Query   map[string]string `json:"query"`
+}
+
+// upstreamAuths is empty unless UPSTREAM_AUTH_FILE is set
+var upstreamAuths map[string]upstreamAuth
+
+func loadUpstreamAuth(path string) (map[string]upstreamAuth, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var auths map[string]upstreamAuth
+	if err := json.Unmarshal(data, &auths); err != nil {
+		return nil, fmt.Errorf("invalid upstream auth %s: %v", path, err)
+	}
+	for host, auth := range auths {
+		for name, value := range auth.Headers {
+			auth.Headers[name] = os.ExpandEnv(value)
+		}
+		for name, value := range auth.Query {
+			auth.Query[name] = os.ExpandEnv(value)
+		}
+		auths[host] = auth
+	}
+	return auths, nil
+}
+
+// authorizeUpstream adds any credentials configured for a request's host
+func authorizeUpstream(req *http.Request) {
+	auth, ok := upstreamAuths[req.URL.Host]
+	if !ok {
+		return
+	}
+	for name, value := range auth.Headers {
+		req.Header.Set(name, value)
+	}
+	if len(auth.Query) > 0 {
+		q := req.URL.Query()
+		for name, value := range auth.Query {
+			q.Set(name, value)
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+}
+
+// retryPolicy retries upstream requests that fail with a network error or a 5xx status,
+// doubling the backoff each time and adding up to jitter so instances don't retry in step
+type retryPolicy struct {
+	retries int
+	backoff time.Duration
+	jitter  time.Duration
+}
+
+// upstreamRetry is set from ELEVATION_RETRIES, ELEVATION_RETRY_BACKOFF and ELEVATION_RETRY_JITTER
+var upstreamRetry = retryPolicy{retries: 2, backoff: 200 * time.Millisecond, jitter: 100 * time.Millisecond}
+
+// do sends a request, retrying transient failures, with every attempt waiting its turn with
+// the limiter. The caller closes the response body.
+func (p retryPolicy) do(client *http.Client, limiter *tokenBucket, req *http.Request) (*http.Response, error) {
+	backoff := p.backoff
+	for attempt := 0; ; attempt++ {
+		if waited := limiter.wait(); waited > 0 {
+			metrics.timing("upstream_throttled", waited)
+		}
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode < 500 || attempt >= p.retries {
+			if attempt > 0 {
+				result := "ok"
+				if err != nil || resp.StatusCode >= 500 {
+					result = "exhausted"
+				}
+				metrics.incr("upstream_retried_requests", "result:"+result)
+			}
+			return resp, err
+		}
+
+		reason := "network error"
+		if err == nil {
+			reason = resp.Status
+			resp.Body.Close()
+		}
+		delay := backoff
+		if p.jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(p.jitter)))
+		}
+		// Only the host and path are logged, as the query may hold an access token
+		log.Printf("Retrying %s%s in %v after %s (retry %d of %d)", req.URL.Host, req.URL.Path, delay.Round(time.Millisecond), reason, attempt+1, p.retries)
+		metrics.incr("upstream_retries")
+		time.Sleep(delay)
+		backoff *= 2
+	}
+}
+
+// tokenBucket limits the rate of outbound requests, allowing bursts of up to burst requests
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// elevationLimiter is nil, and so unlimited, unless ELEVATION_RATE_LIMIT is set
+var elevationLimiter *tokenBucket
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	burst = max(burst, 1)
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait blocks until a request may be made, returning how long that took
+func (b *tokenBucket) wait() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	// Taking the token now, even into debt, queues waiters in order
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	time.Sleep(delay)
+	return delay
+}
+
+// errUpstreamUnavailable means a source's circuit breaker is open, so it wasn't asked at all
+var errUpstreamUnavailable = errors.New("elevation source unavailable")
+
+// breakerFailures and breakerCooldown are set from ELEVATION_BREAKER_FAILURES and
+// ELEVATION_BREAKER_COOLDOWN; zero failures disables the breakers
+var (
+	breakerFailures = 5
+	breakerCooldown = 30 * time.Second
+)
+
+// circuitBreaker stops requests to a source after it fails several times in a row, so clients
+// get an answer straight away instead of each waiting out the timeouts and retries. Once the
+// cooldown has passed, one request is let through to probe whether the source has recovered.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(name string) *circuitBreaker {
+	return &circuitBreaker{name: name, threshold: breakerFailures, cooldown: breakerCooldown}
+}
+
+// allow reports whether a request may be made
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		metrics.incr("circuit_breaker_rejections")
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record notes whether a request reached a working source
+func (b *circuitBreaker) record(ok bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen := b.failures >= b.threshold
+	b.probing = false
+	if ok {
+		if wasOpen {
+			log.Printf("Circuit breaker for %s closed: the source has recovered", b.name)
+			metrics.incr("circuit_breaker_transitions", "state:closed")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		if !wasOpen {
+			log.Printf("Circuit breaker for %s opened after %d failures; retrying in %v", b.name, b.failures, b.cooldown)
+			metrics.incr("circuit_breaker_transitions", "state:open")
+		}
+	}
+}
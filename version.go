@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+// rendererVersion must be bumped whenever a change to the renderer alters tile output
+const rendererVersion = "3"
+
+// tileVersionValue identifies the current tile contents; it changes whenever rendered output
+// would, including when palettes are changed through the admin API
+var tileVersionValue atomic.Pointer[string]
+
+// tileVersion returns the current tile version
+func tileVersion() string {
+	if v := tileVersionValue.Load(); v != nil {
+		return *v
+	}
+	return ""
+}
+
+// refreshTileVersion recomputes the tile version after a change at runtime. Tiles cached in
+// memory and open MBTiles archives don't record the version they were rendered at, so they
+// are dropped when it changes.
+func refreshTileVersion() {
+	version := computeTileVersion()
+	old := tileVersionValue.Swap(&version)
+	if old == nil || *old == version {
+		return
+	}
+	log.Printf("Tile version changed from %s to %s", *old, version)
+	cache.removeMatching(func(key string, tile CachedTile) bool { return true })
+	if mbtiles != nil {
+		mbtiles.closeAll()
+	}
+}
+
+// tileVersionInputs lists everything that affects rendered tiles
+func tileVersionInputs() []string {
+	return []string{
+		"renderer=" + rendererVersion,
+		"elevation=" + elevationUpstream.describe(),
+		"palettes=" + palettesKey(),
+		"bedrock=" + os.Getenv("ELEVATION_BEDROCK"),
+		fmt.Sprintf("resample=%d %s", elevationResampleZoom, elevationResampling),
+		"watermark=" + watermarkText,
+		"rivers=" + os.Getenv("RIVER_MASK_URL") + fmt.Sprintf(" %g", riverBackwaterLength),
+		fmt.Sprintf("smoothing=%s %d", smoothingMethod, smoothingRadius),
+		fmt.Sprintf("bruun=%g %g", bruunClosureDepth, bruunBermHeight),
+		"depth=" + depthRampKey(depthRamp),
+		"water=" + os.Getenv("WATER_MASK_URL"),
+		"coastline=" + os.Getenv("OCEAN_POLYGON_MASK_URL"),
+		fmt.Sprintf("connected=%s %d", os.Getenv("OCEAN_SEED_MASK_URL"), connectedBaseZoom),
+	}
+}
+
+// computeTileVersion hashes the tile version inputs into a short identifier
+func computeTileVersion() string {
+	sum := sha256.Sum256([]byte(strings.Join(tileVersionInputs(), "\n")))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// serveTileVersion tells clients which versioned tile URLs to use
+func serveTileVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	version := tileVersion()
+	json.NewEncoder(w).Encode(map[string]string{
+		"version": version,
+		"tiles":   appURL(fmt.Sprintf("/tile/v/%s/{level}/{z}/{x}/{y}.png", version)),
+	})
+}
+
+// serveVersionedTile serves a tile whose URL includes the tile version, so it can be cached forever
+func serveVersionedTile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if version := tileVersion(); vars["hash"] != version {
+		// Old versions are gone; send the client to the current one without letting the redirect be cached
+		w.Header().Set("Cache-Control", "no-cache")
+		target := fmt.Sprintf("../../../../%s/%s/%s/%s/%s.png", version, vars["level"], vars["z"], vars["x"], vars["y"])
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	handleTileRequest(w, r, true)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// watermarkText is stamped into rendered images when set, as some data licenses require
+var watermarkText string
+
+// stampWatermark draws the watermark in the bottom-right corner, bottom pixels above the bottom edge
+func stampWatermark(img *image.RGBA, bottom int) {
+	if watermarkText == "" {
+		return
+	}
+	bounds := img.Bounds()
+	x := bounds.Max.X - textWidth(watermarkText, 1) - 3
+	y := bounds.Max.Y - textHeight(1) - bottom
+	drawTextHalo(img, x, y, watermarkText, 1, color.RGBA{255, 255, 255, 200}, color.RGBA{0, 0, 0, 120})
+}
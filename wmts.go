@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// wmtsLayer is the layer identifier in WMTS requests, with the sea level as a dimension
+const wmtsLayer = "sea-level"
+
+// requestOrigin returns the scheme and host a request was made to, for absolute URLs
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// serveWMTS answers WMTS GetCapabilities and key-value GetTile requests, so GIS software can
+// add the overlay as a service. The capabilities also point clients at the RESTful tile URLs.
+func serveWMTS(w http.ResponseWriter, r *http.Request) {
+	// Parameter names are case-insensitive in WMTS
+	params := make(map[string]string)
+	for name, values := range r.URL.Query() {
+		params[strings.ToUpper(name)] = values[0]
+	}
+	if service := params["SERVICE"]; service != "" && !strings.EqualFold(service, "WMTS") {
+		http.Error(w, "Unsupported service: "+service, http.StatusBadRequest)
+		return
+	}
+	switch request := params["REQUEST"]; strings.ToLower(request) {
+	case "", "getcapabilities":
+		w.Header().Set("Content-Type", "application/xml")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(wmtsCapabilities(requestOrigin(r) + appURL("")))
+	case "gettile":
+		if layer := params["LAYER"]; layer != wmtsLayer {
+			http.Error(w, "Unknown layer: "+layer, http.StatusBadRequest)
+			return
+		}
+		level := params["LEVEL"]
+		if level == "" {
+			level = "0"
+		}
+		vars := map[string]string{
+			"level": level,
+			"z":     params["TILEMATRIX"],
+			"x":     params["TILECOL"],
+			"y":     params["TILEROW"],
+		}
+		handleTileRequest(w, mux.SetURLVars(r, vars), false)
+	default:
+		http.Error(w, "Unsupported request: "+request, http.StatusBadRequest)
+	}
+}
+
+// wmtsCapabilities describes the overlay as one layer with the sea level as a dimension, in the
+// Google Maps compatible tile matrix set
+func wmtsCapabilities(base string) []byte {
+	var b bytes.Buffer
+	escaped := html.EscapeString(base)
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<Capabilities xmlns="http://www.opengis.net/wmts/1.0" xmlns:ows="http://www.opengis.net/ows/1.1" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.0.0">
+  <ows:ServiceIdentification>
+    <ows:Title>Sea level map</ows:Title>
+    <ows:ServiceType>OGC WMTS</ows:ServiceType>
+    <ows:ServiceTypeVersion>1.0.0</ows:ServiceTypeVersion>
+  </ows:ServiceIdentification>
+  <ows:OperationsMetadata>
+`)
+	for _, operation := range []string{"GetCapabilities", "GetTile"} {
+		fmt.Fprintf(&b, `    <ows:Operation name="%s">
+      <ows:DCP><ows:HTTP><ows:Get xlink:href="%s/wmts?">
+        <ows:Constraint name="GetEncoding"><ows:AllowedValues><ows:Value>KVP</ows:Value></ows:AllowedValues></ows:Constraint>
+      </ows:Get></ows:HTTP></ows:DCP>
+    </ows:Operation>
+`, operation, escaped)
+	}
+	fmt.Fprintf(&b, `  </ows:OperationsMetadata>
+  <Contents>
+    <Layer>
+      <ows:Title>Flooded areas</ows:Title>
+      <ows:Abstract>%s</ows:Abstract>
+      <ows:WGS84BoundingBox>
+        <ows:LowerCorner>-180 %g</ows:LowerCorner>
+        <ows:UpperCorner>180 %g</ows:UpperCorner>
+      </ows:WGS84BoundingBox>
+      <ows:Identifier>%s</ows:Identifier>
+      <Style isDefault="true"><ows:Identifier>default</ows:Identifier></Style>
+      <Format>image/png</Format>
+      <Dimension>
+        <ows:Identifier>level</ows:Identifier>
+        <ows:UOM>m</ows:UOM>
+        <Default>0</Default>
+`, html.EscapeString(elevationAttribution()), -maxMercatorLat, maxMercatorLat, wmtsLayer)
+	for level := -1000; level <= 1000; level += 10 {
+		fmt.Fprintf(&b, "        <Value>%d</Value>\n", level)
+	}
+	fmt.Fprintf(&b, `      </Dimension>
+      <TileMatrixSetLink><TileMatrixSet>GoogleMapsCompatible</TileMatrixSet></TileMatrixSetLink>
+      <ResourceURL format="image/png" resourceType="tile" template="%s/tile/{level}/{TileMatrix}/{TileCol}/{TileRow}.png"/>
+    </Layer>
+    <TileMatrixSet>
+      <ows:Identifier>GoogleMapsCompatible</ows:Identifier>
+      <ows:SupportedCRS>urn:ogc:def:crs:EPSG::3857</ows:SupportedCRS>
+      <WellKnownScaleSet>urn:ogc:def:wkss:OGC:1.0:GoogleMapsCompatible</WellKnownScaleSet>
+`, escaped)
+	for z := 0; z <= upstreamMaxZoom; z++ {
+		n := 1 << z
+		fmt.Fprintf(&b, `      <TileMatrix>
+        <ows:Identifier>%d</ows:Identifier>
+        <ScaleDenominator>%.10f</ScaleDenominator>
+        <TopLeftCorner>-20037508.3427892 20037508.3427892</TopLeftCorner>
+        <TileWidth>%d</TileWidth>
+        <TileHeight>%d</TileHeight>
+        <MatrixWidth>%d</MatrixWidth>
+        <MatrixHeight>%d</MatrixHeight>
+      </TileMatrix>
+`, z, 559082264.0287178/math.Exp2(float64(z)), tileSize, tileSize, n, n)
+	}
+	b.WriteString(`    </TileMatrixSet>
+  </Contents>
+</Capabilities>
+`)
+	return b.Bytes()
+}